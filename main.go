@@ -7,6 +7,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/endpoint"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/version"
@@ -18,6 +19,8 @@ import (
 var (
 	config        endpoint.Config
 	metricsConfig metrics.Config
+	migrateSource string
+	migrateTarget string
 )
 
 func main() {
@@ -33,9 +36,25 @@ func main() {
 		},
 		cli.StringFlag{
 			Name:        "endpoint",
-			Usage:       "Storage endpoint (default is sqlite)",
+			Usage:       "Storage endpoint (default is sqlite). ${VAR} references are replaced with the value of the environment variable. Postgres and MySQL endpoints may list several comma-separated hosts, to which connections fail over.",
 			Destination: &config.Endpoint,
 		},
+		cli.StringFlag{
+			Name:        "schema-endpoint",
+			Usage:       "Storage endpoint used to create the database and schema, if different credentials are required than for the storage endpoint. Supported by MySQL, Postgres, and SQL Server.",
+			Destination: &config.SchemaEndpoint,
+		},
+		cli.StringFlag{
+			Name:        "read-endpoint",
+			Usage:       "Storage endpoint of a read replica of the datastore, to which lists at past revisions are sent while it is not lagging. Supported by MySQL and Postgres.",
+			Destination: &config.ReadEndpoint,
+		},
+		cli.Int64Flag{
+			Name:        "read-endpoint-max-lag",
+			Usage:       "Maximum number of revisions by which the read replica may lag the datastore before reads are sent to the datastore instead.",
+			Destination: &config.ReadEndpointMaxLag,
+			Value:       100,
+		},
 		cli.StringFlag{
 			Name:        "ca-file",
 			Usage:       "CA cert for DB connection",
@@ -56,6 +75,21 @@ func main() {
 			Usage:       "Key file for etcd connection",
 			Destination: &config.ServerTLSConfig.KeyFile,
 		},
+		cli.StringFlag{
+			Name:        "server-ca-file",
+			Usage:       "CA cert used to verify client certificates for etcd connection. Clients are identified by the common name of their certificate when authentication is enabled.",
+			Destination: &config.ServerTLSConfig.CAFile,
+		},
+		cli.BoolFlag{
+			Name:        "client-cert-auth",
+			Usage:       "Require clients to present a certificate signed by the server CA for etcd connection",
+			Destination: &config.ClientCertAuth,
+		},
+		cli.StringFlag{
+			Name:        "authorization-policy-file",
+			Usage:       "YAML file of rules granting none, read, or readwrite access to key prefixes by client certificate common name. The file is reloaded when it changes.",
+			Destination: &config.AuthorizationPolicyFile,
+		},
 		cli.IntFlag{
 			Name:        "datastore-max-idle-connections",
 			Usage:       "Maximum number of idle connections retained by datastore. If value = 0, the system default will be used. If value < 0, idle connections will not be reused.",
@@ -74,6 +108,29 @@ func main() {
 			Destination: &config.ConnectionPoolConfig.MaxLifetime,
 			Value:       0,
 		},
+		cli.DurationFlag{
+			Name:        "datastore-connection-max-lifetime-jitter",
+			Usage:       "Randomly extend the maximum lifetime of connections by up to this amount of time, so that connections are not all reopened at once.",
+			Destination: &config.ConnectionPoolConfig.MaxLifetimeJitter,
+			Value:       0,
+		},
+		cli.DurationFlag{
+			Name:        "datastore-health-check-interval",
+			Usage:       "Interval at which the datastore is pinged. While it cannot be reached, requests fail immediately as unavailable, and it is pinged with an exponential backoff. If value <= 0, the health check is disabled.",
+			Destination: &config.ConnectionPoolConfig.HealthCheckInterval,
+			Value:       10 * time.Second,
+		},
+		cli.IntFlag{
+			Name:        "datastore-max-concurrent-queries",
+			Usage:       "Maximum number of queries executed concurrently by datastore, with excess queries waiting. Rows and transactions hold their slot until they are closed, committed, or rolled back. If value <= 0, there is no limit",
+			Destination: &config.ConnectionPoolConfig.MaxConcurrentQueries,
+			Value:       0,
+		},
+		cli.BoolFlag{
+			Name:        "datastore-skip-connection-warm-up",
+			Usage:       "Do not open idle datastore connections on startup before serving requests.",
+			Destination: &config.ConnectionPoolConfig.SkipWarmUp,
+		},
 		cli.StringFlag{
 			Name:        "key-file",
 			Usage:       "Key file for DB connection",
@@ -87,7 +144,7 @@ func main() {
 		},
 		cli.DurationFlag{
 			Name:        "slow-sql-threshold",
-			Usage:       "The duration which SQL executed longer than will be logged. Default 1s, set <= 0 to disable slow SQL log.",
+			Usage:       "The duration which SQL executed longer than will be logged as a warning, with the number of rows affected. Default 1s, set <= 0 to disable slow SQL log.",
 			Destination: &metrics.SlowSQLThreshold,
 			Value:       time.Second,
 		},
@@ -96,9 +153,187 @@ func main() {
 			Usage:       "Enable net/http/pprof handlers on the metrics bind address. Default is false.",
 			Destination: &metricsConfig.EnableProfiling,
 		},
+		cli.BoolFlag{
+			Name:        "read-only",
+			Usage:       "Serve reads and watches only; writes are rejected and schema setup, compaction, and lease expiry are disabled.",
+			Destination: &config.ReadOnly,
+		},
+		cli.IntFlag{
+			Name:        "max-key-size",
+			Usage:       "Maximum size in bytes of a key that can be written. Set <= 0 to disable the limit.",
+			Destination: &config.MaxKeySize,
+			Value:       drivers.DefaultMaxKeySize,
+		},
+		cli.IntFlag{
+			Name:        "max-value-size",
+			Usage:       "Maximum size in bytes of a value that can be written. Set <= 0 to disable the limit.",
+			Destination: &config.MaxValueSize,
+			Value:       drivers.DefaultMaxValueSize,
+		},
+		cli.Float64Flag{
+			Name:        "key-write-rate",
+			Usage:       "Maximum number of writes per second to a single key. Writes exceeding the limit fail with a retriable error. Set <= 0 to disable the limit.",
+			Destination: &config.KeyWriteRate,
+		},
+		cli.IntFlag{
+			Name:        "key-write-burst",
+			Usage:       "Number of writes to a single key that may exceed key-write-rate in a burst.",
+			Destination: &config.KeyWriteBurst,
+			Value:       100,
+		},
+		cli.DurationFlag{
+			Name:        "compact-interval",
+			Usage:       "Interval between compactions. If unset, compaction runs every 5 minutes, or at the interval implied by auto-compaction-retention in periodic mode.",
+			Destination: &config.CompactInterval,
+		},
+		cli.IntFlag{
+			Name:        "compact-batch-size",
+			Usage:       "Number of revisions deleted by each compaction batch. Set <= 0 to use the default for the compaction strategy: 1000 for 'batch', 100 for 'ordered'.",
+			Destination: &config.CompactBatchSize,
+		},
+		cli.DurationFlag{
+			Name:        "compact-batch-delay",
+			Usage:       "Pause between compaction batches, to reduce the load on the datastore when compacting a large number of revisions.",
+			Destination: &config.CompactBatchDelay,
+		},
+		cli.Int64Flag{
+			Name:        "compact-min-retain",
+			Usage:       "Number of most recent revisions that are never compacted, regardless of the retention.",
+			Destination: &config.CompactMinRetain,
+			Value:       1000,
+		},
+		cli.IntFlag{
+			Name:        "compact-interval-jitter",
+			Usage:       "Percentage by which the compaction interval is randomly varied, to avoid replicas compacting at the same time. Set <= 0 to disable.",
+			Destination: &config.CompactJitter,
+			Value:       10,
+		},
+		cli.BoolFlag{
+			Name:        "compact-dry-run",
+			Usage:       "Log the number of rows that compaction would delete, instead of compacting.",
+			Destination: &config.CompactDryRun,
+		},
+		cli.StringFlag{
+			Name:        "compact-strategy",
+			Usage:       "How compaction deletes rows: 'batch' to delete each batch with a single statement, or 'ordered' to delete rows in ascending id order in smaller transactions, avoiding deadlocks with concurrent writes.",
+			Destination: &config.CompactStrategy,
+			Value:       "batch",
+		},
+		cli.IntFlag{
+			Name:        "cache-size",
+			Usage:       "Number of gets of single keys cached in memory. Keys written by other kine servers may be read up to one poll interval stale. Set <= 0 to disable.",
+			Destination: &config.CacheSize,
+		},
+		cli.IntFlag{
+			Name:        "watch-cache-size",
+			Usage:       "Number of recent events buffered in memory, so that watches starting from a recent revision do not query the datastore. Set <= 0 to disable.",
+			Destination: &config.WatchCacheSize,
+			Value:       10000,
+		},
+		cli.DurationFlag{
+			Name:        "watch-progress-notify-interval",
+			Usage:       "Interval between progress notifications sent to watches that request them, so that clients can track the store revision when no watched keys change. Set <= 0 to disable.",
+			Destination: &config.NotifyInterval,
+			Value:       5 * time.Second,
+		},
+		cli.StringFlag{
+			Name:        "auto-compaction-mode",
+			Usage:       "Interpretation of auto-compaction-retention, as in etcd: 'periodic' for a duration, or 'revision' for a number of revisions.",
+			Destination: &config.AutoCompactionMode,
+			Value:       "periodic",
+		},
+		cli.StringFlag{
+			Name:        "auto-compaction-retention",
+			Usage:       "History retained by compaction, as in etcd: a duration such as '1h' (or a number of hours) in periodic mode, or a number of revisions in revision mode. If unset, only revisions written since the previous compaction are retained.",
+			Destination: &config.AutoCompactionRetention,
+		},
+		cli.StringFlag{
+			Name:        "tracing-endpoint",
+			Usage:       "Address of an OpenTelemetry OTLP gRPC collector to export traces of RPCs and SQL statements to. Disabled if unset.",
+			Destination: &config.TracingEndpoint,
+		},
+		cli.StringFlag{
+			Name:        "tracing-service-name",
+			Usage:       "Service name reported in traces.",
+			Destination: &config.TracingServiceName,
+			Value:       endpoint.DefaultTracingServiceName,
+		},
+		cli.StringFlag{
+			Name:        "debug-address",
+			Usage:       "Address to serve the current and compact revision and datastore size as JSON at /debug/kine. Disabled if unset.",
+			Destination: &config.DebugAddress,
+		},
+		cli.StringFlag{
+			Name:        "database-name",
+			Usage:       "Name of the database to use if the endpoint does not specify one. Applies to MySQL, Postgres, and SQL Server.",
+			Destination: &config.DatabaseName,
+			Value:       drivers.DefaultDatabaseName,
+		},
+		cli.BoolFlag{
+			Name:        "fast-count",
+			Usage:       "Count keys with a query that only reads the key name and revision columns, instead of the full list query. Not supported by all drivers.",
+			Destination: &config.FastCount,
+		},
+		cli.StringFlag{
+			Name:        "value-compression,compress-values",
+			Usage:       "Compress values before storing them in the datastore, using gzip, snappy, or zstd. Compressed values are always read, regardless of this setting.",
+			Destination: &config.ValueCompression,
+		},
+		cli.IntFlag{
+			Name:        "value-compression-min-size",
+			Usage:       "Minimum size in bytes of values to compress.",
+			Destination: &config.ValueCompressionMinSize,
+			Value:       1024,
+		},
+		cli.StringFlag{
+			Name:        "value-encryption-key",
+			Usage:       "Encrypt values with AES-GCM data keys wrapped by this key: file:///path to a file of base64 AES-256 keys, the first being current, awskms://key-id, or vault://transit-key-name. Encrypted values are only readable with the key.",
+			Destination: &config.ValueEncryptionKey,
+		},
+		cli.StringFlag{
+			Name:        "sqlite-replicate-url",
+			Usage:       "Continuously replicate the SQLite database to S3-compatible object storage, such as s3://bucket/path?endpoint=https://minio:9000&region=us-east-1, using the credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. If the database does not exist, it is restored from the replica on startup.",
+			Destination: &config.SQLiteReplicateURL,
+		},
+		cli.StringFlag{
+			Name:        "sqlite-restore-time",
+			Usage:       "Restore the SQLite database from the replica to its state at this RFC 3339 time, instead of its latest state. Only used if the database does not exist.",
+			Destination: &config.SQLiteRestoreTime,
+		},
+		cli.BoolFlag{
+			Name:        "compress-existing-values",
+			Usage:       "Rewrite values stored before value compression or encryption was enabled in the background, so that they are compressed and encrypted as configured.",
+			Destination: &config.CompressExistingValues,
+		},
 		cli.BoolFlag{Name: "debug"},
 	}
 	app.Action = run
+	app.Commands = []cli.Command{
+		{
+			Name:      "restore",
+			Usage:     "Restore a snapshot saved with 'etcdctl snapshot save' into the empty datastore for the endpoint, and exit",
+			ArgsUsage: "SNAPSHOT_FILE",
+			Flags:     app.Flags,
+			Action:    restore,
+		},
+		{
+			Name:  "migrate",
+			Usage: "Copy all rows, including history, from the source endpoint into the empty datastore for the target endpoint, preserving revisions, and exit",
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:        "source-endpoint",
+					Usage:       "Storage endpoint to copy rows from. ${VAR} references are replaced with the value of the environment variable.",
+					Destination: &migrateSource,
+				},
+				cli.StringFlag{
+					Name:        "target-endpoint",
+					Usage:       "Storage endpoint to copy rows to. ${VAR} references are replaced with the value of the environment variable.",
+					Destination: &migrateTarget,
+				},
+			}, app.Flags...),
+			Action: migrate,
+		},
+	}
 
 	if err := app.Run(os.Args); err != nil {
 		if !errors.Is(err, context.Canceled) {
@@ -107,6 +342,46 @@ func main() {
 	}
 }
 
+func restore(c *cli.Context) error {
+	if c.Bool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	if c.NArg() != 1 {
+		return fmt.Errorf("exactly one snapshot file must be specified")
+	}
+
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	rev, err := endpoint.Restore(ctx, config, f)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Restored snapshot %s at revision %d", c.Args().First(), rev)
+	return nil
+}
+
+func migrate(c *cli.Context) error {
+	if c.Bool("debug") {
+		logrus.SetLevel(logrus.TraceLevel)
+	}
+	if migrateSource == "" || migrateTarget == "" {
+		return fmt.Errorf("both source-endpoint and target-endpoint must be specified")
+	}
+
+	ctx := signals.SetupSignalHandler(context.Background())
+	rev, err := endpoint.Migrate(ctx, config, migrateSource, migrateTarget)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Migrated datastore up to revision %d", rev)
+	return nil
+}
+
 func run(c *cli.Context) error {
 	if c.Bool("debug") {
 		logrus.SetLevel(logrus.TraceLevel)
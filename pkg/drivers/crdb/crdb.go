@@ -0,0 +1,245 @@
+package crdb
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDSN       = "postgres://root@localhost:26257/"
+	defaultPort      = "26257"
+	createDBAttempts = 30
+)
+
+var (
+	// The id column is used as the revision, so it must increase monotonically. unique_rowid(), the
+	// default for SERIAL columns in CockroachDB, only roughly follows insert order across nodes, so
+	// ids are instead allocated from an uncached sequence. Only plain SQL is used, as CockroachDB
+	// does not fully support the PL/pgSQL and Postgres-specific features used by the pgsql driver.
+	schema = []string{
+		`CREATE SEQUENCE IF NOT EXISTS kine_id_seq`,
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id INT8 NOT NULL DEFAULT nextval('kine_id_seq') PRIMARY KEY,
+				name VARCHAR(630),
+				created INT8,
+				deleted INT8,
+				create_revision INT8,
+				prev_revision INT8,
+				lease INT8,
+				value BYTES,
+				old_value BYTES
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_lease
+			(
+				id INT8 NOT NULL PRIMARY KEY,
+				ttl INT8 NOT NULL,
+				expires INT8 NOT NULL
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
+	}
+	createDB = "CREATE DATABASE IF NOT EXISTS "
+)
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	parsedDSN, err := prepareDSN(cfg.DataSourceName, cfg.BackendTLSConfig, cfg.DBName())
+	if err != nil {
+		return nil, err
+	}
+
+	if !cfg.ReadOnly {
+		if err := createDBIfNotExist(ctx, parsedDSN); err != nil {
+			return nil, err
+		}
+	}
+
+	dialect, err := generic.Open(ctx, "postgres", parsedDSN, cfg.ConnectionPoolConfig, "$", true, cfg.MetricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.FastCount = cfg.FastCount
+	dialect.GetSizeSQL = `
+		SELECT COALESCE(SUM(range_size), 0)::INT8
+		FROM crdb_internal.ranges
+		WHERE database_name = current_database() AND table_name = 'kine'`
+	dialect.CompactSQL = `
+		DELETE FROM kine AS kv
+		WHERE
+			kv.id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id > $1 AND
+					kp.id <= $2
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id > $3 AND
+					kd.id <= $4
+			)`
+	dialect.PostRestoreSQL = []string{
+		`SELECT setval('kine_id_seq', (SELECT MAX(id) FROM kine))`,
+	}
+	// CockroachDB runs all transactions at serializable isolation, and reports contention that
+	// it cannot resolve internally as a retryable serialization failure. The statement is
+	// retried, as it has not been applied.
+	dialect.Retry = func(err error) bool {
+		if err, ok := err.(*pq.Error); ok {
+			return err.Code == "40001"
+		}
+		return false
+	}
+	dialect.TranslateErr = func(err error) error {
+		if err, ok := err.(*pq.Error); ok {
+			switch err.Code {
+			case "23505": // unique_violation
+				return server.ErrKeyExists
+			case "40001": // serialization_failure
+				return server.ErrConflict
+			case "57014": // query_canceled, including by statement_timeout
+				return server.ErrTimeout
+			}
+		}
+		return err
+	}
+	// serialization_failure, which includes transaction retry errors
+	dialect.RetriableErrCodes = []string{"40001"}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*pq.Error); ok {
+			return string(err.Code)
+		}
+		return err.Error()
+	}
+
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping database setup in read-only mode")
+	} else {
+		logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+		if err := generic.ApplySchemaMigrations(ctx, dialect.DB, migrations, nil, dialect.Retry); err != nil {
+			return nil, err
+		}
+		logrus.Infof("Database tables and indexes are up to date")
+	}
+
+	return logstructured.New(sqllog.New(dialect, cfg), cfg)
+}
+
+// createDBIfNotExist creates the database named in the DSN. Errors that are not returned by the
+// database server, such as DNS or connection failures, may be transient, so the connection is retried.
+func createDBIfNotExist(ctx context.Context, dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+
+	dbName := strings.SplitN(u.Path, "/", 2)[1]
+	u.Path = "/"
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for i := 1; ; i++ {
+		err = db.PingContext(ctx)
+		if _, ok := err.(*pq.Error); err == nil || ok || i >= createDBAttempts {
+			break
+		}
+		logrus.Warnf("Failed to connect to database server, retrying: %v", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to database server")
+	}
+
+	stmt := createDB + pq.QuoteIdentifier(dbName)
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		return errors.Wrapf(err, "failed to create database %s", dbName)
+	}
+	return nil
+}
+
+func prepareDSN(dataSourceName string, tlsInfo tls.Config, defaultDBName string) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "postgres://" + dataSourceName
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+	if len(u.Path) == 0 || u.Path == "/" {
+		u.Path = "/" + defaultDBName
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	queryMap, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", err
+	}
+	// set up tls dsn
+	params := url.Values{}
+	sslmode := ""
+	if _, ok := queryMap["sslcert"]; tlsInfo.CertFile != "" && !ok {
+		params.Add("sslcert", tlsInfo.CertFile)
+		sslmode = "verify-full"
+	}
+	if _, ok := queryMap["sslkey"]; tlsInfo.KeyFile != "" && !ok {
+		params.Add("sslkey", tlsInfo.KeyFile)
+		sslmode = "verify-full"
+	}
+	if _, ok := queryMap["sslrootcert"]; tlsInfo.CAFile != "" && !ok {
+		params.Add("sslrootcert", tlsInfo.CAFile)
+		sslmode = "verify-full"
+	}
+	if _, ok := queryMap["sslmode"]; !ok && sslmode != "" {
+		params.Add("sslmode", sslmode)
+	}
+	for k, v := range queryMap {
+		params.Add(k, v[0])
+	}
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/canonical/go-dqlite"
 	"github.com/canonical/go-dqlite/client"
 	"github.com/canonical/go-dqlite/driver"
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/drivers/sqlite"
 	"github.com/k3s-io/kine/pkg/server"
@@ -69,8 +70,19 @@ outer:
 	return nil
 }
 
+// New returns a backend for the dqlite database at datasourceName. Use NewWithConfig to set any
+// of the other options of drivers.Config.
 func New(ctx context.Context, datasourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	opts, err := parseOpts(datasourceName)
+	return NewWithConfig(ctx, &drivers.Config{
+		DataSourceName:       datasourceName,
+		ConnectionPoolConfig: connPoolConfig,
+		MetricsRegisterer:    metricsRegisterer,
+	})
+}
+
+// NewWithConfig returns a backend for the dqlite database configured by cfg.
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	opts, err := parseOpts(cfg.DataSourceName)
 	if err != nil {
 		return nil, err
 	}
@@ -98,12 +110,16 @@ func New(ctx context.Context, datasourceName string, connPoolConfig generic.Conn
 	}
 
 	sql.Register("dqlite", d)
-	backend, generic, err := sqlite.NewVariant(ctx, "dqlite", opts.dsn, connPoolConfig, metricsRegisterer)
+	variantCfg := *cfg
+	variantCfg.DataSourceName = opts.dsn
+	backend, generic, err := sqlite.NewVariantWithConfig(ctx, "dqlite", &variantCfg)
 	if err != nil {
 		return nil, errors.Wrap(err, "sqlite client")
 	}
-	if err := migrate(ctx, generic.DB); err != nil {
-		return nil, errors.Wrap(err, "failed to migrate DB from sqlite")
+	if !cfg.ReadOnly {
+		if err := migrate(ctx, generic.DB); err != nil {
+			return nil, errors.Wrap(err, "failed to migrate DB from sqlite")
+		}
 	}
 
 	generic.LockWrites = true
@@ -7,11 +7,18 @@ import (
 	"context"
 	"errors"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var errNoDqlite = errors.New(`this binary is built without dqlite support, compile with "-tags dqlite"`)
+
 func New(ctx context.Context, datasourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	return nil, errors.New(`this binary is built without dqlite support, compile with "-tags dqlite"`)
+	return nil, errNoDqlite
+}
+
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	return nil, errNoDqlite
 }
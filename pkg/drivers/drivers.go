@@ -0,0 +1,243 @@
+package drivers
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logging"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// DefaultDatabaseName is the name of the database used if neither the DSN nor the
+	// config specify one.
+	DefaultDatabaseName = "kubernetes"
+
+	// DefaultMaxKeySize and DefaultMaxValueSize mirror etcd's default maximum request size.
+	DefaultMaxKeySize   = 1.5 * 1024 * 1024
+	DefaultMaxValueSize = 1.5 * 1024 * 1024
+
+	pollIntervalParam  = "poll-interval"
+	pollBatchSizeParam = "poll-batch-size"
+	maxRevisionsParam  = "max-revisions"
+)
+
+// DialFunc opens a network connection to the given address, such as through a proxy or tunnel.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// Config contains the options used by the drivers to create a backend.
+type Config struct {
+	DataSourceName       string
+	BackendTLSConfig     tls.Config
+	ConnectionPoolConfig generic.ConnectionPoolConfig
+	MetricsRegisterer    prometheus.Registerer
+
+	// Logger receives the messages logged by the Postgres driver while it sets up the datastore,
+	// with structured fields. If nil, messages are logged with logrus.
+	Logger logging.Logger
+
+	// DatabaseName is the name of the database used by the MySQL, Postgres, and SQL Server drivers if
+	// the DSN does not specify one. If empty, DefaultDatabaseName is used.
+	DatabaseName string
+
+	// ReadOnly prevents the backend from modifying the datastore. Schema setup, writes,
+	// compaction, and expiry of keys with a lease are all disabled.
+	ReadOnly bool
+
+	// MaxKeySize and MaxValueSize limit the size in bytes of keys and values that
+	// may be written. A value of zero or less disables the limit.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// KeyWriteRate limits the number of writes per second to each key, allowing bursts of up
+	// to KeyWriteBurst writes. Writes exceeding the limit fail with a retriable error. A rate of
+	// zero or less disables the limit.
+	KeyWriteRate  float64
+	KeyWriteBurst int
+
+	// CompactInterval is the interval between compactions. If zero, the default of five minutes
+	// is used, or the interval implied by AutoCompactionRetention in periodic mode.
+	CompactInterval time.Duration
+
+	// CompactBatchSize is the number of revisions deleted by each compaction batch. If zero,
+	// the default for the CompactStrategy is used.
+	CompactBatchSize int
+
+	// CompactBatchDelay is the pause between compaction batches, which gives concurrent writes
+	// and replication a chance to catch up while a large backlog of revisions is compacted.
+	CompactBatchDelay time.Duration
+
+	// CompactMinRetain is the number of most recent revisions that compaction never deletes,
+	// regardless of the retention. If zero, the most recent 1000 revisions are retained.
+	CompactMinRetain int64
+
+	// CompactIntervalJitter randomly varies the compaction interval by up to the
+	// given percentage, so that replicas do not all compact at the same time.
+	CompactIntervalJitter int
+
+	// CompactDryRun logs the number of rows that compaction would delete, instead of deleting them.
+	CompactDryRun bool
+
+	// CompactStrategy selects how compaction deletes rows: "batch" (the default) deletes each
+	// batch of rows with a single statement, and "ordered" deletes rows in ascending id order
+	// so that compaction cannot deadlock against concurrent inserts.
+	CompactStrategy string
+
+	// AutoCompactionMode and AutoCompactionRetention control how much history is retained by
+	// compaction, with the same semantics as the etcd flags of the same name. If the retention
+	// is empty, compaction retains only the revisions written since the previous compaction.
+	AutoCompactionMode      string
+	AutoCompactionRetention string
+
+	// PollInterval is the interval at which the datastore is polled for new rows, if the driver
+	// is not notified of writes. PollBatchSize is the maximum number of rows read by each poll.
+	// They are set from the poll-interval and poll-batch-size DSN parameters. If zero, the
+	// defaults are used.
+	PollInterval  time.Duration
+	PollBatchSize int
+
+	// MaxRevisions is the maximum number of revisions of history to retain. When the current
+	// revision is more than MaxRevisions ahead of the compact revision, compaction runs
+	// immediately instead of waiting for the next interval. It is set from the max-revisions
+	// DSN parameter. If zero, the history is not capped.
+	MaxRevisions int64
+
+	// ValueCompression is the name of the codec used to compress values of at least
+	// ValueCompressionMinSize bytes before they are stored. If empty, values are stored
+	// uncompressed. Compressed values are always decompressed when read.
+	ValueCompression        string
+	ValueCompressionMinSize int
+
+	// ValueEncryptionKey is the URL of the key used to wrap the data keys with which values are
+	// encrypted before they are stored. If empty, values are stored unencrypted. See
+	// logstructured.KeyWrapperByURL for the supported URLs.
+	ValueEncryptionKey string
+
+	// CompressExistingValues starts a background job that compresses, and encrypts, values stored
+	// before ValueCompression or ValueEncryptionKey was set, so that existing rows are rewritten
+	// without waiting for them to be updated or compacted.
+	CompressExistingValues bool
+
+	// SchemaDataSourceName, if set, is used instead of DataSourceName to create the database
+	// and schema, so that a user with more privileges can be used for setup than for serving
+	// requests. It is only supported by the MySQL, Postgres, and SQL Server drivers.
+	SchemaDataSourceName string
+
+	// ReadDataSourceName, if set, is a read replica of the database, such as a streaming replica,
+	// to which lists at past revisions, such as the pages of a list after the first, are sent while
+	// it lags the database by no more than MaxReadLag revisions. Reads of the current revision are
+	// always sent to the database. It is only supported by the MySQL and Postgres drivers.
+	ReadDataSourceName string
+	MaxReadLag         int64
+
+	// CacheSize is the number of gets of single keys cached in memory. Cached keys are invalidated
+	// when they are written, as seen by watching the datastore, so a get may return a value up to
+	// one poll interval old if the key was written by another server. Zero disables the cache.
+	CacheSize int
+
+	// WatchCacheSize is the number of recent events buffered in memory, so that watches starting
+	// from a recent revision catch up without querying the database. Zero disables the cache.
+	WatchCacheSize int
+
+	// FastCount counts keys with a query that avoids reading the full rows of each key.
+	FastCount bool
+
+	// Dialer, if set, is used to open all connections to the database instead of connecting
+	// directly. It is only supported by the Postgres driver.
+	Dialer DialFunc
+
+	// JetStreamReplicas, JetStreamStorage, JetStreamPlacementCluster, and JetStreamPlacementTags
+	// configure the stream that backs the JetStream bucket when the bucket is created. The storage
+	// is either "file" or "memory". They are overridden by the replicas, storage, placementCluster,
+	// and placementTag DSN parameters. If unset, the NATS server defaults are used.
+	JetStreamReplicas         int
+	JetStreamStorage          string
+	JetStreamPlacementCluster string
+	JetStreamPlacementTags    []string
+
+	// SQLiteJournalMode, SQLiteSynchronous, and SQLiteBusyTimeout set the journal mode, synchronous
+	// level, and busy timeout of SQLite connections, and SQLiteCheckpointInterval the interval at
+	// which the WAL is checkpointed and truncated, so that it does not stay at its largest size.
+	// They are overridden by the _journal_mode, _synchronous, _busy_timeout, and
+	// wal-checkpoint-interval DSN parameters. If unset, the WAL journal mode, NORMAL synchronous
+	// level, and a 5 second busy timeout are used, and the WAL is only truncated after
+	// defragmentation.
+	SQLiteJournalMode        string
+	SQLiteSynchronous        string
+	SQLiteBusyTimeout        time.Duration
+	SQLiteCheckpointInterval time.Duration
+
+	// SQLiteReplicateURL is the s3:// URL of object storage to which SQLite databases are
+	// continuously replicated. If the database does not exist, it is restored from the replica,
+	// to its state at SQLiteRestoreTime, an RFC 3339 time, if set.
+	SQLiteReplicateURL string
+	SQLiteRestoreTime  string
+}
+
+// ParseDSNParams removes the DSN parameters that apply to all drivers from DataSourceName,
+// and sets the corresponding options.
+func (c *Config) ParseDSNParams() error {
+	dsn, value := stripParam(c.DataSourceName, pollIntervalParam)
+	if value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return errors.Errorf("invalid %s %q: must be a positive duration", pollIntervalParam, value)
+		}
+		c.PollInterval = d
+	}
+
+	dsn, value = stripParam(dsn, pollBatchSizeParam)
+	if value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return errors.Errorf("invalid %s %q: must be a positive integer", pollBatchSizeParam, value)
+		}
+		c.PollBatchSize = n
+	}
+
+	dsn, value = stripParam(dsn, maxRevisionsParam)
+	if value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return errors.Errorf("invalid %s %q: must be a positive integer", maxRevisionsParam, value)
+		}
+		c.MaxRevisions = n
+	}
+
+	c.DataSourceName = dsn
+	return nil
+}
+
+// stripParam removes a query parameter from the DSN, returning the DSN and the value of
+// the parameter. The DSN is returned unchanged if it does not contain the parameter.
+func stripParam(dsn, name string) (string, string) {
+	i := strings.Index(dsn, "?")
+	if i < 0 {
+		return dsn, ""
+	}
+	values, err := url.ParseQuery(dsn[i+1:])
+	if err != nil || !values.Has(name) {
+		return dsn, ""
+	}
+	value := values.Get(name)
+	values.Del(name)
+	if len(values) == 0 {
+		return dsn[:i], value
+	}
+	return dsn[:i+1] + values.Encode(), value
+}
+
+// DBName returns the name of the database to use if the DSN does not specify one.
+func (c *Config) DBName() string {
+	if c.DatabaseName != "" {
+		return c.DatabaseName
+	}
+	return DefaultDatabaseName
+}
@@ -0,0 +1,46 @@
+package drivers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDSNParams(t *testing.T) {
+	tests := []struct {
+		dsn           string
+		wantDSN       string
+		wantInterval  time.Duration
+		wantBatchSize int
+		wantErr       bool
+	}{
+		{dsn: "root@tcp(localhost)/kine", wantDSN: "root@tcp(localhost)/kine"},
+		{dsn: "root@tcp(localhost)/kine?poll-interval=250ms", wantDSN: "root@tcp(localhost)/kine", wantInterval: 250 * time.Millisecond},
+		{
+			dsn:           "root@tcp(localhost)/kine?poll-interval=5s&poll-batch-size=100&tls=true",
+			wantDSN:       "root@tcp(localhost)/kine?tls=true",
+			wantInterval:  5 * time.Second,
+			wantBatchSize: 100,
+		},
+		{dsn: "root@tcp(localhost)/kine?poll-interval=fast", wantErr: true},
+		{dsn: "root@tcp(localhost)/kine?poll-interval=0s", wantErr: true},
+		{dsn: "root@tcp(localhost)/kine?poll-batch-size=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		c := &Config{DataSourceName: tt.dsn}
+		err := c.ParseDSNParams()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.dsn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.dsn, err)
+			continue
+		}
+		if c.DataSourceName != tt.wantDSN || c.PollInterval != tt.wantInterval || c.PollBatchSize != tt.wantBatchSize {
+			t.Errorf("%s: dsn = %q, poll interval = %v, poll batch size = %d, want %q, %v, %d",
+				tt.dsn, c.DataSourceName, c.PollInterval, c.PollBatchSize, tt.wantDSN, tt.wantInterval, tt.wantBatchSize)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+//go:build test
+// +build test
+
+// Package drivertest provides a suite of tests that exercise a driver against a real datastore,
+// through the server.Backend interface that the driver returns.
+package drivertest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// watchTimeout is the maximum time to wait for an expected watch event.
+const watchTimeout = 10 * time.Second
+
+// Driver describes how to create a backend for a driver under test.
+type Driver struct {
+	// Name identifies the driver in test output.
+	Name string
+	// New creates a backend for the driver from the config.
+	New func(ctx context.Context, cfg *drivers.Config) (server.Backend, error)
+	// DataSourceName returns the DSN of the datastore to test against, or an empty string if
+	// no datastore is available, in which case the suite is skipped.
+	DataSourceName func() string
+}
+
+// Run runs the suite against the driver. Each test uses its own key prefix, so the suite can be
+// run repeatedly against the same datastore.
+func Run(t *testing.T, d Driver) {
+	dsn := d.DataSourceName()
+	if dsn == "" {
+		t.Skipf("No datastore available for %s", d.Name)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend, err := d.New(ctx, &drivers.Config{DataSourceName: dsn})
+	if err != nil {
+		t.Fatalf("Failed to create %s backend: %v", d.Name, err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatalf("Failed to start %s backend: %v", d.Name, err)
+	}
+	defer backend.Close(context.Background())
+
+	prefix := fmt.Sprintf("/drivertest/%d/", time.Now().UnixNano())
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, backend server.Backend, prefix string)
+	}{
+		{"CreateUpdateDelete", testCreateUpdateDelete},
+		{"ListPagination", testListPagination},
+		{"WatchCatchUp", testWatchCatchUp},
+		{"Count", testCount},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(d.Name+"/"+tt.name, func(t *testing.T) {
+			tt.test(t, ctx, backend, prefix+tt.name+"/")
+		})
+	}
+}
+
+func testCreateUpdateDelete(t *testing.T, ctx context.Context, backend server.Backend, prefix string) {
+	key := prefix + "key"
+
+	createRev, err := backend.Create(ctx, key, []byte("v1"), 0)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := backend.Create(ctx, key, []byte("v1"), 0); err != server.ErrKeyExists {
+		t.Fatalf("Create of existing key returned %v, expected %v", err, server.ErrKeyExists)
+	}
+
+	_, kv, err := backend.Get(ctx, key, "", 1, 0)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	expectKV(t, kv, key, "v1", createRev, createRev)
+
+	// An update at a stale revision must not be applied.
+	if _, _, updated, err := backend.Update(ctx, key, []byte("v2"), createRev-1, 0); err != nil || updated {
+		t.Fatalf("Update at stale revision returned updated=%v, err=%v", updated, err)
+	}
+	updateRev, kv, updated, err := backend.Update(ctx, key, []byte("v2"), createRev, 0)
+	if err != nil || !updated {
+		t.Fatalf("Update returned updated=%v, err=%v", updated, err)
+	}
+	expectKV(t, kv, key, "v2", createRev, updateRev)
+
+	// Reading at the create revision returns the original value.
+	_, kv, err = backend.Get(ctx, key, "", 1, createRev)
+	if err != nil {
+		t.Fatalf("Get at revision %d failed: %v", createRev, err)
+	}
+	expectKV(t, kv, key, "v1", createRev, createRev)
+
+	if _, _, deleted, err := backend.Delete(ctx, key, createRev); err != nil || deleted {
+		t.Fatalf("Delete at stale revision returned deleted=%v, err=%v", deleted, err)
+	}
+	if _, _, deleted, err := backend.Delete(ctx, key, updateRev); err != nil || !deleted {
+		t.Fatalf("Delete returned deleted=%v, err=%v", deleted, err)
+	}
+	if _, kv, err := backend.Get(ctx, key, "", 1, 0); err != nil || kv != nil {
+		t.Fatalf("Get of deleted key returned kv=%v, err=%v", kv, err)
+	}
+
+	// A deleted key can be created again.
+	if _, err := backend.Create(ctx, key, []byte("v3"), 0); err != nil {
+		t.Fatalf("Create of deleted key failed: %v", err)
+	}
+}
+
+func testListPagination(t *testing.T, ctx context.Context, backend server.Backend, prefix string) {
+	const keys, pageSize = 10, 3
+
+	var expected []string
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("%skey-%02d", prefix, i)
+		if _, err := backend.Create(ctx, key, []byte(key), 0); err != nil {
+			t.Fatalf("Create of %s failed: %v", key, err)
+		}
+		expected = append(expected, key)
+	}
+
+	// A limit of pageSize+1 is used to determine whether there are more results, as the
+	// server does when handling a range request with a limit.
+	rev, kvs, err := backend.List(ctx, prefix, "", pageSize+1, 0)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(kvs) != pageSize+1 {
+		t.Fatalf("List returned %d keys, expected %d", len(kvs), pageSize+1)
+	}
+
+	var listed []string
+	for {
+		more := len(kvs) > pageSize
+		if more {
+			kvs = kvs[:pageSize]
+		}
+		for _, kv := range kvs {
+			listed = append(listed, kv.Key)
+		}
+		if !more {
+			break
+		}
+		// Later pages are read at the revision of the first page, starting after the last key.
+		if kvs, err = listAt(ctx, backend, prefix, listed[len(listed)-1], pageSize+1, rev); err != nil {
+			t.Fatalf("List after %s at revision %d failed: %v", listed[len(listed)-1], rev, err)
+		}
+	}
+
+	if fmt.Sprint(listed) != fmt.Sprint(expected) {
+		t.Fatalf("Paginated list returned %v, expected %v", listed, expected)
+	}
+
+	// Keys written after the revision of the first page are not listed at that revision.
+	if _, err := backend.Create(ctx, prefix+"key-late", nil, 0); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if kvs, err = listAt(ctx, backend, prefix, "", 0, rev); err != nil {
+		t.Fatalf("List at revision %d failed: %v", rev, err)
+	}
+	if len(kvs) != keys {
+		t.Fatalf("List at revision %d returned %d keys, expected %d", rev, len(kvs), keys)
+	}
+}
+
+func listAt(ctx context.Context, backend server.Backend, prefix, startKey string, limit, revision int64) ([]*server.KeyValue, error) {
+	_, kvs, err := backend.List(ctx, prefix, startKey, limit, revision)
+	return kvs, err
+}
+
+func testWatchCatchUp(t *testing.T, ctx context.Context, backend server.Backend, prefix string) {
+	var startRev int64
+	for i := 0; i < 3; i++ {
+		rev, err := backend.Create(ctx, fmt.Sprintf("%skey-%d", prefix, i), []byte("past"), 0)
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if startRev == 0 {
+			startRev = rev
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	events := backend.Watch(ctx, prefix, startRev)
+
+	// Events from the start revision onwards are delivered first, followed by new events.
+	expectEvents(t, events, prefix+"key-0", prefix+"key-1", prefix+"key-2")
+
+	if _, err := backend.Create(ctx, prefix+"key-3", []byte("live"), 0); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	expectEvents(t, events, prefix+"key-3")
+}
+
+func expectEvents(t *testing.T, events <-chan []*server.Event, keys ...string) {
+	t.Helper()
+	timeout := time.After(watchTimeout)
+	var lastRev int64
+	for len(keys) > 0 {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				t.Fatalf("Watch closed while waiting for %v", keys)
+			}
+			for _, event := range batch {
+				if len(keys) == 0 || event.KV.Key != keys[0] {
+					t.Fatalf("Watch returned unexpected event for %s, expected %v", event.KV.Key, keys)
+				}
+				if event.KV.ModRevision <= lastRev {
+					t.Fatalf("Watch returned event at revision %d after revision %d", event.KV.ModRevision, lastRev)
+				}
+				lastRev = event.KV.ModRevision
+				keys = keys[1:]
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for watch events for %v", keys)
+		}
+	}
+}
+
+func testCount(t *testing.T, ctx context.Context, backend server.Backend, prefix string) {
+	for i := 0; i < 5; i++ {
+		if _, err := backend.Create(ctx, fmt.Sprintf("%skey-%d", prefix, i), nil, 0); err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+	}
+	rev, kv, err := backend.Get(ctx, prefix+"key-0", "", 1, 0)
+	if err != nil || kv == nil {
+		t.Fatalf("Get returned kv=%v, err=%v", kv, err)
+	}
+	if _, _, deleted, err := backend.Delete(ctx, prefix+"key-0", kv.ModRevision); err != nil || !deleted {
+		t.Fatalf("Delete returned deleted=%v, err=%v", deleted, err)
+	}
+
+	// Deleted keys are not counted, and keys outside the prefix are not counted.
+	countRev, count, err := backend.Count(ctx, prefix)
+	if err != nil {
+		t.Fatalf("Count failed: %v", err)
+	}
+	if count != 4 {
+		t.Fatalf("Count returned %d, expected 4", count)
+	}
+	if countRev <= rev {
+		t.Fatalf("Count returned revision %d, expected a revision after %d", countRev, rev)
+	}
+}
+
+func expectKV(t *testing.T, kv *server.KeyValue, key, value string, createRev, modRev int64) {
+	t.Helper()
+	if kv == nil {
+		t.Fatalf("Expected %s, got no key", key)
+	}
+	if kv.Key != key || string(kv.Value) != value || kv.CreateRevision != createRev || kv.ModRevision != modRev {
+		t.Fatalf("Got key=%s value=%q create=%d mod=%d, expected key=%s value=%q create=%d mod=%d",
+			kv.Key, kv.Value, kv.CreateRevision, kv.ModRevision, key, value, createRev, modRev)
+	}
+}
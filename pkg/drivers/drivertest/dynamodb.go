@@ -0,0 +1,25 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/dynamodb"
+)
+
+// DynamoDBEndpointEnv names the environment variable holding the endpoint of the DynamoDB table
+// to test against, in the form passed to kine's --endpoint flag, such as
+// dynamodb://kine?endpoint=http://localhost:8000 for DynamoDB Local.
+const DynamoDBEndpointEnv = "KINE_TEST_DYNAMODB_ENDPOINT"
+
+// DynamoDB tests the DynamoDB driver against the table named by DynamoDBEndpointEnv.
+var DynamoDB = Driver{
+	Name: "dynamodb",
+	New:  dynamodb.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(DynamoDBEndpointEnv), "dynamodb://")
+	},
+}
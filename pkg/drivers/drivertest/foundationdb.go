@@ -0,0 +1,25 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/foundationdb"
+)
+
+// FoundationDBEndpointEnv names the environment variable holding the endpoint of the FoundationDB
+// cluster to test against, in the form passed to kine's --endpoint flag. The driver is only built
+// with the foundationdb build tag.
+const FoundationDBEndpointEnv = "KINE_TEST_FOUNDATIONDB_ENDPOINT"
+
+// FoundationDB tests the FoundationDB driver against the cluster named by FoundationDBEndpointEnv.
+var FoundationDB = Driver{
+	Name: "foundationdb",
+	New:  foundationdb.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(FoundationDBEndpointEnv), "foundationdb://")
+	},
+}
@@ -0,0 +1,15 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import "github.com/k3s-io/kine/pkg/drivers/memory"
+
+// Memory tests the memory driver, which needs no datastore.
+var Memory = Driver{
+	Name: "memory",
+	New:  memory.New,
+	DataSourceName: func() string {
+		return "memory"
+	},
+}
@@ -0,0 +1,24 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/oracle"
+)
+
+// OracleEndpointEnv names the environment variable holding the endpoint of the Oracle datastore
+// to test against, in the form passed to kine's --endpoint flag.
+const OracleEndpointEnv = "KINE_TEST_ORACLE_ENDPOINT"
+
+// Oracle tests the Oracle driver against the datastore named by OracleEndpointEnv.
+var Oracle = Driver{
+	Name: "oracle",
+	New:  oracle.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(OracleEndpointEnv), "oracle://")
+	},
+}
@@ -0,0 +1,24 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+)
+
+// PostgresEndpointEnv names the environment variable holding the endpoint of the Postgres
+// datastore to test against, in the form passed to kine's --endpoint flag.
+const PostgresEndpointEnv = "KINE_TEST_POSTGRES_ENDPOINT"
+
+// Postgres tests the Postgres driver against the datastore named by PostgresEndpointEnv.
+var Postgres = Driver{
+	Name: "postgres",
+	New:  pgsql.NewWithConfig,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(PostgresEndpointEnv), "postgres://")
+	},
+}
@@ -0,0 +1,25 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/spanner"
+)
+
+// SpannerEndpointEnv names the environment variable holding the endpoint of the Spanner database
+// to test against, in the form passed to kine's --endpoint flag. SPANNER_EMULATOR_HOST must also
+// be set to test against the emulator.
+const SpannerEndpointEnv = "KINE_TEST_SPANNER_ENDPOINT"
+
+// Spanner tests the Spanner driver against the database named by SpannerEndpointEnv.
+var Spanner = Driver{
+	Name: "spanner",
+	New:  spanner.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(SpannerEndpointEnv), "spanner://")
+	},
+}
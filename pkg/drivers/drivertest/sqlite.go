@@ -0,0 +1,23 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+)
+
+// SQLite tests the SQLite driver against a new database file in the temporary directory.
+var SQLite = Driver{
+	Name: "sqlite",
+	New:  sqlite.NewWithConfig,
+	DataSourceName: func() string {
+		path := filepath.Join(os.TempDir(), fmt.Sprintf("kine-drivertest-%d.db", time.Now().UnixNano()))
+		return path + "?cache=shared"
+	},
+}
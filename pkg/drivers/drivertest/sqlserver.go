@@ -0,0 +1,24 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/sqlserver"
+)
+
+// SQLServerEndpointEnv names the environment variable holding the endpoint of the SQL Server datastore
+// to test against, in the form passed to kine's --endpoint flag.
+const SQLServerEndpointEnv = "KINE_TEST_SQLSERVER_ENDPOINT"
+
+// SQLServer tests the SQL Server driver against the datastore named by SQLServerEndpointEnv.
+var SQLServer = Driver{
+	Name: "sqlserver",
+	New:  sqlserver.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(SQLServerEndpointEnv), "sqlserver://")
+	},
+}
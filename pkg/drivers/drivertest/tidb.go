@@ -0,0 +1,24 @@
+//go:build test
+// +build test
+
+package drivertest
+
+import (
+	"os"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers/tidb"
+)
+
+// TiDBEndpointEnv names the environment variable holding the endpoint of the TiDB datastore to
+// test against, in the form passed to kine's --endpoint flag.
+const TiDBEndpointEnv = "KINE_TEST_TIDB_ENDPOINT"
+
+// TiDB tests the TiDB driver against the datastore named by TiDBEndpointEnv.
+var TiDB = Driver{
+	Name: "tidb",
+	New:  tidb.New,
+	DataSourceName: func() string {
+		return strings.TrimPrefix(os.Getenv(TiDBEndpointEnv), "tidb://")
+	},
+}
@@ -0,0 +1,101 @@
+package dynamodb
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// requestTimeout bounds each request to DynamoDB.
+	requestTimeout = 30 * time.Second
+	// defaultRegion is the region used if none is set in the DSN, the environment, or the shared
+	// configuration.
+	defaultRegion = "us-east-1"
+)
+
+// item is a DynamoDB item. Only the attribute types used by kine are read. Empty binary values
+// cannot be stored, so attributes with empty values are omitted from items.
+type item map[string]types.AttributeValue
+
+func stringValue(s string) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: s}
+}
+
+func numberValue(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+func boolValue(b bool) types.AttributeValue {
+	return &types.AttributeValueMemberBOOL{Value: b}
+}
+
+func binaryValue(b []byte) types.AttributeValue {
+	return &types.AttributeValueMemberB{Value: b}
+}
+
+func (i item) str(name string) string {
+	if v, ok := i[name].(*types.AttributeValueMemberS); ok {
+		return v.Value
+	}
+	return ""
+}
+
+func (i item) num(name string) int64 {
+	if v, ok := i[name].(*types.AttributeValueMemberN); ok {
+		n, _ := strconv.ParseInt(v.Value, 10, 64)
+		return n
+	}
+	return 0
+}
+
+func (i item) bytes(name string) []byte {
+	if v, ok := i[name].(*types.AttributeValueMemberB); ok {
+		return v.Value
+	}
+	return nil
+}
+
+func (i item) bool(name string) bool {
+	if v, ok := i[name].(*types.AttributeValueMemberBOOL); ok {
+		return v.Value
+	}
+	return false
+}
+
+// isConditionalCheckFailed returns true if the error is the failure of the condition of a write.
+func isConditionalCheckFailed(err error) bool {
+	var condErr *types.ConditionalCheckFailedException
+	return errors.As(err, &condErr)
+}
+
+// newClient returns a DynamoDB client with the configuration and credentials found by the default
+// chain of the AWS SDK: the environment, the shared configuration and credentials files, and the
+// role of the container or instance. Requests are sent to the endpoint of the config, if set, such
+// as that of DynamoDB Local, rather than to DynamoDB in the region.
+func newClient(ctx context.Context, c *config) (*ddb.Client, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx,
+		awsconfig.WithRegion(c.region),
+		awsconfig.WithHTTPClient(awshttp.NewBuildableClient().WithTimeout(requestTimeout)),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load AWS configuration")
+	}
+	if awsCfg.Region == "" {
+		awsCfg.Region = defaultRegion
+	}
+	return ddb.NewFromConfig(awsCfg, func(o *ddb.Options) {
+		if c.endpoint != "" {
+			o.EndpointResolver = ddb.EndpointResolverFromURL(c.endpoint, func(e *aws.Endpoint) {
+				e.HostnameImmutable = true
+			})
+		}
+	}), nil
+}
@@ -0,0 +1,193 @@
+// Package dynamodb implements a kine backend on an Amazon DynamoDB table, so that kine can run
+// without a relational database.
+//
+// Each revision of a key is stored as an item with the key as its partition key and the revision
+// as its sort key. The latest revision of each key is also stored as the item with sort key 0,
+// which is the target of the conditions that detect conflicting creates and updates. A meta item
+// holds the current and compact revisions; it is updated in the same transaction as each write,
+// so that revisions are assigned without gaps. Two global secondary indexes find revisions in
+// order, for watches and compaction, and the latest revisions of keys by name, for lists.
+package dynamodb
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTableName = "kine"
+
+	// tableCreateTimeout bounds the time waited for a new table and its indexes to become active.
+	tableCreateTimeout = 5 * time.Minute
+
+	// revisionIndex is the index of revision items by revision, and nameIndex the index of the
+	// latest revisions of keys by name. Both are partitioned by a constant bucket attribute,
+	// which is only set on the items to be indexed, so that the indexes are sparse.
+	revisionIndex = "revision-index"
+	nameIndex     = "name-index"
+	bucket        = "kine"
+
+	attrName           = "name"
+	attrID             = "id"
+	attrRevisionBucket = "revision_bucket"
+	attrNameBucket     = "name_bucket"
+	attrModRevision    = "mod_revision"
+	attrCreated        = "created"
+	attrDeleted        = "deleted"
+	attrCreateRevision = "create_revision"
+	attrPrevRevision   = "prev_revision"
+	attrLease          = "lease"
+	attrValue          = "value"
+	attrOldValue       = "old_value"
+	attrRevision       = "revision"
+	attrCompact        = "compact_revision"
+
+	// metaName is the partition key of the meta item. It is indexed by name, so that lists can
+	// wait for the index to include the current revision, but is never listed.
+	metaName = "@kine"
+)
+
+type config struct {
+	table    string
+	endpoint string
+	region   string
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	c, err := parseDSN(cfg.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+
+	log := newLog(client, c.table, cfg)
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping DynamoDB table setup in read-only mode")
+	} else if err := log.setup(ctx); err != nil {
+		return nil, errors.Wrap(err, "setting up DynamoDB table")
+	}
+	return logstructured.New(log, cfg)
+}
+
+// parseDSN parses a DSN such as kine?region=us-east-1&endpoint=http://localhost:8000, naming the
+// table. If the region is not set, it is that of the AWS configuration, or us-east-1. If the
+// endpoint is not set, it is that of DynamoDB in the region.
+func parseDSN(dataSourceName string) (*config, error) {
+	table, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		table, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse DSN parameters")
+	}
+
+	c := &config{
+		table:    strings.Trim(table, "/"),
+		endpoint: params.Get("endpoint"),
+		region:   params.Get("region"),
+	}
+	if c.table == "" {
+		c.table = defaultTableName
+	}
+	return c, nil
+}
+
+// setup creates the table and its indexes if they do not exist, waits for them to become
+// active, and creates the meta item.
+func (d *DynamoDB) setup(ctx context.Context) error {
+	keySchema := func(hash, rng string) []types.KeySchemaElement {
+		return []types.KeySchemaElement{
+			{AttributeName: aws.String(hash), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String(rng), KeyType: types.KeyTypeRange},
+		}
+	}
+	index := func(name, hash, rng string) types.GlobalSecondaryIndex {
+		return types.GlobalSecondaryIndex{
+			IndexName:  aws.String(name),
+			KeySchema:  keySchema(hash, rng),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}
+	}
+	attribute := func(name string, attrType types.ScalarAttributeType) types.AttributeDefinition {
+		return types.AttributeDefinition{AttributeName: aws.String(name), AttributeType: attrType}
+	}
+	_, err := d.client.CreateTable(ctx, &ddb.CreateTableInput{
+		TableName:   aws.String(d.table),
+		BillingMode: types.BillingModePayPerRequest,
+		AttributeDefinitions: []types.AttributeDefinition{
+			attribute(attrName, types.ScalarAttributeTypeS),
+			attribute(attrID, types.ScalarAttributeTypeN),
+			attribute(attrRevisionBucket, types.ScalarAttributeTypeS),
+			attribute(attrNameBucket, types.ScalarAttributeTypeS),
+		},
+		KeySchema: keySchema(attrName, attrID),
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndex{
+			index(revisionIndex, attrRevisionBucket, attrID),
+			index(nameIndex, attrNameBucket, attrName),
+		},
+	})
+	var inUse *types.ResourceInUseException
+	if err == nil {
+		logrus.Infof("Created DynamoDB table %s, waiting for it to become active...", d.table)
+	} else if !errors.As(err, &inUse) {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tableCreateTimeout)
+	defer cancel()
+	for {
+		resp, err := d.client.DescribeTable(ctx, &ddb.DescribeTableInput{TableName: aws.String(d.table)})
+		if err != nil {
+			return err
+		}
+		active := resp.Table.TableStatus == types.TableStatusActive
+		indexes := map[string]bool{}
+		for _, index := range resp.Table.GlobalSecondaryIndexes {
+			indexes[aws.ToString(index.IndexName)] = index.IndexStatus == types.IndexStatusActive
+		}
+		if !indexes[revisionIndex] || !indexes[nameIndex] {
+			active = false
+		}
+		if active {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "waiting for table to become active")
+		case <-time.After(time.Second):
+		}
+	}
+
+	_, err = d.client.PutItem(ctx, &ddb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: item{
+			attrName:       stringValue(metaName),
+			attrID:         numberValue(0),
+			attrNameBucket: stringValue(bucket),
+			attrRevision:   numberValue(0),
+			attrCompact:    numberValue(0),
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#name)"),
+		ExpressionAttributeNames: map[string]string{"#name": attrName},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		return err
+	}
+	logrus.Infof("DynamoDB table %s is ready", d.table)
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build test
+// +build test
+
+package dynamodb_test
+
+import (
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers/drivertest"
+)
+
+func TestDriver(t *testing.T) {
+	drivertest.Run(t, drivertest.DynamoDB)
+}
@@ -0,0 +1,902 @@
+package dynamodb
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	pollInterval     = time.Second
+	pollBatchSize    = 500
+
+	// compactStaleIntervals is the number of compaction intervals without a successful
+	// compaction after which compaction is reported as stale.
+	compactStaleIntervals = 3
+
+	// indexWaitTimeout bounds the time that reads wait for the eventually consistent indexes to
+	// include the current revision, after which they read the indexes as they are.
+	indexWaitTimeout  = 2 * time.Second
+	indexWaitInterval = 20 * time.Millisecond
+	// writeRetryDelay is the maximum delay before retrying a write that conflicted with another
+	// write for the same revision.
+	writeRetryDelay = 10 * time.Millisecond
+)
+
+// DynamoDB is a log of the revisions of keys, stored in a DynamoDB table.
+type DynamoDB struct {
+	client      *ddb.Client
+	table       string
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	notify      chan int64
+	compactTo   chan int64
+	readOnly    bool
+
+	// pollRevision is the most recent revision read by the poll loop
+	pollRevision int64
+	// lastCompact is the time in unix nanoseconds at which compaction last completed
+	lastCompact int64
+
+	compactInterval  time.Duration
+	compactMinRetain int64
+	pollInterval     time.Duration
+	pollBatchSize    int64
+}
+
+func newLog(client *ddb.Client, table string, cfg *drivers.Config) *DynamoDB {
+	d := &DynamoDB{
+		client:           client,
+		table:            table,
+		notify:           make(chan int64, 1024),
+		compactTo:        make(chan int64, 1),
+		readOnly:         cfg.ReadOnly,
+		compactInterval:  compactInterval,
+		compactMinRetain: compactMinRetain,
+		pollInterval:     pollInterval,
+		pollBatchSize:    pollBatchSize,
+	}
+	if cfg.CompactInterval > 0 {
+		d.compactInterval = cfg.CompactInterval
+	}
+	if cfg.CompactMinRetain > 0 {
+		d.compactMinRetain = cfg.CompactMinRetain
+	}
+	if cfg.PollInterval > 0 {
+		d.pollInterval = cfg.PollInterval
+	}
+	if cfg.PollBatchSize > 0 {
+		d.pollBatchSize = int64(cfg.PollBatchSize)
+	}
+	return d
+}
+
+func (d *DynamoDB) Start(ctx context.Context) error {
+	d.ctx, d.cancel = context.WithCancel(ctx)
+	if d.readOnly {
+		logrus.Infof("Compaction is disabled in read-only mode")
+	}
+	return nil
+}
+
+// query calls f with each page of items returned by the query, until f returns false or there
+// are no more pages. The number of items counted by each page is also passed, for queries
+// that only count items.
+func (d *DynamoDB) query(ctx context.Context, in *ddb.QueryInput, f func(items []item, count int64) bool) error {
+	in.TableName = aws.String(d.table)
+	for {
+		resp, err := d.client.Query(ctx, in)
+		if err != nil {
+			return err
+		}
+		items := make([]item, len(resp.Items))
+		for i, it := range resp.Items {
+			items[i] = it
+		}
+		if !f(items, int64(resp.Count)) || len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		in.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+}
+
+// getMeta returns the current and compact revisions.
+func (d *DynamoDB) getMeta(ctx context.Context) (int64, int64, error) {
+	resp, err := d.client.GetItem(ctx, &ddb.GetItemInput{
+		TableName:      aws.String(d.table),
+		Key:            item{attrName: stringValue(metaName), attrID: numberValue(0)},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	meta := item(resp.Item)
+	return meta.num(attrRevision), meta.num(attrCompact), nil
+}
+
+// waitForIndex waits until the index includes the revision, or for up to indexWaitTimeout.
+// Writes are reflected in indexes asynchronously, usually within a fraction of a second.
+func (d *DynamoDB) waitForIndex(ctx context.Context, index string, revision int64) error {
+	if revision == 0 {
+		return nil
+	}
+	in := &ddb.QueryInput{IndexName: aws.String(index)}
+	switch index {
+	case revisionIndex:
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND #id >= :rev")
+		in.ExpressionAttributeNames = map[string]string{"#bucket": attrRevisionBucket, "#id": attrID}
+		in.ExpressionAttributeValues = item{":bucket": stringValue(bucket), ":rev": numberValue(revision)}
+		in.Select = types.SelectCount
+		in.Limit = aws.Int32(1)
+	case nameIndex:
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND #name = :meta")
+		in.ExpressionAttributeNames = map[string]string{"#bucket": attrNameBucket, "#name": attrName}
+		in.ExpressionAttributeValues = item{":bucket": stringValue(bucket), ":meta": stringValue(metaName)}
+	}
+
+	deadline := time.Now().Add(indexWaitTimeout)
+	for {
+		indexed := false
+		err := d.query(ctx, in, func(items []item, count int64) bool {
+			if index == revisionIndex {
+				indexed = count > 0
+			} else {
+				indexed = len(items) > 0 && items[0].num(attrRevision) >= revision
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		if indexed {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			logrus.Debugf("DynamoDB index %s does not yet include revision %d", index, revision)
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(indexWaitInterval):
+		}
+	}
+}
+
+func (d *DynamoDB) CurrentRevision(ctx context.Context) (int64, error) {
+	rev, _, err := d.getMeta(ctx)
+	return rev, err
+}
+
+// List returns the latest revision, as of the revision, of keys matching the prefix, in order of
+// their names. The latest revisions of keys are read from the name index; keys updated after the
+// revision are read from their history instead.
+func (d *DynamoDB) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	// as for sqllog, a start key is only used when listing, and the prefix itself is not a key
+	if strings.HasSuffix(prefix, "/") {
+		if prefix == startKey {
+			startKey = ""
+		}
+	} else {
+		startKey = ""
+	}
+
+	rev, compact, err := d.getMeta(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if revision > 0 && revision < compact {
+		return rev, nil, server.ErrCompacted
+	}
+	listRev := rev
+	if revision > 0 && revision < rev {
+		listRev = revision
+	}
+	if err := d.waitForIndex(ctx, nameIndex, rev); err != nil {
+		return 0, nil, err
+	}
+
+	in := &ddb.QueryInput{
+		IndexName:                aws.String(nameIndex),
+		ExpressionAttributeNames: map[string]string{"#bucket": attrNameBucket, "#name": attrName},
+		ExpressionAttributeValues: item{
+			":bucket": stringValue(bucket),
+			":prefix": stringValue(prefix),
+		},
+	}
+	switch {
+	case !strings.HasSuffix(prefix, "/"):
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND #name = :prefix")
+	case startKey != "":
+		// keys after the start key are read until one does not match the prefix
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND #name > :start")
+		in.ExpressionAttributeValues[":start"] = stringValue(startKey)
+		delete(in.ExpressionAttributeValues, ":prefix")
+	default:
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND begins_with(#name, :prefix)")
+	}
+
+	var (
+		events []*server.Event
+		getErr error
+	)
+	err = d.query(ctx, in, func(items []item, _ int64) bool {
+		for _, it := range items {
+			name := it.str(attrName)
+			if name == metaName {
+				continue
+			}
+			if !strings.HasPrefix(name, prefix) {
+				return false
+			}
+			if it.num(attrModRevision) > listRev {
+				if it, getErr = d.getAtRevision(ctx, name, listRev); getErr != nil {
+					return false
+				} else if it == nil {
+					continue
+				}
+			}
+			event := itemToEvent(it)
+			if event.Delete && !includeDeleted {
+				continue
+			}
+			events = append(events, event)
+			if limit > 0 && int64(len(events)) >= limit {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = getErr
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	select {
+	case d.notify <- rev:
+	default:
+	}
+	return rev, events, nil
+}
+
+// getAtRevision returns the latest revision item of the key as of the revision, or nil if the key
+// did not exist.
+func (d *DynamoDB) getAtRevision(ctx context.Context, name string, revision int64) (item, error) {
+	var result item
+	err := d.query(ctx, &ddb.QueryInput{
+		KeyConditionExpression:   aws.String("#name = :name AND #id BETWEEN :first AND :rev"),
+		ExpressionAttributeNames: map[string]string{"#name": attrName, "#id": attrID},
+		ExpressionAttributeValues: item{
+			":name":  stringValue(name),
+			":first": numberValue(1),
+			":rev":   numberValue(revision),
+		},
+		ScanIndexForward: aws.Bool(false),
+		ConsistentRead:   aws.Bool(true),
+		Limit:            aws.Int32(1),
+	}, func(items []item, _ int64) bool {
+		if len(items) > 0 {
+			result = items[0]
+		}
+		return false
+	})
+	return result, err
+}
+
+// After returns up to limit events after the revision for keys matching the prefix, in order of
+// their revisions. Keys with any of the prefixes excluded by server.WithWatchExclusions are
+// not returned.
+func (d *DynamoDB) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	rev, compact, err := d.getMeta(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	if revision > 0 && revision < compact {
+		return rev, nil, server.ErrCompacted
+	}
+	events, err := d.after(ctx, revision, limit, func(name string) bool {
+		if strings.HasSuffix(prefix, "/") {
+			if !strings.HasPrefix(name, prefix) {
+				return false
+			}
+		} else if name != prefix {
+			return false
+		}
+		for _, excluded := range server.WatchExclusions(ctx) {
+			if strings.HasPrefix(name, excluded) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if n := len(events); n > 0 && events[n-1].KV.ModRevision > rev {
+		rev = events[n-1].KV.ModRevision
+	}
+	return rev, events, nil
+}
+
+// after returns up to limit events after the revision for keys matched by the function, read
+// from the revision index once it includes the current revision.
+func (d *DynamoDB) after(ctx context.Context, revision, limit int64, match func(name string) bool) ([]*server.Event, error) {
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.waitForIndex(ctx, revisionIndex, rev); err != nil {
+		return nil, err
+	}
+
+	var events []*server.Event
+	err = d.query(ctx, &ddb.QueryInput{
+		IndexName:                 aws.String(revisionIndex),
+		KeyConditionExpression:    aws.String("#bucket = :bucket AND #id > :rev"),
+		ExpressionAttributeNames:  map[string]string{"#bucket": attrRevisionBucket, "#id": attrID},
+		ExpressionAttributeValues: item{":bucket": stringValue(bucket), ":rev": numberValue(revision)},
+	}, func(items []item, _ int64) bool {
+		for _, it := range items {
+			if !match(it.str(attrName)) {
+				continue
+			}
+			events = append(events, itemToEvent(it))
+			if limit > 0 && int64(len(events)) >= limit {
+				return false
+			}
+		}
+		return true
+	})
+	return events, err
+}
+
+// Count returns the current revision and the number of keys matching the prefix that are not
+// deleted.
+func (d *DynamoDB) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, _, err := d.getMeta(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := d.waitForIndex(ctx, nameIndex, rev); err != nil {
+		return 0, 0, err
+	}
+
+	in := &ddb.QueryInput{
+		IndexName:                aws.String(nameIndex),
+		KeyConditionExpression:   aws.String("#bucket = :bucket AND begins_with(#name, :prefix)"),
+		FilterExpression:         aws.String("#deleted = :false"),
+		ExpressionAttributeNames: map[string]string{"#bucket": attrNameBucket, "#name": attrName, "#deleted": attrDeleted},
+		ExpressionAttributeValues: item{
+			":bucket": stringValue(bucket),
+			":prefix": stringValue(prefix),
+			":false":  boolValue(false),
+		},
+		Select: types.SelectCount,
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		in.KeyConditionExpression = aws.String("#bucket = :bucket AND #name = :prefix")
+	}
+	var count int64
+	err = d.query(ctx, in, func(_ []item, n int64) bool {
+		count += n
+		return true
+	})
+	return rev, count, err
+}
+
+// Append writes the event as the next revision, in a transaction that increments the current
+// revision and replaces the latest revision of the key, on condition that the latest revision is
+// that which the event replaces. server.ErrKeyExists is returned if it is not.
+func (d *DynamoDB) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	for {
+		rev, _, err := d.getMeta(ctx)
+		if err != nil {
+			return 0, err
+		}
+		newRev := rev + 1
+
+		revItem := item{
+			attrName:           stringValue(e.KV.Key),
+			attrID:             numberValue(newRev),
+			attrRevisionBucket: stringValue(bucket),
+			attrCreated:        boolValue(e.Create),
+			attrDeleted:        boolValue(e.Delete),
+			attrCreateRevision: numberValue(e.KV.CreateRevision),
+			attrPrevRevision:   numberValue(e.PrevKV.ModRevision),
+			attrLease:          numberValue(e.KV.Lease),
+		}
+		if len(e.KV.Value) > 0 {
+			revItem[attrValue] = binaryValue(e.KV.Value)
+		}
+		if len(e.PrevKV.Value) > 0 {
+			revItem[attrOldValue] = binaryValue(e.PrevKV.Value)
+		}
+		latestItem := item{}
+		for k, v := range revItem {
+			latestItem[k] = v
+		}
+		delete(latestItem, attrRevisionBucket)
+		latestItem[attrID] = numberValue(0)
+		latestItem[attrNameBucket] = stringValue(bucket)
+		latestItem[attrModRevision] = numberValue(newRev)
+
+		// a key is created if it has no latest revision, or its latest revision is the deletion
+		// that the event replaces; otherwise the latest revision must be that which it replaces
+		latestCondition := "#mod = :prev"
+		latestValues := item{":prev": numberValue(e.PrevKV.ModRevision)}
+		if e.Create {
+			if e.PrevKV.Key == "" {
+				latestCondition = "attribute_not_exists(#mod)"
+				latestValues = nil
+			} else {
+				latestCondition = "#mod = :prev AND #deleted = :true"
+				latestValues[":true"] = boolValue(true)
+			}
+		}
+		latestNames := map[string]string{"#mod": attrModRevision}
+		if strings.Contains(latestCondition, "#deleted") {
+			latestNames["#deleted"] = attrDeleted
+		}
+		latestPut := &types.Put{
+			TableName:                aws.String(d.table),
+			Item:                     latestItem,
+			ConditionExpression:      aws.String(latestCondition),
+			ExpressionAttributeNames: latestNames,
+		}
+		if latestValues != nil {
+			latestPut.ExpressionAttributeValues = latestValues
+		}
+
+		_, err = d.client.TransactWriteItems(ctx, &ddb.TransactWriteItemsInput{
+			TransactItems: []types.TransactWriteItem{
+				{Update: &types.Update{
+					TableName:                 aws.String(d.table),
+					Key:                       item{attrName: stringValue(metaName), attrID: numberValue(0)},
+					UpdateExpression:          aws.String("SET #rev = :new"),
+					ConditionExpression:       aws.String("#rev = :rev"),
+					ExpressionAttributeNames:  map[string]string{"#rev": attrRevision},
+					ExpressionAttributeValues: item{":rev": numberValue(rev), ":new": numberValue(newRev)},
+				}},
+				{Put: &types.Put{
+					TableName: aws.String(d.table),
+					Item:      revItem,
+				}},
+				{Put: latestPut},
+			},
+		})
+		var cancelled *types.TransactionCanceledException
+		if errors.As(err, &cancelled) {
+			reasons := cancelled.CancellationReasons
+			if len(reasons) == 3 && aws.ToString(reasons[2].Code) == "ConditionalCheckFailed" {
+				return 0, server.ErrKeyExists
+			}
+			// another write took the revision, or conflicted with this transaction
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(time.Duration(rand.Int63n(int64(writeRetryDelay)))):
+			}
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		select {
+		case d.notify <- newRev:
+		default:
+		}
+		return newRev, nil
+	}
+}
+
+// DeleteLease deletes all keys attached to the lease whose latest revision is not newer than the
+// revision, and returns the number of keys deleted.
+func (d *DynamoDB) DeleteLease(ctx context.Context, lease, revision int64) (int64, error) {
+	var events []*server.Event
+	err := d.query(ctx, &ddb.QueryInput{
+		IndexName:              aws.String(nameIndex),
+		KeyConditionExpression: aws.String("#bucket = :bucket"),
+		FilterExpression:       aws.String("#lease = :lease AND #deleted = :false AND #mod <= :rev"),
+		ExpressionAttributeNames: map[string]string{
+			"#bucket":  attrNameBucket,
+			"#lease":   attrLease,
+			"#deleted": attrDeleted,
+			"#mod":     attrModRevision,
+		},
+		ExpressionAttributeValues: item{
+			":bucket": stringValue(bucket),
+			":lease":  numberValue(lease),
+			":false":  boolValue(false),
+			":rev":    numberValue(revision),
+		},
+	}, func(items []item, _ int64) bool {
+		for _, it := range items {
+			events = append(events, itemToEvent(it))
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, event := range events {
+		_, err := d.Append(ctx, &server.Event{
+			Delete: true,
+			KV:     event.KV,
+			PrevKV: event.KV,
+		})
+		if err == server.ErrKeyExists {
+			// the key was updated since it was read, and is no longer attached to the lease
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// WatchProgressRevision returns the most recent revision read by the poll loop.
+func (d *DynamoDB) WatchProgressRevision() int64 {
+	return atomic.LoadInt64(&d.pollRevision)
+}
+
+func (d *DynamoDB) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	res := make(chan []*server.Event, 100)
+	values, err := d.broadcaster.Subscribe(ctx, d.startWatch)
+	if err != nil {
+		logrus.Errorf("Failed to start watch: %v", err)
+		close(res)
+		return res
+	}
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			eventList := i.([]*server.Event)
+			filtered := make([]*server.Event, 0, len(eventList))
+			for _, event := range eventList {
+				if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+					filtered = append(filtered, event)
+				}
+			}
+			if len(filtered) > 0 {
+				res <- filtered
+			}
+		}
+	}()
+
+	return res
+}
+
+func (d *DynamoDB) startWatch() (chan interface{}, error) {
+	_, pollStart, err := d.getMeta(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{})
+	// as for sqllog, compaction and polling are started together, so that watches start at the
+	// oldest revision
+	if !d.readOnly {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.compactor()
+		}()
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.poll(c, pollStart)
+	}()
+	return c, nil
+}
+
+// poll sends the events after the last revision to watches, in order of their revisions. As
+// revisions are written without gaps, a missing revision has not yet been included in the
+// revision index, so events are only sent up to it, until it has been missing for a second.
+func (d *DynamoDB) poll(result chan interface{}, pollStart int64) {
+	var (
+		last     = pollStart
+		skip     int64
+		skipTime time.Time
+	)
+
+	wait := time.NewTicker(d.pollInterval)
+	defer wait.Stop()
+	defer close(result)
+
+	for {
+		select {
+		case <-d.ctx.Done():
+			return
+		case check := <-d.notify:
+			if check <= last {
+				continue
+			}
+		case <-wait.C:
+		}
+
+		events, err := d.after(d.ctx, last, d.pollBatchSize, func(string) bool { return true })
+		if err != nil {
+			if d.ctx.Err() == nil {
+				logrus.Errorf("fail to list latest changes: %v", err)
+			}
+			continue
+		}
+
+		var sequential []*server.Event
+		rev := last
+		for _, event := range events {
+			next := rev + 1
+			if event.KV.ModRevision != next {
+				if next == skip && time.Since(skipTime) > time.Second {
+					logrus.Errorf("GAP %s, revision=%d, delete=%v, next=%d", event.KV.Key, event.KV.ModRevision, event.Delete, next)
+				} else {
+					if skip != next {
+						skip, skipTime = next, time.Now()
+					}
+					select {
+					case d.notify <- next:
+					default:
+					}
+					break
+				}
+			}
+			rev = event.KV.ModRevision
+			sequential = append(sequential, event)
+		}
+
+		if len(sequential) > 0 {
+			last = rev
+			atomic.StoreInt64(&d.pollRevision, last)
+			metrics.CurrentRevision.Set(float64(last))
+			result <- sequential
+		}
+	}
+}
+
+// Compact schedules compaction to the given revision, which must not be newer than the current
+// revision.
+func (d *DynamoDB) Compact(ctx context.Context, revision int64) error {
+	if d.readOnly {
+		return server.ErrReadOnly
+	}
+	rev, compact, err := d.getMeta(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get current revision")
+	}
+	if revision > rev {
+		return server.ErrFutureRev
+	}
+	if revision <= compact {
+		return server.ErrCompacted
+	}
+	select {
+	case <-d.compactTo:
+	default:
+	}
+	select {
+	case d.compactTo <- revision:
+	default:
+	}
+	return nil
+}
+
+// compactor periodically compacts to all but the most recent compactMinRetain revisions, or to
+// the revision requested by Compact.
+func (d *DynamoDB) compactor() {
+	t := time.NewTicker(d.compactInterval)
+	defer t.Stop()
+	for {
+		requested := int64(0)
+		select {
+		case <-d.ctx.Done():
+			return
+		case <-t.C:
+		case requested = <-d.compactTo:
+		}
+
+		rev, compact, err := d.getMeta(d.ctx)
+		if err != nil {
+			logrus.Errorf("Compact failed to get current revision: %v", err)
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			continue
+		}
+		target := rev - d.compactMinRetain
+		if requested > 0 {
+			target = requested
+		}
+		if target <= compact {
+			continue
+		}
+
+		deleted, err := d.compact(d.ctx, compact, target)
+		metrics.CompactDeletedRows.Observe(float64(deleted))
+		if err != nil {
+			if d.ctx.Err() == nil {
+				logrus.Errorf("Compact failed: %v", err)
+				metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			}
+			continue
+		}
+		atomic.StoreInt64(&d.lastCompact, time.Now().UnixNano())
+		metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+		logrus.Infof("COMPACT compacted from %d to %d, deleting %d items", compact, target, deleted)
+	}
+}
+
+// compact deletes the revisions replaced by revisions after the compact revision, up to the
+// target revision, and the deletions in that range, as the SQL compaction does. The latest
+// revision of a key is deleted with its deletion.
+func (d *DynamoDB) compact(ctx context.Context, compact, target int64) (int64, error) {
+	type key struct {
+		name string
+		id   int64
+	}
+	var keys []key
+	var tombstones []key
+	err := d.query(ctx, &ddb.QueryInput{
+		IndexName:                 aws.String(revisionIndex),
+		KeyConditionExpression:    aws.String("#bucket = :bucket AND #id BETWEEN :from AND :to"),
+		ExpressionAttributeNames:  map[string]string{"#bucket": attrRevisionBucket, "#id": attrID},
+		ExpressionAttributeValues: item{":bucket": stringValue(bucket), ":from": numberValue(compact + 1), ":to": numberValue(target)},
+	}, func(items []item, _ int64) bool {
+		for _, it := range items {
+			name := it.str(attrName)
+			if prev := it.num(attrPrevRevision); prev > 0 && !it.bool(attrCreated) {
+				keys = append(keys, key{name, prev})
+			}
+			if it.bool(attrDeleted) {
+				keys = append(keys, key{name, it.num(attrID)})
+				tombstones = append(tombstones, key{name, it.num(attrID)})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+	for _, k := range keys {
+		_, err := d.client.DeleteItem(ctx, &ddb.DeleteItemInput{
+			TableName: aws.String(d.table),
+			Key:       item{attrName: stringValue(k.name), attrID: numberValue(k.id)},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	for _, k := range tombstones {
+		_, err := d.client.DeleteItem(ctx, &ddb.DeleteItemInput{
+			TableName:                 aws.String(d.table),
+			Key:                       item{attrName: stringValue(k.name), attrID: numberValue(0)},
+			ConditionExpression:       aws.String("#mod = :id"),
+			ExpressionAttributeNames:  map[string]string{"#mod": attrModRevision},
+			ExpressionAttributeValues: item{":id": numberValue(k.id)},
+		})
+		if err != nil && !isConditionalCheckFailed(err) {
+			return deleted, err
+		}
+	}
+
+	_, err = d.client.UpdateItem(ctx, &ddb.UpdateItemInput{
+		TableName:                 aws.String(d.table),
+		Key:                       item{attrName: stringValue(metaName), attrID: numberValue(0)},
+		UpdateExpression:          aws.String("SET #compact = :target"),
+		ConditionExpression:       aws.String("#compact < :target"),
+		ExpressionAttributeNames:  map[string]string{"#compact": attrCompact},
+		ExpressionAttributeValues: item{":target": numberValue(target)},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		return deleted, err
+	}
+	return deleted, nil
+}
+
+// DbSize returns the size of the table, which DynamoDB updates approximately every six hours.
+func (d *DynamoDB) DbSize(ctx context.Context) (int64, error) {
+	resp, err := d.client.DescribeTable(ctx, &ddb.DescribeTableInput{TableName: aws.String(d.table)})
+	if err != nil {
+		return 0, err
+	}
+	return aws.ToInt64(resp.Table.TableSizeBytes), nil
+}
+
+// Health checks that the table is reachable.
+func (d *DynamoDB) Health(ctx context.Context) (*server.HealthStatus, error) {
+	rev, compact, err := d.getMeta(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current revision")
+	}
+	status := &server.HealthStatus{
+		CurrentRevision: rev,
+		CompactRevision: compact,
+	}
+	if lastCompact := atomic.LoadInt64(&d.lastCompact); lastCompact != 0 {
+		status.LastCompact = time.Unix(0, lastCompact)
+		status.CompactStale = time.Since(status.LastCompact) > compactStaleIntervals*d.compactInterval
+	}
+	return status, nil
+}
+
+// Close stops the compaction and polling loops. If ctx is done before they have stopped, Close
+// returns anyway.
+func (d *DynamoDB) Close(ctx context.Context) error {
+	if d.cancel != nil {
+		d.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for compaction and polling to stop: %v", ctx.Err())
+	}
+	return nil
+}
+
+// itemToEvent returns the event for a revision item, or the latest revision item of a key.
+func itemToEvent(it item) *server.Event {
+	modRevision := it.num(attrID)
+	if modRevision == 0 {
+		modRevision = it.num(attrModRevision)
+	}
+	event := &server.Event{
+		Create: it.bool(attrCreated),
+		Delete: it.bool(attrDeleted),
+		KV: &server.KeyValue{
+			Key:            it.str(attrName),
+			ModRevision:    modRevision,
+			CreateRevision: it.num(attrCreateRevision),
+			Lease:          it.num(attrLease),
+			Value:          it.bytes(attrValue),
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: it.num(attrPrevRevision),
+			Value:       it.bytes(attrOldValue),
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event
+}
@@ -0,0 +1,271 @@
+//go:build test
+// +build test
+
+package dynamodb
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ddb "github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// testEndpointEnv names the environment variable holding the endpoint of the DynamoDB table to
+// test against, as for drivertest.DynamoDBEndpointEnv.
+const testEndpointEnv = "KINE_TEST_DYNAMODB_ENDPOINT"
+
+// newTestLog returns a started log on a new table, which is deleted when the test completes, so
+// that revisions start from the first. The table is created at the endpoint named by
+// testEndpointEnv, such as that of DynamoDB Local; the test is skipped if it is not set.
+func newTestLog(t *testing.T) *DynamoDB {
+	t.Helper()
+	endpoint := os.Getenv(testEndpointEnv)
+	if endpoint == "" {
+		t.Skipf("%s is not set", testEndpointEnv)
+	}
+	c, err := parseDSN(strings.TrimPrefix(endpoint, "dynamodb://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.table = fmt.Sprintf("kine-test-%d", time.Now().UnixNano())
+
+	ctx := context.Background()
+	client, err := newClient(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newLog(client, c.table, &drivers.Config{})
+	if err := d.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := client.DeleteTable(context.Background(), &ddb.DeleteTableInput{TableName: aws.String(c.table)}); err != nil {
+			t.Logf("Failed to delete table %s: %v", c.table, err)
+		}
+	})
+	if err := d.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { d.Close(context.Background()) })
+	return d
+}
+
+func createEvent(key, value string) *server.Event {
+	return &server.Event{
+		Create: true,
+		KV:     &server.KeyValue{Key: key, Value: []byte(value)},
+		PrevKV: &server.KeyValue{},
+	}
+}
+
+func updateEvent(key, value string, createRev, prevRev int64) *server.Event {
+	return &server.Event{
+		KV:     &server.KeyValue{Key: key, Value: []byte(value), CreateRevision: createRev},
+		PrevKV: &server.KeyValue{Key: key, ModRevision: prevRev},
+	}
+}
+
+func deleteEvent(key string, createRev, prevRev int64) *server.Event {
+	kv := &server.KeyValue{Key: key, CreateRevision: createRev, ModRevision: prevRev}
+	return &server.Event{Delete: true, KV: kv, PrevKV: kv}
+}
+
+func appendEvent(t *testing.T, d *DynamoDB, event *server.Event) int64 {
+	t.Helper()
+	rev, err := d.Append(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Append of %s failed: %v", event.KV.Key, err)
+	}
+	return rev
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	d := newTestLog(t)
+
+	createRev := appendEvent(t, d, createEvent("/a", "1"))
+	if _, err := d.Append(ctx, createEvent("/a", "1")); err != server.ErrKeyExists {
+		t.Fatalf("create of existing key returned %v, want %v", err, server.ErrKeyExists)
+	}
+
+	// an update must replace the latest revision of the key
+	updateRev := appendEvent(t, d, updateEvent("/a", "2", createRev, createRev))
+	if _, err := d.Append(ctx, updateEvent("/a", "3", createRev, createRev)); err != server.ErrKeyExists {
+		t.Fatalf("update of a replaced revision returned %v, want %v", err, server.ErrKeyExists)
+	}
+	deleteRev := appendEvent(t, d, deleteEvent("/a", createRev, updateRev))
+
+	// a deleted key is created again by replacing its deletion
+	if _, err := d.Append(ctx, createEvent("/a", "4")); err != server.ErrKeyExists {
+		t.Fatalf("create of deleted key without its deletion returned %v, want %v", err, server.ErrKeyExists)
+	}
+	recreate := createEvent("/a", "4")
+	recreate.PrevKV = &server.KeyValue{Key: "/a", ModRevision: updateRev}
+	if _, err := d.Append(ctx, recreate); err != server.ErrKeyExists {
+		t.Fatalf("create of deleted key replacing revision %d returned %v, want %v", updateRev, err, server.ErrKeyExists)
+	}
+	recreate.PrevKV.ModRevision = deleteRev
+	recreateRev := appendEvent(t, d, recreate)
+
+	_, events, err := d.List(ctx, "/a", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].KV.Value) != "4" || events[0].KV.ModRevision != recreateRev {
+		t.Fatalf("List returned %v, want /a = 4 at %d", events, recreateRev)
+	}
+
+	// only one of concurrent creates of a key succeeds
+	const writers = 5
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := d.Append(ctx, createEvent("/b", fmt.Sprint(i)))
+			if err != nil && err != server.ErrKeyExists {
+				t.Errorf("concurrent create failed: %v", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				created++
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Errorf("%d concurrent creates of a key succeeded, want 1", created)
+	}
+}
+
+func TestRevisionAllocation(t *testing.T) {
+	const writers, writes = 8, 10
+	ctx := context.Background()
+	d := newTestLog(t)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		revs []int64
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				rev, err := d.Append(ctx, createEvent(fmt.Sprintf("/revs/%d/%d", w, i), "v"))
+				if err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				mu.Lock()
+				revs = append(revs, rev)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// concurrent writes are assigned every revision once, without gaps
+	sort.Slice(revs, func(i, j int) bool { return revs[i] < revs[j] })
+	for i, rev := range revs {
+		if rev != int64(i+1) {
+			t.Fatalf("revisions %v are not consecutive from 1", revs)
+		}
+	}
+	if rev, err := d.CurrentRevision(ctx); err != nil || rev != writers*writes {
+		t.Fatalf("CurrentRevision returned %d, %v, want %d", rev, err, writers*writes)
+	}
+
+	_, events, err := d.After(ctx, "/revs/", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != writers*writes {
+		t.Fatalf("After returned %d events, want %d", len(events), writers*writes)
+	}
+	for i, event := range events {
+		if event.KV.ModRevision != int64(i+1) {
+			t.Fatalf("After returned event %d at revision %d, want %d", i, event.KV.ModRevision, i+1)
+		}
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	d := newTestLog(t)
+
+	// /a has five revisions, /b is created and deleted, and /c is created
+	aCreate := appendEvent(t, d, createEvent("/a", "0"))
+	aRev := aCreate
+	for i := 1; i < 5; i++ {
+		aRev = appendEvent(t, d, updateEvent("/a", fmt.Sprint(i), aCreate, aRev))
+	}
+	bCreate := appendEvent(t, d, createEvent("/b", "b"))
+	bDelete := appendEvent(t, d, deleteEvent("/b", bCreate, bCreate))
+	cCreate := appendEvent(t, d, createEvent("/c", "c"))
+
+	// the four replaced revisions of /a, and both revisions of /b
+	deleted, err := d.compact(ctx, 0, bDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 6 {
+		t.Errorf("compaction deleted %d items, want 6", deleted)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		revision int64
+		want     int64
+	}{
+		{"/a", aRev, aRev},
+		{"/a", aRev - 1, 0},
+		{"/b", bDelete, 0},
+		{"/c", cCreate, cCreate},
+	} {
+		it, err := d.getAtRevision(ctx, tt.name, tt.revision)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := it.num(attrID); got != tt.want {
+			t.Errorf("revision of %s at %d after compaction = %d, want %d", tt.name, tt.revision, got, tt.want)
+		}
+	}
+	_, events, err := d.List(ctx, "/", "", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, event := range events {
+		names = append(names, event.KV.Key)
+	}
+	if strings.Join(names, ",") != "/a,/c" {
+		t.Errorf("keys after compaction = %v, want [/a /c]", names)
+	}
+
+	if _, compact, err := d.getMeta(ctx); err != nil || compact != bDelete {
+		t.Fatalf("compact revision = %d, %v, want %d", compact, err, bDelete)
+	}
+	if _, _, err := d.List(ctx, "/", "", 0, aCreate, false); err != server.ErrCompacted {
+		t.Errorf("List at compacted revision returned %v, want %v", err, server.ErrCompacted)
+	}
+	if err := d.Compact(ctx, bDelete); err != server.ErrCompacted {
+		t.Errorf("Compact to the compact revision returned %v, want %v", err, server.ErrCompacted)
+	}
+}
@@ -0,0 +1,91 @@
+//go:build foundationdb
+// +build foundationdb
+
+// Package foundationdb implements a kine backend on a FoundationDB cluster, using its ordered
+// key-value model. It requires the FoundationDB client library, and Go bindings matching its
+// version; it is only built with the foundationdb build tag.
+//
+// Revisions are the commit versions of writes, read from their versionstamps. Every write reads and
+// writes the key holding the current revision, so writes conflict with each other and at most one
+// is committed at each version. Each revision of a key is stored under a (name, versionstamp)
+// tuple, split into chunks as values are limited to 100kB, and is indexed by its versionstamp for
+// watches and compaction. The latest revision of each key is stored under its name, so that lists
+// are range reads.
+package foundationdb
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAPIVersion = 710
+	defaultPrefix     = "kine"
+	// transactionTimeout bounds the time spent on each transaction, including retries. Transactions
+	// are also limited to five seconds by FoundationDB.
+	transactionTimeout = 30000
+)
+
+type config struct {
+	clusterFile string
+	prefix      string
+	apiVersion  int
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	c, err := parseDSN(cfg.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := fdb.APIVersion(c.apiVersion); err != nil {
+		return nil, errors.Wrap(err, "failed to select FoundationDB API version")
+	}
+	db, err := fdb.OpenDatabase(c.clusterFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open FoundationDB database")
+	}
+	if err := db.Options().SetTransactionTimeout(transactionTimeout); err != nil {
+		return nil, err
+	}
+	logrus.Infof("Using FoundationDB keys under the %q prefix", c.prefix)
+	return logstructured.New(newLog(db, subspace.Sub(c.prefix), cfg), cfg)
+}
+
+// parseDSN parses a DSN such as /etc/foundationdb/fdb.cluster?prefix=kine&api-version=710,
+// naming the cluster file. The default cluster file is used if it is empty. Keys are stored under
+// a subspace named by the prefix, so that several datastores can share a cluster.
+func parseDSN(dataSourceName string) (*config, error) {
+	clusterFile, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		clusterFile, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse DSN parameters")
+	}
+
+	c := &config{
+		clusterFile: clusterFile,
+		prefix:      params.Get("prefix"),
+		apiVersion:  defaultAPIVersion,
+	}
+	if c.prefix == "" {
+		c.prefix = defaultPrefix
+	}
+	if v := params.Get("api-version"); v != "" {
+		if c.apiVersion, err = strconv.Atoi(v); err != nil {
+			return nil, errors.Wrap(err, "invalid api-version")
+		}
+	}
+	return c, nil
+}
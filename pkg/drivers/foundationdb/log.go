@@ -0,0 +1,994 @@
+//go:build foundationdb
+// +build foundationdb
+
+package foundationdb
+
+import (
+	"context"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/tuple"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	pollInterval     = time.Second
+	pollBatchSize    = 500
+
+	// compactStaleIntervals is the number of compaction intervals without a successful
+	// compaction after which compaction is reported as stale.
+	compactStaleIntervals = 3
+	// compactBatchSize is the number of revisions compacted by each transaction, which must
+	// complete within the five second limit.
+	compactBatchSize = 1000
+	// chunkSize is the maximum size of a value.
+	chunkSize = 100000
+)
+
+// FoundationDB is a log of the revisions of keys, stored in a FoundationDB cluster.
+type FoundationDB struct {
+	db          fdb.Database
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	notify      chan int64
+	compactTo   chan int64
+	readOnly    bool
+
+	// history holds the revisions of keys, as (name, versionstamp, chunk) tuples; revisions indexes
+	// them by versionstamp; latest holds the versionstamp of the latest revision of each key, by
+	// name; and leases indexes the keys that are attached to leases, as (lease, name) tuples.
+	history     subspace.Subspace
+	revisions   subspace.Subspace
+	latest      subspace.Subspace
+	leases      subspace.Subspace
+	revisionKey fdb.Key
+	compactKey  fdb.Key
+
+	// pollRevision is the most recent revision read by the poll loop
+	pollRevision int64
+	// lastCompact is the time in unix nanoseconds at which compaction last completed
+	lastCompact int64
+
+	compactInterval  time.Duration
+	compactMinRetain int64
+	pollInterval     time.Duration
+	pollBatchSize    int64
+}
+
+func newLog(db fdb.Database, root subspace.Subspace, cfg *drivers.Config) *FoundationDB {
+	f := &FoundationDB{
+		db:               db,
+		notify:           make(chan int64, 1024),
+		compactTo:        make(chan int64, 1),
+		readOnly:         cfg.ReadOnly,
+		history:          root.Sub("k"),
+		revisions:        root.Sub("r"),
+		latest:           root.Sub("l"),
+		leases:           root.Sub("e"),
+		revisionKey:      root.Pack(tuple.Tuple{"m", "revision"}),
+		compactKey:       root.Pack(tuple.Tuple{"m", "compact"}),
+		compactInterval:  compactInterval,
+		compactMinRetain: compactMinRetain,
+		pollInterval:     pollInterval,
+		pollBatchSize:    pollBatchSize,
+	}
+	if cfg.CompactInterval > 0 {
+		f.compactInterval = cfg.CompactInterval
+	}
+	if cfg.CompactMinRetain > 0 {
+		f.compactMinRetain = cfg.CompactMinRetain
+	}
+	if cfg.PollInterval > 0 {
+		f.pollInterval = cfg.PollInterval
+	}
+	if cfg.PollBatchSize > 0 {
+		f.pollBatchSize = int64(cfg.PollBatchSize)
+	}
+	return f
+}
+
+func (f *FoundationDB) Start(ctx context.Context) error {
+	f.ctx, f.cancel = context.WithCancel(ctx)
+	if f.readOnly {
+		logrus.Infof("Compaction is disabled in read-only mode")
+	}
+	return nil
+}
+
+// versionstamp returns the lowest versionstamp of the revision. Revisions are the commit versions
+// of transactions; the versionstamps of transactions committed at the same version differ only
+// in their order within the batch, so those of the revision are below that of the next revision.
+func versionstamp(revision int64) tuple.Versionstamp {
+	vs := tuple.Versionstamp{}
+	binary.BigEndian.PutUint64(vs.TransactionVersion[:8], uint64(revision))
+	return vs
+}
+
+// revisionOf returns the revision of a versionstamp.
+func revisionOf(vs tuple.Versionstamp) int64 {
+	return int64(binary.BigEndian.Uint64(vs.TransactionVersion[:8]))
+}
+
+func tupleInt(t tuple.Tuple, i int) int64 {
+	n, _ := t[i].(int64)
+	return n
+}
+
+func tupleBool(t tuple.Tuple, i int) bool {
+	b, _ := t[i].(bool)
+	return b
+}
+
+func tupleBytes(t tuple.Tuple, i int) []byte {
+	b, _ := t[i].([]byte)
+	return b
+}
+
+// getMeta returns the current and compact revisions.
+func (f *FoundationDB) getMeta(rtr fdb.ReadTransaction) (int64, int64, error) {
+	var rev, compact int64
+	value, err := rtr.Get(f.revisionKey).Get()
+	if err != nil {
+		return 0, 0, err
+	}
+	if value != nil {
+		t, err := tuple.Unpack(value)
+		if err != nil {
+			return 0, 0, err
+		}
+		rev = revisionOf(t[0].(tuple.Versionstamp))
+	}
+	value, err = rtr.Get(f.compactKey).Get()
+	if err != nil {
+		return 0, 0, err
+	}
+	if value != nil {
+		t, err := tuple.Unpack(value)
+		if err != nil {
+			return 0, 0, err
+		}
+		compact = tupleInt(t, 0)
+	}
+	return rev, compact, nil
+}
+
+func (f *FoundationDB) CurrentRevision(ctx context.Context) (int64, error) {
+	result, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		rev, _, err := f.getMeta(rtr)
+		return rev, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+// readRecord returns the event for the revision of the key with the versionstamp, or nil if it
+// does not exist.
+func (f *FoundationDB) readRecord(rtr fdb.ReadTransaction, name string, vs tuple.Versionstamp) (*server.Event, error) {
+	kvs, err := rtr.GetRange(f.history.Sub(name, vs), fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	var record []byte
+	for _, kv := range kvs {
+		record = append(record, kv.Value...)
+	}
+	t, err := tuple.Unpack(record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid revision %d of %s", revisionOf(vs), name)
+	}
+
+	event := &server.Event{
+		Create: tupleBool(t, 0),
+		Delete: tupleBool(t, 1),
+		KV: &server.KeyValue{
+			Key:            name,
+			ModRevision:    revisionOf(vs),
+			CreateRevision: tupleInt(t, 2),
+			Lease:          tupleInt(t, 4),
+			Value:          tupleBytes(t, 5),
+		},
+		PrevKV: &server.KeyValue{
+			ModRevision: tupleInt(t, 3),
+			Value:       tupleBytes(t, 6),
+		},
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event, nil
+}
+
+// readRecordAt returns the event for the latest revision of the key as of the revision, or nil if
+// the key did not exist.
+func (f *FoundationDB) readRecordAt(rtr fdb.ReadTransaction, name string, revision int64) (*server.Event, error) {
+	r := fdb.KeyRange{Begin: f.history.Sub(name), End: f.history.Pack(tuple.Tuple{name, versionstamp(revision + 1)})}
+	kvs, err := rtr.GetRange(r, fdb.RangeOptions{Limit: 1, Reverse: true, Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+	if err != nil || len(kvs) == 0 {
+		return nil, err
+	}
+	t, err := f.history.Unpack(kvs[0].Key)
+	if err != nil {
+		return nil, err
+	}
+	return f.readRecord(rtr, name, t[1].(tuple.Versionstamp))
+}
+
+// nameRange returns the range of the latest revisions of the keys matching the prefix, or the key
+// itself if the prefix does not end with a slash, after the start key, if any.
+func (f *FoundationDB) nameRange(prefix, startKey string) (fdb.KeyRange, error) {
+	key := f.latest.Pack(tuple.Tuple{prefix})
+	if !strings.HasSuffix(prefix, "/") {
+		return fdb.KeyRange{Begin: key, End: append(key, 0x00)}, nil
+	}
+	// the packed prefix ends with the terminator of the string, without which it is a prefix of
+	// the packed names that it is a prefix of
+	begin := key[:len(key)-1]
+	end, err := fdb.Strinc(begin)
+	if err != nil {
+		return fdb.KeyRange{}, err
+	}
+	r := fdb.KeyRange{Begin: begin, End: fdb.Key(end)}
+	if startKey != "" {
+		r.Begin = append(f.latest.Pack(tuple.Tuple{startKey}), 0x00)
+	}
+	return r, nil
+}
+
+// List returns the latest revision, as of the revision, of keys matching the prefix, in order of
+// their names, from a range read of the latest revisions of keys. At earlier revisions, the latest
+// revision of each key is read from its history instead.
+func (f *FoundationDB) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	// as for sqllog, a start key is only used when listing, and the prefix itself is not a key
+	if strings.HasSuffix(prefix, "/") {
+		if prefix == startKey {
+			startKey = ""
+		}
+	} else {
+		startKey = ""
+	}
+	r, err := f.nameRange(prefix, startKey)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var (
+		rev    int64
+		events []*server.Event
+	)
+	_, err = f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		events = nil
+		var compact int64
+		var err error
+		if rev, compact, err = f.getMeta(rtr); err != nil {
+			return nil, err
+		}
+		if revision > 0 && revision < compact {
+			return nil, server.ErrCompacted
+		}
+		current := revision <= 0 || revision >= rev
+
+		it := rtr.GetRange(r, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+		for it.Advance() {
+			kv, err := it.Get()
+			if err != nil {
+				return nil, err
+			}
+			key, err := f.latest.Unpack(kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			name := key[0].(string)
+
+			var event *server.Event
+			if current {
+				latest, err := tuple.Unpack(kv.Value)
+				if err != nil {
+					return nil, err
+				}
+				if tupleBool(latest, 1) && !includeDeleted {
+					continue
+				}
+				event, err = f.readRecord(rtr, name, latest[0].(tuple.Versionstamp))
+			} else {
+				event, err = f.readRecordAt(rtr, name, revision)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if event == nil || (event.Delete && !includeDeleted) {
+				continue
+			}
+			events = append(events, event)
+			if limit > 0 && int64(len(events)) >= limit {
+				break
+			}
+		}
+		return nil, nil
+	})
+	if err == server.ErrCompacted {
+		return rev, nil, err
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	select {
+	case f.notify <- rev:
+	default:
+	}
+	return rev, events, nil
+}
+
+// After returns up to limit events after the revision for keys matching the prefix, in order of
+// their revisions. Keys with any of the prefixes excluded by server.WithWatchExclusions are
+// not returned.
+func (f *FoundationDB) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	excluded := server.WatchExclusions(ctx)
+	rev, compact, events, err := f.after(revision, limit, func(name string) bool {
+		if strings.HasSuffix(prefix, "/") {
+			if !strings.HasPrefix(name, prefix) {
+				return false
+			}
+		} else if name != prefix {
+			return false
+		}
+		for _, e := range excluded {
+			if strings.HasPrefix(name, e) {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if revision > 0 && revision < compact {
+		return rev, nil, server.ErrCompacted
+	}
+	return rev, events, nil
+}
+
+// after returns the current and compact revisions, and up to limit events after the revision for
+// keys matched by the function.
+func (f *FoundationDB) after(revision, limit int64, match func(name string) bool) (int64, int64, []*server.Event, error) {
+	var (
+		rev, compact int64
+		events       []*server.Event
+	)
+	_, end := f.revisions.FDBRangeKeys()
+	r := fdb.KeyRange{Begin: f.revisions.Pack(tuple.Tuple{versionstamp(revision + 1)}), End: end}
+	_, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		events = nil
+		var err error
+		if rev, compact, err = f.getMeta(rtr); err != nil {
+			return nil, err
+		}
+		it := rtr.GetRange(r, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+		for it.Advance() {
+			kv, err := it.Get()
+			if err != nil {
+				return nil, err
+			}
+			index, err := tuple.Unpack(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			name := index[0].(string)
+			if !match(name) {
+				continue
+			}
+			key, err := f.revisions.Unpack(kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			event, err := f.readRecord(rtr, name, key[0].(tuple.Versionstamp))
+			if err != nil {
+				return nil, err
+			}
+			if event == nil {
+				continue
+			}
+			events = append(events, event)
+			if limit > 0 && int64(len(events)) >= limit {
+				break
+			}
+		}
+		return nil, nil
+	})
+	return rev, compact, events, err
+}
+
+// Count returns the current revision and the number of keys matching the prefix that are not
+// deleted.
+func (f *FoundationDB) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	r, err := f.nameRange(prefix, "")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rev, count int64
+	_, err = f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		count = 0
+		var err error
+		if rev, _, err = f.getMeta(rtr); err != nil {
+			return nil, err
+		}
+		it := rtr.GetRange(r, fdb.RangeOptions{Mode: fdb.StreamingModeIterator}).Iterator()
+		for it.Advance() {
+			kv, err := it.Get()
+			if err != nil {
+				return nil, err
+			}
+			latest, err := tuple.Unpack(kv.Value)
+			if err != nil {
+				return nil, err
+			}
+			if !tupleBool(latest, 1) {
+				count++
+			}
+		}
+		return nil, nil
+	})
+	return rev, count, err
+}
+
+// Append writes the event, in a transaction that also replaces the latest revision of the key and
+// the current revision, on condition that the latest revision of the key is that which the event
+// replaces. server.ErrKeyExists is returned if it is not. The revision of the event is the commit
+// version of the transaction.
+func (f *FoundationDB) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+	record := tuple.Tuple{e.Create, e.Delete, e.KV.CreateRevision, e.PrevKV.ModRevision, e.KV.Lease, e.KV.Value, e.PrevKV.Value}.Pack()
+
+	result, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		// writes are serialized by all reading the current revision that they write
+		if err := tr.AddReadConflictKey(f.revisionKey); err != nil {
+			return nil, err
+		}
+		latestKey := f.latest.Pack(tuple.Tuple{e.KV.Key})
+		value, err := tr.Get(latestKey).Get()
+		if err != nil {
+			return nil, err
+		}
+
+		// a key is created if it has no latest revision, or its latest revision is the deletion
+		// that the event replaces; otherwise the latest revision must be that which it replaces
+		var latest tuple.Tuple
+		if value != nil {
+			if latest, err = tuple.Unpack(value); err != nil {
+				return nil, err
+			}
+		}
+		replaces := latest != nil && revisionOf(latest[0].(tuple.Versionstamp)) == e.PrevKV.ModRevision
+		switch {
+		case e.Create && e.PrevKV.Key == "":
+			if latest != nil {
+				return nil, server.ErrKeyExists
+			}
+		case e.Create:
+			if !replaces || !tupleBool(latest, 1) {
+				return nil, server.ErrKeyExists
+			}
+		case !replaces:
+			return nil, server.ErrKeyExists
+		}
+
+		if latest != nil && tupleInt(latest, 2) != 0 {
+			tr.Clear(f.leases.Pack(tuple.Tuple{tupleInt(latest, 2), e.KV.Key}))
+		}
+		if !e.Delete && e.KV.Lease != 0 {
+			tr.Set(f.leases.Pack(tuple.Tuple{e.KV.Lease, e.KV.Key}), nil)
+		}
+
+		vs := tuple.IncompleteVersionstamp(0)
+		for i := 0; i*chunkSize < len(record); i++ {
+			key, err := f.history.PackWithVersionstamp(tuple.Tuple{e.KV.Key, vs, int64(i)})
+			if err != nil {
+				return nil, err
+			}
+			end := (i + 1) * chunkSize
+			if end > len(record) {
+				end = len(record)
+			}
+			tr.SetVersionstampedKey(key, record[i*chunkSize:end])
+		}
+		key, err := f.revisions.PackWithVersionstamp(tuple.Tuple{vs})
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedKey(key, tuple.Tuple{e.KV.Key, e.Create, e.Delete, e.PrevKV.ModRevision}.Pack())
+		latestValue, err := tuple.Tuple{vs, e.Delete, e.KV.Lease}.PackWithVersionstamp(nil)
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedValue(latestKey, latestValue)
+		revisionValue, err := tuple.Tuple{vs}.PackWithVersionstamp(nil)
+		if err != nil {
+			return nil, err
+		}
+		tr.SetVersionstampedValue(f.revisionKey, revisionValue)
+		return tr.GetVersionstamp(), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	stamp, err := result.(fdb.FutureKey).Get()
+	if err != nil {
+		return 0, err
+	}
+
+	rev := int64(binary.BigEndian.Uint64(stamp[:8]))
+	select {
+	case f.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// DeleteLease deletes all keys attached to the lease whose latest revision is not newer than the
+// revision, and returns the number of keys deleted.
+func (f *FoundationDB) DeleteLease(ctx context.Context, lease, revision int64) (int64, error) {
+	var events []*server.Event
+	_, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		events = nil
+		kvs, err := rtr.GetRange(f.leases.Sub(lease), fdb.RangeOptions{Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range kvs {
+			key, err := f.leases.Unpack(kv.Key)
+			if err != nil {
+				return nil, err
+			}
+			name := key[1].(string)
+			value, err := rtr.Get(f.latest.Pack(tuple.Tuple{name})).Get()
+			if err != nil || value == nil {
+				continue
+			}
+			latest, err := tuple.Unpack(value)
+			if err != nil {
+				return nil, err
+			}
+			vs := latest[0].(tuple.Versionstamp)
+			if tupleBool(latest, 1) || revisionOf(vs) > revision {
+				continue
+			}
+			event, err := f.readRecord(rtr, name, vs)
+			if err != nil {
+				return nil, err
+			}
+			if event != nil {
+				events = append(events, event)
+			}
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, event := range events {
+		_, err := f.Append(ctx, &server.Event{
+			Delete: true,
+			KV:     event.KV,
+			PrevKV: event.KV,
+		})
+		if err == server.ErrKeyExists {
+			// the key was updated since it was read, and is no longer attached to the lease
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// WatchProgressRevision returns the most recent revision read by the poll loop.
+func (f *FoundationDB) WatchProgressRevision() int64 {
+	return atomic.LoadInt64(&f.pollRevision)
+}
+
+func (f *FoundationDB) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	res := make(chan []*server.Event, 100)
+	values, err := f.broadcaster.Subscribe(ctx, f.startWatch)
+	if err != nil {
+		logrus.Errorf("Failed to start watch: %v", err)
+		close(res)
+		return res
+	}
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			eventList := i.([]*server.Event)
+			filtered := make([]*server.Event, 0, len(eventList))
+			for _, event := range eventList {
+				if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+					filtered = append(filtered, event)
+				}
+			}
+			if len(filtered) > 0 {
+				res <- filtered
+			}
+		}
+	}()
+
+	return res
+}
+
+func (f *FoundationDB) startWatch() (chan interface{}, error) {
+	result, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		_, compact, err := f.getMeta(rtr)
+		return compact, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pollStart := result.(int64)
+
+	c := make(chan interface{})
+	// as for sqllog, compaction and polling are started together, so that watches start at the
+	// oldest revision
+	if !f.readOnly {
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.compactor()
+		}()
+	}
+	f.wg.Add(2)
+	go func() {
+		defer f.wg.Done()
+		f.watchRevision()
+	}()
+	go func() {
+		defer f.wg.Done()
+		f.poll(c, pollStart)
+	}()
+	return c, nil
+}
+
+// watchRevision notifies the poll loop when the current revision is changed, including by other
+// kine instances sharing the cluster, using a FoundationDB watch.
+func (f *FoundationDB) watchRevision() {
+	for {
+		result, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			return tr.Watch(f.revisionKey), nil
+		})
+		if err == nil {
+			watch := result.(fdb.FutureNil)
+			done := make(chan error, 1)
+			go func() {
+				done <- watch.Get()
+			}()
+			select {
+			case <-f.ctx.Done():
+				watch.Cancel()
+				return
+			case err = <-done:
+			}
+		}
+		if err != nil {
+			if f.ctx.Err() == nil {
+				logrus.Debugf("Failed to watch current revision: %v", err)
+			}
+			select {
+			case <-f.ctx.Done():
+				return
+			case <-time.After(f.pollInterval):
+			}
+			continue
+		}
+		if rev, err := f.CurrentRevision(f.ctx); err == nil {
+			select {
+			case f.notify <- rev:
+			default:
+			}
+		}
+	}
+}
+
+// poll sends the events after the last revision to watches, in order of their revisions. Unlike
+// the SQL backends, there is no need to wait for gaps to be filled, as reads include all writes
+// committed at earlier versions, and writes are never committed at earlier versions than reads.
+func (f *FoundationDB) poll(result chan interface{}, pollStart int64) {
+	last := pollStart
+
+	wait := time.NewTicker(f.pollInterval)
+	defer wait.Stop()
+	defer close(result)
+
+	for {
+		select {
+		case <-f.ctx.Done():
+			return
+		case check := <-f.notify:
+			if check <= last {
+				continue
+			}
+		case <-wait.C:
+		}
+
+		_, _, events, err := f.after(last, f.pollBatchSize, func(string) bool { return true })
+		if err != nil {
+			if f.ctx.Err() == nil {
+				logrus.Errorf("fail to list latest changes: %v", err)
+			}
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		last = events[len(events)-1].KV.ModRevision
+		atomic.StoreInt64(&f.pollRevision, last)
+		metrics.CurrentRevision.Set(float64(last))
+		result <- events
+	}
+}
+
+// Compact schedules compaction to the given revision, which must not be newer than the current
+// revision.
+func (f *FoundationDB) Compact(ctx context.Context, revision int64) error {
+	if f.readOnly {
+		return server.ErrReadOnly
+	}
+	var rev, compact int64
+	_, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		var err error
+		rev, compact, err = f.getMeta(rtr)
+		return nil, err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to get current revision")
+	}
+	if revision > rev {
+		return server.ErrFutureRev
+	}
+	if revision <= compact {
+		return server.ErrCompacted
+	}
+	select {
+	case <-f.compactTo:
+	default:
+	}
+	select {
+	case f.compactTo <- revision:
+	default:
+	}
+	return nil
+}
+
+// compactor periodically compacts to all but the most recent compactMinRetain revisions, or to
+// the revision requested by Compact. As revisions are not consecutive, the target revision is
+// found by counting back from the newest revision.
+func (f *FoundationDB) compactor() {
+	t := time.NewTicker(f.compactInterval)
+	defer t.Stop()
+	for {
+		requested := int64(0)
+		select {
+		case <-f.ctx.Done():
+			return
+		case <-t.C:
+		case requested = <-f.compactTo:
+		}
+
+		var compact, target int64
+		_, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+			var err error
+			if _, compact, err = f.getMeta(rtr); err != nil {
+				return nil, err
+			}
+			target = requested
+			if target > 0 {
+				return nil, nil
+			}
+			kvs, err := rtr.GetRange(f.revisions, fdb.RangeOptions{
+				Limit:   int(f.compactMinRetain) + 1,
+				Reverse: true,
+				Mode:    fdb.StreamingModeWantAll,
+			}).GetSliceWithError()
+			if err != nil || int64(len(kvs)) <= f.compactMinRetain {
+				return nil, err
+			}
+			key, err := f.revisions.Unpack(kvs[len(kvs)-1].Key)
+			if err != nil {
+				return nil, err
+			}
+			target = revisionOf(key[0].(tuple.Versionstamp))
+			return nil, nil
+		})
+		if err != nil {
+			logrus.Errorf("Compact failed to get target revision: %v", err)
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			continue
+		}
+		if target <= compact {
+			continue
+		}
+
+		deleted, err := f.compact(compact, target)
+		metrics.CompactDeletedRows.Observe(float64(deleted))
+		if err != nil {
+			logrus.Errorf("Compact failed: %v", err)
+			metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			continue
+		}
+		atomic.StoreInt64(&f.lastCompact, time.Now().UnixNano())
+		metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+		logrus.Infof("COMPACT compacted from %d to %d, deleting %d revisions", compact, target, deleted)
+	}
+}
+
+// compact deletes the revisions replaced by revisions after the compact revision, up to the
+// target revision, and the deletions in that range, as the SQL compaction does. The latest
+// revision of a key is deleted with its deletion.
+func (f *FoundationDB) compact(compact, target int64) (int64, error) {
+	var deleted int64
+	for from := compact; from < target; {
+		result, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			r := fdb.KeyRange{
+				Begin: f.revisions.Pack(tuple.Tuple{versionstamp(from + 1)}),
+				End:   f.revisions.Pack(tuple.Tuple{versionstamp(target + 1)}),
+			}
+			kvs, err := tr.GetRange(r, fdb.RangeOptions{Limit: compactBatchSize, Mode: fdb.StreamingModeWantAll}).GetSliceWithError()
+			if err != nil || len(kvs) == 0 {
+				return compactBatch{last: target}, err
+			}
+
+			batch := compactBatch{}
+			for _, kv := range kvs {
+				key, err := f.revisions.Unpack(kv.Key)
+				if err != nil {
+					return nil, err
+				}
+				index, err := tuple.Unpack(kv.Value)
+				if err != nil {
+					return nil, err
+				}
+				vs := key[0].(tuple.Versionstamp)
+				name := index[0].(string)
+				batch.last = revisionOf(vs)
+
+				if prev := tupleInt(index, 3); prev > 0 && !tupleBool(index, 1) {
+					f.clearRevision(tr, name, prev)
+					batch.deleted++
+				}
+				if tupleBool(index, 2) {
+					f.clearRevision(tr, name, batch.last)
+					batch.deleted++
+					latestKey := f.latest.Pack(tuple.Tuple{name})
+					value, err := tr.Get(latestKey).Get()
+					if err != nil {
+						return nil, err
+					}
+					if value == nil {
+						continue
+					}
+					latest, err := tuple.Unpack(value)
+					if err != nil {
+						return nil, err
+					}
+					if revisionOf(latest[0].(tuple.Versionstamp)) == batch.last {
+						tr.Clear(latestKey)
+					}
+				}
+			}
+			return batch, nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		batch := result.(compactBatch)
+		deleted += batch.deleted
+		from = batch.last
+	}
+
+	_, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		_, current, err := f.getMeta(tr)
+		if err != nil || current >= target {
+			return nil, err
+		}
+		tr.Set(f.compactKey, tuple.Tuple{target}.Pack())
+		return nil, nil
+	})
+	return deleted, err
+}
+
+// compactBatch is the result of compacting a batch of revisions.
+type compactBatch struct {
+	last    int64
+	deleted int64
+}
+
+// clearRevision deletes the revision of the key, and its index entry.
+func (f *FoundationDB) clearRevision(tr fdb.Transaction, name string, revision int64) {
+	tr.ClearRange(fdb.KeyRange{
+		Begin: f.history.Pack(tuple.Tuple{name, versionstamp(revision)}),
+		End:   f.history.Pack(tuple.Tuple{name, versionstamp(revision + 1)}),
+	})
+	tr.ClearRange(fdb.KeyRange{
+		Begin: f.revisions.Pack(tuple.Tuple{versionstamp(revision)}),
+		End:   f.revisions.Pack(tuple.Tuple{versionstamp(revision + 1)}),
+	})
+}
+
+// DbSize returns the estimated size of the revisions of keys, which are the bulk of what is stored.
+func (f *FoundationDB) DbSize(ctx context.Context) (int64, error) {
+	result, err := f.db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+		return tr.GetEstimatedRangeSizeBytes(f.history).Get()
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result.(int64), nil
+}
+
+// Health checks that the cluster is reachable.
+func (f *FoundationDB) Health(ctx context.Context) (*server.HealthStatus, error) {
+	var rev, compact int64
+	_, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+		var err error
+		rev, compact, err = f.getMeta(rtr)
+		return nil, err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current revision")
+	}
+	status := &server.HealthStatus{
+		CurrentRevision: rev,
+		CompactRevision: compact,
+	}
+	if lastCompact := atomic.LoadInt64(&f.lastCompact); lastCompact != 0 {
+		status.LastCompact = time.Unix(0, lastCompact)
+		status.CompactStale = time.Since(status.LastCompact) > compactStaleIntervals*f.compactInterval
+	}
+	return status, nil
+}
+
+// Close stops the compaction, polling, and watch loops. If ctx is done before they have stopped,
+// Close returns anyway.
+func (f *FoundationDB) Close(ctx context.Context) error {
+	if f.cancel != nil {
+		f.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for compaction and polling to stop: %v", ctx.Err())
+	}
+	return nil
+}
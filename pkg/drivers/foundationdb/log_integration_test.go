@@ -0,0 +1,293 @@
+//go:build test && foundationdb
+// +build test,foundationdb
+
+package foundationdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apple/foundationdb/bindings/go/src/fdb"
+	"github.com/apple/foundationdb/bindings/go/src/fdb/subspace"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// testEndpointEnv names the environment variable holding the endpoint of the FoundationDB cluster
+// to test against, as for drivertest.FoundationDBEndpointEnv.
+const testEndpointEnv = "KINE_TEST_FOUNDATIONDB_ENDPOINT"
+
+// newTestLog returns a started log under a new prefix in the cluster named by testEndpointEnv,
+// whose keys are cleared when the test completes; the test is skipped if it is not set.
+func newTestLog(t *testing.T) *FoundationDB {
+	t.Helper()
+	endpoint := os.Getenv(testEndpointEnv)
+	if endpoint == "" {
+		t.Skipf("%s is not set", testEndpointEnv)
+	}
+	c, err := parseDSN(strings.TrimPrefix(endpoint, "foundationdb://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fdb.APIVersion(c.apiVersion); err != nil {
+		t.Fatal(err)
+	}
+	db, err := fdb.OpenDatabase(c.clusterFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := subspace.Sub(fmt.Sprintf("kine-test-%d", time.Now().UnixNano()))
+	f := newLog(db, root, &drivers.Config{})
+	if err := f.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		f.Close(context.Background())
+		_, err := db.Transact(func(tr fdb.Transaction) (interface{}, error) {
+			tr.ClearRange(root)
+			return nil, nil
+		})
+		if err != nil {
+			t.Logf("Failed to clear test keys: %v", err)
+		}
+	})
+	return f
+}
+
+func createEvent(key, value string) *server.Event {
+	return &server.Event{
+		Create: true,
+		KV:     &server.KeyValue{Key: key, Value: []byte(value)},
+		PrevKV: &server.KeyValue{},
+	}
+}
+
+func updateEvent(key, value string, createRev, prevRev int64) *server.Event {
+	return &server.Event{
+		KV:     &server.KeyValue{Key: key, Value: []byte(value), CreateRevision: createRev},
+		PrevKV: &server.KeyValue{Key: key, ModRevision: prevRev},
+	}
+}
+
+func deleteEvent(key string, createRev, prevRev int64) *server.Event {
+	kv := &server.KeyValue{Key: key, CreateRevision: createRev, ModRevision: prevRev}
+	return &server.Event{Delete: true, KV: kv, PrevKV: kv}
+}
+
+func appendEvent(t *testing.T, f *FoundationDB, event *server.Event) int64 {
+	t.Helper()
+	rev, err := f.Append(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Append of %s failed: %v", event.KV.Key, err)
+	}
+	return rev
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	f := newTestLog(t)
+
+	createRev := appendEvent(t, f, createEvent("/a", "1"))
+	if _, err := f.Append(ctx, createEvent("/a", "1")); err != server.ErrKeyExists {
+		t.Fatalf("create of existing key returned %v, want %v", err, server.ErrKeyExists)
+	}
+
+	// an update must replace the latest revision of the key
+	updateRev := appendEvent(t, f, updateEvent("/a", "2", createRev, createRev))
+	if _, err := f.Append(ctx, updateEvent("/a", "3", createRev, createRev)); err != server.ErrKeyExists {
+		t.Fatalf("update of a replaced revision returned %v, want %v", err, server.ErrKeyExists)
+	}
+	deleteRev := appendEvent(t, f, deleteEvent("/a", createRev, updateRev))
+
+	// a deleted key is created again by replacing its deletion
+	if _, err := f.Append(ctx, createEvent("/a", "4")); err != server.ErrKeyExists {
+		t.Fatalf("create of deleted key without its deletion returned %v, want %v", err, server.ErrKeyExists)
+	}
+	recreate := createEvent("/a", "4")
+	recreate.PrevKV = &server.KeyValue{Key: "/a", ModRevision: updateRev}
+	if _, err := f.Append(ctx, recreate); err != server.ErrKeyExists {
+		t.Fatalf("create of deleted key replacing revision %d returned %v, want %v", updateRev, err, server.ErrKeyExists)
+	}
+	recreate.PrevKV.ModRevision = deleteRev
+	recreateRev := appendEvent(t, f, recreate)
+
+	_, events, err := f.List(ctx, "/a", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].KV.Value) != "4" || events[0].KV.ModRevision != recreateRev {
+		t.Fatalf("List returned %v, want /a = 4 at %d", events, recreateRev)
+	}
+	_, events, err = f.List(ctx, "/a", "", 0, updateRev, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].KV.Value) != "2" {
+		t.Fatalf("List at revision %d returned %v, want /a = 2", updateRev, events)
+	}
+}
+
+func TestRevisionsOrdered(t *testing.T) {
+	const writers, writes = 8, 10
+	ctx := context.Background()
+	f := newTestLog(t)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		revs []int64
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				rev, err := f.Append(ctx, createEvent(fmt.Sprintf("/revs/%d/%d", w, i), "v"))
+				if err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				mu.Lock()
+				revs = append(revs, rev)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// revisions are commit versions, at most one write is committed at each, and are read in the
+	// order of commit
+	sort.Slice(revs, func(i, j int) bool { return revs[i] < revs[j] })
+	for i := 1; i < len(revs); i++ {
+		if revs[i] == revs[i-1] {
+			t.Fatalf("revision %d was assigned twice", revs[i])
+		}
+	}
+	if rev, err := f.CurrentRevision(ctx); err != nil || rev != revs[len(revs)-1] {
+		t.Fatalf("CurrentRevision returned %d, %v, want %d", rev, err, revs[len(revs)-1])
+	}
+
+	_, events, err := f.After(ctx, "/revs/", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(revs) {
+		t.Fatalf("After returned %d events, want %d", len(events), len(revs))
+	}
+	for i, event := range events {
+		if event.KV.ModRevision != revs[i] {
+			t.Fatalf("After returned event %d at revision %d, want %d", i, event.KV.ModRevision, revs[i])
+		}
+	}
+}
+
+func TestLargeValues(t *testing.T) {
+	ctx := context.Background()
+	f := newTestLog(t)
+
+	// values are split into chunks, of which the records of these revisions have three
+	first := bytes.Repeat([]byte{'a'}, 2*chunkSize+1)
+	second := bytes.Repeat([]byte{'b'}, 2*chunkSize+1)
+	createRev := appendEvent(t, f, createEvent("/large", string(first)))
+	update := updateEvent("/large", string(second), createRev, createRev)
+	update.PrevKV.Value = first
+	updateRev := appendEvent(t, f, update)
+
+	for _, tt := range []struct {
+		revision int64
+		want     []byte
+	}{
+		{createRev, first},
+		{updateRev, second},
+	} {
+		_, events, err := f.List(ctx, "/large", "", 0, tt.revision, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || !bytes.Equal(events[0].KV.Value, tt.want) {
+			t.Fatalf("List at revision %d did not return the value written", tt.revision)
+		}
+	}
+	_, events, err := f.After(ctx, "/large", createRev, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || !bytes.Equal(events[0].PrevKV.Value, first) {
+		t.Fatalf("After did not return the previous value of the update")
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	f := newTestLog(t)
+
+	// /a has five revisions, /b is created and deleted, and /c is created
+	aCreate := appendEvent(t, f, createEvent("/a", "0"))
+	aRev := aCreate
+	for i := 1; i < 5; i++ {
+		aRev = appendEvent(t, f, updateEvent("/a", fmt.Sprint(i), aCreate, aRev))
+	}
+	bCreate := appendEvent(t, f, createEvent("/b", "b"))
+	bDelete := appendEvent(t, f, deleteEvent("/b", bCreate, bCreate))
+	cCreate := appendEvent(t, f, createEvent("/c", "c"))
+
+	// the four replaced revisions of /a, and both revisions of /b
+	deleted, err := f.compact(0, bDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 6 {
+		t.Errorf("compaction deleted %d revisions, want 6", deleted)
+	}
+
+	for _, tt := range []struct {
+		name     string
+		revision int64
+		want     int64
+	}{
+		{"/a", aRev, aRev},
+		{"/a", aRev - 1, 0},
+		{"/b", bDelete, 0},
+		{"/c", cCreate, cCreate},
+	} {
+		result, err := f.db.ReadTransact(func(rtr fdb.ReadTransaction) (interface{}, error) {
+			return f.readRecordAt(rtr, tt.name, tt.revision)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got int64
+		if event := result.(*server.Event); event != nil {
+			got = event.KV.ModRevision
+		}
+		if got != tt.want {
+			t.Errorf("revision of %s at %d after compaction = %d, want %d", tt.name, tt.revision, got, tt.want)
+		}
+	}
+	_, events, err := f.List(ctx, "/", "", 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, event := range events {
+		names = append(names, event.KV.Key)
+	}
+	if strings.Join(names, ",") != "/a,/c" {
+		t.Errorf("keys after compaction = %v, want [/a /c]", names)
+	}
+
+	if _, _, err := f.List(ctx, "/", "", 0, aCreate, false); err != server.ErrCompacted {
+		t.Errorf("List at compacted revision returned %v, want %v", err, server.ErrCompacted)
+	}
+	if err := f.Compact(ctx, bDelete); err != server.ErrCompacted {
+		t.Errorf("Compact to the compact revision returned %v, want %v", err, server.ErrCompacted)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !foundationdb
+// +build !foundationdb
+
+package foundationdb
+
+import (
+	"context"
+	"errors"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	return nil, errors.New(`this binary is built without FoundationDB support, compile with "-tags foundationdb"`)
+}
@@ -0,0 +1,208 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+)
+
+// recordingDriver is a database/sql driver that records the statements executed through it.
+// Queries return a single row with a single column, and explained queries return the plan.
+type recordingDriver struct {
+	mu         sync.Mutex
+	statements []string
+	readOnly   []bool
+}
+
+func (d *recordingDriver) Open(name string) (driver.Conn, error) {
+	return &recordingDriverConn{driver: d}, nil
+}
+
+func (d *recordingDriver) record(query string, readOnly bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.statements = append(d.statements, query)
+	d.readOnly = append(d.readOnly, readOnly)
+}
+
+// explained returns the statements that were explained, and whether each was explained in a
+// read-only transaction.
+func (d *recordingDriver) explained() ([]string, []bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var (
+		explained []string
+		readOnly  []bool
+	)
+	for i, stmt := range d.statements {
+		if strings.HasPrefix(stmt, "EXPLAIN ") {
+			explained = append(explained, stmt)
+			readOnly = append(readOnly, d.readOnly[i])
+		}
+	}
+	return explained, readOnly
+}
+
+type recordingDriverConn struct {
+	driver   *recordingDriver
+	readOnly bool
+}
+
+func (c *recordingDriverConn) Prepare(query string) (driver.Stmt, error) {
+	return &recordingDriverStmt{conn: c, query: query}, nil
+}
+
+func (c *recordingDriverConn) Close() error { return nil }
+
+func (c *recordingDriverConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *recordingDriverConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.readOnly = opts.ReadOnly
+	return c, nil
+}
+
+func (c *recordingDriverConn) Commit() error {
+	c.readOnly = false
+	return nil
+}
+
+func (c *recordingDriverConn) Rollback() error {
+	c.readOnly = false
+	return nil
+}
+
+type recordingDriverStmt struct {
+	conn  *recordingDriverConn
+	query string
+}
+
+func (s *recordingDriverStmt) Close() error  { return nil }
+func (s *recordingDriverStmt) NumInput() int { return -1 }
+
+func (s *recordingDriverStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.driver.record(s.query, s.conn.readOnly)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *recordingDriverStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.driver.record(s.query, s.conn.readOnly)
+	value := driver.Value(int64(1))
+	if strings.HasPrefix(s.query, "EXPLAIN ") {
+		value = "Index Scan using kine_name_index on kine"
+	}
+	return &recordingDriverRows{values: []driver.Value{value}}, nil
+}
+
+type recordingDriverRows struct {
+	values []driver.Value
+}
+
+func (r *recordingDriverRows) Columns() []string { return []string{"value"} }
+func (r *recordingDriverRows) Close() error      { return nil }
+
+func (r *recordingDriverRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0], r.values = r.values[0], r.values[1:]
+	return nil
+}
+
+var explainDriver = &recordingDriver{}
+
+func init() {
+	sql.Register("kine-explain-test", explainDriver)
+}
+
+func TestExplainSlow(t *testing.T) {
+	threshold := metrics.SlowSQLThreshold
+	defer func() { metrics.SlowSQLThreshold = threshold }()
+
+	db, err := sql.Open("kine-explain-test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := &Generic{
+		DB:                 db,
+		ErrCode:            func(error) string { return "" },
+		ExplainSQL:         "EXPLAIN (ANALYZE false) %s",
+		ExplainSlowQueries: true,
+	}
+	ctx := context.Background()
+
+	// run executes each statement in turn, waiting for any plan to be obtained in the background
+	// before the next, as only one plan is obtained at a time.
+	run := func() {
+		t.Helper()
+		statements := []func() error{
+			func() error {
+				var value int64
+				return d.queryRow(ctx, "SELECT 1 FROM kine WHERE name = ?", "/a").Scan(&value)
+			},
+			// writes executed as queries, so that they can return values, are not explained
+			func() error {
+				var value int64
+				return d.queryRow(ctx, "INSERT INTO kine(name) VALUES(?) RETURNING id", "/a").Scan(&value)
+			},
+			func() error {
+				rows, err := d.query(ctx, "  select id FROM kine WHERE name LIKE ?", "/%")
+				if err != nil {
+					return err
+				}
+				return rows.Close()
+			},
+			func() error {
+				_, err := d.execute(ctx, "DELETE FROM kine WHERE id <= ?", 1)
+				return err
+			},
+		}
+		for _, stmt := range statements {
+			if err := stmt(); err != nil {
+				t.Fatal(err)
+			}
+			for atomic.LoadInt32(&d.explaining) != 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	metrics.SlowSQLThreshold = time.Hour
+	run()
+	if explained, _ := explainDriver.explained(); len(explained) != 0 {
+		t.Fatalf("fast queries were explained: %v", explained)
+	}
+
+	metrics.SlowSQLThreshold = time.Nanosecond
+	run()
+	explained, readOnly := explainDriver.explained()
+	want := []string{
+		"EXPLAIN (ANALYZE false) SELECT 1 FROM kine WHERE name = ?",
+		"EXPLAIN (ANALYZE false)   select id FROM kine WHERE name LIKE ?",
+	}
+	if strings.Join(explained, "\n") != strings.Join(want, "\n") {
+		t.Errorf("explained %q, want %q", explained, want)
+	}
+	for i, ro := range readOnly {
+		if !ro {
+			t.Errorf("%q was not run in a read-only transaction", explained[i])
+		}
+	}
+
+	// explaining can be disabled
+	d.ExplainSlowQueries = false
+	run()
+	if got, _ := explainDriver.explained(); len(got) != len(explained) {
+		t.Errorf("queries were explained with explaining disabled: %q", got[len(explained):])
+	}
+}
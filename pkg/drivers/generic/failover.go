@@ -0,0 +1,116 @@
+package generic
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Hosts are tried with an exponential backoff between failoverMinBackoff and
+	// failoverMaxBackoff, so that a cluster that is failing over is not flooded with connections.
+	failoverMinBackoff = 100 * time.Millisecond
+	failoverMaxBackoff = 2 * time.Second
+)
+
+// ConnectFunc opens a connection to a host of the database.
+type ConnectFunc func(ctx context.Context, host string) (driver.Conn, error)
+
+// HostFailover opens connections to one of several hosts of the database, such as the members of
+// a cluster that fail over between each other. Connections are opened to the host that accepted
+// the last connection, and once it fails, to the following hosts in turn.
+type HostFailover struct {
+	driverName string
+	hosts      []string
+
+	mu      sync.Mutex
+	current int
+}
+
+func NewHostFailover(driverName string, hosts []string) *HostFailover {
+	return &HostFailover{
+		driverName: driverName,
+		hosts:      hosts,
+	}
+}
+
+// Connect opens a connection using connect, starting with the current host. If it fails, the
+// following hosts are tried in turn, with a backoff between attempts, until one accepts the
+// connection or every host has been tried. The host that accepts the connection becomes the
+// current host.
+func (f *HostFailover) Connect(ctx context.Context, connect ConnectFunc) (driver.Conn, error) {
+	f.mu.Lock()
+	start := f.current
+	f.mu.Unlock()
+
+	backoff := failoverMinBackoff
+	var err error
+	for i := range f.hosts {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > failoverMaxBackoff {
+				backoff = failoverMaxBackoff
+			}
+		}
+
+		n := (start + i) % len(f.hosts)
+		var conn driver.Conn
+		if conn, err = connect(ctx, f.hosts[n]); err != nil {
+			logrus.Warnf("Failed to connect to %s database host %s: %v", f.driverName, f.hosts[n], err)
+			continue
+		}
+
+		f.mu.Lock()
+		if previous := f.current; previous != n {
+			f.current = n
+			metrics.SQLFailoversTotal.WithLabelValues(f.driverName).Inc()
+			logrus.Warnf("Failed over %s database from host %s to %s", f.driverName, f.hosts[previous], f.hosts[n])
+		}
+		f.mu.Unlock()
+		return conn, nil
+	}
+	return nil, err
+}
+
+// QueryBool executes a query returning a single boolean on the connection, such as to check
+// whether the host of the connection accepts writes before failing over to it.
+func QueryBool(ctx context.Context, conn driver.Conn, query string) (bool, error) {
+	queryer, ok := conn.(driver.QueryerContext)
+	if !ok {
+		return false, fmt.Errorf("%T does not support queries", conn)
+	}
+	rows, err := queryer.QueryContext(ctx, query, nil)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	values := make([]driver.Value, len(rows.Columns()))
+	if err := rows.Next(values); err != nil {
+		if err == io.EOF {
+			return false, fmt.Errorf("no rows returned by %s", query)
+		}
+		return false, err
+	}
+	switch v := values[0].(type) {
+	case bool:
+		return v, nil
+	case int64:
+		return v != 0, nil
+	case []byte:
+		return string(v) == "1" || string(v) == "true" || string(v) == "t", nil
+	case string:
+		return v == "1" || v == "true" || v == "t", nil
+	}
+	return false, fmt.Errorf("unexpected %T returned by %s", values[0], query)
+}
@@ -3,12 +3,14 @@ package generic
 import (
 	"context"
 	"database/sql"
-	"errors"
+	"database/sql/driver"
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Rican7/retry/backoff"
@@ -16,6 +18,7 @@ import (
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/sirupsen/logrus"
@@ -23,6 +26,7 @@ import (
 
 const (
 	defaultMaxIdleConns = 2 // copied from database/sql
+	explainTimeout      = 10 * time.Second
 )
 
 // explicit interface check
@@ -49,6 +53,32 @@ var (
 				ikv.name = ? AND
 				ikv.id <= ?)`
 
+	// afterSQL is formatted with any additional conditions on the rows returned
+	afterSQL = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM kine AS kv
+		WHERE
+			kv.name LIKE ? ESCAPE '!' AND
+			kv.id > ?
+			%%s
+		ORDER BY kv.id ASC`, revSQL, compactRevSQL, columns)
+
+	// getKeysSQL is formatted with the placeholders for the list of keys
+	getKeysSQL = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM kine AS kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			WHERE
+				mkv.name IN (%%s)
+			GROUP BY mkv.name) AS maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0
+		ORDER BY kv.name ASC
+		`, revSQL, compactRevSQL, columns)
+
 	listSQL = fmt.Sprintf(`
 		SELECT *
 		FROM (
@@ -58,7 +88,7 @@ var (
 				SELECT MAX(mkv.id) AS id
 				FROM kine AS mkv
 				WHERE
-					mkv.name LIKE ?
+					mkv.name LIKE ? ESCAPE '!'
 					%%s
 				GROUP BY mkv.name) AS maxkv
 				ON maxkv.id = kv.id
@@ -73,11 +103,20 @@ var (
 type ErrRetry func(error) bool
 type TranslateErr func(error) error
 type ErrCode func(error) string
+type ApplyLimit func(sql string, limit int64) string
 
 type ConnectionPoolConfig struct {
 	MaxIdle     int           // zero means defaultMaxIdleConns; negative means 0
 	MaxOpen     int           // <= 0 means unlimited
 	MaxLifetime time.Duration // maximum amount of time a connection may be reused
+	SkipWarmUp  bool          // do not open idle connections before the datastore is used
+	// MaxLifetimeJitter randomly extends MaxLifetime by up to this duration, so that connections
+	// opened together are not all reopened at once
+	MaxLifetimeJitter time.Duration
+	// HealthCheckInterval is the interval at which the database is pinged; zero disables the health check
+	HealthCheckInterval time.Duration
+	// MaxConcurrentQueries limits the number of queries executed at once; zero or negative means unlimited
+	MaxConcurrentQueries int
 }
 
 type Generic struct {
@@ -88,22 +127,94 @@ type Generic struct {
 	DB                    *sql.DB
 	GetCurrentSQL         string
 	GetRevisionSQL        string
+	GetAtRevisionSQL      string
 	RevisionSQL           string
+	CompactRevisionSQL    string
 	ListRevisionStartSQL  string
 	GetRevisionAfterSQL   string
 	CountSQL              string
+	FastCountSQL          string
 	AfterSQL              string
 	DeleteSQL             string
+	UpdateValueSQL        string
+	DeleteLeaseSQL        string
+	GrantLeaseSQL         string
+	RenewLeaseSQL         string
+	GetLeaseSQL           string
+	RevokeLeaseSQL        string
+	ListLeasesSQL         string
+	ExpiredLeasesSQL      string
+	LeaseKeysSQL          string
 	CompactSQL            string
+	CompactDryRunSQL      string
+	CompactIDsSQL         string
+	CompactPrefixSQL      string
 	UpdateCompactSQL      string
 	PostCompactSQL        string
+	VacuumSQL             string
+	PreRestoreSQL         []string
+	PostRestoreSQL        []string
+	DefragSQL             []string
 	InsertSQL             string
 	FillSQL               string
 	InsertLastInsertIDSQL string
 	GetSizeSQL            string
+	ExplainSQL            string
 	Retry                 ErrRetry
 	TranslateErr          TranslateErr
 	ErrCode               ErrCode
+	ApplyLimit            ApplyLimit
+	// RetriableErrCodes lists the error codes, as returned by ErrCode, of transient errors
+	// such as deadlocks and serialization failures that can be resolved by retrying.
+	RetriableErrCodes []string
+
+	// AfterFormatSQL and GetCurrentKeysFormatSQL are formatted at runtime, with additional
+	// conditions and with the placeholders for the list of keys respectively, before the
+	// placeholders are rewritten for the dialect.
+	AfterFormatSQL          string
+	GetCurrentKeysFormatSQL string
+
+	// InsertOutParam passes an output parameter for the id as the final argument to InsertSQL,
+	// for dialects that return the id of the inserted row with RETURNING ... INTO.
+	InsertOutParam bool
+
+	// VacuumThreshold is the number of rows that must be deleted by compaction for VacuumSQL to
+	// be executed afterwards. Zero disables execution of VacuumSQL.
+	VacuumThreshold int64
+
+	// IDColumnBits is the width in bits of the signed id and revision columns, which bounds the
+	// revisions that can be written. Zero means 64 bits.
+	IDColumnBits int
+
+	// FastCount counts keys using FastCountSQL instead of CountSQL, if set
+	FastCount bool
+
+	// ExplainSlowQueries logs the plan of read queries that take longer than metrics.SlowSQLThreshold,
+	// obtained by executing ExplainSQL with the query substituted for the format verb.
+	ExplainSlowQueries bool
+
+	// ReadDB is a read replica of DB, to which lists at past revisions are sent while it lags DB
+	// by no more than MaxReadLag revisions, or nil if there is none. See OpenReadReplica.
+	ReadDB     *sql.DB
+	MaxReadLag int64
+
+	// querySem limits the number of concurrently executing queries, if not nil
+	querySem chan struct{}
+	// paramCharacter and numbered control how placeholders are written in queries built at runtime
+	paramCharacter string
+	numbered       bool
+	// explaining is set while the plan of a slow query is being obtained
+	explaining int32
+	// driverName is the name of the database driver, by which SQL metrics are labeled
+	driverName string
+	// monitored is set if the pool is monitored by the health check, which records its result in health
+	monitored   bool
+	health      poolHealth
+	stopMonitor context.CancelFunc
+	// replicaRevision is the revision of the read replica when it was last checked, or zero if
+	// the replica lagged by more than MaxReadLag or could not be reached
+	replicaRevision int64
+	stopReplica     context.CancelFunc
 }
 
 func q(sql, param string, numbered bool) string {
@@ -123,17 +234,12 @@ func q(sql, param string, numbered bool) string {
 }
 
 func (d *Generic) Migrate(ctx context.Context) {
-	var (
-		count     = 0
-		countKV   = d.queryRow(ctx, "SELECT COUNT(*) FROM key_value")
-		countKine = d.queryRow(ctx, "SELECT COUNT(*) FROM kine")
-	)
-
-	if err := countKV.Scan(&count); err != nil || count == 0 {
+	count := 0
+	if err := d.queryRow(ctx, "SELECT COUNT(*) FROM key_value").Scan(&count); err != nil || count == 0 {
 		return
 	}
 
-	if err := countKine.Scan(&count); err != nil || count != 0 {
+	if err := d.queryRow(ctx, "SELECT COUNT(*) FROM kine").Scan(&count); err != nil || count != 0 {
 		return
 	}
 
@@ -148,7 +254,7 @@ func (d *Generic) Migrate(ctx context.Context) {
 	}
 }
 
-func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB, driverName string) {
+func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB, driverName string) int {
 	// behavior copied from database/sql - zero means defaultMaxIdleConns; negative means 0
 	if connPoolConfig.MaxIdle < 0 {
 		connPoolConfig.MaxIdle = 0
@@ -160,16 +266,48 @@ func configureConnectionPooling(connPoolConfig ConnectionPoolConfig, db *sql.DB,
 	db.SetMaxIdleConns(connPoolConfig.MaxIdle)
 	db.SetMaxOpenConns(connPoolConfig.MaxOpen)
 	db.SetConnMaxLifetime(connPoolConfig.MaxLifetime)
+
+	if connPoolConfig.MaxOpen > 0 && connPoolConfig.MaxOpen < connPoolConfig.MaxIdle {
+		return connPoolConfig.MaxOpen
+	}
+	return connPoolConfig.MaxIdle
+}
+
+// warmUp opens the given number of connections and runs a trivial query on each, before
+// returning them to the pool as idle connections. This avoids the latency of establishing
+// connections while serving the first requests. Failures are not fatal, as connections
+// will be opened again on demand.
+func warmUp(ctx context.Context, db *sql.DB, count int) {
+	conns := make([]*sql.Conn, 0, count)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			logrus.Warnf("Failed to open connection during warm-up: %v", err)
+			return
+		}
+		conns = append(conns, conn)
+		if _, err := conn.ExecContext(ctx, "SELECT 1"); err != nil {
+			logrus.Warnf("Failed to execute query during warm-up: %v", err)
+			return
+		}
+	}
+	logrus.Infof("Opened %d database connections during warm-up", len(conns))
 }
 
-func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
-	db, err := sql.Open(driverName, dataSourceName)
+func openAndTest(ctx context.Context, open func() (*sql.DB, error)) (*sql.DB, error) {
+	db, err := open()
 	if err != nil {
 		return nil, err
 	}
 
 	for i := 0; i < 3; i++ {
-		if err := db.Ping(); err != nil {
+		if err := db.PingContext(ctx); err != nil {
 			db.Close()
 			return nil, err
 		}
@@ -179,13 +317,29 @@ func openAndTest(driverName, dataSourceName string) (*sql.DB, error) {
 }
 
 func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
+	open := func() (*sql.DB, error) {
+		return sql.Open(driverName, dataSourceName)
+	}
+	return openDB(ctx, driverName, open, connPoolConfig, paramCharacter, numbered, metricsRegisterer)
+}
+
+// OpenConnector is like Open, but opens connections to the database using the connector, instead
+// of a registered driver. This allows the driver to be configured, such as with a custom dialer.
+func OpenConnector(ctx context.Context, driverName string, connector driver.Connector, connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
+	open := func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+	return openDB(ctx, driverName, open, connPoolConfig, paramCharacter, numbered, metricsRegisterer)
+}
+
+func openDB(ctx context.Context, driverName string, open func() (*sql.DB, error), connPoolConfig ConnectionPoolConfig, paramCharacter string, numbered bool, metricsRegisterer prometheus.Registerer) (*Generic, error) {
 	var (
 		db  *sql.DB
 		err error
 	)
 
 	for i := 0; i < 300; i++ {
-		db, err = openAndTest(driverName, dataSourceName)
+		db, err = openAndTest(ctx, open)
 		if err == nil {
 			break
 		}
@@ -198,14 +352,31 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 		}
 	}
 
-	configureConnectionPooling(connPoolConfig, db, driverName)
+	maxIdle := configureConnectionPooling(connPoolConfig, db, driverName)
+	if !connPoolConfig.SkipWarmUp {
+		warmUp(ctx, db, maxIdle)
+	}
 
 	if metricsRegisterer != nil {
 		metricsRegisterer.MustRegister(collectors.NewDBStatsCollector(db, "kine"))
 	}
 
-	return &Generic{
-		DB: db,
+	querySem := newQuerySem(connPoolConfig.MaxConcurrentQueries)
+	if querySem != nil {
+		logrus.Infof("Limiting %s database to %d concurrent queries", driverName, cap(querySem))
+	}
+
+	d := &Generic{
+		DB:             db,
+		querySem:       querySem,
+		paramCharacter: paramCharacter,
+		numbered:       numbered,
+		driverName:     driverName,
+
+		RevisionSQL:             q(revSQL, paramCharacter, numbered),
+		CompactRevisionSQL:      q(compactRevSQL, paramCharacter, numbered),
+		AfterFormatSQL:          afterSQL,
+		GetCurrentKeysFormatSQL: getKeysSQL,
 
 		GetRevisionSQL: q(fmt.Sprintf(`
 			SELECT
@@ -223,18 +394,118 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 				%s
 			) c`, revSQL, fmt.Sprintf(listSQL, "")), paramCharacter, numbered),
 
-		AfterSQL: q(fmt.Sprintf(`
-			SELECT (%s), (%s), %s
+		// FastCountSQL only reads the columns needed to find the latest revision of each key,
+		// instead of counting the rows of the full list query.
+		FastCountSQL: q(fmt.Sprintf(`
+			SELECT (%s), COUNT(kv.id)
 			FROM kine AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				WHERE
+					mkv.name LIKE ? ESCAPE '!'
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
 			WHERE
-				kv.name LIKE ? AND
-				kv.id > ?
-			ORDER BY kv.id ASC`, revSQL, compactRevSQL, columns), paramCharacter, numbered),
+				kv.deleted = 0 OR
+				?`, revSQL), paramCharacter, numbered),
+
+		AfterSQL: q(fmt.Sprintf(afterSQL, ""), paramCharacter, numbered),
 
 		DeleteSQL: q(`
 			DELETE FROM kine AS kv
 			WHERE kv.id = ?`, paramCharacter, numbered),
 
+		UpdateValueSQL: q(`
+			UPDATE kine
+			SET value = ?, old_value = COALESCE(?, old_value)
+			WHERE id = ?`, paramCharacter, numbered),
+
+		DeleteLeaseSQL: q(`
+			INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+			SELECT kv.name, 0, 1, kv.create_revision, kv.id, kv.lease, kv.value, kv.value
+			FROM kine AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				WHERE mkv.name IN (
+					SELECT lkv.name
+					FROM kine AS lkv
+					WHERE lkv.lease = ?)
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
+			WHERE
+				kv.lease = ? AND
+				kv.deleted = 0 AND
+				kv.id <= ?
+			ORDER BY kv.id ASC`, paramCharacter, numbered),
+
+		GrantLeaseSQL:    q(grantLeaseSQL, paramCharacter, numbered),
+		RenewLeaseSQL:    q(renewLeaseSQL, paramCharacter, numbered),
+		GetLeaseSQL:      q(getLeaseSQL, paramCharacter, numbered),
+		RevokeLeaseSQL:   q(revokeLeaseSQL, paramCharacter, numbered),
+		ListLeasesSQL:    listLeasesSQL,
+		ExpiredLeasesSQL: q(expiredLeasesSQL, paramCharacter, numbered),
+		LeaseKeysSQL:     q(leaseKeysSQL, paramCharacter, numbered),
+
+		CompactDryRunSQL: q(`
+			SELECT COUNT(*), COALESCE(MIN(kv.id), 0), COALESCE(MAX(kv.id), 0)
+			FROM kine AS kv
+			JOIN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id <= ?
+			) AS ks
+			ON kv.id = ks.id`, paramCharacter, numbered),
+
+		CompactIDsSQL: q(`
+			SELECT ks.id
+			FROM (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id > ? AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.deleted != 0 AND
+					kd.id > ? AND
+					kd.id <= ?
+			) AS ks
+			ORDER BY ks.id ASC`, paramCharacter, numbered),
+
+		CompactPrefixSQL: q(`
+			DELETE FROM kine
+			WHERE id IN (
+				SELECT kp.prev_revision AS id
+				FROM kine AS kp
+				WHERE
+					kp.name LIKE ? ESCAPE '!' AND
+					kp.name != 'compact_rev_key' AND
+					kp.prev_revision != 0 AND
+					kp.id <= ?
+				UNION
+				SELECT kd.id AS id
+				FROM kine AS kd
+				WHERE
+					kd.name LIKE ? ESCAPE '!' AND
+					kd.deleted != 0 AND
+					kd.id <= ?
+			)`, paramCharacter, numbered),
+
 		UpdateCompactSQL: q(`
 			UPDATE kine
 			SET prev_revision = ?
@@ -248,25 +519,196 @@ func Open(ctx context.Context, driverName, dataSourceName string, connPoolConfig
 
 		FillSQL: q(`INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
 			values(?, ?, ?, ?, ?, ?, ?, ?, ?)`, paramCharacter, numbered),
-	}, err
+	}
+
+	if err == nil && (connPoolConfig.HealthCheckInterval > 0 || (connPoolConfig.MaxLifetime > 0 && connPoolConfig.MaxLifetimeJitter > 0)) {
+		d.monitored = connPoolConfig.HealthCheckInterval > 0
+		var monitorCtx context.Context
+		monitorCtx, d.stopMonitor = context.WithCancel(ctx)
+		go d.monitorPool(monitorCtx, connPoolConfig)
+	}
+	return d, err
+}
+
+// newQuerySem returns the semaphore limiting queries to maxQueries at once, or nil if maxQueries
+// is not positive, in which case queries are only limited by the connection pool.
+func newQuerySem(maxQueries int) chan struct{} {
+	if maxQueries <= 0 {
+		return nil
+	}
+	return make(chan struct{}, maxQueries)
+}
+
+// acquire waits until the number of concurrently executing queries is below the limit,
+// so that excess queries are queued before requesting a connection from the pool.
+// The returned function must be called once the query has completed. If the health check
+// has found the database to be unavailable, its error is returned immediately instead.
+func (d *Generic) acquire(ctx context.Context) (func(), error) {
+	if err := d.health.get(); err != nil {
+		return nil, err
+	}
+	if d.querySem == nil {
+		return func() {}, nil
+	}
+	select {
+	case d.querySem <- struct{}{}:
+		return func() { <-d.querySem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
-func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
-	logrus.Tracef("QUERY %v : %s", args, util.Stripped(sql))
+func (d *Generic) query(ctx context.Context, sql string, args ...interface{}) (server.Rows, error) {
+	return d.queryOn(ctx, d.DB, sql, args...)
+}
+
+// queryOn executes the query on the database, or on its read replica. The query limit slot is
+// held until the returned rows are closed or fully read.
+func (d *Generic) queryOn(ctx context.Context, db *sql.DB, sql string, args ...interface{}) (result server.Rows, err error) {
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logrus.Tracef("QUERY %v : %s", util.Redacted(args), util.Stripped(sql))
+	ctx, endSpan := d.traceStatement(ctx, sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		endSpan(err)
+		metrics.ObserveSQL(startTime, d.ErrCode(err))
+		d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, -1)
+		d.explainSlow(startTime, sql, args)
 	}()
-	return d.DB.QueryContext(ctx, sql, args...)
+	rows, err := db.QueryContext(ctx, sql, args...)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &releasingRows{Rows: rows, release: release}, nil
+}
+
+// releasingRows releases the query limit slot of a query once its rows are closed, which
+// database/sql also does when Next returns false.
+type releasingRows struct {
+	*sql.Rows
+	once    sync.Once
+	release func()
+}
+
+func (r *releasingRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.once.Do(r.release)
+	return false
+}
+
+func (r *releasingRows) Close() error {
+	err := r.Rows.Close()
+	r.once.Do(r.release)
+	return err
 }
 
-func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("QUERY ROW %v : %s", args, util.Stripped(sql))
+// releasingRow is the result of queryRow. Like *sql.Row, errors from the query are deferred until
+// Scan is called; the query limit slot is released once the row has been scanned.
+type releasingRow struct {
+	row     *sql.Row
+	err     error
+	release func()
+}
+
+func (r *releasingRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.release()
+	return r.row.Scan(dest...)
+}
+
+func (r *releasingRow) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Err()
+}
+
+func (d *Generic) queryRow(ctx context.Context, sql string, args ...interface{}) *releasingRow {
+	return d.queryRowOn(ctx, d.DB, sql, args...)
+}
+
+// queryRowOn executes the query on the database, or on its read replica. The returned row
+// must be scanned, so that the query limit slot is released.
+func (d *Generic) queryRowOn(ctx context.Context, db *sql.DB, sql string, args ...interface{}) (result *releasingRow) {
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return &releasingRow{err: err}
+	}
+
+	logrus.Tracef("QUERY ROW %v : %s", util.Redacted(args), util.Stripped(sql))
+	ctx, endSpan := d.traceStatement(ctx, sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()), util.Stripped(sql), args)
+		endSpan(result.Err())
+		metrics.ObserveSQL(startTime, d.ErrCode(result.Err()))
+		d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, -1)
+		d.explainSlow(startTime, sql, args)
+	}()
+	return &releasingRow{row: db.QueryRowContext(ctx, sql, args...), release: release}
+}
+
+// explainSlow logs the plan of the query if it was slow and explaining slow queries is enabled.
+// Only SELECT statements are explained, as some writes are executed as queries so that they can
+// return values. The plan is obtained in the background using a read-only transaction, so that
+// the caller is not delayed, and only one plan is obtained at a time.
+func (d *Generic) explainSlow(startTime time.Time, query string, args []interface{}) {
+	if !d.ExplainSlowQueries || d.ExplainSQL == "" || metrics.SlowSQLThreshold <= 0 || time.Since(startTime) < metrics.SlowSQLThreshold {
+		return
+	}
+	if !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT") {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&d.explaining, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&d.explaining, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+		defer cancel()
+
+		plan, err := d.explain(ctx, query, args)
+		if err != nil {
+			logrus.Warnf("Failed to explain slow SQL %s: %v", util.Stripped(query), err)
+			return
+		}
+		logrus.Infof("Plan of slow SQL %s :\n%s", util.Stripped(query), plan)
 	}()
-	return d.DB.QueryRowContext(ctx, sql, args...)
+}
+
+func (d *Generic) explain(ctx context.Context, query string, args []interface{}) (string, error) {
+	tx, err := d.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(d.ExplainSQL, query), args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", err
+		}
+		plan = append(plan, line)
+	}
+	return strings.Join(plan, "\n"), rows.Err()
 }
 
 func (d *Generic) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
@@ -275,13 +717,24 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 		defer d.Unlock()
 	}
 
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
 	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
 	for i := uint(0); i < 20; i++ {
-		logrus.Tracef("EXEC (try: %d) %v : %s", i, args, util.Stripped(sql))
+		logrus.Tracef("EXEC (try: %d) %v : %s", i, util.Redacted(args), util.Stripped(sql))
+		spanCtx, endSpan := d.traceStatement(ctx, sql)
 		startTime := time.Now()
-		result, err = d.DB.ExecContext(ctx, sql, args...)
-		metrics.ObserveSQL(startTime, d.ErrCode(err), util.Stripped(sql), args)
+		result, err = d.DB.ExecContext(spanCtx, sql, args...)
+		endSpan(err)
+		metrics.ObserveSQL(startTime, d.ErrCode(err))
+		d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, rowsAffected(result, err))
 		if err != nil && d.Retry != nil && d.Retry(err) {
+			metrics.SQLRetriesTotal.WithLabelValues(d.driverName).Inc()
 			wait(i)
 			continue
 		}
@@ -292,7 +745,7 @@ func (d *Generic) execute(ctx context.Context, sql string, args ...interface{})
 
 func (d *Generic) GetCompactRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, compactRevSQL)
+	row := d.queryRow(ctx, d.CompactRevisionSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -306,56 +759,150 @@ func (d *Generic) SetCompactRevision(ctx context.Context, revision int64) error
 	return err
 }
 
-func (d *Generic) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("COMPACT %v", revision)
-	res, err := d.execute(ctx, d.CompactSQL, revision, revision)
+// Compact deletes rows superseded or deleted by the revisions after compactRev, up to and including
+// revision. Rows up to compactRev have already been compacted, so they are not scanned again.
+func (d *Generic) Compact(ctx context.Context, compactRev, revision int64) (int64, error) {
+	logrus.Tracef("COMPACT %v %v", compactRev, revision)
+	res, err := d.execute(ctx, d.CompactSQL, compactRev, revision, compactRev, revision)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// CompactDryRun returns the number of rows that would be deleted by compacting to the
+// given revision, along with the lowest and highest ids of those rows.
+func (d *Generic) CompactDryRun(ctx context.Context, revision int64) (count, minID, maxID int64, err error) {
+	logrus.Tracef("COMPACTDRYRUN %v", revision)
+	row := d.queryRow(ctx, d.CompactDryRunSQL, revision, revision)
+	err = row.Scan(&count, &minID, &maxID)
+	return
+}
+
+// CompactPrefix deletes rows for keys matching the prefix that were replaced or deleted at or
+// before the given revision, and returns the number of rows deleted.
+func (d *Generic) CompactPrefix(ctx context.Context, prefix string, revision int64) (int64, error) {
+	logrus.Tracef("COMPACTPREFIX %s %v", prefix, revision)
+	res, err := d.execute(ctx, d.CompactPrefixSQL, prefix, revision, prefix, revision)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (d *Generic) PostCompact(ctx context.Context) error {
-	logrus.Trace("POSTCOMPACT")
+func (d *Generic) IsRetriable(err error) bool {
+	if err == nil || d.ErrCode == nil {
+		return false
+	}
+	code := d.ErrCode(errors.Cause(err))
+	for _, c := range d.RetriableErrCodes {
+		if code == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *Generic) PostCompact(ctx context.Context, deletedRows int64) error {
+	logrus.Tracef("POSTCOMPACT %v", deletedRows)
 	if d.PostCompactSQL != "" {
-		_, err := d.execute(ctx, d.PostCompactSQL)
-		return err
+		if _, err := d.execute(ctx, d.PostCompactSQL); err != nil {
+			return err
+		}
+	}
+	if d.VacuumSQL != "" && d.VacuumThreshold > 0 && deletedRows >= d.VacuumThreshold {
+		logrus.Infof("Compaction deleted %d rows, vacuuming table", deletedRows)
+		if _, err := d.execute(ctx, d.VacuumSQL); err != nil {
+			return errors.Wrap(err, "failed to vacuum table")
+		}
 	}
 	return nil
 }
 
-func (d *Generic) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+func (d *Generic) GetRevision(ctx context.Context, revision int64) (server.Rows, error) {
 	return d.query(ctx, d.GetRevisionSQL, revision)
 }
 
+// GetCurrentKeys returns the current revision of each of the keys that exists, ordered by key,
+// using a single query.
+func (d *Generic) GetCurrentKeys(ctx context.Context, keys []string) (server.Rows, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to get")
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(keys)), ", ")
+	args := make([]interface{}, len(keys))
+	for i, key := range keys {
+		args[i] = key
+	}
+	return d.query(ctx, q(fmt.Sprintf(d.GetCurrentKeysFormatSQL, placeholders), d.paramCharacter, d.numbered), args...)
+}
+
+// GetAtRevision returns the latest row for the key with an id no greater than the revision,
+// including rows that have been archived by compaction. It is only supported by dialects that
+// archive compacted rows.
+func (d *Generic) GetAtRevision(ctx context.Context, key string, revision int64) (server.Rows, error) {
+	if d.GetAtRevisionSQL == "" {
+		return nil, server.ErrNotSupported
+	}
+	return d.query(ctx, d.GetAtRevisionSQL, key, revision)
+}
+
 func (d *Generic) DeleteRevision(ctx context.Context, revision int64) error {
 	logrus.Tracef("DELETEREVISION %v", revision)
 	_, err := d.execute(ctx, d.DeleteSQL, revision)
 	return err
 }
 
-func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error) {
+// UpdateValue replaces the stored value of a revision, and its previous value if prevValue is not
+// nil, without changing the revision. It is used to rewrite values in a different encoding.
+func (d *Generic) UpdateValue(ctx context.Context, revision int64, value, prevValue []byte) error {
+	logrus.Tracef("UPDATEVALUE %v", revision)
+	_, err := d.execute(ctx, d.UpdateValueSQL, value, prevValue, revision)
+	return err
+}
+
+// DeleteLease appends a deletion for the latest revision of every key with the given lease,
+// as long as that revision is not newer than the provided revision. The number of keys
+// deleted is returned.
+func (d *Generic) DeleteLease(ctx context.Context, lease, revision int64) (int64, error) {
+	logrus.Tracef("DELETELEASE %v %v", lease, revision)
+	res, err := d.execute(ctx, d.DeleteLeaseSQL, lease, lease, revision)
+	if err != nil {
+		return 0, d.translateErr(err)
+	}
+	return res.RowsAffected()
+}
+
+// limit adds a clause to the query to limit the number of rows returned.
+func (d *Generic) limit(sql string, limit int64) string {
+	if d.ApplyLimit != nil {
+		return d.ApplyLimit(sql, limit)
+	}
+	return fmt.Sprintf("%s LIMIT %d", sql, limit)
+}
+
+func (d *Generic) ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (server.Rows, error) {
 	sql := d.GetCurrentSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
 	return d.query(ctx, sql, prefix, includeDeleted)
 }
 
-func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error) {
+func (d *Generic) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (server.Rows, error) {
 	if startKey == "" {
 		sql := d.ListRevisionStartSQL
 		if limit > 0 {
-			sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+			sql = d.limit(sql, limit)
 		}
-		return d.query(ctx, sql, prefix, revision, includeDeleted)
+		return d.queryOn(ctx, d.readDB(revision), sql, prefix, revision, includeDeleted)
 	}
 
 	sql := d.GetRevisionAfterSQL
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, revision, startKey, revision, includeDeleted)
+	return d.queryOn(ctx, d.readDB(revision), sql, prefix, revision, startKey, revision, includeDeleted)
 }
 
 func (d *Generic) Count(ctx context.Context, prefix string) (int64, int64, error) {
@@ -364,14 +911,18 @@ func (d *Generic) Count(ctx context.Context, prefix string) (int64, int64, error
 		id  int64
 	)
 
-	row := d.queryRow(ctx, d.CountSQL, prefix, false)
+	sql := d.CountSQL
+	if d.FastCount && d.FastCountSQL != "" {
+		sql = d.FastCountSQL
+	}
+	row := d.queryRow(ctx, sql, prefix, false)
 	err := row.Scan(&rev, &id)
 	return rev.Int64, id, err
 }
 
 func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := d.queryRow(ctx, revSQL)
+	row := d.queryRow(ctx, d.RevisionSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -379,12 +930,22 @@ func (d *Generic) CurrentRevision(ctx context.Context) (int64, error) {
 	return id, err
 }
 
-func (d *Generic) After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error) {
+// After returns the rows after the given revision with names matching the prefix pattern, and
+// not matching any of the exclude patterns.
+func (d *Generic) After(ctx context.Context, prefix string, exclude []string, rev, limit int64) (server.Rows, error) {
 	sql := d.AfterSQL
+	args := []interface{}{prefix, rev}
+	if len(exclude) > 0 {
+		conditions := strings.Repeat("AND kv.name NOT LIKE ? ESCAPE '!'\n", len(exclude))
+		sql = q(fmt.Sprintf(d.AfterFormatSQL, conditions), d.paramCharacter, d.numbered)
+		for _, pattern := range exclude {
+			args = append(args, pattern)
+		}
+	}
 	if limit > 0 {
-		sql = fmt.Sprintf("%s LIMIT %d", sql, limit)
+		sql = d.limit(sql, limit)
 	}
-	return d.query(ctx, sql, prefix, rev)
+	return d.query(ctx, sql, args...)
 }
 
 func (d *Generic) Fill(ctx context.Context, revision int64) error {
@@ -396,14 +957,59 @@ func (d *Generic) IsFill(key string) bool {
 	return strings.HasPrefix(key, "gap-")
 }
 
-func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
-	if d.TranslateErr != nil {
-		defer func() {
-			if err != nil {
-				err = d.TranslateErr(err)
-			}
-		}()
+// MaxRevision returns the largest revision that fits in the id column.
+func (d *Generic) MaxRevision() int64 {
+	if d.IDColumnBits <= 0 || d.IDColumnBits >= 64 {
+		return math.MaxInt64
+	}
+	return 1<<(d.IDColumnBits-1) - 1
+}
+
+// InsertRevision inserts a row with an explicit id, preserving the revision it was
+// originally written at. This is used when restoring rows from a snapshot.
+func (d *Generic) InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) error {
+	cVal := 0
+	dVal := 0
+	if create {
+		cVal = 1
+	}
+	if delete {
+		dVal = 1
+	}
+
+	_, err := d.execute(ctx, d.FillSQL, revision, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+	return d.translateErr(err)
+}
+
+// PreRestore executes any preparation required before rows are bulk inserted with
+// explicit ids, such as dropping indexes that slow down inserts.
+func (d *Generic) PreRestore(ctx context.Context) error {
+	logrus.Trace("PRERESTORE")
+	for _, stmt := range d.PreRestoreSQL {
+		if _, err := d.execute(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PostRestore executes any cleanup required after rows have been inserted with
+// explicit ids, such as rebuilding indexes dropped by PreRestore and advancing the
+// id sequence past the restored rows.
+func (d *Generic) PostRestore(ctx context.Context) error {
+	logrus.Trace("POSTRESTORE")
+	for _, stmt := range d.PostRestoreSQL {
+		if _, err := d.execute(ctx, stmt); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (id int64, err error) {
+	defer func() {
+		err = d.translateErr(err)
+	}()
 
 	cVal := 0
 	dVal := 0
@@ -422,9 +1028,38 @@ func (d *Generic) Insert(ctx context.Context, key string, create, delete bool, c
 		return row.LastInsertId()
 	}
 
-	row := d.queryRow(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
-	err = row.Scan(&id)
-	return id, err
+	if d.InsertOutParam {
+		_, err := d.execute(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue, sql.Out{Dest: &id})
+		return id, err
+	}
+
+	wait := strategy.Backoff(backoff.Linear(100 + time.Millisecond))
+	for i := uint(0); i < 20; i++ {
+		row := d.queryRow(ctx, d.InsertSQL, key, cVal, dVal, createRevision, previousRevision, ttl, value, prevValue)
+		err = row.Scan(&id)
+		if err != nil && d.Retry != nil && d.Retry(err) {
+			metrics.SQLRetriesTotal.WithLabelValues(d.driverName).Inc()
+			wait(i)
+			continue
+		}
+		return id, err
+	}
+	return
+}
+
+// Defragment executes the statements that rebuild the kine table to reclaim the space freed
+// by compaction, or returns server.ErrNotSupported if the dialect has none.
+func (d *Generic) Defragment(ctx context.Context) error {
+	if len(d.DefragSQL) == 0 {
+		return server.ErrNotSupported
+	}
+	logrus.Trace("DEFRAGMENT")
+	for _, stmt := range d.DefragSQL {
+		if _, err := d.execute(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (d *Generic) GetSize(ctx context.Context) (int64, error) {
@@ -438,3 +1073,14 @@ func (d *Generic) GetSize(ctx context.Context) (int64, error) {
 	}
 	return size, nil
 }
+
+func (d *Generic) Close() error {
+	if d.stopMonitor != nil {
+		d.stopMonitor()
+	}
+	if d.ReadDB != nil {
+		d.stopReplica()
+		d.ReadDB.Close()
+	}
+	return d.DB.Close()
+}
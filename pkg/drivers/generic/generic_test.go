@@ -0,0 +1,219 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestGeneric returns a Generic on an empty sqlite database, limited to maxQueries
+// concurrent queries if greater than zero.
+func newTestGeneric(t *testing.T, maxQueries int) *Generic {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d := &Generic{
+		DB:      db,
+		ErrCode: func(error) string { return "" },
+	}
+	d.querySem = newQuerySem(maxQueries)
+	return d
+}
+
+func TestQueryRowConcurrencyLimit(t *testing.T) {
+	errUnavailable := errors.New("database is unavailable")
+	tests := []struct {
+		name       string
+		maxQueries int
+		inFlight   int
+		healthErr  error
+		wantErr    error
+	}{
+		{name: "unlimited", inFlight: 0},
+		{name: "below the limit", maxQueries: 2, inFlight: 1},
+		{name: "at the limit", maxQueries: 2, inFlight: 2, wantErr: context.DeadlineExceeded},
+		{name: "unavailable", maxQueries: 2, healthErr: errUnavailable, wantErr: errUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newTestGeneric(t, tt.maxQueries)
+			d.health.err = tt.healthErr
+			for i := 0; i < tt.inFlight; i++ {
+				if _, err := d.acquire(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			var one int
+			err := d.queryRow(ctx, "SELECT 1").Scan(&one)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && one != 1 {
+				t.Errorf("result = %d, want 1", one)
+			}
+		})
+	}
+}
+
+func TestQueryRowWaitsForRelease(t *testing.T) {
+	d := newTestGeneric(t, 1)
+	release, err := d.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var one int
+		done <- d.queryRow(context.Background(), "SELECT 1").Scan(&one)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("query completed while the limit was reached: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not complete after a query was released")
+	}
+}
+
+func TestQueryHoldsLimitUntilClosed(t *testing.T) {
+	ctx := context.Background()
+	d := newTestGeneric(t, 1)
+	full := func() bool {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		release, err := d.acquire(ctx)
+		if err != nil {
+			return true
+		}
+		release()
+		return false
+	}
+
+	rows, err := d.query(ctx, "SELECT 1 UNION ALL SELECT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full() {
+		t.Error("limit released before the rows were read")
+	}
+	for rows.Next() {
+	}
+	if full() {
+		t.Error("limit not released after the rows were read")
+	}
+	if err := rows.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err = d.query(ctx, "SELECT 1 UNION ALL SELECT 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows.Close()
+	if full() {
+		t.Error("limit not released after the rows were closed")
+	}
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !full() {
+		t.Error("limit released before the transaction was committed")
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	tx.MustRollback()
+	if full() {
+		t.Error("limit not released after the transaction was committed")
+	}
+}
+
+func TestQueryCancelled(t *testing.T) {
+	d := newTestGeneric(t, 1)
+	// counts far enough that the query only ends when it is interrupted
+	d.GetSizeSQL = `WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n) SELECT COUNT(*) FROM n`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.GetSize(ctx)
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled query returned %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query did not return after its context was cancelled")
+	}
+
+	if inUse := d.DB.Stats().InUse; inUse != 0 {
+		t.Errorf("connections in use after cancellation = %d, want 0", inUse)
+	}
+	// the query limit slot was released too
+	var one int
+	if err := d.queryRow(context.Background(), "SELECT 1").Scan(&one); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewQuerySem(t *testing.T) {
+	for _, maxQueries := range []int{0, -1} {
+		if sem := newQuerySem(maxQueries); sem != nil {
+			t.Errorf("newQuerySem(%d) limits queries to %d, want no limit", maxQueries, cap(sem))
+		}
+	}
+	if sem := newQuerySem(3); cap(sem) != 3 {
+		t.Errorf("newQuerySem(3) limits queries to %d, want 3", cap(sem))
+	}
+}
+
+func TestWarmUp(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   ConnectionPoolConfig
+		wantIdle int
+	}{
+		{name: "warm-up", config: ConnectionPoolConfig{MaxIdle: 4}, wantIdle: 4},
+		{name: "limited by max open", config: ConnectionPoolConfig{MaxIdle: 4, MaxOpen: 3}, wantIdle: 3},
+		// only the connection opened to ping the database is idle
+		{name: "skipped", config: ConnectionPoolConfig{MaxIdle: 4, SkipWarmUp: true}, wantIdle: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := Open(context.Background(), "sqlite3", filepath.Join(t.TempDir(), "db"), tt.config, "?", false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.DB.Close()
+			if idle := d.DB.Stats().Idle; idle != tt.wantIdle {
+				t.Errorf("idle connections = %d, want %d", idle, tt.wantIdle)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package generic
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// healthCheckTimeout bounds each ping of the database by the health check.
+	healthCheckTimeout = 5 * time.Second
+
+	// While the database is unavailable, it is pinged with an exponential backoff between
+	// reconnectMinBackoff and reconnectMaxBackoff, instead of at the health check interval.
+	reconnectMinBackoff = 500 * time.Millisecond
+	reconnectMaxBackoff = 30 * time.Second
+)
+
+// poolHealth records whether the database was reachable when last pinged by the health check.
+type poolHealth struct {
+	mu sync.RWMutex
+	// err is returned by queries while the database is unavailable, or nil if it is available
+	err   error
+	since time.Time
+}
+
+func (h *poolHealth) get() error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.err
+}
+
+// set records the result of a ping, and returns true if the database has become available or
+// unavailable, with the time for which it was unavailable if it has become available again.
+func (h *poolHealth) set(err error) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	wasAvailable := h.err == nil
+	if err == nil {
+		h.err = nil
+		if wasAvailable {
+			return 0, false
+		}
+		return time.Since(h.since), true
+	}
+	h.err = status.Errorf(codes.Unavailable, "database is unavailable: %v", err)
+	if wasAvailable {
+		h.since = time.Now()
+		return 0, true
+	}
+	return 0, false
+}
+
+// monitorPool pings the database at the health check interval, and randomizes the maximum
+// lifetime of connections by up to the jitter, until the context is done. Connections opened
+// together, such as by warm-up, are thus not all closed and reopened at once. Once a ping
+// fails, queries fail immediately with codes.Unavailable, and the database is pinged with an
+// exponential backoff until it is reachable again.
+func (d *Generic) monitorPool(ctx context.Context, cfg ConnectionPoolConfig) {
+	interval := cfg.HealthCheckInterval
+	if interval <= 0 {
+		interval = cfg.MaxLifetimeJitter
+	}
+	wait := interval
+	backoff := reconnectMinBackoff
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if cfg.MaxLifetime > 0 && cfg.MaxLifetimeJitter > 0 {
+			d.DB.SetConnMaxLifetime(cfg.MaxLifetime + time.Duration(rand.Int63n(int64(cfg.MaxLifetimeJitter))))
+		}
+
+		wait = interval
+		if cfg.HealthCheckInterval > 0 {
+			pingCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			err := d.DB.PingContext(pingCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return
+			}
+
+			unavailable, changed := d.health.set(err)
+			switch {
+			case err != nil && changed:
+				logrus.Errorf("Database %s is unavailable, reconnecting: %v", d.driverName, err)
+			case err != nil:
+				logrus.Debugf("Database %s is still unavailable, retrying in %s: %v", d.driverName, backoff, err)
+			case changed:
+				logrus.Infof("Database %s is available again after %s", d.driverName, unavailable.Round(time.Second))
+			}
+
+			if err != nil {
+				wait = backoff
+				if backoff *= 2; backoff > reconnectMaxBackoff {
+					backoff = reconnectMaxBackoff
+				}
+			} else {
+				backoff = reconnectMinBackoff
+			}
+		}
+		timer.Reset(wait)
+	}
+}
+
+// Ping returns an error if the database is unavailable. If the pool is monitored by the health
+// check, the result of the last check is returned, otherwise the database is pinged.
+func (d *Generic) Ping(ctx context.Context) error {
+	if d.monitored {
+		return d.health.get()
+	}
+	if err := d.DB.PingContext(ctx); err != nil {
+		return status.Errorf(codes.Unavailable, "database is unavailable: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package generic
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Leases are stored in the kine_lease table, which each driver creates with its schema. The
+// expiry time of a lease is stored as seconds since the Unix epoch.
+const (
+	grantLeaseSQL = `
+		INSERT INTO kine_lease(id, ttl, expires)
+		VALUES(?, ?, ?)`
+
+	renewLeaseSQL = `
+		UPDATE kine_lease
+		SET expires = ? + ttl
+		WHERE id = ?`
+
+	getLeaseSQL = `
+		SELECT kl.ttl, kl.expires
+		FROM kine_lease AS kl
+		WHERE kl.id = ?`
+
+	revokeLeaseSQL = `
+		DELETE FROM kine_lease
+		WHERE id = ?`
+
+	listLeasesSQL = `
+		SELECT kl.id
+		FROM kine_lease AS kl
+		ORDER BY kl.id ASC`
+
+	expiredLeasesSQL = `
+		SELECT kl.id
+		FROM kine_lease AS kl
+		WHERE kl.expires <= ?
+		ORDER BY kl.expires ASC`
+
+	leaseKeysSQL = `
+		SELECT kv.name
+		FROM kine AS kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			GROUP BY mkv.name) AS maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.lease = ? AND
+			kv.deleted = 0
+		ORDER BY kv.name ASC`
+)
+
+// GrantLease stores a lease with the given TTL and expiry time.
+func (d *Generic) GrantLease(ctx context.Context, id, ttl, expires int64) error {
+	logrus.Tracef("GRANTLEASE %v %v %v", id, ttl, expires)
+	_, err := d.execute(ctx, d.GrantLeaseSQL, id, ttl, expires)
+	return d.translateErr(err)
+}
+
+// RenewLease sets the expiry time of a lease to its TTL after now. false is returned if the
+// lease does not exist.
+func (d *Generic) RenewLease(ctx context.Context, id, now int64) (bool, error) {
+	logrus.Tracef("RENEWLEASE %v %v", id, now)
+	res, err := d.execute(ctx, d.RenewLeaseSQL, now, id)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+// GetLease returns the TTL and expiry time of a lease. sql.ErrNoRows is returned if the lease
+// does not exist.
+func (d *Generic) GetLease(ctx context.Context, id int64) (int64, int64, error) {
+	var ttl, expires int64
+	row := d.queryRow(ctx, d.GetLeaseSQL, id)
+	err := row.Scan(&ttl, &expires)
+	return ttl, expires, err
+}
+
+// RevokeLease deletes a lease. Keys attached to the lease are not deleted.
+func (d *Generic) RevokeLease(ctx context.Context, id int64) error {
+	logrus.Tracef("REVOKELEASE %v", id)
+	_, err := d.execute(ctx, d.RevokeLeaseSQL, id)
+	return err
+}
+
+// ListLeases returns the ids of all leases.
+func (d *Generic) ListLeases(ctx context.Context) ([]int64, error) {
+	return d.queryIDs(ctx, d.ListLeasesSQL)
+}
+
+// ExpiredLeases returns the ids of leases that expired at or before now.
+func (d *Generic) ExpiredLeases(ctx context.Context, now int64) ([]int64, error) {
+	return d.queryIDs(ctx, d.ExpiredLeasesSQL, now)
+}
+
+// LeaseKeys returns the keys currently attached to a lease.
+func (d *Generic) LeaseKeys(ctx context.Context, id int64) ([]string, error) {
+	rows, err := d.query(ctx, d.LeaseKeysSQL, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (d *Generic) queryIDs(ctx context.Context, sql string, args ...interface{}) ([]int64, error) {
+	rows, err := d.query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,87 @@
+package generic
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of statement by which SQL metrics are labeled.
+const (
+	statementList    = "list"
+	statementGet     = "get"
+	statementAfter   = "after"
+	statementInsert  = "insert"
+	statementCompact = "compact"
+	statementCount   = "count"
+	statementLease   = "lease"
+	statementOther   = "other"
+)
+
+// statementKind returns the kind of the statement, by comparing it with the statements of the
+// dialect. Statements built at runtime, such as After with exclusions, are reported as other.
+func (d *Generic) statementKind(sql string) string {
+	switch sql {
+	case d.GetCurrentSQL, d.ListRevisionStartSQL, d.GetRevisionAfterSQL:
+		return statementList
+	case d.GetRevisionSQL, d.GetAtRevisionSQL, d.RevisionSQL:
+		return statementGet
+	case d.AfterSQL:
+		return statementAfter
+	case d.InsertSQL, d.InsertLastInsertIDSQL, d.FillSQL, d.DeleteSQL, d.UpdateValueSQL:
+		return statementInsert
+	case d.CompactSQL, d.CompactDryRunSQL, d.CompactIDsSQL, d.CompactPrefixSQL, d.CompactRevisionSQL, d.UpdateCompactSQL, d.PostCompactSQL, d.VacuumSQL:
+		return statementCompact
+	case d.CountSQL, d.FastCountSQL:
+		return statementCount
+	case d.GrantLeaseSQL, d.RenewLeaseSQL, d.GetLeaseSQL, d.RevokeLeaseSQL, d.ListLeasesSQL, d.ExpiredLeasesSQL, d.LeaseKeysSQL, d.DeleteLeaseSQL:
+		return statementLease
+	}
+	return statementOther
+}
+
+// observeStatement records the duration of the statement by kind and backend.
+func (d *Generic) observeStatement(start time.Time, sql string) {
+	metrics.SQLStatementTime.WithLabelValues(d.statementKind(sql), d.driverName).Observe(time.Since(start).Seconds())
+}
+
+// logSlow logs the statement if it took longer than metrics.SlowSQLThreshold. rows is the number of
+// rows affected by the statement, or -1 for queries, whose rows are only read after they return.
+func logSlow(startTime time.Time, sql string, args []interface{}, rows int64) {
+	duration := time.Since(startTime)
+	if metrics.SlowSQLThreshold <= 0 || duration < metrics.SlowSQLThreshold {
+		return
+	}
+	if rows < 0 {
+		logrus.Warnf("Slow SQL (started: %v) (total time: %v): %s : %v", startTime, duration, util.Stripped(sql), util.Redacted(args))
+		return
+	}
+	logrus.Warnf("Slow SQL (started: %v) (total time: %v) (rows: %d): %s : %v", startTime, duration, rows, util.Stripped(sql), util.Redacted(args))
+}
+
+// rowsAffected returns the number of rows affected by an executed statement, or -1 if not known.
+func rowsAffected(result sql.Result, err error) int64 {
+	if err != nil || result == nil {
+		return -1
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return -1
+	}
+	return rows
+}
+
+// translateErr translates the error with TranslateErr, if set, counting the errors translated.
+func (d *Generic) translateErr(err error) error {
+	if err == nil || d.TranslateErr == nil {
+		return err
+	}
+	translated := d.TranslateErr(err)
+	if translated != err {
+		metrics.SQLTranslatedErrorsTotal.WithLabelValues(d.ErrCode(err), d.driverName).Inc()
+	}
+	return translated
+}
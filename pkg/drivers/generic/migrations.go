@@ -0,0 +1,157 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/logging"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	createMigrationsSQL = `CREATE TABLE IF NOT EXISTS kine_migrations (id INTEGER NOT NULL PRIMARY KEY)`
+	migrationAppliedSQL = `SELECT COUNT(*) FROM kine_migrations WHERE id = %d`
+	recordMigrationSQL  = `INSERT INTO kine_migrations(id) VALUES (%d)`
+
+	migrationAttempts   = 5
+	migrationRetryDelay = 500 * time.Millisecond
+)
+
+// SchemaMigration is a numbered schema change. Migrations are applied in order of
+// increasing ID, and each migration is only ever applied once per database.
+type SchemaMigration struct {
+	ID    int
+	Stmts []string
+	// Func, if set, is called once Stmts have been committed, outside of any transaction, for
+	// changes that must not hold locks for their duration, such as backfilling a column in
+	// batches. The migration is recorded as applied once it returns without error, so it must
+	// be safe to call again if interrupted, and concurrently by another replica.
+	Func func(ctx context.Context, db *sql.DB) error
+}
+
+// IgnoreErr returns true if an error returned by a migration statement is benign,
+// for example because the object being created already exists.
+type IgnoreErr func(error) bool
+
+// ApplySchemaMigrations creates the kine_migrations table if necessary, and then applies any
+// migrations that have not yet been recorded as applied. Each migration is executed and
+// recorded within its own transaction, although some databases implicitly commit DDL, unless
+// it has a Func, which is called between executing and recording the migration.
+// Migration statements should be idempotent, so that replicas racing to apply the same
+// migration do not fail. If a statement fails with an error for which retryErr returns
+// true, such as a conflict with DDL being executed concurrently by another replica, the
+// migration is retried after a short delay.
+func ApplySchemaMigrations(ctx context.Context, db *sql.DB, migrations []SchemaMigration, ignoreErr IgnoreErr, retryErr ErrRetry) error {
+	return ApplySchemaMigrationsWithTable(ctx, db, createMigrationsSQL, migrations, ignoreErr, retryErr)
+}
+
+// ApplySchemaMigrationsWithTable is the same as ApplySchemaMigrations, but uses the provided
+// statement to create the kine_migrations table, for databases that do not support
+// CREATE TABLE IF NOT EXISTS.
+func ApplySchemaMigrationsWithTable(ctx context.Context, db *sql.DB, createTableSQL string, migrations []SchemaMigration, ignoreErr IgnoreErr, retryErr ErrRetry) error {
+	log := logging.FromContext(ctx)
+	for i := 1; ; i++ {
+		log.Tracef("SETUP EXEC : %v", util.Stripped(createTableSQL))
+		_, err := db.ExecContext(ctx, createTableSQL)
+		if err == nil {
+			break
+		}
+		if !canRetryMigration(ctx, err, retryErr, i) {
+			return errors.Wrap(err, "failed to create migrations table")
+		}
+	}
+
+	for _, m := range migrations {
+		applied, err := migrationApplied(ctx, db, m.ID)
+		if err != nil {
+			return err
+		}
+		mlog := log.WithFields(logging.Fields{"migration": m.ID})
+		if applied {
+			mlog.Tracef("SETUP migration already applied")
+			continue
+		}
+
+		mlog.Infof("Applying schema migration")
+		for i := 1; ; i++ {
+			err := applySchemaMigration(ctx, db, m, ignoreErr)
+			if err == nil {
+				break
+			}
+			// another replica may have applied this migration concurrently
+			if applied, _ := migrationApplied(ctx, db, m.ID); applied {
+				break
+			}
+			if !canRetryMigration(ctx, err, retryErr, i) {
+				return errors.Wrapf(err, "failed to apply schema migration %d", m.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// canRetryMigration returns true, after waiting for the retry delay, if the error is benign
+// and the maximum number of attempts has not been reached.
+func canRetryMigration(ctx context.Context, err error, retryErr ErrRetry, attempt int) bool {
+	if retryErr == nil || !retryErr(err) || attempt >= migrationAttempts {
+		return false
+	}
+	logging.FromContext(ctx).WithFields(logging.Fields{"error": err}).Infof("Schema setup conflicted with another replica, retrying")
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(migrationRetryDelay):
+		return true
+	}
+}
+
+func migrationApplied(ctx context.Context, db *sql.DB, id int) (bool, error) {
+	var count int
+	row := db.QueryRowContext(ctx, fmt.Sprintf(migrationAppliedSQL, id))
+	if err := row.Scan(&count); err != nil {
+		return false, errors.Wrapf(err, "failed to check status of schema migration %d", id)
+	}
+	return count > 0, nil
+}
+
+func applySchemaMigration(ctx context.Context, db *sql.DB, m SchemaMigration, ignoreErr IgnoreErr) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	log := logging.FromContext(ctx)
+	for _, stmt := range m.Stmts {
+		log.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			if ignoreErr == nil || !ignoreErr(err) {
+				return err
+			}
+		}
+	}
+
+	if m.Func != nil {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		if err := m.Func(ctx, db); err != nil {
+			return err
+		}
+		stmt := fmt.Sprintf(recordMigrationSQL, m.ID)
+		log.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+		_, err := db.ExecContext(ctx, stmt)
+		return err
+	}
+
+	stmt := fmt.Sprintf(recordMigrationSQL, m.ID)
+	log.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,106 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// appliedMigrations returns the ids recorded in the kine_migrations table.
+func appliedMigrations(t *testing.T, db *sql.DB) []int {
+	t.Helper()
+	rows, err := db.Query("SELECT id FROM kine_migrations ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestApplySchemaMigrations(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The statements are not idempotent, so applying a migration twice fails.
+	funcCalls := 0
+	migrations := []SchemaMigration{
+		{ID: 1, Stmts: []string{"CREATE TABLE a (id INTEGER)"}},
+		{ID: 2, Stmts: []string{"CREATE TABLE b (id INTEGER)"}, Func: func(ctx context.Context, db *sql.DB) error {
+			funcCalls++
+			_, err := db.ExecContext(ctx, "INSERT INTO b(id) VALUES (1)")
+			return err
+		}},
+	}
+
+	if err := ApplySchemaMigrations(ctx, db, migrations, nil, nil); err != nil {
+		t.Fatalf("first boot: %v", err)
+	}
+	if ids := appliedMigrations(t, db); !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Fatalf("applied migrations after first boot = %v, want [1 2]", ids)
+	}
+	if funcCalls != 1 {
+		t.Fatalf("migration func called %d times after first boot, want 1", funcCalls)
+	}
+
+	if err := ApplySchemaMigrations(ctx, db, migrations, nil, nil); err != nil {
+		t.Fatalf("second boot: %v", err)
+	}
+	if funcCalls != 1 {
+		t.Fatalf("migration func called %d times after second boot, want 1", funcCalls)
+	}
+
+	// Only the new migration is applied once one is added.
+	migrations = append(migrations, SchemaMigration{ID: 3, Stmts: []string{"CREATE TABLE c (id INTEGER)"}})
+	if err := ApplySchemaMigrations(ctx, db, migrations, nil, nil); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	if ids := appliedMigrations(t, db); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Fatalf("applied migrations after upgrade = %v, want [1 2 3]", ids)
+	}
+}
+
+func TestApplySchemaMigrationsFailure(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	migrations := []SchemaMigration{
+		{ID: 1, Stmts: []string{"CREATE TABLE a (id INTEGER)"}},
+		{ID: 2, Stmts: []string{"CREATE TABLE b (id INTEGER)", "NOT VALID SQL"}},
+		{ID: 3, Stmts: []string{"CREATE TABLE c (id INTEGER)"}},
+	}
+	if err := ApplySchemaMigrations(ctx, db, migrations, nil, nil); err == nil {
+		t.Fatal("expected an error from the invalid migration")
+	}
+	if ids := appliedMigrations(t, db); !reflect.DeepEqual(ids, []int{1}) {
+		t.Fatalf("applied migrations = %v, want [1]", ids)
+	}
+	// The failed migration was rolled back, so none of its statements took effect.
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'b'").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("table created by the failed migration exists")
+	}
+}
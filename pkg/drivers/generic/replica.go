@@ -0,0 +1,124 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// replicaCheckInterval is the interval at which the revision of the read replica is compared
+// with the revision of the database.
+const replicaCheckInterval = time.Second
+
+// OpenReadReplica opens a read replica of the database, such as a streaming replica, to which
+// lists at past revisions are sent while it lags the database by no more than maxLag revisions.
+func (d *Generic) OpenReadReplica(ctx context.Context, driverName, dataSourceName string, connPoolConfig ConnectionPoolConfig, maxLag int64) error {
+	open := func() (*sql.DB, error) {
+		return sql.Open(driverName, dataSourceName)
+	}
+	return d.openReadReplica(ctx, open, connPoolConfig, maxLag)
+}
+
+// OpenReadReplicaConnector is like OpenReadReplica, but opens connections to the replica using
+// the connector, instead of a registered driver.
+func (d *Generic) OpenReadReplicaConnector(ctx context.Context, connector driver.Connector, connPoolConfig ConnectionPoolConfig, maxLag int64) error {
+	open := func() (*sql.DB, error) {
+		return sql.OpenDB(connector), nil
+	}
+	return d.openReadReplica(ctx, open, connPoolConfig, maxLag)
+}
+
+func (d *Generic) openReadReplica(ctx context.Context, open func() (*sql.DB, error), connPoolConfig ConnectionPoolConfig, maxLag int64) error {
+	// the replica is not pinged, so that kine can start while it is unavailable; reads are sent
+	// to the database until the replica has been checked
+	db, err := open()
+	if err != nil {
+		return err
+	}
+	configureConnectionPooling(connPoolConfig, db, d.driverName+" read replica")
+
+	d.ReadDB = db
+	d.MaxReadLag = maxLag
+	ctx, d.stopReplica = context.WithCancel(ctx)
+	go d.monitorReadReplica(ctx)
+	return nil
+}
+
+// readDB returns the read replica if it has applied the revision, and lagged the database by no
+// more than MaxReadLag revisions when last checked, or the database otherwise. Reads of the
+// current revision, which is requested with a revision of zero, are always sent to the database,
+// as the replica may not yet have applied the latest writes.
+func (d *Generic) readDB(revision int64) *sql.DB {
+	if d.ReadDB == nil || revision <= 0 {
+		return d.DB
+	}
+	replicaRevision := atomic.LoadInt64(&d.replicaRevision)
+	if replicaRevision == 0 || replicaRevision < revision {
+		return d.DB
+	}
+	return d.ReadDB
+}
+
+// monitorReadReplica periodically checks the read replica, until the context is done.
+func (d *Generic) monitorReadReplica(ctx context.Context) {
+	ticker := time.NewTicker(replicaCheckInterval)
+	defer ticker.Stop()
+	usable := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		usable = d.checkReadReplica(ctx, usable)
+	}
+}
+
+// checkReadReplica compares the revision of the read replica with the revision of the database,
+// records the lag, and returns whether reads may be sent to the replica. usable is the result of
+// the previous check. The replica is read before the database, so that the measured lag is never
+// less than the actual lag.
+func (d *Generic) checkReadReplica(ctx context.Context, usable bool) bool {
+	var replicaRevision, revision sql.NullInt64
+	err := d.queryRowOn(ctx, d.ReadDB, d.RevisionSQL).Scan(&replicaRevision)
+	if err == nil {
+		err = d.queryRow(ctx, d.RevisionSQL).Scan(&revision)
+	}
+	if ctx.Err() != nil {
+		return usable
+	}
+
+	lag := revision.Int64 - replicaRevision.Int64
+	if err == nil {
+		metrics.SQLReplicaLag.Set(float64(lag))
+	}
+	switch {
+	case err != nil:
+		if usable {
+			logrus.Warnf("Sending reads to the primary database, as the read replica could not be checked: %v", err)
+		}
+		usable = false
+	case lag > d.MaxReadLag:
+		if usable {
+			logrus.Warnf("Sending reads to the primary database, as the read replica lags by %d revisions", lag)
+		}
+		usable = false
+	default:
+		if !usable {
+			logrus.Infof("Sending reads to the read replica, which lags by %d revisions", lag)
+		}
+		usable = true
+	}
+
+	if usable {
+		atomic.StoreInt64(&d.replicaRevision, replicaRevision.Int64)
+	} else {
+		atomic.StoreInt64(&d.replicaRevision, 0)
+	}
+	return usable
+}
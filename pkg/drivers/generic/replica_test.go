@@ -0,0 +1,146 @@
+package generic
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// openRevisions opens a sqlite database in dir whose kine table holds the given number of rows.
+func openRevisions(t *testing.T, dir, name string, revisions int) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(dir, name+".db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec("CREATE TABLE kine (id INTEGER PRIMARY KEY AUTOINCREMENT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < revisions; i++ {
+		if _, err := db.Exec("INSERT INTO kine DEFAULT VALUES"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestCheckReadReplica(t *testing.T) {
+	tests := []struct {
+		name            string
+		primary         int
+		replica         int
+		maxLag          int64
+		usable          bool
+		wantUsable      bool
+		wantLag         float64
+		wantReplicaRead bool
+	}{
+		{name: "in sync", primary: 5, replica: 5, maxLag: 0, wantUsable: true, wantLag: 0, wantReplicaRead: true},
+		{name: "lag within bound", primary: 10, replica: 8, maxLag: 2, wantUsable: true, wantLag: 2, wantReplicaRead: true},
+		{name: "lag beyond bound", primary: 10, replica: 5, maxLag: 2, usable: true, wantUsable: false, wantLag: 5},
+		{name: "empty replica", primary: 3, replica: 0, maxLag: 5, wantUsable: true, wantLag: 3},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			d := &Generic{
+				DB:          openRevisions(t, dir, fmt.Sprintf("primary%d", i), tt.primary),
+				ReadDB:      openRevisions(t, dir, fmt.Sprintf("replica%d", i), tt.replica),
+				MaxReadLag:  tt.maxLag,
+				RevisionSQL: "SELECT MAX(id) FROM kine",
+				ErrCode:     func(error) string { return "" },
+			}
+
+			usable := d.checkReadReplica(context.Background(), tt.usable)
+			if usable != tt.wantUsable {
+				t.Errorf("usable = %v, want %v", usable, tt.wantUsable)
+			}
+			if lag := testutil.ToFloat64(metrics.SQLReplicaLag); lag != tt.wantLag {
+				t.Errorf("lag gauge = %v, want %v", lag, tt.wantLag)
+			}
+			// a replica without any rows has not applied any revision, so reads stay on the primary
+			if got := d.readDB(int64(tt.replica)) == d.ReadDB; got != tt.wantReplicaRead {
+				t.Errorf("read from replica = %v, want %v", got, tt.wantReplicaRead)
+			}
+		})
+	}
+}
+
+func TestCheckReadReplicaError(t *testing.T) {
+	dir := t.TempDir()
+	d := &Generic{
+		DB:          openRevisions(t, dir, "primary", 3),
+		ReadDB:      openRevisions(t, dir, "replica", 3),
+		RevisionSQL: "SELECT MAX(id) FROM kine",
+		ErrCode:     func(error) string { return "" },
+	}
+	if !d.checkReadReplica(context.Background(), false) {
+		t.Fatal("replica is not usable")
+	}
+
+	d.ReadDB.Close()
+	if d.checkReadReplica(context.Background(), true) {
+		t.Error("replica that cannot be checked is usable")
+	}
+	if d.readDB(3) != d.DB {
+		t.Error("reads are not sent to the primary after the replica could not be checked")
+	}
+}
+
+func TestReadReplicaRouting(t *testing.T) {
+	dir := t.TempDir()
+	d := &Generic{
+		DB:                   openRevisions(t, dir, "primary", 10),
+		ReadDB:               openRevisions(t, dir, "replica", 8),
+		MaxReadLag:           5,
+		RevisionSQL:          "SELECT MAX(id) FROM kine",
+		GetCurrentSQL:        "SELECT MAX(id) FROM kine WHERE ? IS NOT NULL AND ? IS NOT NULL",
+		ListRevisionStartSQL: "SELECT MAX(id) FROM kine WHERE ? IS NOT NULL AND ? IS NOT NULL AND ? IS NOT NULL",
+		CountSQL:             "SELECT MAX(id), COUNT(*) FROM kine WHERE ? IS NOT NULL AND ? IS NOT NULL",
+		ErrCode:              func(error) string { return "" },
+	}
+	ctx := context.Background()
+	if !d.checkReadReplica(ctx, false) {
+		t.Fatal("lagging replica is not usable")
+	}
+
+	maxID := func(rows server.Rows, err error) int64 {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var id int64
+		if !rows.Next() {
+			t.Fatal("no rows")
+		}
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	// reads of the current revision, including those made before writes, go to the primary
+	if id := maxID(d.ListCurrent(ctx, "/", 0, false)); id != 10 {
+		t.Errorf("current list read revision %d, want 10 from the primary", id)
+	}
+	if rev, _, err := d.Count(ctx, "/"); err != nil || rev != 10 {
+		t.Errorf("count read revision %d (error %v), want 10 from the primary", rev, err)
+	}
+
+	// reads at a revision applied by the replica go to the replica, and later revisions to the primary
+	if id := maxID(d.List(ctx, "/", "", 0, 8, false)); id != 8 {
+		t.Errorf("list at revision 8 read revision %d, want 8 from the replica", id)
+	}
+	if id := maxID(d.List(ctx, "/", "", 0, 9, false)); id != 10 {
+		t.Errorf("list at revision 9 read revision %d, want 10 from the primary", id)
+	}
+}
@@ -0,0 +1,33 @@
+package generic
+
+import (
+	"context"
+
+	"github.com/k3s-io/kine/pkg/util"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/semconv"
+)
+
+// tracer records spans using the global tracer provider, which does nothing unless tracing
+// has been set up.
+var tracer = otel.Tracer("github.com/k3s-io/kine/pkg/drivers/generic")
+
+// traceStatement starts a span for the statement, as a child of any span in the context. The
+// returned function ends the span, recording the error of the statement, if any.
+func (d *Generic) traceStatement(ctx context.Context, sql string) (context.Context, func(error)) {
+	ctx, span := tracer.Start(ctx, "sql "+d.statementKind(sql))
+	if span.IsRecording() {
+		span.SetAttributes(
+			semconv.DBSystemKey.String(d.driverName),
+			semconv.DBStatementKey.String(util.Stripped(sql).String()),
+		)
+	}
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
@@ -3,6 +3,7 @@ package generic
 import (
 	"context"
 	"database/sql"
+	"sync"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/metrics"
@@ -15,24 +16,35 @@ import (
 var _ server.Transaction = (*Tx)(nil)
 
 type Tx struct {
-	x *sql.Tx
-	d *Generic
+	x       *sql.Tx
+	d       *Generic
+	once    sync.Once
+	release func()
 }
 
+// BeginTx starts a transaction. As the transaction holds a connection until it is committed
+// or rolled back, it counts as a single query against the query limit for its whole duration.
 func (d *Generic) BeginTx(ctx context.Context, opts *sql.TxOptions) (server.Transaction, error) {
 	logrus.Tracef("TX BEGIN")
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
 	x, err := d.DB.BeginTx(ctx, opts)
 	if err != nil {
+		release()
 		return nil, err
 	}
 	return &Tx{
-		x: x,
-		d: d,
+		x:       x,
+		d:       d,
+		release: release,
 	}, nil
 }
 
 func (t *Tx) Commit() error {
 	logrus.Tracef("TX COMMIT")
+	defer t.once.Do(t.release)
 	return t.x.Commit()
 }
 
@@ -44,6 +56,7 @@ func (t *Tx) MustCommit() {
 
 func (t *Tx) Rollback() error {
 	logrus.Tracef("TX ROLLBACK")
+	defer t.once.Do(t.release)
 	return t.x.Rollback()
 }
 
@@ -57,7 +70,7 @@ func (t *Tx) MustRollback() {
 
 func (t *Tx) GetCompactRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := t.queryRow(ctx, compactRevSQL)
+	row := t.queryRow(ctx, t.d.CompactRevisionSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -71,16 +84,36 @@ func (t *Tx) SetCompactRevision(ctx context.Context, revision int64) error {
 	return err
 }
 
-func (t *Tx) Compact(ctx context.Context, revision int64) (int64, error) {
-	logrus.Tracef("TX COMPACT %v", revision)
-	res, err := t.execute(ctx, t.d.CompactSQL, revision, revision)
+func (t *Tx) Compact(ctx context.Context, compactRev, revision int64) (int64, error) {
+	logrus.Tracef("TX COMPACT %v %v", compactRev, revision)
+	res, err := t.execute(ctx, t.d.CompactSQL, compactRev, revision, compactRev, revision)
 	if err != nil {
 		return 0, err
 	}
 	return res.RowsAffected()
 }
 
-func (t *Tx) GetRevision(ctx context.Context, revision int64) (*sql.Rows, error) {
+// CompactIDs returns the ids of the rows that Compact would delete, in ascending order.
+func (t *Tx) CompactIDs(ctx context.Context, compactRev, revision int64) ([]int64, error) {
+	logrus.Tracef("TX COMPACTIDS %v %v", compactRev, revision)
+	rows, err := t.query(ctx, t.d.CompactIDsSQL, compactRev, revision, compactRev, revision)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (t *Tx) GetRevision(ctx context.Context, revision int64) (server.Rows, error) {
 	return t.query(ctx, t.d.GetRevisionSQL, revision)
 }
 
@@ -92,7 +125,7 @@ func (t *Tx) DeleteRevision(ctx context.Context, revision int64) error {
 
 func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 	var id int64
-	row := t.queryRow(ctx, revSQL)
+	row := t.queryRow(ctx, t.d.RevisionSQL)
 	err := row.Scan(&id)
 	if err == sql.ErrNoRows {
 		return 0, nil
@@ -101,28 +134,40 @@ func (t *Tx) CurrentRevision(ctx context.Context) (int64, error) {
 }
 
 func (t *Tx) query(ctx context.Context, sql string, args ...interface{}) (result *sql.Rows, err error) {
-	logrus.Tracef("TX QUERY %v : %s", args, util.Stripped(sql))
+	logrus.Tracef("TX QUERY %v : %s", util.Redacted(args), util.Stripped(sql))
+	ctx, endSpan := t.d.traceStatement(ctx, sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		endSpan(err)
+		metrics.ObserveSQL(startTime, t.d.ErrCode(err))
+		t.d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, -1)
 	}()
 	return t.x.QueryContext(ctx, sql, args...)
 }
 
 func (t *Tx) queryRow(ctx context.Context, sql string, args ...interface{}) (result *sql.Row) {
-	logrus.Tracef("TX QUERY ROW %v : %s", args, util.Stripped(sql))
+	logrus.Tracef("TX QUERY ROW %v : %s", util.Redacted(args), util.Stripped(sql))
+	ctx, endSpan := t.d.traceStatement(ctx, sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()), util.Stripped(sql), args)
+		endSpan(result.Err())
+		metrics.ObserveSQL(startTime, t.d.ErrCode(result.Err()))
+		t.d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, -1)
 	}()
 	return t.x.QueryRowContext(ctx, sql, args...)
 }
 
 func (t *Tx) execute(ctx context.Context, sql string, args ...interface{}) (result sql.Result, err error) {
-	logrus.Tracef("TX EXEC %v : %s", args, util.Stripped(sql))
+	logrus.Tracef("TX EXEC %v : %s", util.Redacted(args), util.Stripped(sql))
+	ctx, endSpan := t.d.traceStatement(ctx, sql)
 	startTime := time.Now()
 	defer func() {
-		metrics.ObserveSQL(startTime, t.d.ErrCode(err), util.Stripped(sql), args)
+		endSpan(err)
+		metrics.ObserveSQL(startTime, t.d.ErrCode(err))
+		t.d.observeStatement(startTime, sql)
+		logSlow(startTime, sql, args, rowsAffected(result, err))
 	}()
 	return t.x.ExecContext(ctx, sql, args...)
 }
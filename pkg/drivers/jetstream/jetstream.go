@@ -3,6 +3,7 @@ package jetstream
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/url"
 	"regexp"
@@ -12,6 +13,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/jetstream/kv"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
@@ -36,6 +38,9 @@ type Config struct {
 	revHistory uint8
 	bucket     string
 	slowMethod time.Duration
+	replicas   int
+	storage    nats.StorageType
+	placement  *nats.Placement
 }
 
 type JetStream struct {
@@ -44,6 +49,7 @@ type JetStream struct {
 	kvDirectoryMutex *sync.RWMutex
 	kvDirectoryMuxes map[string]*sync.RWMutex
 	jetStream        nats.JetStreamContext
+	conn             *nats.Conn
 	slowMethod       time.Duration
 	server.Backend
 }
@@ -57,7 +63,7 @@ type JSValue struct {
 
 // New get the JetStream Backend, establish connection to NATS JetStream. At the moment nats.go does not have
 // connection string support so kine will use:
-//		nats://(token|username:password)hostname:port?bucket=bucketName&contextFile=nats-context&slowMethod=<duration>&revHistory=<revCount>`.
+//		nats://(token|username:password)hostname:port?bucket=bucketName&contextFile=nats-context&slowMethod=<duration>&revHistory=<revCount>&replicas=<count>&storage=(file|memory)&placementCluster=<cluster>&placementTag=<tag>`.
 //
 // If contextFile is provided then do not provide a hostname:port in the endpoint URL, instead use the context file to
 // provide the NATS server url(s).
@@ -66,6 +72,13 @@ type JSValue struct {
 //		contextFile: specifies the nats context file to load e.g. /etc/nats/context.json
 //		revHistory: controls the rev history for JetStream defaults to 10 must be > 2 and <= 64
 //		slowMethod: used to log methods slower than provided duration default 500ms
+//		replicas: the number of replicas of the bucket stream, between 1 and 5
+//		storage: whether the bucket stream is stored in files or in memory, file or memory
+//		placementCluster: the cluster the bucket stream is placed in
+//		placementTag: a tag required of the servers the bucket stream is placed on, may be repeated
+//
+// The replicas, storage, and placement only apply when the bucket is created. They default to the
+// JetStream settings in the kine config, and then to the NATS server defaults.
 //
 // Multiple urls can be passed in a comma separated format - only the first in the list will be evaluated for query
 // parameters. While auth is valid in the url, the preferred way to pass auth is through a context file. If user/pass or
@@ -95,7 +108,17 @@ type JSValue struct {
 }
 */
 func New(ctx context.Context, connection string, tlsInfo tls.Config) (server.Backend, error) {
-	config, err := parseNatsConnection(connection, tlsInfo)
+	return NewWithConfig(ctx, &drivers.Config{DataSourceName: connection, BackendTLSConfig: tlsInfo})
+}
+
+// NewWithConfig returns a backend for the JetStream server configured by cfg. The connection
+// string in cfg.DataSourceName has the format described for New.
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	if cfg.ReadOnly {
+		return nil, errors.New("read-only mode is not supported by the jetstream driver")
+	}
+
+	config, err := parseNatsConnection(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +146,12 @@ func New(ctx context.Context, connection string, tlsInfo tls.Config) (server.Bac
 				Bucket:      config.bucket,
 				Description: "Holds kine key/values",
 				History:     config.revHistory,
+				Replicas:    config.replicas,
+				Storage:     config.storage,
+				Placement:   config.placement,
 			})
+	} else if err == nil {
+		checkBucketConfig(bucket, config)
 	}
 
 	kvB := kv.NewEncodedKV(bucket, &kv.EtcdKeyCodec{}, &kv.S2ValueCodec{})
@@ -138,18 +166,42 @@ func New(ctx context.Context, connection string, tlsInfo tls.Config) (server.Bac
 		kvDirectoryMutex: &sync.RWMutex{},
 		kvDirectoryMuxes: make(map[string]*sync.RWMutex),
 		jetStream:        js,
+		conn:             conn,
 		slowMethod:       config.slowMethod,
 	}, nil
 }
 
+// checkBucketConfig warns if the stream of an existing bucket does not have the configured
+// replicas or storage, as they are only applied when the bucket is created.
+func checkBucketConfig(bucket nats.KeyValue, config *Config) {
+	status, err := bucket.Status()
+	if err != nil {
+		logrus.Warnf("failed to get status of bucket %s: %v", config.bucket, err)
+		return
+	}
+	bs, ok := status.(*nats.KeyValueBucketStatus)
+	if !ok {
+		return
+	}
+	streamConfig := bs.StreamInfo().Config
+	if config.replicas > 0 && streamConfig.Replicas != config.replicas {
+		logrus.Warnf("bucket %s has %d replicas instead of the configured %d", config.bucket, streamConfig.Replicas, config.replicas)
+	}
+	if streamConfig.Storage != config.storage {
+		logrus.Warnf("bucket %s uses %s storage instead of the configured %s storage", config.bucket, streamConfig.Storage, config.storage)
+	}
+}
+
 // parseNatsConnection returns nats connection url, bucketName and []nats.Option, error
-func parseNatsConnection(dsn string, tlsInfo tls.Config) (*Config, error) {
+func parseNatsConnection(cfg *drivers.Config) (*Config, error) {
+	tlsInfo := cfg.BackendTLSConfig
 
 	jsConfig := &Config{
 		slowMethod: defaultSlowMethod,
 		revHistory: defaultRevHistory,
+		replicas:   cfg.JetStreamReplicas,
 	}
-	connections := strings.Split(dsn, ",")
+	connections := strings.Split(cfg.DataSourceName, ",")
 	jsConfig.bucket = defaultBucket
 
 	jsConfig.options = make([]nats.Option, 0)
@@ -186,6 +238,44 @@ func parseNatsConnection(dsn string, tlsInfo tls.Config) (*Config, error) {
 		}
 	}
 
+	if r, ok := queryMap["replicas"]; ok {
+		replicas, err := strconv.Atoi(r[0])
+		if err != nil {
+			return nil, err
+		}
+		jsConfig.replicas = replicas
+	}
+	if jsConfig.replicas < 0 || jsConfig.replicas > 5 {
+		return nil, fmt.Errorf("invalid replicas, must be >= 1 and <= 5")
+	}
+
+	storage := cfg.JetStreamStorage
+	if s, ok := queryMap["storage"]; ok {
+		storage = s[0]
+	}
+	switch storage {
+	case "", "file":
+		jsConfig.storage = nats.FileStorage
+	case "memory":
+		jsConfig.storage = nats.MemoryStorage
+	default:
+		return nil, fmt.Errorf("invalid storage=%s, must be file or memory", storage)
+	}
+
+	placement := &nats.Placement{
+		Cluster: cfg.JetStreamPlacementCluster,
+		Tags:    cfg.JetStreamPlacementTags,
+	}
+	if c, ok := queryMap["placementCluster"]; ok {
+		placement.Cluster = c[0]
+	}
+	if t, ok := queryMap["placementTag"]; ok {
+		placement.Tags = t
+	}
+	if placement.Cluster != "" || len(placement.Tags) > 0 {
+		jsConfig.placement = placement
+	}
+
 	contextFile, hasContext := queryMap["contextFile"]
 	if hasContext && u.Host != "" {
 		return jsConfig, fmt.Errorf("when using context endpoint no host should be provided")
@@ -892,6 +982,28 @@ func (j *JetStream) getPreviousEntry(ctx context.Context, entry nats.KeyValueEnt
 	return nil, nil
 }
 
+// Health checks that the bucket is reachable. Compaction is handled by JetStream
+// retaining a limited history, so compaction status is not reported.
+func (j *JetStream) Health(context.Context) (*server.HealthStatus, error) {
+	currentRev, err := j.currentRevision()
+	if err != nil {
+		return nil, err
+	}
+	compactRev, err := j.compactRevision()
+	if err != nil {
+		return nil, err
+	}
+	return &server.HealthStatus{
+		CurrentRevision: currentRev,
+		CompactRevision: compactRev,
+	}, nil
+}
+
+// Close drains and closes the connection to NATS.
+func (j *JetStream) Close(context.Context) error {
+	return j.conn.Drain()
+}
+
 // DbSize get the kineBucket size from JetStream.
 func (j *JetStream) DbSize(context.Context) (int64, error) {
 	status, err := j.kvBucket.Status()
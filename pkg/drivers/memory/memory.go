@@ -0,0 +1,597 @@
+// Package memory implements a kine backend that holds all revisions in memory, for tests and
+// ephemeral clusters. Nothing is persisted, so all data is lost when kine exits.
+//
+// Unlike the other drivers, it implements server.Backend directly rather than through
+// logstructured, and so also serves as a reference implementation of its semantics. The revisions
+// of each key are held in a btree ordered by name, for lists, and every revision is appended to a
+// log ordered by revision, for watches. Revisions are consecutive, as in etcd. Compaction removes
+// the revisions replaced by, or deleted at, the compact revision or earlier. Keys with a lease
+// expire after the lease, in seconds, as leases are not managed by the backend.
+package memory
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/btree"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+
+	// compactStaleIntervals is the number of compaction intervals without a successful
+	// compaction after which compaction is reported as stale.
+	compactStaleIntervals = 3
+	// watchBatchSize is the maximum number of events sent to a watch at once.
+	watchBatchSize = 1000
+	// btreeDegree is the degree of the btree of keys.
+	btreeDegree = 32
+	// maxLeaseTTL is the largest lease that can be treated as a TTL in seconds without
+	// overflowing a time.Duration.
+	maxLeaseTTL = math.MaxInt64 / int64(time.Second)
+)
+
+// entry holds the revisions of a key, in order of their revisions.
+type entry struct {
+	key       string
+	revisions []*server.Event
+}
+
+func (e *entry) Less(than btree.Item) bool {
+	return e.key < than.(*entry).key
+}
+
+// at returns the latest revision of the key as of the revision, or the latest revision if the
+// revision is zero, or nil if the key did not exist.
+func (e *entry) at(revision int64) *server.Event {
+	if revision == 0 {
+		return e.revisions[len(e.revisions)-1]
+	}
+	i := sort.Search(len(e.revisions), func(i int) bool {
+		return e.revisions[i].KV.ModRevision > revision
+	})
+	if i == 0 {
+		return nil
+	}
+	return e.revisions[i-1]
+}
+
+// watcher is a watch on the log.
+type watcher struct {
+	// revision is the revision up to which events have been sent to the watch
+	revision int64
+}
+
+// Memory is a datastore held in memory. Keys, values, and events returned by it are shared with
+// the datastore and must not be modified.
+type Memory struct {
+	mu sync.RWMutex
+	// keys holds an entry for each key that has revisions that have not been compacted
+	keys *btree.BTree
+	// events holds every event after the compact revision, in order of their revisions
+	events []*server.Event
+	// changed is closed and replaced when events are appended
+	changed    chan struct{}
+	rev        int64
+	compactRev int64
+	watchers   map[*watcher]struct{}
+	// timers expire the keys with a lease, by name
+	timers map[string]*time.Timer
+	// lastCompact is the time at which compaction last completed
+	lastCompact time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	compactInterval  time.Duration
+	compactMinRetain int64
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	m := &Memory{
+		keys:             btree.New(btreeDegree),
+		changed:          make(chan struct{}),
+		watchers:         map[*watcher]struct{}{},
+		timers:           map[string]*time.Timer{},
+		compactInterval:  compactInterval,
+		compactMinRetain: compactMinRetain,
+	}
+	if cfg.CompactInterval > 0 {
+		m.compactInterval = cfg.CompactInterval
+	}
+	if cfg.CompactMinRetain > 0 {
+		m.compactMinRetain = cfg.CompactMinRetain
+	}
+	return m, nil
+}
+
+func (m *Memory) Start(ctx context.Context) error {
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	logrus.Warnf("Using the memory datastore; all data will be lost when kine exits")
+
+	// See https://github.com/kubernetes/kubernetes/blob/442a69c3bdf6fe8e525b05887e57d89db1e2f3a5/staging/src/k8s.io/apiserver/pkg/storage/storagebackend/factory/etcd3.go#L97
+	if _, err := m.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0); err != nil && err != server.ErrKeyExists {
+		logrus.Errorf("Failed to create health check key: %v", err)
+	}
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		m.compactor()
+	}()
+	return nil
+}
+
+// checkRevision returns an error if a read at the revision cannot be served.
+func (m *Memory) checkRevision(revision int64) error {
+	if revision == 0 {
+		return nil
+	}
+	if revision < m.compactRev {
+		return server.ErrCompacted
+	}
+	if revision > m.rev {
+		return server.ErrFutureRev
+	}
+	return nil
+}
+
+// readRevision returns the revision of a read at the revision.
+func (m *Memory) readRevision(revision int64) int64 {
+	if revision != 0 {
+		return revision
+	}
+	return m.rev
+}
+
+// latest returns the latest revision of the key, or nil if it has none.
+func (m *Memory) latest(key string) *server.Event {
+	item := m.keys.Get(&entry{key: key})
+	if item == nil {
+		return nil
+	}
+	return item.(*entry).at(0)
+}
+
+// append appends the event to the log, and to the revisions of its key, at the next revision,
+// which is returned. m.mu must be held for writing.
+func (m *Memory) append(event *server.Event) int64 {
+	m.rev++
+	event.KV.ModRevision = m.rev
+	if event.Create {
+		event.KV.CreateRevision = m.rev
+	}
+	m.events = append(m.events, event)
+
+	item := m.keys.Get(&entry{key: event.KV.Key})
+	if item == nil {
+		item = &entry{key: event.KV.Key}
+		m.keys.ReplaceOrInsert(item)
+	}
+	e := item.(*entry)
+	e.revisions = append(e.revisions, event)
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+	m.expireAfterLease(event)
+	return m.rev
+}
+
+// expireAfterLease schedules the key to be deleted once its lease has expired, if it has one.
+// Any previously scheduled expiry of the key is cancelled. m.mu must be held for writing.
+func (m *Memory) expireAfterLease(event *server.Event) {
+	key, lease, revision := event.KV.Key, event.KV.Lease, event.KV.ModRevision
+	if timer, ok := m.timers[key]; ok {
+		timer.Stop()
+		delete(m.timers, key)
+	}
+	if event.Delete || lease <= 0 || m.ctx == nil {
+		return
+	}
+	if lease > maxLeaseTTL {
+		logrus.Warnf("Not expiring %s: lease %d is too large", key, lease)
+		return
+	}
+	m.timers[key] = time.AfterFunc(time.Duration(lease)*time.Second, func() {
+		if m.ctx.Err() != nil {
+			return
+		}
+		// the key is only deleted if it has not been written since
+		if _, _, _, err := m.Delete(m.ctx, key, revision); err != nil {
+			logrus.Errorf("Failed to delete expired key %s: %v", key, err)
+			return
+		}
+		logrus.Tracef("TTL key=%s, lease=%d, rev=%d", key, lease, revision)
+	})
+}
+
+func (m *Memory) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (int64, *server.KeyValue, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := m.checkRevision(revision); err != nil {
+		return m.rev, nil, err
+	}
+	item := m.keys.Get(&entry{key: key})
+	if item == nil {
+		return m.readRevision(revision), nil, nil
+	}
+	event := item.(*entry).at(revision)
+	if event == nil || event.Delete {
+		return m.readRevision(revision), nil, nil
+	}
+	return m.readRevision(revision), event.KV, nil
+}
+
+func (m *Memory) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if prev := m.latest(key); prev != nil && !prev.Delete {
+		return m.rev, server.ErrKeyExists
+	}
+	return m.append(&server.Event{
+		Create: true,
+		KV: &server.KeyValue{
+			Key:   key,
+			Value: value,
+			Lease: lease,
+		},
+	}), nil
+}
+
+// Delete deletes the key, if its latest revision is the revision or the revision is zero. The
+// deleted value is returned, and whether the key was deleted or did not exist.
+func (m *Memory) Delete(ctx context.Context, key string, revision int64) (int64, *server.KeyValue, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.latest(key)
+	if prev == nil {
+		return m.rev, nil, true, nil
+	}
+	if prev.Delete {
+		return m.rev, prev.KV, true, nil
+	}
+	if revision != 0 && prev.KV.ModRevision != revision {
+		return m.rev, prev.KV, false, nil
+	}
+	rev := m.append(&server.Event{
+		Delete: true,
+		KV: &server.KeyValue{
+			Key:            key,
+			CreateRevision: prev.KV.CreateRevision,
+			Value:          prev.KV.Value,
+			Lease:          prev.KV.Lease,
+		},
+		PrevKV: prev.KV,
+	})
+	return rev, prev.KV, true, nil
+}
+
+// Update replaces the value and lease of the key, if its latest revision is the revision. The
+// current value is returned, and whether it was updated.
+func (m *Memory) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *server.KeyValue, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prev := m.latest(key)
+	if prev == nil || prev.Delete {
+		return m.rev, nil, false, nil
+	}
+	if prev.KV.ModRevision != revision {
+		return m.rev, prev.KV, false, nil
+	}
+	event := &server.Event{
+		KV: &server.KeyValue{
+			Key:            key,
+			CreateRevision: prev.KV.CreateRevision,
+			Value:          value,
+			Lease:          lease,
+		},
+		PrevKV: prev.KV,
+	}
+	return m.append(event), event.KV, true, nil
+}
+
+// matches returns true if the key matches the prefix, which is a key unless it ends with a
+// slash.
+func matches(key, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(key, prefix)
+	}
+	return key == prefix
+}
+
+// ascend calls the function with the entry of each key matching the prefix, after the start
+// key, in order of their names, until it returns false.
+func (m *Memory) ascend(prefix, startKey string, fn func(e *entry) bool) {
+	pivot := prefix
+	if startKey != "" && startKey >= prefix {
+		pivot = startKey + "\x00"
+	}
+	m.keys.AscendGreaterOrEqual(&entry{key: pivot}, func(item btree.Item) bool {
+		e := item.(*entry)
+		if !matches(e.key, prefix) {
+			return false
+		}
+		return fn(e)
+	})
+}
+
+// List returns the keys matching the prefix, as of the revision, in order of their names. As for
+// the other drivers, the start key is only used when listing, and is the last key of the previous
+// page, which is not returned again.
+func (m *Memory) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*server.KeyValue, error) {
+	if !strings.HasSuffix(prefix, "/") || prefix == startKey {
+		startKey = ""
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if err := m.checkRevision(revision); err != nil {
+		return m.rev, nil, err
+	}
+	var kvs []*server.KeyValue
+	m.ascend(prefix, startKey, func(e *entry) bool {
+		if event := e.at(revision); event != nil && !event.Delete {
+			kvs = append(kvs, event.KV)
+		}
+		return limit <= 0 || int64(len(kvs)) < limit
+	})
+	return m.readRevision(revision), kvs, nil
+}
+
+// Count returns the current revision and the number of keys matching the prefix.
+func (m *Memory) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var count int64
+	m.ascend(prefix, "", func(e *entry) bool {
+		if !e.at(0).Delete {
+			count++
+		}
+		return true
+	})
+	return m.rev, count, nil
+}
+
+// Watch returns the events for keys matching the prefix, from the revision, or from the next
+// revision if it is zero. The channel is closed when ctx is done, or if the events from the
+// revision have been compacted, or the watch falls behind compaction.
+func (m *Memory) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
+	logrus.Tracef("WATCH %s, revision=%d", prefix, revision)
+	result := make(chan []*server.Event, 100)
+	exclude := server.WatchExclusions(ctx)
+
+	m.mu.Lock()
+	w := &watcher{revision: m.rev}
+	if revision > 0 {
+		w.revision = revision - 1
+	}
+	if w.revision < m.compactRev {
+		m.mu.Unlock()
+		logrus.Errorf("Failed to watch %s from revision %d: %v", prefix, revision, server.ErrCompacted)
+		close(result)
+		return result
+	}
+	m.watchers[w] = struct{}{}
+	m.mu.Unlock()
+
+	go func() {
+		defer close(result)
+		defer func() {
+			m.mu.Lock()
+			delete(m.watchers, w)
+			m.mu.Unlock()
+		}()
+
+		for {
+			m.mu.RLock()
+			if w.revision < m.compactRev {
+				m.mu.RUnlock()
+				logrus.Errorf("Watch of %s fell behind compaction at revision %d", prefix, w.revision)
+				return
+			}
+			// events are consecutive, from the revision after the compact revision
+			events := m.events[w.revision-m.compactRev:]
+			if len(events) > watchBatchSize {
+				events = events[:watchBatchSize]
+			}
+			changed := m.changed
+			m.mu.RUnlock()
+
+			if len(events) == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-m.ctx.Done():
+					return
+				case <-changed:
+				}
+				continue
+			}
+
+			filtered := make([]*server.Event, 0, len(events))
+			for _, event := range events {
+				if matches(event.KV.Key, prefix) {
+					filtered = append(filtered, event)
+				}
+			}
+			if filtered = server.ExcludeEvents(filtered, exclude); len(filtered) > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-m.ctx.Done():
+					return
+				case result <- filtered:
+				}
+			}
+
+			m.mu.Lock()
+			w.revision = events[len(events)-1].KV.ModRevision
+			m.mu.Unlock()
+		}
+	}()
+
+	return result
+}
+
+// WatchProgressRevision returns the revision up to which events have been sent to every watch.
+func (m *Memory) WatchProgressRevision() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	rev := m.rev
+	for w := range m.watchers {
+		if w.revision < rev {
+			rev = w.revision
+		}
+	}
+	return rev
+}
+
+// Compact compacts to the revision.
+func (m *Memory) Compact(ctx context.Context, revision int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if revision > m.rev {
+		return server.ErrFutureRev
+	}
+	if revision <= m.compactRev {
+		return server.ErrCompacted
+	}
+	m.compact(revision)
+	return nil
+}
+
+// compactor periodically compacts to all but the most recent compactMinRetain revisions.
+func (m *Memory) compactor() {
+	t := time.NewTicker(m.compactInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		m.mu.Lock()
+		if target := m.rev - m.compactMinRetain; target > m.compactRev {
+			m.compact(target)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// compact removes the events up to the revision from the log, and the revisions of keys replaced
+// by, or deleted at, the revision or earlier. m.mu must be held for writing.
+func (m *Memory) compact(revision int64) {
+	compacted := m.events[:revision-m.compactRev]
+	m.events = append([]*server.Event(nil), m.events[revision-m.compactRev:]...)
+
+	var deleted int64
+	keys := map[string]bool{}
+	for _, event := range compacted {
+		if keys[event.KV.Key] {
+			continue
+		}
+		keys[event.KV.Key] = true
+
+		item := m.keys.Get(&entry{key: event.KV.Key})
+		if item == nil {
+			continue
+		}
+		e := item.(*entry)
+		// the latest revision as of the compact revision is kept, unless it is a deletion
+		i := sort.Search(len(e.revisions), func(i int) bool {
+			return e.revisions[i].KV.ModRevision > revision
+		})
+		if i > 0 && !e.revisions[i-1].Delete {
+			i--
+		}
+		deleted += int64(i)
+		if i == len(e.revisions) {
+			m.keys.Delete(e)
+			continue
+		}
+		e.revisions = append([]*server.Event(nil), e.revisions[i:]...)
+	}
+
+	from := m.compactRev
+	m.compactRev = revision
+	m.lastCompact = time.Now()
+	metrics.CompactDeletedRows.Observe(float64(deleted))
+	metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+	logrus.Infof("COMPACT compacted from %d to %d, deleting %d revisions", from, revision, deleted)
+}
+
+// DbSize returns the size of the keys and values of all revisions.
+func (m *Memory) DbSize(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var size int64
+	m.keys.Ascend(func(item btree.Item) bool {
+		for _, event := range item.(*entry).revisions {
+			size += int64(len(event.KV.Key) + len(event.KV.Value))
+		}
+		return true
+	})
+	return size, nil
+}
+
+func (m *Memory) Health(ctx context.Context) (*server.HealthStatus, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	status := &server.HealthStatus{
+		CurrentRevision: m.rev,
+		CompactRevision: m.compactRev,
+	}
+	if !m.lastCompact.IsZero() {
+		status.LastCompact = m.lastCompact
+		status.CompactStale = time.Since(m.lastCompact) > compactStaleIntervals*m.compactInterval
+	}
+	return status, nil
+}
+
+// Close stops compaction, lease expiry, and watches. If ctx is done before compaction has
+// stopped, Close returns anyway.
+func (m *Memory) Close(ctx context.Context) error {
+	if m.cancel != nil {
+		m.cancel()
+	}
+
+	m.mu.Lock()
+	for key, timer := range m.timers {
+		timer.Stop()
+		delete(m.timers, key)
+	}
+	m.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for compaction to stop: %v", ctx.Err())
+	}
+	return nil
+}
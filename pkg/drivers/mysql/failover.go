@@ -0,0 +1,119 @@
+package mysql
+
+import (
+	"context"
+	cryptotls "crypto/tls"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+// splitAddrs returns the addresses of a DSN with comma-separated addresses, such as
+// user:password@tcp(host1:3306,host2:3306)/kubernetes, and the DSN for each of them. A DSN with
+// a single address is returned unchanged, with no addresses.
+func splitAddrs(dataSourceName string) ([]string, []string) {
+	// as for the driver, the last slash ends the address, as the password may contain slashes
+	slash := strings.LastIndex(dataSourceName, "/")
+	if slash < 0 {
+		return nil, []string{dataSourceName}
+	}
+	at := strings.LastIndex(dataSourceName[:slash], "@")
+	open := strings.Index(dataSourceName[at+1:slash], "(")
+	if open < 0 || !strings.HasSuffix(dataSourceName[:slash], ")") {
+		return nil, []string{dataSourceName}
+	}
+	open += at + 1
+
+	addrs := strings.Split(dataSourceName[open+1:slash-1], ",")
+	if len(addrs) == 1 {
+		return nil, []string{dataSourceName}
+	}
+	dsns := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		dsns = append(dsns, dataSourceName[:open+1]+addr+dataSourceName[slash-1:])
+	}
+	return addrs, dsns
+}
+
+// prepareDSNs prepares the DSN for each of the addresses of the DSN, as for prepareDSN. The
+// addresses are only returned if there are several.
+func prepareDSNs(dataSourceName string, tlsConfig *cryptotls.Config, defaultDBName string) ([]string, []string, error) {
+	addrs, dsns := splitAddrs(dataSourceName)
+	for i, dsn := range dsns {
+		parsedDSN, err := prepareDSN(dsn, tlsConfig, defaultDBName)
+		if err != nil {
+			return nil, nil, err
+		}
+		dsns[i] = parsedDSN
+	}
+	return addrs, dsns, nil
+}
+
+// failoverConnector opens connections to the first of several hosts that accepts them and is not
+// read-only, unless read-only hosts are allowed, failing over to the other hosts when it cannot
+// be reached.
+type failoverConnector struct {
+	dsns          map[string]string
+	failover      *generic.HostFailover
+	allowReadOnly bool
+}
+
+func newFailoverConnector(addrs, dsns []string) *failoverConnector {
+	c := &failoverConnector{
+		dsns:     map[string]string{},
+		failover: generic.NewHostFailover("mysql", addrs),
+	}
+	for i, addr := range addrs {
+		c.dsns[addr] = dsns[i]
+	}
+	return c
+}
+
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.failover.Connect(ctx, func(ctx context.Context, addr string) (driver.Conn, error) {
+		config, err := mysql.ParseDSN(c.dsns[addr])
+		if err != nil {
+			return nil, err
+		}
+		connector, err := mysql.NewConnector(config)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := connector.Connect(ctx)
+		if err != nil || c.allowReadOnly {
+			return conn, err
+		}
+		readOnly, err := generic.QueryBool(ctx, conn, "SELECT @@global.read_only")
+		if err == nil && readOnly {
+			err = fmt.Errorf("host is read-only")
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return &mysql.MySQLDriver{}
+}
+
+// openReadReplica opens the read replica of the database, using the same TLS configuration and
+// database name as the database. Read-only hosts are allowed, as replicas usually are.
+func openReadReplica(ctx context.Context, dialect *generic.Generic, cfg *drivers.Config, tlsConfig *cryptotls.Config) error {
+	addrs, dsns, err := prepareDSNs(cfg.ReadDataSourceName, tlsConfig, cfg.DBName())
+	if err != nil {
+		return err
+	}
+	if len(dsns) > 1 {
+		connector := newFailoverConnector(addrs, dsns)
+		connector.allowReadOnly = true
+		return dialect.OpenReadReplicaConnector(ctx, connector, cfg.ConnectionPoolConfig, cfg.MaxReadLag)
+	}
+	return dialect.OpenReadReplica(ctx, "mysql", dsns[0], cfg.ConnectionPoolConfig, cfg.MaxReadLag)
+}
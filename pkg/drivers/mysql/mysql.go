@@ -7,12 +7,13 @@ import (
 	"fmt"
 
 	"github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/logstructured"
 	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
-	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -43,38 +44,109 @@ var (
 		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
 	}
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_lease
+			(
+				id BIGINT NOT NULL PRIMARY KEY,
+				ttl BIGINT NOT NULL,
+				expires BIGINT NOT NULL
+			)`,
+		`CREATE INDEX kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
+	}
 	createDB = "CREATE DATABASE IF NOT EXISTS "
 )
 
+// New returns a backend for the MySQL database at dataSourceName. Use NewWithConfig to set any
+// of the other options of drivers.Config.
 func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	tlsConfig, err := tlsInfo.ClientConfig()
+	return NewWithConfig(ctx, &drivers.Config{
+		DataSourceName:       dataSourceName,
+		BackendTLSConfig:     tlsInfo,
+		ConnectionPoolConfig: connPoolConfig,
+		MetricsRegisterer:    metricsRegisterer,
+	})
+}
+
+// NewWithConfig returns a backend for the MySQL database configured by cfg.
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	backend, dialect, err := NewVariant(ctx, cfg, migrations)
 	if err != nil {
 		return nil, err
 	}
+	// the id column of the MySQL schema is a 32-bit INTEGER
+	dialect.IDColumnBits = 32
+	return backend, nil
+}
+
+// NewVariant returns a backend for a MySQL-compatible database, using the provided schema migrations.
+// The dialect is also returned so that the caller can adjust it for differences from MySQL.
+func NewVariant(ctx context.Context, cfg *drivers.Config, migrations []generic.SchemaMigration) (server.Backend, *generic.Generic, error) {
+	tlsConfig, err := cfg.BackendTLSConfig.ClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
 
 	if tlsConfig != nil {
 		tlsConfig.MinVersion = cryptotls.VersionTLS11
 	}
 
-	parsedDSN, err := prepareDSN(dataSourceName, tlsConfig)
+	addrs, dsns, err := prepareDSNs(cfg.DataSourceName, tlsConfig, cfg.DBName())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	if err := createDBIfNotExist(parsedDSN); err != nil {
-		return nil, err
+	// If a separate schema DSN is provided, create the database and schema using those credentials,
+	// and only use the primary DSN to serve requests.
+	schemaCreated := false
+	if cfg.SchemaDataSourceName != "" && !cfg.ReadOnly {
+		if err := createSchema(ctx, cfg, migrations); err != nil {
+			return nil, nil, err
+		}
+		schemaCreated = true
+	}
+
+	if !cfg.ReadOnly && !schemaCreated {
+		// the database is created using the first host that accepts the statement
+		for _, dsn := range dsns {
+			if err = createDBIfNotExist(ctx, dsn); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	dialect, err := generic.Open(ctx, "mysql", parsedDSN, connPoolConfig, "?", false, metricsRegisterer)
+	var dialect *generic.Generic
+	if len(dsns) > 1 {
+		dialect, err = generic.OpenConnector(ctx, "mysql", newFailoverConnector(addrs, dsns), cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer)
+	} else {
+		dialect, err = generic.Open(ctx, "mysql", dsns[0], cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer)
+	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if cfg.ReadDataSourceName != "" {
+		if err := openReadReplica(ctx, dialect, cfg, tlsConfig); err != nil {
+			return nil, nil, errors.Wrap(err, "opening read replica")
+		}
 	}
+	dialect.FastCount = cfg.FastCount
 
 	dialect.LastInsertID = true
 	dialect.GetSizeSQL = `
 		SELECT SUM(data_length + index_length)
 		FROM information_schema.TABLES
 		WHERE table_schema = DATABASE() AND table_name = 'kine'`
+	// InnoDB rebuilds the table and its indexes for OPTIMIZE TABLE
+	dialect.DefragSQL = []string{
+		`OPTIMIZE TABLE kine`,
+	}
 	dialect.CompactSQL = `
 		DELETE kv FROM kine AS kv
 		INNER JOIN (
@@ -83,11 +155,33 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoo
 			WHERE
 				kp.name != 'compact_rev_key' AND
 				kp.prev_revision != 0 AND
+				kp.id > ? AND
 				kp.id <= ?
 			UNION
 			SELECT kd.id AS id
 			FROM kine AS kd
 			WHERE
+				kd.deleted != 0 AND
+				kd.id > ? AND
+				kd.id <= ?
+		) AS ks
+		ON kv.id = ks.id`
+	// MySQL cannot select from the table being deleted from in a subquery, so use a join instead
+	dialect.CompactPrefixSQL = `
+		DELETE kv FROM kine AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name LIKE ? ESCAPE '!' AND
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.name LIKE ? ESCAPE '!' AND
 				kd.deleted != 0 AND
 				kd.id <= ?
 		) AS ks
@@ -98,6 +192,8 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoo
 		}
 		return err
 	}
+	// ER_LOCK_DEADLOCK and ER_LOCK_WAIT_TIMEOUT
+	dialect.RetriableErrCodes = []string{"1213", "1205"}
 	dialect.ErrCode = func(err error) string {
 		if err == nil {
 			return ""
@@ -107,32 +203,72 @@ func New(ctx context.Context, dataSourceName string, tlsInfo tls.Config, connPoo
 		}
 		return err.Error()
 	}
-	if err := setup(dialect.DB); err != nil {
-		return nil, err
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping database setup in read-only mode")
+	} else {
+		if !schemaCreated {
+			if err := setup(ctx, dialect.DB, migrations); err != nil {
+				return nil, nil, err
+			}
+		}
+		dialect.Migrate(context.Background())
 	}
 
-	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), nil
+	backend, err := logstructured.New(sqllog.New(dialect, cfg), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backend, dialect, nil
 }
 
-func setup(db *sql.DB) error {
+// createSchema creates the database and schema using the schema DSN, closing the connection once complete.
+func createSchema(ctx context.Context, cfg *drivers.Config, migrations []generic.SchemaMigration) error {
+	logrus.Infof("Configuring database schema using the schema datastore endpoint")
+
+	tlsConfig, err := cfg.BackendTLSConfig.ClientConfig()
+	if err != nil {
+		return err
+	}
+	schemaDSN, err := prepareDSN(cfg.SchemaDataSourceName, tlsConfig, cfg.DBName())
+	if err != nil {
+		return err
+	}
+
+	if err := createDBIfNotExist(ctx, schemaDSN); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("mysql", schemaDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return setup(ctx, db, migrations)
+}
+
+func setup(ctx context.Context, db *sql.DB, migrations []generic.SchemaMigration) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 
-	for _, stmt := range schema {
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		_, err := db.Exec(stmt)
-		if err != nil {
-			if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1061 {
-				return err
-			}
-		}
+	// MySQL does not support CREATE INDEX IF NOT EXISTS, so ignore duplicate key name errors
+	ignoreErr := func(err error) bool {
+		mysqlError, ok := err.(*mysql.MySQLError)
+		return ok && mysqlError.Number == 1061
+	}
+	// Tolerate table already exists and deadlock errors caused by another replica running setup concurrently
+	retryErr := func(err error) bool {
+		mysqlError, ok := err.(*mysql.MySQLError)
+		return ok && (mysqlError.Number == 1050 || mysqlError.Number == 1213)
+	}
+	if err := generic.ApplySchemaMigrations(ctx, db, migrations, ignoreErr, retryErr); err != nil {
+		return err
 	}
 
 	logrus.Infof("Database tables and indexes are up to date")
 	return nil
 }
 
-func createDBIfNotExist(dataSourceName string) error {
+func createDBIfNotExist(ctx context.Context, dataSourceName string) error {
 	config, err := mysql.ParseDSN(dataSourceName)
 	if err != nil {
 		return err
@@ -143,7 +279,7 @@ func createDBIfNotExist(dataSourceName string) error {
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(createDB + dbName)
+	_, err = db.ExecContext(ctx, createDB+dbName)
 	if err != nil {
 		if mysqlError, ok := err.(*mysql.MySQLError); !ok || mysqlError.Number != 1049 {
 			return err
@@ -153,7 +289,7 @@ func createDBIfNotExist(dataSourceName string) error {
 		if err != nil {
 			return err
 		}
-		_, err = db.Exec(createDB + dbName)
+		_, err = db.ExecContext(ctx, createDB+dbName)
 		if err != nil {
 			return err
 		}
@@ -161,7 +297,7 @@ func createDBIfNotExist(dataSourceName string) error {
 	return nil
 }
 
-func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, error) {
+func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config, defaultDBName string) (string, error) {
 	if len(dataSourceName) == 0 {
 		dataSourceName = defaultUnixDSN
 		if tlsConfig != nil {
@@ -172,18 +308,18 @@ func prepareDSN(dataSourceName string, tlsConfig *cryptotls.Config) (string, err
 	if err != nil {
 		return "", err
 	}
-	// setting up tlsConfig
+	// MySQL 8 defaults to caching_sha2_password, which requires a secure transport or RSA key
+	// exchange for full authentication. Connections use TLS if cert material is configured;
+	// otherwise the tls and allowPublicKeyRetrieval parameters of the DSN are left as they are.
 	if tlsConfig != nil {
 		if err := mysql.RegisterTLSConfig("kine", tlsConfig); err != nil {
 			return "", err
 		}
 		config.TLSConfig = "kine"
 	}
-	dbName := "kubernetes"
-	if len(config.DBName) > 0 {
-		dbName = config.DBName
+	if len(config.DBName) == 0 {
+		config.DBName = defaultDBName
 	}
-	config.DBName = dbName
 	parsedDSN := config.FormatDSN()
 
 	return parsedDSN, nil
@@ -0,0 +1,51 @@
+package mysql
+
+import (
+	cryptotls "crypto/tls"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestPrepareDSN(t *testing.T) {
+	tests := []struct {
+		name               string
+		dsn                string
+		tlsConfig          *cryptotls.Config
+		net, addr          string
+		dbName             string
+		tls                string
+		publicKeyRetrieval bool
+	}{
+		{name: "default", net: "unix", addr: "/var/run/mysqld/mysqld.sock", dbName: "kubernetes"},
+		{name: "default with cert material", tlsConfig: &cryptotls.Config{ServerName: "127.0.0.1"}, net: "tcp", addr: "127.0.0.1:3306", dbName: "kubernetes", tls: "kine"},
+		{name: "tcp without cert material", dsn: "kine:secret@tcp(db:3306)/", net: "tcp", addr: "db:3306", dbName: "kubernetes"},
+		{name: "cert material", dsn: "kine:secret@tcp(db:3306)/kine", tlsConfig: &cryptotls.Config{ServerName: "db"}, net: "tcp", addr: "db:3306", dbName: "kine", tls: "kine"},
+		{name: "explicit tls", dsn: "kine:secret@tcp(db:3306)/kine?tls=preferred", net: "tcp", addr: "db:3306", dbName: "kine", tls: "preferred"},
+		{name: "public key retrieval", dsn: "kine:secret@tcp(db:3306)/kine?allowPublicKeyRetrieval=true", net: "tcp", addr: "db:3306", dbName: "kine", publicKeyRetrieval: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, err := prepareDSN(tt.dsn, tt.tlsConfig, "kubernetes")
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := mysql.ParseDSN(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Net != tt.net || config.Addr != tt.addr || config.DBName != tt.dbName {
+				t.Errorf("DSN %s connects to %s(%s)/%s, want %s(%s)/%s", dsn, config.Net, config.Addr, config.DBName, tt.net, tt.addr, tt.dbName)
+			}
+			if config.TLSConfig != tt.tls {
+				t.Errorf("DSN %s has tls=%q, want %q", dsn, config.TLSConfig, tt.tls)
+			}
+			if tt.tls == "kine" && config.TLS.ServerName != tt.tlsConfig.ServerName {
+				t.Errorf("DSN %s does not use the configured cert material", dsn)
+			}
+			if config.AllowPublicKeyRetrieval != tt.publicKeyRetrieval {
+				t.Errorf("DSN %s has allowPublicKeyRetrieval=%v, want %v", dsn, config.AllowPublicKeyRetrieval, tt.publicKeyRetrieval)
+			}
+		})
+	}
+}
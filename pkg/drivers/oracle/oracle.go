@@ -0,0 +1,405 @@
+package oracle
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/pkg/errors"
+	"github.com/sijms/go-ora/v2/network"
+	"github.com/sirupsen/logrus"
+
+	// oracle db driver
+	_ "github.com/sijms/go-ora/v2"
+)
+
+const (
+	defaultDSN = "oracle://kine@localhost:1521"
+	driverName = "oracle"
+)
+
+var (
+	// Oracle has no CREATE ... IF NOT EXISTS before 23c, so statements that fail because the
+	// object already exists are ignored. The id column is populated from a sequence rather than
+	// being an identity column, so that rows can be inserted with an explicit id when filling
+	// gaps or restoring a snapshot. The sequence is ordered and uncached, so that ids increase
+	// monotonically across RAC instances.
+	schema = []string{
+		`CREATE SEQUENCE kine_id_seq START WITH 1 INCREMENT BY 1 NOCACHE ORDER`,
+		`CREATE TABLE kine
+			(
+				id NUMBER(19) DEFAULT kine_id_seq.NEXTVAL NOT NULL,
+				name VARCHAR2(630),
+				created NUMBER(10),
+				deleted NUMBER(10),
+				create_revision NUMBER(19),
+				prev_revision NUMBER(19),
+				lease NUMBER(19),
+				value BLOB,
+				old_value BLOB,
+				CONSTRAINT kine_pkey PRIMARY KEY (id)
+			)`,
+		`CREATE INDEX kine_name_index ON kine (name)`,
+		`CREATE INDEX kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`CREATE TABLE kine_lease
+			(
+				id NUMBER(19) NOT NULL,
+				ttl NUMBER(19) NOT NULL,
+				expires NUMBER(19) NOT NULL,
+				CONSTRAINT kine_lease_pkey PRIMARY KEY (id)
+			)`,
+		`CREATE INDEX kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
+	}
+	createMigrationsSQL = `
+		BEGIN
+			EXECUTE IMMEDIATE 'CREATE TABLE kine_migrations (id NUMBER(10) NOT NULL PRIMARY KEY)';
+		EXCEPTION
+			WHEN OTHERS THEN
+				IF SQLCODE != -955 THEN
+					RAISE;
+				END IF;
+		END;`
+
+	// Oracle does not allow AS before table aliases, and has no boolean type in SQL, so the
+	// queries below differ from the generic ones in those respects.
+	columns = "kv.id AS theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value"
+	revSQL  = `
+		SELECT MAX(rkv.id) AS id
+		FROM kine rkv`
+
+	compactRevSQL = `
+		SELECT MAX(crkv.prev_revision) AS prev_revision
+		FROM kine crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	idOfKey = `
+		AND
+		mkv.id <= ? AND
+		mkv.id > (
+			SELECT MAX(ikv.id) AS id
+			FROM kine ikv
+			WHERE
+				ikv.name = ? AND
+				ikv.id <= ?)`
+
+	listCurrentSQL = fmt.Sprintf(`
+			SELECT (%s) AS current_revision, (%s) AS compact_revision, %s
+			FROM kine kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine mkv
+				WHERE
+					mkv.name LIKE ? ESCAPE '!'
+					%%s
+				GROUP BY mkv.name) maxkv
+				ON maxkv.id = kv.id
+			WHERE
+				kv.deleted = 0 OR
+				? = 1`, revSQL, compactRevSQL, columns)
+
+	listSQL = fmt.Sprintf(`
+		SELECT *
+		FROM (
+			%s
+		) lkv
+		ORDER BY lkv.theid ASC`, listCurrentSQL)
+
+	afterSQL = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM kine kv
+		WHERE
+			kv.name LIKE ? ESCAPE '!' AND
+			kv.id > ?
+			%%s
+		ORDER BY kv.id ASC`, revSQL, compactRevSQL, columns)
+
+	getKeysSQL = fmt.Sprintf(`
+		SELECT (%s), (%s), %s
+		FROM kine kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine mkv
+			WHERE
+				mkv.name IN (%%s)
+			GROUP BY mkv.name) maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0
+		ORDER BY kv.name ASC`, revSQL, compactRevSQL, columns)
+
+	// compactKeysSQL selects the ids of rows superseded or deleted by the revisions in a range.
+	compactKeysSQL = `
+		SELECT kp.prev_revision AS id
+		FROM kine kp
+		WHERE
+			kp.name != 'compact_rev_key' AND
+			kp.prev_revision != 0 AND
+			kp.id > ? AND
+			kp.id <= ?
+		UNION
+		SELECT kd.id AS id
+		FROM kine kd
+		WHERE
+			kd.deleted != 0 AND
+			kd.id > ? AND
+			kd.id <= ?`
+)
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	parsedDSN, err := prepareDSN(cfg.DataSourceName, cfg.BackendTLSConfig, cfg.DBName())
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := generic.Open(ctx, driverName, parsedDSN, cfg.ConnectionPoolConfig, ":", true, cfg.MetricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.FastCount = cfg.FastCount
+
+	dialect.RevisionSQL = revSQL
+	dialect.CompactRevisionSQL = compactRevSQL
+	dialect.AfterFormatSQL = afterSQL
+	dialect.GetCurrentKeysFormatSQL = getKeysSQL
+	dialect.AfterSQL = q(fmt.Sprintf(afterSQL, ""))
+	dialect.GetRevisionSQL = q(fmt.Sprintf(`
+		SELECT
+		0, 0, %s
+		FROM kine kv
+		WHERE kv.id = ?`, columns))
+	dialect.GetCurrentSQL = q(fmt.Sprintf(listSQL, ""))
+	dialect.ListRevisionStartSQL = q(fmt.Sprintf(listSQL, "AND mkv.id <= ?"))
+	dialect.GetRevisionAfterSQL = q(fmt.Sprintf(listSQL, idOfKey))
+	dialect.CountSQL = q(fmt.Sprintf(`
+		SELECT (%s), COUNT(c.theid)
+		FROM (
+			%s
+		) c`, revSQL, fmt.Sprintf(listCurrentSQL, "")))
+	dialect.FastCountSQL = q(fmt.Sprintf(`
+		SELECT (%s), COUNT(kv.id)
+		FROM kine kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine mkv
+			WHERE
+				mkv.name LIKE ? ESCAPE '!'
+			GROUP BY mkv.name) maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0 OR
+			? = 1`, revSQL))
+	dialect.DeleteSQL = q(`
+		DELETE FROM kine
+		WHERE id = ?`)
+	dialect.DeleteLeaseSQL = q(`
+		INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		SELECT kv.name, 0, 1, kv.create_revision, kv.id, kv.lease, kv.value, kv.value
+		FROM kine kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine mkv
+			WHERE mkv.name IN (
+				SELECT lkv.name
+				FROM kine lkv
+				WHERE lkv.lease = ?)
+			GROUP BY mkv.name) maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.lease = ? AND
+			kv.deleted = 0 AND
+			kv.id <= ?
+		ORDER BY kv.id ASC`)
+	dialect.InsertSQL = q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING id INTO ?`)
+	dialect.InsertOutParam = true
+	dialect.CompactSQL = q(fmt.Sprintf(`
+		DELETE FROM kine
+		WHERE id IN (%s)`, compactKeysSQL))
+	dialect.CompactIDsSQL = q(fmt.Sprintf(`
+		SELECT ks.id
+		FROM (%s) ks
+		ORDER BY ks.id ASC`, compactKeysSQL))
+	dialect.CompactDryRunSQL = q(`
+		SELECT COUNT(*), COALESCE(MIN(ks.id), 0), COALESCE(MAX(ks.id), 0)
+		FROM (
+			SELECT kp.prev_revision AS id
+			FROM kine kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ?
+		) ks`)
+	dialect.CompactPrefixSQL = q(`
+		DELETE FROM kine
+		WHERE id IN (
+			SELECT kp.prev_revision AS id
+			FROM kine kp
+			WHERE
+				kp.name LIKE ? ESCAPE '!' AND
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine kd
+			WHERE
+				kd.name LIKE ? ESCAPE '!' AND
+				kd.deleted != 0 AND
+				kd.id <= ?
+		)`)
+	dialect.GetLeaseSQL = q(`
+		SELECT kl.ttl, kl.expires
+		FROM kine_lease kl
+		WHERE kl.id = ?`)
+	dialect.ListLeasesSQL = `
+		SELECT kl.id
+		FROM kine_lease kl
+		ORDER BY kl.id ASC`
+	dialect.ExpiredLeasesSQL = q(`
+		SELECT kl.id
+		FROM kine_lease kl
+		WHERE kl.expires <= ?
+		ORDER BY kl.expires ASC`)
+	dialect.LeaseKeysSQL = q(`
+		SELECT kv.name
+		FROM kine kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine mkv
+			WHERE mkv.name IN (
+				SELECT lkv.name
+				FROM kine lkv
+				WHERE lkv.lease = ?)
+			GROUP BY mkv.name) maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.lease = ? AND
+			kv.deleted = 0
+		ORDER BY kv.name ASC`)
+	// values are stored in separate LOB segments
+	dialect.GetSizeSQL = `
+		SELECT COALESCE(SUM(s.bytes), 0)
+		FROM user_segments s
+		WHERE
+			s.segment_name = 'KINE' OR
+			s.segment_name IN (
+				SELECT l.segment_name
+				FROM user_lobs l
+				WHERE l.table_name = 'KINE')`
+	dialect.PostRestoreSQL = []string{`
+		DECLARE
+			next_id NUMBER;
+		BEGIN
+			SELECT COALESCE(MAX(id), 0) + 1 INTO next_id FROM kine;
+			EXECUTE IMMEDIATE 'ALTER SEQUENCE kine_id_seq RESTART START WITH ' || next_id;
+		END;`,
+	}
+	dialect.ApplyLimit = func(sql string, limit int64) string {
+		return fmt.Sprintf("%s FETCH FIRST %d ROWS ONLY", sql, limit)
+	}
+	dialect.TranslateErr = func(err error) error {
+		// ORA-00001: unique constraint violated
+		if err, ok := err.(*network.OracleError); ok && err.ErrCode == 1 {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	// ORA-00060 deadlock detected, and ORA-08177 can't serialize access for this transaction
+	dialect.RetriableErrCodes = []string{"60", "8177"}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(*network.OracleError); ok {
+			return fmt.Sprint(err.ErrCode)
+		}
+		return err.Error()
+	}
+
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping database setup in read-only mode")
+	} else {
+		if err := setup(ctx, dialect); err != nil {
+			return nil, err
+		}
+	}
+
+	return logstructured.New(sqllog.New(dialect, cfg), cfg)
+}
+
+func setup(ctx context.Context, dialect *generic.Generic) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	// ORA-00955 name is already used by an existing object, and ORA-01408 such column list
+	// already indexed, if the schema was created by another replica or outside of kine
+	ignoreErr := func(err error) bool {
+		code := dialect.ErrCode(err)
+		return code == "955" || code == "1408"
+	}
+	if err := generic.ApplySchemaMigrationsWithTable(ctx, dialect.DB, createMigrationsSQL, migrations, ignoreErr, nil); err != nil {
+		return err
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func q(sql string) string {
+	regex := regexp.MustCompile(`\?`)
+	pref := ":"
+	n := 0
+	return regex.ReplaceAllStringFunc(sql, func(string) string {
+		n++
+		return pref + strconv.Itoa(n)
+	})
+}
+
+// prepareDSN adds the scheme to the data source name. The path of the URL is the Oracle service
+// name; if it is not set, the database name is used.
+func prepareDSN(dataSourceName string, tlsInfo tls.Config, defaultDBName string) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "oracle://" + dataSourceName
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/" + defaultDBName
+	}
+	// the driver reads certificates from an Oracle wallet, configured with the wallet parameter
+	if tlsInfo.CertFile != "" || tlsInfo.KeyFile != "" || tlsInfo.CAFile != "" {
+		return "", errors.New("certificate files are not supported by the oracle driver; use the ssl and wallet parameters instead")
+	}
+
+	return u.String(), nil
+}
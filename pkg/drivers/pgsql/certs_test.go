@@ -0,0 +1,151 @@
+package pgsql
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	cryptotls "crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newCert returns a PEM encoded self-signed certificate and key with the common name.
+func newCert(t *testing.T, commonName string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeCert writes a new client certificate and key with the common name to the files, as a
+// rotation in place would.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	cert, key := newCert(t, commonName)
+	if err := os.WriteFile(certFile, cert, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// clientCertServer accepts Postgres connections, negotiates TLS, and reports the common name of
+// the client certificate of each connection before closing it.
+func clientCertServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	cert, key := newCert(t, "server")
+	serverCert, err := cryptotls.X509KeyPair(cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	clients := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				// the SSLRequest message is 8 bytes long
+				if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+					return
+				}
+				if _, err := conn.Write([]byte("S")); err != nil {
+					return
+				}
+				tlsConn := cryptotls.Server(conn, &cryptotls.Config{
+					Certificates: []cryptotls.Certificate{serverCert},
+					ClientAuth:   cryptotls.RequireAnyClientCert,
+				})
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}()
+		}
+	}()
+	return listener.Addr().String(), clients
+}
+
+func TestRotatedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	writeCert(t, certFile, keyFile, "original")
+	address, clients := clientCertServer(t)
+
+	values := url.Values{"sslmode": {"require"}, "sslcert": {certFile}, "sslkey": {keyFile}}
+	c := &connector{dsn: "postgres://kine@" + address + "/kine?" + values.Encode(), inlineCerts: true}
+	connect := func() string {
+		t.Helper()
+		// the server closes the connection once the client certificate is received
+		if conn, err := c.Connect(context.Background()); err == nil {
+			conn.Close()
+		}
+		select {
+		case commonName := <-clients:
+			return commonName
+		case <-time.After(5 * time.Second):
+			t.Fatal("no client certificate was received")
+			return ""
+		}
+	}
+
+	if commonName := connect(); commonName != "original" {
+		t.Errorf("client certificate = %s, want original", commonName)
+	}
+	writeCert(t, certFile, keyFile, "rotated")
+	if commonName := connect(); commonName != "rotated" {
+		t.Errorf("client certificate after rotation = %s, want rotated", commonName)
+	}
+
+	// A certificate read while it is being written is read again.
+	cert, key := newCert(t, "rewritten")
+	if err := os.WriteFile(certFile, cert[:len(cert)/2], 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(certReadRetryDelay / 2)
+		os.WriteFile(keyFile, key, 0600)
+		os.WriteFile(certFile, cert, 0600)
+	}()
+	if commonName := connect(); commonName != "rewritten" {
+		t.Errorf("client certificate after a partial write = %s, want rewritten", commonName)
+	}
+}
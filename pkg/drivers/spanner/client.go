@@ -0,0 +1,70 @@
+package spanner
+
+import (
+	"context"
+
+	"cloud.google.com/go/spanner"
+	database "cloud.google.com/go/spanner/admin/database/apiv1"
+	"google.golang.org/api/option"
+)
+
+// client holds the clients of a database, for queries and transactions, and for the schema
+// changes made on startup.
+type client struct {
+	database string
+	data     *spanner.Client
+	admin    *database.DatabaseAdminClient
+}
+
+// newClient returns the clients of the database of the config. Credentials are found by the
+// client libraries, from GOOGLE_APPLICATION_CREDENTIALS or the metadata server of the instance
+// kine runs on. If SPANNER_EMULATOR_HOST is set, the client libraries connect to the emulator at
+// that address instead, without credentials.
+func newClient(ctx context.Context, c *config) (*client, error) {
+	var opts []option.ClientOption
+	if c.endpoint != "" {
+		opts = append(opts, option.WithEndpoint(c.endpoint))
+	}
+	admin, err := database.NewDatabaseAdminClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	data, err := spanner.NewClient(ctx, c.database, opts...)
+	if err != nil {
+		admin.Close()
+		return nil, err
+	}
+	return &client{
+		database: c.database,
+		data:     data,
+		admin:    admin,
+	}, nil
+}
+
+// close closes the clients, deleting their sessions.
+func (c *client) close() {
+	c.data.Close()
+	c.admin.Close()
+}
+
+// querier runs queries in a transaction; it is implemented by both read-only and read-write
+// transactions.
+type querier interface {
+	Query(ctx context.Context, statement spanner.Statement) *spanner.RowIterator
+}
+
+// queryFunc runs a query within a transaction, and returns the rows of the result. Parameters are
+// referred to as @name in the query.
+type queryFunc func(sql string, params map[string]interface{}) ([]*spanner.Row, error)
+
+// transactionQuery returns a queryFunc that runs queries in the transaction.
+func transactionQuery(ctx context.Context, txn querier) queryFunc {
+	return func(sql string, params map[string]interface{}) ([]*spanner.Row, error) {
+		var rows []*spanner.Row
+		err := txn.Query(ctx, spanner.Statement{SQL: sql, Params: params}).Do(func(r *spanner.Row) error {
+			rows = append(rows, r)
+			return nil
+		})
+		return rows, err
+	}
+}
@@ -0,0 +1,797 @@
+package spanner
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	compactInterval  = 5 * time.Minute
+	compactMinRetain = 1000
+	pollInterval     = time.Second
+	pollBatchSize    = 500
+
+	// compactStaleIntervals is the number of compaction intervals without a successful
+	// compaction after which compaction is reported as stale.
+	compactStaleIntervals = 3
+	// compactBatchSize is the number of revisions compacted by each transaction.
+	compactBatchSize = 1000
+	// listPageSize is the number of keys read by each query of a list.
+	listPageSize = 1000
+
+	// revisionColumns are the columns of a kine_revisions row r read by rowToEvent.
+	revisionColumns = `r.name, UNIX_MICROS(r.revision), r.created, r.deleted, r.create_revision, r.prev_revision, r.lease, r.value, r.old_value`
+)
+
+// Spanner is a log of the revisions of keys, stored in a Spanner database.
+type Spanner struct {
+	client      *client
+	broadcaster broadcaster.Broadcaster
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	notify      chan int64
+	compactTo   chan int64
+	readOnly    bool
+
+	// pollRevision is the most recent revision read by the poll loop
+	pollRevision int64
+	// lastCompact is the time in unix nanoseconds at which compaction last completed
+	lastCompact int64
+
+	compactInterval  time.Duration
+	compactMinRetain int64
+	pollInterval     time.Duration
+	pollBatchSize    int64
+}
+
+func newLog(client *client, cfg *drivers.Config) *Spanner {
+	s := &Spanner{
+		client:           client,
+		notify:           make(chan int64, 1024),
+		compactTo:        make(chan int64, 1),
+		readOnly:         cfg.ReadOnly,
+		compactInterval:  compactInterval,
+		compactMinRetain: compactMinRetain,
+		pollInterval:     pollInterval,
+		pollBatchSize:    pollBatchSize,
+	}
+	if cfg.CompactInterval > 0 {
+		s.compactInterval = cfg.CompactInterval
+	}
+	if cfg.CompactMinRetain > 0 {
+		s.compactMinRetain = cfg.CompactMinRetain
+	}
+	if cfg.PollInterval > 0 {
+		s.pollInterval = cfg.PollInterval
+	}
+	if cfg.PollBatchSize > 0 {
+		s.pollBatchSize = int64(cfg.PollBatchSize)
+	}
+	return s
+}
+
+func (s *Spanner) Start(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if s.readOnly {
+		logrus.Infof("Compaction is disabled in read-only mode")
+	}
+	return nil
+}
+
+// read calls f in a strong read-only transaction, so that all of its queries read the same
+// snapshot of the database.
+func (s *Spanner) read(ctx context.Context, f func(query queryFunc) error) error {
+	txn := s.client.data.ReadOnlyTransaction()
+	defer txn.Close()
+	return f(transactionQuery(ctx, txn))
+}
+
+// write calls f in a read-write transaction, and commits the mutations that it returns. The
+// client retries the transaction if it is aborted because it conflicted with another. The commit
+// timestamp is returned. If f returns an error, the transaction is rolled back.
+func (s *Spanner) write(ctx context.Context, f func(query queryFunc) ([]*spanner.Mutation, error)) (time.Time, error) {
+	return s.client.data.ReadWriteTransaction(ctx, func(ctx context.Context, txn *spanner.ReadWriteTransaction) error {
+		mutations, err := f(transactionQuery(ctx, txn))
+		if err != nil {
+			return err
+		}
+		return txn.BufferWrite(mutations)
+	})
+}
+
+// getMeta returns the current and compact revisions.
+func getMeta(query queryFunc) (int64, int64, error) {
+	rows, err := query(`SELECT UNIX_MICROS(revision), compact_revision FROM kine_meta WHERE id = 0`, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(rows) == 0 {
+		return 0, 0, errors.New("meta row not found")
+	}
+	var rev, compact int64
+	err = rows[0].Columns(&rev, &compact)
+	return rev, compact, err
+}
+
+func (s *Spanner) CurrentRevision(ctx context.Context) (int64, error) {
+	var rev int64
+	err := s.read(ctx, func(query queryFunc) (err error) {
+		rev, _, err = getMeta(query)
+		return err
+	})
+	return rev, err
+}
+
+// nameCondition returns the condition matching the names of keys with the prefix, or the key
+// itself if the prefix does not end with a slash.
+func nameCondition(column, prefix string) string {
+	if strings.HasSuffix(prefix, "/") {
+		return `STARTS_WITH(` + column + `, @prefix)`
+	}
+	return column + ` = @prefix`
+}
+
+// List returns the latest revision, as of the revision, of keys matching the prefix, in order of
+// their names. The latest revisions of keys are found through kine_keys; at earlier revisions,
+// the latest revision of each key is found from its history instead.
+func (s *Spanner) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
+	// as for sqllog, a start key is only used when listing, and the prefix itself is not a key
+	if strings.HasSuffix(prefix, "/") {
+		if prefix == startKey {
+			startKey = ""
+		}
+	} else {
+		startKey = ""
+	}
+
+	var (
+		rev    int64
+		events []*server.Event
+	)
+	err := s.read(ctx, func(query queryFunc) error {
+		events = nil
+		start := startKey
+		var compact int64
+		var err error
+		if rev, compact, err = getMeta(query); err != nil {
+			return err
+		}
+		if revision > 0 && revision < compact {
+			return server.ErrCompacted
+		}
+
+		var sql string
+		if revision <= 0 || revision >= rev {
+			sql = `SELECT ` + revisionColumns + `
+				FROM kine_keys AS k
+				JOIN kine_revisions AS r ON r.name = k.name AND r.revision = k.mod_revision
+				WHERE ` + nameCondition("k.name", prefix) + ` AND k.name > @start`
+			if !includeDeleted {
+				sql += ` AND NOT k.deleted`
+			}
+		} else {
+			sql = `SELECT ` + revisionColumns + `
+				FROM kine_revisions AS r
+				WHERE ` + nameCondition("r.name", prefix) + ` AND r.name > @start AND r.revision = (
+					SELECT MAX(p.revision)
+					FROM kine_revisions AS p
+					WHERE p.name = r.name AND p.revision <= TIMESTAMP_MICROS(@revision)
+				)`
+			if !includeDeleted {
+				sql += ` AND NOT r.deleted`
+			}
+		}
+		sql += ` ORDER BY r.name LIMIT @limit`
+
+		// keys are read in pages, each starting after the last key of the previous page
+		for {
+			pageSize := int64(listPageSize)
+			if limit > 0 && limit-int64(len(events)) < pageSize {
+				pageSize = limit - int64(len(events))
+			}
+			params := map[string]interface{}{
+				"prefix": prefix,
+				"start":  start,
+				"limit":  pageSize,
+			}
+			if strings.Contains(sql, "@revision") {
+				params["revision"] = revision
+			}
+			rows, err := query(sql, params)
+			if err != nil {
+				return err
+			}
+			for _, r := range rows {
+				event, err := rowToEvent(r)
+				if err != nil {
+					return err
+				}
+				events = append(events, event)
+			}
+			if int64(len(rows)) < pageSize || (limit > 0 && int64(len(events)) >= limit) {
+				return nil
+			}
+			start = events[len(events)-1].KV.Key
+		}
+	})
+	if err == server.ErrCompacted {
+		return rev, nil, err
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	select {
+	case s.notify <- rev:
+	default:
+	}
+	return rev, events, nil
+}
+
+// After returns up to limit events after the revision for keys matching the prefix, in order of
+// their revisions. Keys with any of the prefixes excluded by server.WithWatchExclusions are
+// not returned.
+func (s *Spanner) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	rev, compact, events, err := s.after(ctx, prefix, server.WatchExclusions(ctx), revision, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+	if revision > 0 && revision < compact {
+		return rev, nil, server.ErrCompacted
+	}
+	return rev, events, nil
+}
+
+// after returns the current and compact revisions, and up to limit events after the revision for
+// keys matching the prefix, or all keys if the prefix is empty, but not the excluded prefixes.
+func (s *Spanner) after(ctx context.Context, prefix string, excluded []string, revision, limit int64) (int64, int64, []*server.Event, error) {
+	sql := `SELECT ` + revisionColumns + `
+		FROM kine_revisions@{FORCE_INDEX=kine_revisions_revision_index} AS r
+		WHERE r.revision > TIMESTAMP_MICROS(@revision)`
+	params := map[string]interface{}{"revision": revision}
+	if prefix != "" {
+		sql += ` AND ` + nameCondition("r.name", prefix)
+		params["prefix"] = prefix
+	}
+	if len(excluded) > 0 {
+		sql += ` AND NOT EXISTS (SELECT 1 FROM UNNEST(@excluded) AS e WHERE STARTS_WITH(r.name, e))`
+		params["excluded"] = excluded
+	}
+	sql += ` ORDER BY r.revision`
+	if limit > 0 {
+		sql += ` LIMIT @limit`
+		params["limit"] = limit
+	}
+
+	var (
+		rev, compact int64
+		events       []*server.Event
+	)
+	err := s.read(ctx, func(query queryFunc) error {
+		var err error
+		if rev, compact, err = getMeta(query); err != nil {
+			return err
+		}
+		rows, err := query(sql, params)
+		if err != nil {
+			return err
+		}
+		events, err = rowsToEvents(rows)
+		return err
+	})
+	return rev, compact, events, err
+}
+
+// Count returns the current revision and the number of keys matching the prefix that are not
+// deleted.
+func (s *Spanner) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	var rev, count int64
+	err := s.read(ctx, func(query queryFunc) error {
+		var err error
+		if rev, _, err = getMeta(query); err != nil {
+			return err
+		}
+		rows, err := query(`SELECT COUNT(*) FROM kine_keys AS k WHERE `+nameCondition("k.name", prefix)+` AND NOT k.deleted`,
+			map[string]interface{}{"prefix": prefix})
+		if err != nil {
+			return err
+		}
+		return rows[0].Columns(&count)
+	})
+	return rev, count, err
+}
+
+// Append writes the event, in a transaction that also replaces the latest revision of the key and
+// the current revision, on condition that the latest revision of the key is that which the event
+// replaces. server.ErrKeyExists is returned if it is not. The revision of the event is the commit
+// timestamp of the transaction.
+func (s *Spanner) Append(ctx context.Context, event *server.Event) (int64, error) {
+	e := *event
+	if e.KV == nil {
+		e.KV = &server.KeyValue{}
+	}
+	if e.PrevKV == nil {
+		e.PrevKV = &server.KeyValue{}
+	}
+
+	commitTime, err := s.write(ctx, func(query queryFunc) ([]*spanner.Mutation, error) {
+		rows, err := query(`SELECT UNIX_MICROS(mod_revision), deleted FROM kine_keys WHERE name = @name`,
+			map[string]interface{}{"name": e.KV.Key})
+		if err != nil {
+			return nil, err
+		}
+		var (
+			latest  int64
+			deleted bool
+		)
+		exists := len(rows) > 0
+		if exists {
+			if err := rows[0].Columns(&latest, &deleted); err != nil {
+				return nil, err
+			}
+		}
+
+		// a key is created if it has no latest revision, or its latest revision is the deletion
+		// that the event replaces; otherwise the latest revision must be that which it replaces
+		replaces := exists && latest == e.PrevKV.ModRevision
+		switch {
+		case e.Create && e.PrevKV.Key == "":
+			if exists {
+				return nil, server.ErrKeyExists
+			}
+		case e.Create:
+			if !replaces || !deleted {
+				return nil, server.ErrKeyExists
+			}
+		case !replaces:
+			return nil, server.ErrKeyExists
+		}
+
+		return []*spanner.Mutation{
+			spanner.InsertOrUpdate("kine_keys", []string{"name", "mod_revision", "deleted", "lease"},
+				[]interface{}{e.KV.Key, spanner.CommitTimestamp, e.Delete, e.KV.Lease}),
+			spanner.Insert("kine_revisions", []string{"name", "revision", "created", "deleted", "create_revision", "prev_revision", "lease", "value", "old_value"},
+				[]interface{}{e.KV.Key, spanner.CommitTimestamp, e.Create, e.Delete, e.KV.CreateRevision, e.PrevKV.ModRevision, e.KV.Lease, e.KV.Value, e.PrevKV.Value}),
+			spanner.Update("kine_meta", []string{"id", "revision"}, []interface{}{int64(0), spanner.CommitTimestamp}),
+		}, nil
+	})
+	if errors.Is(err, server.ErrKeyExists) {
+		return 0, server.ErrKeyExists
+	} else if err != nil {
+		return 0, err
+	}
+
+	rev := commitTime.UnixMicro()
+	select {
+	case s.notify <- rev:
+	default:
+	}
+	return rev, nil
+}
+
+// DeleteLease deletes all keys attached to the lease whose latest revision is not newer than the
+// revision, and returns the number of keys deleted.
+func (s *Spanner) DeleteLease(ctx context.Context, lease, revision int64) (int64, error) {
+	var events []*server.Event
+	err := s.read(ctx, func(query queryFunc) error {
+		rows, err := query(`SELECT `+revisionColumns+`
+			FROM kine_keys@{FORCE_INDEX=kine_keys_lease_index} AS k
+			JOIN kine_revisions AS r ON r.name = k.name AND r.revision = k.mod_revision
+			WHERE k.lease = @lease AND NOT k.deleted AND k.mod_revision <= TIMESTAMP_MICROS(@revision)`,
+			map[string]interface{}{"lease": lease, "revision": revision})
+		if err != nil {
+			return err
+		}
+		events, err = rowsToEvents(rows)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for _, event := range events {
+		_, err := s.Append(ctx, &server.Event{
+			Delete: true,
+			KV:     event.KV,
+			PrevKV: event.KV,
+		})
+		if err == server.ErrKeyExists {
+			// the key was updated since it was read, and is no longer attached to the lease
+			continue
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// WatchProgressRevision returns the most recent revision read by the poll loop.
+func (s *Spanner) WatchProgressRevision() int64 {
+	return atomic.LoadInt64(&s.pollRevision)
+}
+
+func (s *Spanner) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	res := make(chan []*server.Event, 100)
+	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
+	if err != nil {
+		logrus.Errorf("Failed to start watch: %v", err)
+		close(res)
+		return res
+	}
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+
+	go func() {
+		defer close(res)
+		for i := range values {
+			eventList := i.([]*server.Event)
+			filtered := make([]*server.Event, 0, len(eventList))
+			for _, event := range eventList {
+				if (checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) || event.KV.Key == prefix {
+					filtered = append(filtered, event)
+				}
+			}
+			if len(filtered) > 0 {
+				res <- filtered
+			}
+		}
+	}()
+
+	return res
+}
+
+func (s *Spanner) startWatch() (chan interface{}, error) {
+	var pollStart int64
+	err := s.read(s.ctx, func(query queryFunc) (err error) {
+		_, pollStart, err = getMeta(query)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := make(chan interface{})
+	// as for sqllog, compaction and polling are started together, so that watches start at the
+	// oldest revision
+	if !s.readOnly {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.compactor()
+		}()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.poll(c, pollStart)
+	}()
+	return c, nil
+}
+
+// poll sends the events after the last revision to watches, in order of their revisions. Unlike
+// the SQL backends, there is no need to wait for gaps to be filled, as strong reads include all
+// writes committed before them, and writes are never committed with earlier revisions.
+func (s *Spanner) poll(result chan interface{}, pollStart int64) {
+	last := pollStart
+
+	wait := time.NewTicker(s.pollInterval)
+	defer wait.Stop()
+	defer close(result)
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case check := <-s.notify:
+			if check <= last {
+				continue
+			}
+		case <-wait.C:
+		}
+
+		_, _, events, err := s.after(s.ctx, "", nil, last, s.pollBatchSize)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logrus.Errorf("fail to list latest changes: %v", err)
+			}
+			continue
+		}
+		if len(events) == 0 {
+			continue
+		}
+
+		last = events[len(events)-1].KV.ModRevision
+		atomic.StoreInt64(&s.pollRevision, last)
+		metrics.CurrentRevision.Set(float64(last))
+		result <- events
+	}
+}
+
+// Compact schedules compaction to the given revision, which must not be newer than the current
+// revision.
+func (s *Spanner) Compact(ctx context.Context, revision int64) error {
+	if s.readOnly {
+		return server.ErrReadOnly
+	}
+	var rev, compact int64
+	err := s.read(ctx, func(query queryFunc) (err error) {
+		rev, compact, err = getMeta(query)
+		return err
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to get current revision")
+	}
+	if revision > rev {
+		return server.ErrFutureRev
+	}
+	if revision <= compact {
+		return server.ErrCompacted
+	}
+	select {
+	case <-s.compactTo:
+	default:
+	}
+	select {
+	case s.compactTo <- revision:
+	default:
+	}
+	return nil
+}
+
+// compactor periodically compacts to all but the most recent compactMinRetain revisions, or to
+// the revision requested by Compact. As revisions are not consecutive, the target revision is
+// found by counting back from the newest revision.
+func (s *Spanner) compactor() {
+	t := time.NewTicker(s.compactInterval)
+	defer t.Stop()
+	for {
+		requested := int64(0)
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-t.C:
+		case requested = <-s.compactTo:
+		}
+
+		var compact, target int64
+		err := s.read(s.ctx, func(query queryFunc) error {
+			var err error
+			if _, compact, err = getMeta(query); err != nil {
+				return err
+			}
+			target = requested
+			if target > 0 {
+				return nil
+			}
+			rows, err := query(`SELECT UNIX_MICROS(revision)
+				FROM kine_revisions@{FORCE_INDEX=kine_revisions_revision_index}
+				ORDER BY revision DESC
+				LIMIT 1 OFFSET @retain`, map[string]interface{}{"retain": s.compactMinRetain})
+			if err == nil && len(rows) > 0 {
+				err = rows[0].Columns(&target)
+			}
+			return err
+		})
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logrus.Errorf("Compact failed to get target revision: %v", err)
+				metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			}
+			continue
+		}
+		if target <= compact {
+			continue
+		}
+
+		deleted, err := s.compact(s.ctx, compact, target)
+		metrics.CompactDeletedRows.Observe(float64(deleted))
+		if err != nil {
+			if s.ctx.Err() == nil {
+				logrus.Errorf("Compact failed: %v", err)
+				metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+			}
+			continue
+		}
+		atomic.StoreInt64(&s.lastCompact, time.Now().UnixNano())
+		metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+		logrus.Infof("COMPACT compacted from %d to %d, deleting %d rows", compact, target, deleted)
+	}
+}
+
+// compact deletes the revisions replaced by revisions after the compact revision, up to the
+// target revision, and the deletions in that range, as the SQL compaction does. Keys whose latest
+// revision is a deletion in that range are deleted with all of their revisions. Each batch of
+// revisions is compacted in a transaction, as the number of mutations in a commit is limited.
+func (s *Spanner) compact(ctx context.Context, compact, target int64) (int64, error) {
+	var deleted int64
+	for from := compact; from < target; {
+		var rows []*spanner.Row
+		err := s.read(ctx, func(query queryFunc) (err error) {
+			rows, err = query(`SELECT r.name, UNIX_MICROS(r.revision), r.created, r.deleted, r.prev_revision
+				FROM kine_revisions@{FORCE_INDEX=kine_revisions_revision_index} AS r
+				WHERE r.revision > TIMESTAMP_MICROS(@from) AND r.revision <= TIMESTAMP_MICROS(@target)
+				ORDER BY r.revision
+				LIMIT @limit`, map[string]interface{}{"from": from, "target": target, "limit": int64(compactBatchSize)})
+			return err
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		var (
+			keys       []spanner.Key
+			tombstones []string
+			revision   int64
+		)
+		for _, r := range rows {
+			var (
+				name              string
+				created, isDelete bool
+				prev              int64
+			)
+			if err := r.Columns(&name, &revision, &created, &isDelete, &prev); err != nil {
+				return deleted, err
+			}
+			if prev > 0 && !created {
+				keys = append(keys, spanner.Key{name, time.UnixMicro(prev)})
+			}
+			if isDelete {
+				keys = append(keys, spanner.Key{name, time.UnixMicro(revision)})
+				tombstones = append(tombstones, name)
+			}
+		}
+
+		if len(keys) == 0 {
+			from = revision
+			continue
+		}
+		_, err = s.write(ctx, func(query queryFunc) ([]*spanner.Mutation, error) {
+			mutations := []*spanner.Mutation{spanner.Delete("kine_revisions", spanner.KeySetFromKeys(keys...))}
+			if len(tombstones) == 0 {
+				return mutations, nil
+			}
+			// keys that have not been created again since their deletion are deleted, along with
+			// any remaining revisions
+			rows, err := query(`SELECT name FROM kine_keys
+				WHERE name IN UNNEST(@names) AND deleted AND mod_revision <= TIMESTAMP_MICROS(@target)`,
+				map[string]interface{}{"names": tombstones, "target": target})
+			if err != nil {
+				return nil, err
+			}
+			if len(rows) > 0 {
+				names := make([]spanner.Key, len(rows))
+				for i, r := range rows {
+					var name string
+					if err := r.Columns(&name); err != nil {
+						return nil, err
+					}
+					names[i] = spanner.Key{name}
+				}
+				mutations = append(mutations, spanner.Delete("kine_keys", spanner.KeySetFromKeys(names...)))
+			}
+			return mutations, nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(len(keys))
+		from = revision
+	}
+
+	_, err := s.write(ctx, func(query queryFunc) ([]*spanner.Mutation, error) {
+		_, current, err := getMeta(query)
+		if err != nil || current >= target {
+			return nil, err
+		}
+		return []*spanner.Mutation{spanner.Update("kine_meta", []string{"id", "compact_revision"}, []interface{}{int64(0), target})}, nil
+	})
+	return deleted, err
+}
+
+// DbSize returns the size of the tables, from the table size statistics that Spanner updates
+// hourly.
+func (s *Spanner) DbSize(ctx context.Context) (int64, error) {
+	var size int64
+	err := s.read(ctx, func(query queryFunc) error {
+		rows, err := query(`SELECT SUM(used_bytes)
+			FROM SPANNER_SYS.TABLE_SIZES_STATS_1HOUR
+			WHERE
+				interval_end = (SELECT MAX(interval_end) FROM SPANNER_SYS.TABLE_SIZES_STATS_1HOUR) AND
+				table_name IN ('kine_keys', 'kine_revisions')`, nil)
+		if err == nil && len(rows) > 0 {
+			var used spanner.NullInt64
+			err = rows[0].Columns(&used)
+			size = used.Int64
+		}
+		return err
+	})
+	return size, err
+}
+
+// Health checks that the database is reachable.
+func (s *Spanner) Health(ctx context.Context) (*server.HealthStatus, error) {
+	var rev, compact int64
+	err := s.read(ctx, func(query queryFunc) (err error) {
+		rev, compact, err = getMeta(query)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current revision")
+	}
+	status := &server.HealthStatus{
+		CurrentRevision: rev,
+		CompactRevision: compact,
+	}
+	if lastCompact := atomic.LoadInt64(&s.lastCompact); lastCompact != 0 {
+		status.LastCompact = time.Unix(0, lastCompact)
+		status.CompactStale = time.Since(status.LastCompact) > compactStaleIntervals*s.compactInterval
+	}
+	return status, nil
+}
+
+// Close stops the compaction and polling loops, and closes the clients, deleting their sessions.
+// If ctx is done before the loops have stopped, Close returns anyway.
+func (s *Spanner) Close(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for compaction and polling to stop: %v", ctx.Err())
+	}
+	s.client.close()
+	return nil
+}
+
+// rowToEvent returns the event for a row of revisionColumns.
+func rowToEvent(r *spanner.Row) (*server.Event, error) {
+	event := &server.Event{
+		KV:     &server.KeyValue{},
+		PrevKV: &server.KeyValue{},
+	}
+	err := r.Columns(&event.KV.Key, &event.KV.ModRevision, &event.Create, &event.Delete, &event.KV.CreateRevision,
+		&event.PrevKV.ModRevision, &event.KV.Lease, &event.KV.Value, &event.PrevKV.Value)
+	if err != nil {
+		return nil, err
+	}
+	if event.Create {
+		event.KV.CreateRevision = event.KV.ModRevision
+		event.PrevKV = nil
+	}
+	return event, nil
+}
+
+func rowsToEvents(rows []*spanner.Row) ([]*server.Event, error) {
+	events := make([]*server.Event, len(rows))
+	for i, r := range rows {
+		event, err := rowToEvent(r)
+		if err != nil {
+			return nil, err
+		}
+		events[i] = event
+	}
+	return events, nil
+}
@@ -0,0 +1,258 @@
+//go:build test
+// +build test
+
+package spanner
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	databasepb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+)
+
+// testEndpointEnv names the environment variable holding the endpoint of the Spanner database to
+// test against, as for drivertest.SpannerEndpointEnv.
+const testEndpointEnv = "KINE_TEST_SPANNER_ENDPOINT"
+
+// newTestLog returns a started log on a new database in the instance of the database named by
+// testEndpointEnv, which is dropped when the test completes. As a database is created for each
+// test, these tests are only run against the emulator, named by SPANNER_EMULATOR_HOST.
+func newTestLog(t *testing.T) *Spanner {
+	t.Helper()
+	endpoint := os.Getenv(testEndpointEnv)
+	if endpoint == "" || os.Getenv("SPANNER_EMULATOR_HOST") == "" {
+		t.Skipf("%s and SPANNER_EMULATOR_HOST are not set", testEndpointEnv)
+	}
+	c, err := parseDSN(strings.TrimPrefix(endpoint, "spanner://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := c.database[:strings.Index(c.database, "/databases/")]
+	c.database = fmt.Sprintf("%s/databases/kine_test_%d", instance, time.Now().UnixNano())
+
+	ctx := context.Background()
+	client, err := newClient(ctx, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newLog(client, &drivers.Config{})
+	t.Cleanup(func() {
+		if err := client.admin.DropDatabase(context.Background(), &databasepb.DropDatabaseRequest{Database: c.database}); err != nil {
+			t.Logf("Failed to drop database %s: %v", c.database, err)
+		}
+		client.close()
+	})
+	if err := s.setup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.wg.Wait()
+	})
+	return s
+}
+
+func createEvent(key, value string) *server.Event {
+	return &server.Event{
+		Create: true,
+		KV:     &server.KeyValue{Key: key, Value: []byte(value)},
+		PrevKV: &server.KeyValue{},
+	}
+}
+
+func updateEvent(key, value string, createRev, prevRev int64) *server.Event {
+	return &server.Event{
+		KV:     &server.KeyValue{Key: key, Value: []byte(value), CreateRevision: createRev},
+		PrevKV: &server.KeyValue{Key: key, ModRevision: prevRev},
+	}
+}
+
+func deleteEvent(key string, createRev, prevRev int64) *server.Event {
+	kv := &server.KeyValue{Key: key, CreateRevision: createRev, ModRevision: prevRev}
+	return &server.Event{Delete: true, KV: kv, PrevKV: kv}
+}
+
+func appendEvent(t *testing.T, s *Spanner, event *server.Event) int64 {
+	t.Helper()
+	rev, err := s.Append(context.Background(), event)
+	if err != nil {
+		t.Fatalf("Append of %s failed: %v", event.KV.Key, err)
+	}
+	return rev
+}
+
+func TestConditionalWrites(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLog(t)
+
+	createRev := appendEvent(t, s, createEvent("/a", "1"))
+	if _, err := s.Append(ctx, createEvent("/a", "1")); err != server.ErrKeyExists {
+		t.Fatalf("create of existing key returned %v, want %v", err, server.ErrKeyExists)
+	}
+
+	// an update must replace the latest revision of the key
+	updateRev := appendEvent(t, s, updateEvent("/a", "2", createRev, createRev))
+	if _, err := s.Append(ctx, updateEvent("/a", "3", createRev, createRev)); err != server.ErrKeyExists {
+		t.Fatalf("update of a replaced revision returned %v, want %v", err, server.ErrKeyExists)
+	}
+	deleteRev := appendEvent(t, s, deleteEvent("/a", createRev, updateRev))
+
+	// a deleted key is created again by replacing its deletion
+	if _, err := s.Append(ctx, createEvent("/a", "4")); err != server.ErrKeyExists {
+		t.Fatalf("create of deleted key without its deletion returned %v, want %v", err, server.ErrKeyExists)
+	}
+	recreate := createEvent("/a", "4")
+	recreate.PrevKV = &server.KeyValue{Key: "/a", ModRevision: deleteRev}
+	recreateRev := appendEvent(t, s, recreate)
+
+	_, events, err := s.List(ctx, "/a", "", 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].KV.Value) != "4" || events[0].KV.ModRevision != recreateRev {
+		t.Fatalf("List returned %v, want /a = 4 at %d", events, recreateRev)
+	}
+	_, events, err = s.List(ctx, "/a", "", 0, updateRev, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || string(events[0].KV.Value) != "2" {
+		t.Fatalf("List at revision %d returned %v, want /a = 2", updateRev, events)
+	}
+}
+
+func TestRevisionsOrdered(t *testing.T) {
+	const writers, writes = 4, 10
+	ctx := context.Background()
+	s := newTestLog(t)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		revs []int64
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				rev, err := s.Append(ctx, createEvent(fmt.Sprintf("/revs/%d/%d", w, i), "v"))
+				if err != nil {
+					t.Errorf("Append failed: %v", err)
+					return
+				}
+				mu.Lock()
+				revs = append(revs, rev)
+				mu.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// revisions are commit timestamps, which are unique, and are read in the order of commit
+	sort.Slice(revs, func(i, j int) bool { return revs[i] < revs[j] })
+	for i := 1; i < len(revs); i++ {
+		if revs[i] == revs[i-1] {
+			t.Fatalf("revision %d was assigned twice", revs[i])
+		}
+	}
+	if rev, err := s.CurrentRevision(ctx); err != nil || rev != revs[len(revs)-1] {
+		t.Fatalf("CurrentRevision returned %d, %v, want %d", rev, err, revs[len(revs)-1])
+	}
+
+	_, events, err := s.After(ctx, "/revs/", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(revs) {
+		t.Fatalf("After returned %d events, want %d", len(events), len(revs))
+	}
+	for i, event := range events {
+		if event.KV.ModRevision != revs[i] {
+			t.Fatalf("After returned event %d at revision %d, want %d", i, event.KV.ModRevision, revs[i])
+		}
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	ctx := context.Background()
+	s := newTestLog(t)
+
+	// /a has five revisions, /b is created and deleted, and /c is created
+	aCreate := appendEvent(t, s, createEvent("/a", "0"))
+	aRev := aCreate
+	for i := 1; i < 5; i++ {
+		aRev = appendEvent(t, s, updateEvent("/a", fmt.Sprint(i), aCreate, aRev))
+	}
+	bCreate := appendEvent(t, s, createEvent("/b", "b"))
+	bDelete := appendEvent(t, s, deleteEvent("/b", bCreate, bCreate))
+	appendEvent(t, s, createEvent("/c", "c"))
+
+	// the four replaced revisions of /a, and both revisions of /b
+	deleted, err := s.compact(ctx, 0, bDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 6 {
+		t.Errorf("compaction deleted %d rows, want 6", deleted)
+	}
+
+	revisions := map[string]int64{}
+	var keys []string
+	err = s.read(ctx, func(query queryFunc) error {
+		rows, err := query(`SELECT name, COUNT(*) FROM kine_revisions GROUP BY name`, nil)
+		if err != nil {
+			return err
+		}
+		for _, r := range rows {
+			var (
+				name  string
+				count int64
+			)
+			if err := r.Columns(&name, &count); err != nil {
+				return err
+			}
+			revisions[name] = count
+		}
+		if rows, err = query(`SELECT name FROM kine_keys ORDER BY name`, nil); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			var name string
+			if err := r.Columns(&name); err != nil {
+				return err
+			}
+			keys = append(keys, name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revisions["/a"] != 1 || revisions["/b"] != 0 || revisions["/c"] != 1 {
+		t.Errorf("revisions after compaction = %v, want one of /a and /c", revisions)
+	}
+	if strings.Join(keys, ",") != "/a,/c" {
+		t.Errorf("keys after compaction = %v, want [/a /c]", keys)
+	}
+
+	if _, _, err := s.List(ctx, "/", "", 0, aCreate, false); err != server.ErrCompacted {
+		t.Errorf("List at compacted revision returned %v, want %v", err, server.ErrCompacted)
+	}
+	if err := s.Compact(ctx, bDelete); err != server.ErrCompacted {
+		t.Errorf("Compact to the compact revision returned %v, want %v", err, server.ErrCompacted)
+	}
+}
@@ -0,0 +1,158 @@
+// Package spanner implements a kine backend on a Google Cloud Spanner database, for globally
+// replicated Kubernetes state.
+//
+// Revisions are the commit timestamps of writes, in microseconds since the epoch. Every write
+// also updates the meta row holding the current revision, so that writes are serialized and
+// their commit timestamps are unique and increase in commit order. As strong reads see all writes
+// with commit timestamps before their read timestamp, revisions are never seen out of order, even
+// though they are not consecutive. The latest revision of each key is stored in the kine_keys
+// table, with its revisions in the kine_revisions table interleaved in it, so that they are stored
+// together.
+package spanner
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	databasepb "google.golang.org/genproto/googleapis/spanner/admin/database/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// schemaUpdateTimeout bounds the time waited for the database to be created, or its schema
+	// updated.
+	schemaUpdateTimeout = 10 * time.Minute
+)
+
+var (
+	// The revision index orders revisions for watches and compaction. Indexing commit timestamps
+	// concentrates writes on one split of the index, but writes are serialized anyway.
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_meta (
+			id INT64 NOT NULL,
+			revision TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp = true),
+			compact_revision INT64 NOT NULL,
+		) PRIMARY KEY (id)`,
+		`CREATE TABLE IF NOT EXISTS kine_keys (
+			name STRING(MAX) NOT NULL,
+			mod_revision TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp = true),
+			deleted BOOL NOT NULL,
+			lease INT64 NOT NULL,
+		) PRIMARY KEY (name)`,
+		`CREATE TABLE IF NOT EXISTS kine_revisions (
+			name STRING(MAX) NOT NULL,
+			revision TIMESTAMP NOT NULL OPTIONS (allow_commit_timestamp = true),
+			created BOOL NOT NULL,
+			deleted BOOL NOT NULL,
+			create_revision INT64 NOT NULL,
+			prev_revision INT64 NOT NULL,
+			lease INT64 NOT NULL,
+			value BYTES(MAX),
+			old_value BYTES(MAX),
+		) PRIMARY KEY (name, revision DESC),
+		INTERLEAVE IN PARENT kine_keys ON DELETE CASCADE`,
+		`CREATE INDEX IF NOT EXISTS kine_revisions_revision_index ON kine_revisions (revision)`,
+		`CREATE INDEX IF NOT EXISTS kine_keys_lease_index ON kine_keys (lease)`,
+	}
+	databaseRegexp = regexp.MustCompile(`^projects/[^/]+/instances/[^/]+/databases/([^/]+)$`)
+)
+
+type config struct {
+	database string
+	endpoint string
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	c, err := parseDSN(cfg.DataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newClient(ctx, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create Spanner client")
+	}
+
+	log := newLog(client, cfg)
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping Spanner schema setup in read-only mode")
+	} else if err := log.setup(ctx); err != nil {
+		client.close()
+		return nil, errors.Wrap(err, "setting up Spanner database")
+	}
+	return logstructured.New(log, cfg)
+}
+
+// parseDSN parses a DSN such as projects/p/instances/i/databases/d?endpoint=spanner.googleapis.com:443,
+// naming the database. The endpoint defaults to that of Spanner.
+func parseDSN(dataSourceName string) (*config, error) {
+	database, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		database, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse DSN parameters")
+	}
+
+	c := &config{
+		database: strings.Trim(database, "/"),
+		endpoint: params.Get("endpoint"),
+	}
+	if !databaseRegexp.MatchString(c.database) {
+		return nil, fmt.Errorf("invalid Spanner database %q: must be projects/<project>/instances/<instance>/databases/<database>", c.database)
+	}
+	return c, nil
+}
+
+// setup creates the database with the schema if it does not exist, or else applies the schema,
+// which only creates the tables and indexes that do not already exist, and creates the meta row.
+func (s *Spanner) setup(ctx context.Context) error {
+	logrus.Infof("Configuring database schema, this may take a moment...")
+	ctx, cancel := context.WithTimeout(ctx, schemaUpdateTimeout)
+	defer cancel()
+
+	update, err := s.client.admin.UpdateDatabaseDdl(ctx, &databasepb.UpdateDatabaseDdlRequest{
+		Database:   s.client.database,
+		Statements: schema,
+	})
+	if err == nil {
+		err = update.Wait(ctx)
+	}
+	if status.Code(err) == codes.NotFound {
+		instance := s.client.database[:strings.Index(s.client.database, "/databases/")]
+		name := databaseRegexp.FindStringSubmatch(s.client.database)[1]
+		logrus.Infof("Creating Spanner database %s", name)
+		create, createErr := s.client.admin.CreateDatabase(ctx, &databasepb.CreateDatabaseRequest{
+			Parent:          instance,
+			CreateStatement: "CREATE DATABASE `" + name + "`",
+			ExtraStatements: schema,
+		})
+		if createErr == nil {
+			_, createErr = create.Wait(ctx)
+		}
+		err = createErr
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.data.Apply(ctx, []*spanner.Mutation{
+		spanner.Insert("kine_meta", []string{"id", "revision", "compact_revision"}, []interface{}{int64(0), spanner.CommitTimestamp, int64(0)}),
+	})
+	if err != nil && spanner.ErrCode(err) != codes.AlreadyExists {
+		return errors.Wrap(err, "failed to create meta row")
+	}
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
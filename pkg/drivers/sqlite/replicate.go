@@ -0,0 +1,508 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// replicateSyncInterval is the interval at which new frames of the WAL are copied to the replica.
+	replicateSyncInterval = time.Second
+	// replicateCheckpointSize is the size of the WAL after which it is checkpointed and restarted
+	// by the replicator. The WAL cannot otherwise be restarted while it is being replicated.
+	replicateCheckpointSize = 4 << 20
+	// replicateSnapshotInterval is the interval at which a new generation is started with a
+	// snapshot of the database, so that restoring does not replay an unbounded number of frames.
+	// The current and previous generations are retained.
+	replicateSnapshotInterval = 24 * time.Hour
+
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682
+)
+
+// errWALMismatch is returned when the WAL has been restarted without the replicator copying all
+// of its frames, so that replication must start again from a new snapshot.
+var errWALMismatch = errors.New("WAL was restarted before it was replicated")
+
+// replicator continuously copies the database to object storage, as a series of generations.
+// Each generation starts with a snapshot of the database, followed by the committed frames of the
+// WAL, in segments named for the WAL index, incremented each time the WAL is restarted, and their
+// offset within it:
+//
+//	generations/<generation>/snapshot.db.gz
+//	generations/<generation>/wal/<index>/<offset>.wal.gz
+//
+// The replicator holds a read transaction, so that the WAL is not restarted, and so overwritten,
+// until all of its frames have been copied. It restarts the WAL itself once the WAL has grown.
+type replicator struct {
+	db     *sql.DB
+	path   string
+	client *s3Client
+
+	// conn holds the read transaction, when one is open
+	conn *sql.Conn
+
+	generation   string
+	snapshotTime time.Time
+	index        int
+	// pos is the offset of the WAL up to which it has been copied, and salt and checksum are
+	// those of the WAL header and the last copied frame
+	pos           int64
+	salt          []byte
+	order         binary.ByteOrder
+	pageSize      int64
+	checksum      [2]uint32
+	expectRestart bool
+}
+
+func newReplicator(dataSourceName, path string, client *s3Client) (*replicator, error) {
+	// connections are opened separately from those of the dialect, so that holding the read
+	// transaction does not take a connection from the pool
+	db, err := sql.Open("sqlite3", dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	return &replicator{
+		db:     db,
+		path:   path,
+		client: client,
+	}, nil
+}
+
+// run replicates the database until the context is done.
+func (r *replicator) run(ctx context.Context) {
+	defer r.db.Close()
+	defer r.endRead()
+
+	logrus.Infof("Replicating SQLite database %s to object storage", r.path)
+	ticker := time.NewTicker(replicateSyncInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		switch {
+		case r.generation == "" || time.Since(r.snapshotTime) > replicateSnapshotInterval:
+			err = r.startGeneration(ctx)
+		default:
+			if err = r.sync(ctx); err == nil && r.pos > replicateCheckpointSize {
+				err = r.checkpoint(ctx)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errWALMismatch {
+			logrus.Warnf("Starting a new generation of the SQLite replica, as the WAL was restarted before it was replicated")
+			r.generation = ""
+		} else if err != nil {
+			logrus.Warnf("Failed to replicate SQLite database: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// startGeneration truncates the WAL and copies the database, holding a write lock so that it
+// is consistent, and uploads the copy as the snapshot of a new generation. Generations older
+// than the previous one are then deleted.
+func (r *replicator) startGeneration(ctx context.Context) error {
+	if err := r.endRead(); err != nil {
+		return err
+	}
+	var busy, pages, checkpointed int64
+	if err := r.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed); err != nil {
+		return errors.Wrap(err, "failed to checkpoint WAL")
+	}
+	if busy != 0 {
+		return errors.New("failed to checkpoint WAL, as the database is busy")
+	}
+
+	data, err := r.withWriteLock(ctx, func() ([]byte, error) {
+		if info, err := os.Stat(r.path + "-wal"); err == nil && info.Size() > 0 {
+			return nil, errors.New("WAL was written to while being truncated")
+		}
+		return os.ReadFile(r.path)
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	generation := fmt.Sprintf("%016x", now.UnixNano())
+	if err := r.client.put(ctx, "generations/"+generation+"/snapshot.db.gz", gzipBytes(data)); err != nil {
+		return errors.Wrap(err, "failed to upload snapshot")
+	}
+	logrus.Infof("Started generation %s of the SQLite replica with a snapshot of %d bytes", generation, len(data))
+
+	r.generation = generation
+	r.snapshotTime = now
+	r.index = 0
+	r.pos = 0
+	r.salt = nil
+	r.expectRestart = false
+
+	if err := r.prune(ctx); err != nil {
+		logrus.Warnf("Failed to delete old generations of the SQLite replica: %v", err)
+	}
+	return nil
+}
+
+// sync copies the frames of committed transactions that have been written to the WAL since it
+// was last copied.
+func (r *replicator) sync(ctx context.Context) error {
+	f, err := os.Open(r.path + "-wal")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(f, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the WAL is empty until the first transaction after it has been truncated
+		return nil
+	} else if err != nil {
+		return err
+	}
+	magic := binary.BigEndian.Uint32(header)
+	if magic&^1 != walMagic {
+		return fmt.Errorf("invalid WAL header magic %x", magic)
+	}
+
+	if salt := header[16:24]; r.salt == nil || !bytes.Equal(salt, r.salt) {
+		if r.salt != nil {
+			if !r.expectRestart {
+				return errWALMismatch
+			}
+			if r.pos > 0 {
+				r.index++
+			}
+		}
+		r.order = binary.ByteOrder(binary.LittleEndian)
+		if magic&1 != 0 {
+			r.order = binary.BigEndian
+		}
+		s1, s2 := walChecksum(r.order, header[:24], 0, 0)
+		if s1 != binary.BigEndian.Uint32(header[24:]) || s2 != binary.BigEndian.Uint32(header[28:]) {
+			// the header is being written
+			return nil
+		}
+		r.salt = append([]byte(nil), salt...)
+		r.pageSize = int64(binary.BigEndian.Uint32(header[8:]))
+		r.checksum = [2]uint32{s1, s2}
+		r.pos = 0
+		r.expectRestart = false
+	}
+
+	start := r.pos
+	if start == 0 {
+		start = walHeaderSize
+	}
+	data, err := io.ReadAll(io.NewSectionReader(f, start, 1<<62))
+	if err != nil {
+		return err
+	}
+
+	// frames are only copied up to the last valid commit frame, as frames may still be being written
+	frameSize := walFrameHeaderSize + r.pageSize
+	s1, s2 := r.checksum[0], r.checksum[1]
+	committed, checksum := int64(0), r.checksum
+	for off := int64(0); off+frameSize <= int64(len(data)); off += frameSize {
+		frame := data[off : off+frameSize]
+		if !bytes.Equal(frame[8:16], r.salt) {
+			break
+		}
+		s1, s2 = walChecksum(r.order, frame[:8], s1, s2)
+		s1, s2 = walChecksum(r.order, frame[walFrameHeaderSize:], s1, s2)
+		if s1 != binary.BigEndian.Uint32(frame[16:]) || s2 != binary.BigEndian.Uint32(frame[20:]) {
+			break
+		}
+		if binary.BigEndian.Uint32(frame[4:]) != 0 {
+			committed, checksum = off+frameSize, [2]uint32{s1, s2}
+		}
+	}
+	if committed == 0 {
+		return nil
+	}
+
+	segment := data[:committed]
+	if r.pos == 0 {
+		segment = append(header, segment...)
+	}
+	key := fmt.Sprintf("generations/%s/wal/%08x/%016x.wal.gz", r.generation, r.index, r.pos)
+	if err := r.client.put(ctx, key, gzipBytes(segment)); err != nil {
+		return errors.Wrap(err, "failed to upload WAL segment")
+	}
+	r.pos = start + committed
+	r.checksum = checksum
+	return nil
+}
+
+// checkpoint checkpoints the WAL so that it is restarted by the next transaction. The frames
+// written before the checkpoint completed are copied while holding a write lock, so that the WAL
+// cannot be restarted before they have been.
+func (r *replicator) checkpoint(ctx context.Context) error {
+	if err := r.endRead(); err != nil {
+		return err
+	}
+	var busy, pages, checkpointed int64
+	err := r.db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(RESTART)`).Scan(&busy, &pages, &checkpointed)
+	if err == nil && busy != 0 {
+		err = errors.New("database is busy")
+	}
+	if err != nil {
+		// try again after the next sync
+		if err := r.beginRead(ctx); err != nil {
+			return err
+		}
+		return errors.Wrap(err, "failed to checkpoint WAL")
+	}
+
+	_, err = r.withWriteLock(ctx, func() ([]byte, error) {
+		return nil, r.sync(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	r.expectRestart = true
+	logrus.Debugf("Checkpointed SQLite WAL of %d pages after replicating it", pages)
+	return nil
+}
+
+// withWriteLock calls f while holding a write lock on the database, and begins the read
+// transaction before releasing it, so that no transactions are committed in between.
+func (r *replicator) withWriteLock(ctx context.Context, f func() ([]byte, error)) ([]byte, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, errors.Wrap(err, "failed to lock database")
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	data, err := f()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.beginRead(ctx); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// beginRead begins the read transaction, if one is not open.
+func (r *replicator) beginRead(ctx context.Context) error {
+	if r.conn != nil {
+		return nil
+	}
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	// the transaction only reads from the database once a table is read
+	if _, err := conn.ExecContext(ctx, "BEGIN"); err != nil {
+		conn.Close()
+		return err
+	}
+	var n int64
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&n); err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		conn.Close()
+		return err
+	}
+	r.conn = conn
+	return nil
+}
+
+// endRead ends the read transaction, if one is open.
+func (r *replicator) endRead() error {
+	if r.conn == nil {
+		return nil
+	}
+	_, err := r.conn.ExecContext(context.Background(), "ROLLBACK")
+	r.conn.Close()
+	r.conn = nil
+	return err
+}
+
+// prune deletes the generations older than the previous one.
+func (r *replicator) prune(ctx context.Context) error {
+	objects, err := r.client.list(ctx, "generations/")
+	if err != nil {
+		return err
+	}
+	generations := map[string][]string{}
+	for _, object := range objects {
+		if parts := strings.SplitN(object.Key, "/", 3); len(parts) == 3 {
+			generations[parts[1]] = append(generations[parts[1]], object.Key)
+		}
+	}
+	names := make([]string, 0, len(generations))
+	for name := range generations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-2; i++ {
+		for _, key := range generations[names[i]] {
+			if err := r.client.delete(ctx, key); err != nil {
+				return err
+			}
+		}
+		logrus.Infof("Deleted generation %s of the SQLite replica", names[i])
+	}
+	return nil
+}
+
+// restoreReplica restores the database from the latest generation of the replica, or the latest
+// generation started before the restore time, applying the segments of the WAL uploaded before
+// it. The database is not restored if there is no replica.
+func restoreReplica(ctx context.Context, client *s3Client, path string, restoreTime time.Time) error {
+	objects, err := client.list(ctx, "generations/")
+	if err != nil {
+		return err
+	}
+	var generation string
+	segments := map[string][]s3Object{}
+	for _, object := range objects {
+		parts := strings.SplitN(object.Key, "/", 3)
+		if len(parts) != 3 || (!restoreTime.IsZero() && object.LastModified.After(restoreTime)) {
+			continue
+		}
+		switch {
+		case parts[2] == "snapshot.db.gz":
+			if parts[1] > generation {
+				generation = parts[1]
+			}
+		case strings.HasPrefix(parts[2], "wal/"):
+			segments[parts[1]] = append(segments[parts[1]], object)
+		}
+	}
+	if generation == "" {
+		if !restoreTime.IsZero() {
+			return fmt.Errorf("no generation of the replica was started before %s", restoreTime.Format(time.RFC3339))
+		}
+		logrus.Infof("Not restoring SQLite database, as there is no replica")
+		return nil
+	}
+
+	logrus.Infof("Restoring SQLite database %s from generation %s of the replica", path, generation)
+	tmpPath := path + ".restore"
+	defer os.Remove(tmpPath + "-wal")
+	defer os.Remove(tmpPath + "-shm")
+	data, err := getGzipped(ctx, client, "generations/"+generation+"/snapshot.db.gz")
+	if err != nil {
+		return errors.Wrap(err, "failed to download snapshot")
+	}
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+
+	// segments are ordered by their index and offset, as their keys are; they are applied up to
+	// the first that is missing, as later segments cannot be applied without it
+	var wal []byte
+	index := ""
+	for i, object := range segments[generation] {
+		parts := strings.Split(strings.TrimSuffix(object.Key, ".wal.gz"), "/")
+		if len(parts) != 5 {
+			continue
+		}
+		if parts[3] != index {
+			if err := applyWAL(tmpPath, wal); err != nil {
+				return err
+			}
+			index, wal = parts[3], nil
+		}
+		if offset := fmt.Sprintf("%016x", len(wal)); parts[4] != offset {
+			logrus.Warnf("Not restoring WAL segments from index %s offset %s of the SQLite replica, as the segment at offset %s is missing", index, parts[4], offset)
+			break
+		}
+		data, err := getGzipped(ctx, client, object.Key)
+		if err != nil {
+			return errors.Wrap(err, "failed to download WAL segment")
+		}
+		wal = append(wal, data...)
+		logrus.Debugf("Downloaded WAL segment %d of %d", i+1, len(segments[generation]))
+	}
+	if err := applyWAL(tmpPath, wal); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	logrus.Infof("Restored SQLite database %s from the replica", path)
+	return nil
+}
+
+// applyWAL checkpoints the WAL into the database. SQLite ignores frames after the last valid
+// commit frame of the WAL.
+func applyWAL(path string, wal []byte) error {
+	if len(wal) == 0 {
+		return nil
+	}
+	if err := os.WriteFile(path+"-wal", wal, 0600); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var busy, pages, checkpointed int64
+	if err := db.QueryRow(`PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed); err != nil {
+		return errors.Wrap(err, "failed to apply WAL")
+	}
+	return nil
+}
+
+// walChecksum continues the checksum of the WAL over the data, which is a multiple of 8 bytes.
+func walChecksum(order binary.ByteOrder, data []byte, s1, s2 uint32) (uint32, uint32) {
+	for i := 0; i+8 <= len(data); i += 8 {
+		s1 += order.Uint32(data[i:]) + s2
+		s2 += order.Uint32(data[i+4:]) + s1
+	}
+	return s1, s2
+}
+
+func gzipBytes(data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func getGzipped(ctx context.Context, client *s3Client, key string) ([]byte, error) {
+	data, err := client.get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,176 @@
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/k3s-io/kine/pkg/sigv4"
+	"github.com/pkg/errors"
+)
+
+// s3RequestTimeout bounds each request to object storage. Segments of the WAL are small, but
+// snapshots are the size of the database.
+const s3RequestTimeout = 5 * time.Minute
+
+// s3Client stores objects under a prefix of a bucket in S3-compatible object storage, such as AWS
+// S3 or MinIO, using path-style requests signed with AWS Signature Version 4.
+type s3Client struct {
+	endpoint string
+	bucket   string
+	prefix   string
+	signer   *sigv4.Signer
+	client   *http.Client
+}
+
+// s3Object is an object listed by s3Client.list. The key is relative to the prefix of the client.
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+	Size         int64
+}
+
+// newS3Client returns a client for a URL such as s3://bucket/path?endpoint=https://minio:9000&region=us-east-1.
+// The endpoint defaults to AWS S3 in the region, and the region to AWS_REGION or us-east-1.
+// Credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN.
+func newS3Client(rawURL string) (*s3Client, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse replica URL")
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid replica URL %q: must be s3://bucket/path", rawURL)
+	}
+
+	query := u.Query()
+	region := query.Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	// keys are escaped once, as S3 expects in the canonical request, by do
+	signer, err := sigv4.New("s3", region, func(o *v4.SignerOptions) {
+		o.DisableURIPathEscaping = true
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure replication to object storage")
+	}
+
+	c := &s3Client{
+		endpoint: strings.TrimSuffix(query.Get("endpoint"), "/"),
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		signer:   signer,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+	}
+	if c.endpoint == "" {
+		c.endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	if c.prefix != "" {
+		c.prefix += "/"
+	}
+	return c, nil
+}
+
+func (c *s3Client) put(ctx context.Context, key string, body []byte) error {
+	_, err := c.do(ctx, http.MethodPut, c.prefix+key, nil, body)
+	return err
+}
+
+func (c *s3Client) get(ctx context.Context, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, c.prefix+key, nil, nil)
+}
+
+func (c *s3Client) delete(ctx context.Context, key string) error {
+	_, err := c.do(ctx, http.MethodDelete, c.prefix+key, nil, nil)
+	return err
+}
+
+// list returns the objects with keys starting with the prefix, in order of their keys.
+func (c *s3Client) list(ctx context.Context, prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", c.prefix+prefix)
+	for {
+		data, err := c.do(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return nil, errors.Wrap(err, "failed to parse object listing")
+		}
+		for _, object := range result.Contents {
+			object.Key = strings.TrimPrefix(object.Key, c.prefix)
+			objects = append(objects, object)
+		}
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// do sends a request for the key, or for the bucket if the key is empty, signing it with AWS
+// Signature Version 4, and returns the body of the response.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, body []byte) ([]byte, error) {
+	path := "/" + s3Escape(c.bucket, false)
+	if key != "" {
+		path += "/" + s3Escape(key, true)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	if err := c.signer.Sign(ctx, req, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s failed with status %s: %s", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// s3Escape escapes all but the unreserved characters of a bucket or key, as required for the
+// canonical request, leaving slashes in keys unescaped.
+func s3Escape(s string, key bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_', c == '~':
+			b.WriteByte(c)
+		case c == '/' && key:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
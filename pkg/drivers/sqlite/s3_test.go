@@ -0,0 +1,166 @@
+package sqlite
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a bucket of S3-compatible object storage, which checks that requests are signed for
+// S3 in eu-west-1 with the kine access key, and lists two objects per page.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=kine/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+		http.Error(w, "invalid authorization "+auth, http.StatusForbidden)
+		return
+	}
+	hash := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(hash[:]) {
+		http.Error(w, "payload hash does not match", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/bucket" {
+		f.list(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+	case http.MethodGet:
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("list-type") != "2" {
+		http.Error(w, "unsupported list type", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	keys = keys[start:]
+
+	type object struct {
+		Key          string
+		LastModified time.Time
+		Size         int64
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Contents              []object
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}{}
+	if len(keys) > 2 {
+		keys = keys[:2]
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	for _, key := range keys {
+		result.Contents = append(result.Contents, object{Key: key, LastModified: time.Now().UTC(), Size: int64(len(f.objects[key]))})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Client(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeS3{objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "kine")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	c, err := newS3Client("s3://bucket/replica?region=eu-west-1&endpoint=" + srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys with characters that are escaped in the path are signed as sent
+	keys := []string{"wal/0001", "wal/0002", "wal/0003 a+b", "snapshot"}
+	for _, key := range keys {
+		if err := c.put(ctx, key, []byte(key)); err != nil {
+			t.Fatalf("put of %s failed: %v", key, err)
+		}
+	}
+	fake.mu.Lock()
+	_, ok := fake.objects["replica/wal/0003 a+b"]
+	fake.mu.Unlock()
+	if !ok {
+		t.Fatal("put did not store the object under the replica prefix")
+	}
+
+	objects, err := c.list(ctx, "wal/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed []string
+	for _, object := range objects {
+		listed = append(listed, object.Key)
+	}
+	if strings.Join(listed, ",") != "wal/0001,wal/0002,wal/0003 a+b" {
+		t.Errorf("list returned %v, want the three WAL segments", listed)
+	}
+
+	data, err := c.get(ctx, "wal/0003 a+b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "wal/0003 a+b" {
+		t.Errorf("get returned %q, want %q", data, "wal/0003 a+b")
+	}
+	if err := c.delete(ctx, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.get(ctx, "snapshot"); err == nil {
+		t.Error("get of a deleted object succeeded")
+	}
+}
+
+func TestS3ClientWithoutCredentials(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := newS3Client("s3://bucket/replica"); err == nil {
+		t.Error("newS3Client without credentials succeeded")
+	}
+}
@@ -7,9 +7,13 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/logstructured"
 	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
@@ -43,16 +47,166 @@ var (
 		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
 		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
 		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
-		`PRAGMA wal_checkpoint(TRUNCATE)`,
+	}
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_lease
+			(
+				id INTEGER NOT NULL PRIMARY KEY,
+				ttl INTEGER NOT NULL,
+				expires INTEGER NOT NULL
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
 	}
 )
 
+// defaultPragmas are applied by the sqlite3 driver to every new connection, unless
+// overridden by the equivalent parameter or one of its aliases in the DSN.
+var defaultPragmas = []struct {
+	key     string
+	aliases []string
+	value   string
+}{
+	{key: "_journal_mode", aliases: []string{"_journal"}, value: "WAL"},
+	{key: "_busy_timeout", aliases: []string{"_timeout"}, value: "5000"},
+	{key: "_synchronous", aliases: []string{"_sync"}, value: "NORMAL"},
+}
+
+// checkpointIntervalParam is the DSN parameter setting the interval at which the WAL is
+// checkpointed and truncated. It is removed from the DSN before it is passed to the driver.
+const checkpointIntervalParam = "wal-checkpoint-interval"
+
+var (
+	journalModes      = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	synchronousLevels = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// New returns a backend for the SQLite database at dataSourceName. Use NewWithConfig to set any
+// of the other options of drivers.Config.
 func New(ctx context.Context, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, error) {
-	backend, _, err := NewVariant(ctx, "sqlite3", dataSourceName, connPoolConfig, metricsRegisterer)
-	return backend, err
+	return NewWithConfig(ctx, &drivers.Config{
+		DataSourceName:       dataSourceName,
+		ConnectionPoolConfig: connPoolConfig,
+		MetricsRegisterer:    metricsRegisterer,
+	})
+}
+
+// NewWithConfig returns a backend for the SQLite database configured by cfg.
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	dataSourceName := cfg.DataSourceName
+	if dataSourceName == "" {
+		if err := os.MkdirAll("./db", 0700); err != nil {
+			return nil, err
+		}
+		dataSourceName = "./db/state.db?cache=shared"
+	}
+
+	dataSourceName, journalMode, checkpointInterval, err := prepareDSN(dataSourceName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	isWAL := strings.EqualFold(journalMode, "WAL")
+	if checkpointInterval > 0 && !isWAL {
+		logrus.Warnf("Not checkpointing the WAL, as the SQLite journal mode is %s", journalMode)
+		checkpointInterval = 0
+	}
+
+	var replica *s3Client
+	path := databasePath(dataSourceName)
+	if cfg.SQLiteReplicateURL != "" {
+		if !isWAL {
+			return nil, fmt.Errorf("SQLite databases can only be replicated in WAL journal mode, not %s", journalMode)
+		}
+		if path == "" {
+			return nil, fmt.Errorf("in-memory SQLite databases cannot be replicated")
+		}
+		if replica, err = newS3Client(cfg.SQLiteReplicateURL); err != nil {
+			return nil, err
+		}
+		if err := restoreIfNotExists(ctx, replica, path, cfg.SQLiteRestoreTime); err != nil {
+			return nil, errors.Wrap(err, "restoring SQLite database from replica")
+		}
+	}
+
+	sqliteCfg := *cfg
+	sqliteCfg.DataSourceName = dataSourceName
+	backend, dialect, err := NewVariantWithConfig(ctx, "sqlite3", &sqliteCfg)
+	if err != nil {
+		return nil, err
+	}
+	if replica != nil && !cfg.ReadOnly {
+		// the replicator checkpoints and restarts the WAL once it has been replicated, and holds
+		// a read transaction until then, which checkpoints by kine would wait on
+		dialect.PostCompactSQL = ""
+		dialect.DefragSQL = []string{`VACUUM`}
+		checkpointInterval = 0
+
+		r, err := newReplicator(dataSourceName, path, replica)
+		if err != nil {
+			return nil, err
+		}
+		go r.run(ctx)
+	}
+	if checkpointInterval > 0 && !cfg.ReadOnly {
+		go checkpointWAL(ctx, dialect.DB, checkpointInterval)
+	}
+	return backend, nil
 }
 
+// restoreIfNotExists restores the database from the replica, if the database does not exist.
+// The restore time is an RFC 3339 time, or empty to restore the latest state.
+func restoreIfNotExists(ctx context.Context, replica *s3Client, path, restoreTime string) error {
+	var t time.Time
+	if restoreTime != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, restoreTime); err != nil {
+			return errors.Wrap(err, "invalid restore time")
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		if !t.IsZero() {
+			logrus.Warnf("Not restoring SQLite database %s to %s, as it already exists", path, restoreTime)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return restoreReplica(ctx, replica, path, t)
+}
+
+// databasePath returns the path of the database file for the DSN, or an empty string if the
+// database is in memory.
+func databasePath(dataSourceName string) string {
+	path, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		path, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+	path = strings.TrimPrefix(path, "file:")
+	if params, _ := url.ParseQuery(rawQuery); path == "" || path == ":memory:" || params.Get("mode") == "memory" {
+		return ""
+	}
+	return path
+}
+
+// NewVariant returns a backend for a SQLite-compatible database at dataSourceName, opened with
+// the named database/sql driver, and its dialect. Use NewVariantWithConfig to set any of the other
+// options of drivers.Config.
 func NewVariant(ctx context.Context, driverName, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, *generic.Generic, error) {
+	return NewVariantWithConfig(ctx, driverName, &drivers.Config{
+		DataSourceName:       dataSourceName,
+		ConnectionPoolConfig: connPoolConfig,
+		MetricsRegisterer:    metricsRegisterer,
+	})
+}
+
+// NewVariantWithConfig returns a backend for a SQLite-compatible database configured by cfg,
+// opened with the named database/sql driver, and its dialect.
+func NewVariantWithConfig(ctx context.Context, driverName string, cfg *drivers.Config) (server.Backend, *generic.Generic, error) {
+	dataSourceName := cfg.DataSourceName
 	if dataSourceName == "" {
 		if err := os.MkdirAll("./db", 0700); err != nil {
 			return nil, nil, err
@@ -60,10 +214,11 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 		dataSourceName = "./db/state.db?_journal=WAL&cache=shared"
 	}
 
-	dialect, err := generic.Open(ctx, driverName, dataSourceName, connPoolConfig, "?", false, metricsRegisterer)
+	dialect, err := generic.Open(ctx, driverName, dataSourceName, cfg.ConnectionPoolConfig, "?", false, cfg.MetricsRegisterer)
 	if err != nil {
 		return nil, nil, err
 	}
+	dialect.FastCount = cfg.FastCount
 
 	dialect.LastInsertID = true
 	dialect.GetSizeSQL = `SELECT SUM(pgsize) FROM dbstat`
@@ -76,15 +231,28 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 				WHERE
 					kp.name != 'compact_rev_key' AND
 					kp.prev_revision != 0 AND
+					kp.id > ? AND
 					kp.id <= ?
 				UNION
 				SELECT kd.id AS id
 				FROM kine AS kd
 				WHERE
 					kd.deleted != 0 AND
+					kd.id > ? AND
 					kd.id <= ?
 			)`
 	dialect.PostCompactSQL = `PRAGMA wal_checkpoint(FULL)`
+	// VACUUM rebuilds the database file; the WAL is then truncated, as it grows to the size of the database
+	dialect.DefragSQL = []string{
+		`VACUUM`,
+		`PRAGMA wal_checkpoint(TRUNCATE)`,
+	}
+	dialect.PreRestoreSQL = []string{
+		`DROP INDEX IF EXISTS kine_name_prev_revision_uindex`,
+	}
+	dialect.PostRestoreSQL = []string{
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
 	dialect.TranslateErr = func(err error) error {
 		if err, ok := err.(sqlite3.Error); ok && err.ExtendedCode == sqlite3.ErrConstraintUnique {
 			return server.ErrKeyExists
@@ -101,10 +269,19 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 		return err.Error()
 	}
 
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping database setup in read-only mode")
+		backend, err := logstructured.New(sqllog.New(dialect, cfg), cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return backend, dialect, nil
+	}
+
 	// this is the first SQL that will be executed on a new DB conn so
 	// loop on failure here because in the case of dqlite it could still be initializing
 	for i := 0; i < 300; i++ {
-		err = setup(dialect.DB)
+		err = setup(ctx, dialect.DB)
 		if err == nil {
 			break
 		}
@@ -121,20 +298,132 @@ func NewVariant(ctx context.Context, driverName, dataSourceName string, connPool
 	}
 
 	dialect.Migrate(context.Background())
-	return logstructured.New(sqllog.New(dialect)), dialect, nil
+	backend, err := logstructured.New(sqllog.New(dialect, cfg), cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	return backend, dialect, nil
 }
 
-func setup(db *sql.DB) error {
+func setup(ctx context.Context, db *sql.DB) error {
 	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
 
-	for _, stmt := range schema {
-		logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
-		_, err := db.Exec(stmt)
-		if err != nil {
-			return err
-		}
+	if err := generic.ApplySchemaMigrations(ctx, db, migrations, nil, nil); err != nil {
+		return err
+	}
+
+	// checkpoints cannot be run within a transaction, so this is done outside the migrations
+	stmt := `PRAGMA wal_checkpoint(TRUNCATE)`
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(stmt))
+	if _, err := db.ExecContext(ctx, stmt); err != nil {
+		return err
 	}
 
 	logrus.Infof("Database tables and indexes are up to date")
 	return nil
 }
+
+// prepareDSN adds the journal mode, busy timeout, and synchronous pragmas to the DSN, as configured
+// or by default, unless set by the DSN. WAL mode and a busy timeout allow concurrent readers and
+// writers without immediately failing with "database is locked" errors. The journal mode, and the
+// interval at which the WAL is checkpointed, are also returned.
+func prepareDSN(dataSourceName string, cfg *drivers.Config) (string, string, time.Duration, error) {
+	path, rawQuery := dataSourceName, ""
+	if i := strings.IndexRune(dataSourceName, '?'); i >= 0 {
+		path, rawQuery = dataSourceName[:i], dataSourceName[i+1:]
+	}
+
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", "", 0, errors.Wrap(err, "failed to parse DSN parameters")
+	}
+
+	checkpointInterval := cfg.SQLiteCheckpointInterval
+	if params.Has(checkpointIntervalParam) {
+		value := params.Get(checkpointIntervalParam)
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return "", "", 0, errors.Errorf("invalid %s %q: must be a non-negative duration", checkpointIntervalParam, value)
+		}
+		checkpointInterval = d
+		params.Del(checkpointIntervalParam)
+	}
+
+	configured := map[string]string{}
+	if cfg.SQLiteJournalMode != "" {
+		if !oneOf(cfg.SQLiteJournalMode, journalModes) {
+			return "", "", 0, errors.Errorf("invalid SQLite journal mode %q: must be one of %s", cfg.SQLiteJournalMode, strings.Join(journalModes, ", "))
+		}
+		configured["_journal_mode"] = strings.ToUpper(cfg.SQLiteJournalMode)
+	}
+	if cfg.SQLiteSynchronous != "" {
+		if !oneOf(cfg.SQLiteSynchronous, synchronousLevels) {
+			return "", "", 0, errors.Errorf("invalid SQLite synchronous level %q: must be one of %s", cfg.SQLiteSynchronous, strings.Join(synchronousLevels, ", "))
+		}
+		configured["_synchronous"] = strings.ToUpper(cfg.SQLiteSynchronous)
+	}
+	if cfg.SQLiteBusyTimeout > 0 {
+		configured["_busy_timeout"] = strconv.FormatInt(cfg.SQLiteBusyTimeout.Milliseconds(), 10)
+	}
+
+	journalMode := ""
+outer:
+	for _, pragma := range defaultPragmas {
+		for _, k := range append([]string{pragma.key}, pragma.aliases...) {
+			if params.Has(k) {
+				if pragma.key == "_journal_mode" {
+					journalMode = params.Get(k)
+				}
+				continue outer
+			}
+		}
+		value := pragma.value
+		if v, ok := configured[pragma.key]; ok {
+			value = v
+		}
+		if pragma.key == "_journal_mode" {
+			journalMode = value
+		}
+		params.Set(pragma.key, value)
+	}
+
+	return path + "?" + params.Encode(), journalMode, checkpointInterval, nil
+}
+
+func oneOf(value string, values []string) bool {
+	for _, v := range values {
+		if strings.EqualFold(value, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkpointWAL checkpoints the WAL at the interval until the context is done, truncating it so
+// that the disk space used by the WAL after a burst of writes is released. SQLite checkpoints
+// the WAL automatically, but only truncates it if configured to.
+func checkpointWAL(ctx context.Context, db *sql.DB, interval time.Duration) {
+	logrus.Infof("Checkpointing and truncating the SQLite WAL every %s", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var busy, pages, checkpointed int64
+		err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &pages, &checkpointed)
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			logrus.Warnf("Failed to checkpoint the SQLite WAL: %v", err)
+		case busy != 0:
+			logrus.Debugf("SQLite WAL checkpoint did not complete, as the database is busy; checkpointed %d of %d pages", checkpointed, pages)
+		default:
+			logrus.Debugf("Checkpointed and truncated the SQLite WAL of %d pages", pages)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"database/sql"
 	"errors"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/prometheus/client_golang/prometheus"
@@ -19,10 +20,18 @@ func New(ctx context.Context, dataSourceName string, connPoolConfig generic.Conn
 	return nil, errNoCgo
 }
 
-func NewVariant(driverName, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, *generic.Generic, error) {
+func NewWithConfig(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	return nil, errNoCgo
+}
+
+func NewVariant(ctx context.Context, driverName, dataSourceName string, connPoolConfig generic.ConnectionPoolConfig, metricsRegisterer prometheus.Registerer) (server.Backend, *generic.Generic, error) {
+	return nil, nil, errNoCgo
+}
+
+func NewVariantWithConfig(ctx context.Context, driverName string, cfg *drivers.Config) (server.Backend, *generic.Generic, error) {
 	return nil, nil, errNoCgo
 }
 
-func setup(db *sql.DB) error {
+func setup(ctx context.Context, db *sql.DB) error {
 	return errNoCgo
 }
@@ -0,0 +1,108 @@
+//go:build cgo
+// +build cgo
+
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+)
+
+func TestPrepareDSN(t *testing.T) {
+	tests := []struct {
+		name string
+		dsn  string
+		cfg  drivers.Config
+		want map[string]string
+	}{
+		{
+			name: "defaults",
+			dsn:  "/tmp/state.db",
+			want: map[string]string{"_journal_mode": "WAL", "_busy_timeout": "5000", "_synchronous": "NORMAL"},
+		},
+		{
+			name: "set by the DSN",
+			dsn:  "/tmp/state.db?_journal=DELETE&_timeout=100&cache=shared",
+			want: map[string]string{"_journal": "DELETE", "_timeout": "100", "_synchronous": "NORMAL", "cache": "shared"},
+		},
+		{
+			name: "configured",
+			dsn:  "/tmp/state.db",
+			cfg:  drivers.Config{SQLiteJournalMode: "truncate", SQLiteSynchronous: "full"},
+			want: map[string]string{"_journal_mode": "TRUNCATE", "_busy_timeout": "5000", "_synchronous": "FULL"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsn, _, _, err := prepareDSN(tt.dsn, &tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(dsn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			params := u.Query()
+			if len(params) != len(tt.want) {
+				t.Errorf("DSN %s has %d parameters, want %d", dsn, len(params), len(tt.want))
+			}
+			for k, v := range tt.want {
+				if params.Get(k) != v {
+					t.Errorf("%s = %q, want %q", k, params.Get(k), v)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, dialect, err := NewVariantWithConfig(ctx, "sqlite3", &drivers.Config{DataSourceName: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialect.Close()
+
+	var journalMode string
+	if err := dialect.DB.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("journal mode = %s, want wal", journalMode)
+	}
+
+	const writers, writes = 8, 50
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*writes)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				if _, err := backend.Create(ctx, fmt.Sprintf("/writer-%d/%d", i, j), []byte("value"), 0); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("concurrent write failed: %v", err)
+	}
+
+	_, count, err := backend.Count(ctx, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != writers*writes {
+		t.Errorf("count = %d, want %d", count, writers*writes)
+	}
+}
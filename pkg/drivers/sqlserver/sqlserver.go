@@ -0,0 +1,387 @@
+package sqlserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/k3s-io/kine/pkg/tls"
+	"github.com/k3s-io/kine/pkg/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDSN = "sqlserver://sa@localhost:1433"
+	driverName = "sqlserver"
+)
+
+var (
+	// kineTable is the definition of the kine table, formatted with the name of the table. The id
+	// column is an IDENTITY column; rows that are inserted with an explicit id, when filling gaps
+	// or restoring a snapshot, are inserted with IDENTITY_INSERT enabled.
+	kineTable = `
+			CREATE TABLE %[1]s
+			(
+				id BIGINT IDENTITY(1,1) NOT NULL,
+				name NVARCHAR(630),
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease BIGINT,
+				value VARBINARY(MAX),
+				old_value VARBINARY(MAX),
+				CONSTRAINT %[1]s_pkey PRIMARY KEY (id)
+			)`
+	// SQL Server has no CREATE ... IF NOT EXISTS, so each statement checks the catalog instead.
+	indexes = []string{
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_name_index' AND object_id = OBJECT_ID('kine'))
+			CREATE INDEX kine_name_index ON kine (name)`,
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_name_id_index' AND object_id = OBJECT_ID('kine'))
+			CREATE INDEX kine_name_id_index ON kine (name,id)`,
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_id_deleted_index' AND object_id = OBJECT_ID('kine'))
+			CREATE INDEX kine_id_deleted_index ON kine (id,deleted)`,
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_prev_revision_index' AND object_id = OBJECT_ID('kine'))
+			CREATE INDEX kine_prev_revision_index ON kine (prev_revision)`,
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_name_prev_revision_uindex' AND object_id = OBJECT_ID('kine'))
+			CREATE UNIQUE INDEX kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	schema = append([]string{
+		`IF OBJECT_ID('kine', 'U') IS NULL` + fmt.Sprintf(kineTable, "kine"),
+	}, indexes...)
+	// identitySchema converts a kine table created by earlier versions, whose id column was
+	// populated from the kine_id_seq sequence, to use an IDENTITY column. SQL Server cannot add
+	// the IDENTITY property to an existing column, so the rows are copied to a new table which
+	// then replaces the old one. The identity is advanced to the last value issued by the
+	// sequence, so that revisions are never reused.
+	identitySchema = append([]string{
+		`IF COLUMNPROPERTY(OBJECT_ID('kine'), 'id', 'IsIdentity') = 0
+		BEGIN` + fmt.Sprintf(kineTable, "kine_identity") + `;
+			SET IDENTITY_INSERT kine_identity ON;
+			INSERT INTO kine_identity(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+				SELECT id, name, created, deleted, create_revision, prev_revision, lease, value, old_value
+				FROM kine;
+			SET IDENTITY_INSERT kine_identity OFF;
+			DECLARE @id BIGINT;
+			SELECT @id = CAST(current_value AS BIGINT) FROM sys.sequences WHERE name = 'kine_id_seq';
+			IF @id > IDENT_CURRENT('kine_identity') DBCC CHECKIDENT ('kine_identity', RESEED, @id);
+			DROP TABLE kine;
+			EXEC sp_rename 'kine_identity', 'kine';
+			EXEC sp_rename 'kine_identity_pkey', 'kine_pkey', 'OBJECT';
+		END`,
+		`IF OBJECT_ID('kine_id_seq', 'SO') IS NOT NULL
+			DROP SEQUENCE kine_id_seq`,
+	}, indexes...)
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`IF OBJECT_ID('kine_lease', 'U') IS NULL
+			CREATE TABLE kine_lease
+			(
+				id BIGINT NOT NULL,
+				ttl BIGINT NOT NULL,
+				expires BIGINT NOT NULL,
+				CONSTRAINT kine_lease_pkey PRIMARY KEY (id)
+			)`,
+		`IF NOT EXISTS (SELECT * FROM sys.indexes WHERE name = 'kine_lease_expires_index' AND object_id = OBJECT_ID('kine_lease'))
+			CREATE INDEX kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
+		{ID: 3, Stmts: identitySchema},
+	}
+	createMigrationsSQL = `
+		IF OBJECT_ID('kine_migrations', 'U') IS NULL
+			CREATE TABLE kine_migrations (id INTEGER NOT NULL PRIMARY KEY)`
+	createDB = `
+		DECLARE @stmt NVARCHAR(300) = 'CREATE DATABASE ' + QUOTENAME(@p1);
+		IF DB_ID(@p1) IS NULL EXEC(@stmt)`
+
+	columns = "kv.id AS theid, kv.name, kv.created, kv.deleted, kv.create_revision, kv.prev_revision, kv.lease, kv.value, kv.old_value"
+	revSQL  = `
+		SELECT MAX(rkv.id) AS id
+		FROM kine AS rkv`
+
+	compactRevSQL = `
+		SELECT MAX(crkv.prev_revision) AS prev_revision
+		FROM kine AS crkv
+		WHERE crkv.name = 'compact_rev_key'`
+
+	idOfKey = `
+		AND
+		mkv.id <= ? AND
+		mkv.id > (
+			SELECT MAX(ikv.id) AS id
+			FROM kine AS ikv
+			WHERE
+				ikv.name = ? AND
+				ikv.id <= ?)`
+
+	// SQL Server requires every column of a derived table to be named, does not allow
+	// ORDER BY within a derived table, and has no boolean type, so the list query differs
+	// from the generic one in those respects.
+	listCurrentSQL = fmt.Sprintf(`
+			SELECT (%s) AS current_revision, (%s) AS compact_revision, %s
+			FROM kine AS kv
+			JOIN (
+				SELECT MAX(mkv.id) AS id
+				FROM kine AS mkv
+				WHERE
+					mkv.name LIKE ? ESCAPE '!'
+					%%s
+				GROUP BY mkv.name) AS maxkv
+				ON maxkv.id = kv.id
+			WHERE
+				kv.deleted = 0 OR
+				? = 1`, revSQL, compactRevSQL, columns)
+
+	listSQL = fmt.Sprintf(`
+		SELECT *
+		FROM (
+			%s
+		) AS lkv
+		ORDER BY lkv.theid ASC`, listCurrentSQL)
+)
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	parsedDSN, err := prepareDSN(cfg.DataSourceName, cfg.BackendTLSConfig, cfg.DBName())
+	if err != nil {
+		return nil, err
+	}
+
+	// If a separate schema DSN is provided, create the database and schema using those credentials,
+	// and only use the primary DSN to serve requests.
+	schemaCreated := false
+	if cfg.SchemaDataSourceName != "" && !cfg.ReadOnly {
+		if err := createSchema(ctx, cfg); err != nil {
+			return nil, err
+		}
+		schemaCreated = true
+	}
+
+	if !cfg.ReadOnly && !schemaCreated {
+		if err := createDBIfNotExist(ctx, parsedDSN); err != nil {
+			return nil, err
+		}
+	}
+
+	dialect, err := generic.Open(ctx, driverName, parsedDSN, cfg.ConnectionPoolConfig, "@p", true, cfg.MetricsRegisterer)
+	if err != nil {
+		return nil, err
+	}
+	dialect.FastCount = cfg.FastCount
+
+	dialect.GetCurrentSQL = q(fmt.Sprintf(listSQL, ""))
+	dialect.ListRevisionStartSQL = q(fmt.Sprintf(listSQL, "AND mkv.id <= ?"))
+	dialect.GetRevisionAfterSQL = q(fmt.Sprintf(listSQL, idOfKey))
+	dialect.CountSQL = q(fmt.Sprintf(`
+		SELECT (%s), COUNT(c.theid)
+		FROM (
+			%s
+		) AS c`, revSQL, fmt.Sprintf(listCurrentSQL, "")))
+	dialect.FastCountSQL = q(fmt.Sprintf(`
+		SELECT (%s), COUNT(kv.id)
+		FROM kine AS kv
+		JOIN (
+			SELECT MAX(mkv.id) AS id
+			FROM kine AS mkv
+			WHERE
+				mkv.name LIKE ? ESCAPE '!'
+			GROUP BY mkv.name) AS maxkv
+			ON maxkv.id = kv.id
+		WHERE
+			kv.deleted = 0 OR
+			? = 1`, revSQL))
+	dialect.DeleteSQL = q(`
+		DELETE FROM kine
+		WHERE id = ?`)
+	// nil values are sent as NVARCHAR, which cannot be implicitly converted to VARBINARY
+	dialect.InsertSQL = q(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		OUTPUT INSERTED.id
+		VALUES(?, ?, ?, ?, ?, ?, CAST(? AS VARBINARY(MAX)), CAST(? AS VARBINARY(MAX)))`)
+	// IDENTITY_INSERT is only enabled for the duration of the statement that sets an explicit id.
+	dialect.FillSQL = q(`SET IDENTITY_INSERT kine ON;
+		INSERT INTO kine(id, name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+		VALUES(?, ?, ?, ?, ?, ?, ?, CAST(? AS VARBINARY(MAX)), CAST(? AS VARBINARY(MAX)));
+		SET IDENTITY_INSERT kine OFF`)
+	dialect.UpdateValueSQL = q(`
+		UPDATE kine
+		SET value = CAST(? AS VARBINARY(MAX)), old_value = COALESCE(CAST(? AS VARBINARY(MAX)), old_value)
+		WHERE id = ?`)
+	dialect.CompactSQL = q(`
+		DELETE kv FROM kine AS kv
+		INNER JOIN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id > ? AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id > ? AND
+				kd.id <= ?
+		) AS ks
+		ON kv.id = ks.id`)
+	dialect.GetSizeSQL = `
+		SELECT CAST(SUM(a.total_pages) AS BIGINT) * 8192
+		FROM sys.partitions AS p
+		JOIN sys.allocation_units AS a
+			ON a.container_id = p.partition_id
+		WHERE p.object_id = OBJECT_ID('kine')`
+	dialect.PostRestoreSQL = []string{`
+		DECLARE @id BIGINT;
+		SELECT @id = COALESCE(MAX(id), 0) FROM kine;
+		DBCC CHECKIDENT ('kine', RESEED, @id)`,
+	}
+	dialect.ApplyLimit = func(sql string, limit int64) string {
+		return fmt.Sprintf("%s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", sql, limit)
+	}
+	dialect.TranslateErr = func(err error) error {
+		// unique constraint and unique index violations
+		if err, ok := err.(mssql.Error); ok && (err.Number == 2627 || err.Number == 2601) {
+			return server.ErrKeyExists
+		}
+		return err
+	}
+	// deadlock victim, and snapshot isolation update conflict
+	dialect.RetriableErrCodes = []string{"1205", "3960"}
+	dialect.ErrCode = func(err error) string {
+		if err == nil {
+			return ""
+		}
+		if err, ok := err.(mssql.Error); ok {
+			return fmt.Sprint(err.Number)
+		}
+		return err.Error()
+	}
+
+	if cfg.ReadOnly {
+		logrus.Infof("Skipping database setup in read-only mode")
+	} else if !schemaCreated {
+		if err := setup(ctx, dialect.DB); err != nil {
+			return nil, err
+		}
+	}
+
+	return logstructured.New(sqllog.New(dialect, cfg), cfg)
+}
+
+// createSchema creates the database and schema using the schema DSN, closing the connection once complete.
+func createSchema(ctx context.Context, cfg *drivers.Config) error {
+	logrus.Infof("Configuring database schema using the schema datastore endpoint")
+
+	schemaDSN, err := prepareDSN(cfg.SchemaDataSourceName, cfg.BackendTLSConfig, cfg.DBName())
+	if err != nil {
+		return err
+	}
+
+	if err := createDBIfNotExist(ctx, schemaDSN); err != nil {
+		return err
+	}
+
+	db, err := sql.Open(driverName, schemaDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return setup(ctx, db)
+}
+
+func setup(ctx context.Context, db *sql.DB) error {
+	logrus.Infof("Configuring database table schema and indexes, this may take a moment...")
+
+	// Tolerate object already exists and deadlock errors caused by another replica running setup concurrently
+	retryErr := func(err error) bool {
+		mssqlError, ok := err.(mssql.Error)
+		return ok && (mssqlError.Number == 2714 || mssqlError.Number == 1913 || mssqlError.Number == 1205)
+	}
+	if err := generic.ApplySchemaMigrationsWithTable(ctx, db, createMigrationsSQL, migrations, nil, retryErr); err != nil {
+		return err
+	}
+
+	logrus.Infof("Database tables and indexes are up to date")
+	return nil
+}
+
+func createDBIfNotExist(ctx context.Context, dataSourceName string) error {
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return err
+	}
+
+	params := u.Query()
+	dbName := params.Get("database")
+	params.Set("database", "master")
+	u.RawQuery = params.Encode()
+
+	db, err := sql.Open(driverName, u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	logrus.Tracef("SETUP EXEC : %v", util.Stripped(createDB))
+	if _, err := db.ExecContext(ctx, createDB, dbName); err != nil {
+		// another replica may have created the database concurrently
+		if mssqlError, ok := err.(mssql.Error); !ok || mssqlError.Number != 1801 {
+			return errors.Wrapf(err, "failed to create database %s", dbName)
+		}
+	}
+	return nil
+}
+
+func q(sql string) string {
+	regex := regexp.MustCompile(`\?`)
+	pref := "@p"
+	n := 0
+	return regex.ReplaceAllStringFunc(sql, func(string) string {
+		n++
+		return pref + strconv.Itoa(n)
+	})
+}
+
+func prepareDSN(dataSourceName string, tlsInfo tls.Config, defaultDBName string) (string, error) {
+	if len(dataSourceName) == 0 {
+		dataSourceName = defaultDSN
+	} else {
+		dataSourceName = "sqlserver://" + dataSourceName
+	}
+	u, err := url.Parse(dataSourceName)
+	if err != nil {
+		return "", err
+	}
+
+	params := u.Query()
+	if len(params.Get("database")) == 0 {
+		params.Set("database", defaultDBName)
+	}
+	// the driver can verify the server certificate, but does not support client certificates
+	if tlsInfo.CertFile != "" || tlsInfo.KeyFile != "" {
+		return "", errors.New("client certificate authentication is not supported by the sqlserver driver")
+	}
+	if tlsInfo.CAFile != "" {
+		params.Set("certificate", tlsInfo.CAFile)
+		if len(params.Get("encrypt")) == 0 {
+			params.Set("encrypt", "true")
+		}
+	}
+	u.RawQuery = params.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,100 @@
+package tidb
+
+import (
+	"context"
+	"strings"
+
+	gomysql "github.com/go-sql-driver/mysql"
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/mysql"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+var (
+	// The id column must increase monotonically, as it is used as the revision; AUTO_RANDOM would
+	// avoid write hotspots but cannot be used. AUTO_ID_CACHE 1 ensures that ids are allocated in
+	// order across TiDB servers, instead of each server allocating from its own cached range.
+	schema = []string{
+		`CREATE TABLE IF NOT EXISTS kine
+			(
+				id BIGINT AUTO_INCREMENT,
+				name VARCHAR(630) CHARACTER SET ascii,
+				created INTEGER,
+				deleted INTEGER,
+				create_revision BIGINT,
+				prev_revision BIGINT,
+				lease INTEGER,
+				value MEDIUMBLOB,
+				old_value MEDIUMBLOB,
+				PRIMARY KEY (id) CLUSTERED
+			) AUTO_ID_CACHE 1;`,
+		`CREATE INDEX IF NOT EXISTS kine_name_index ON kine (name)`,
+		`CREATE INDEX IF NOT EXISTS kine_name_id_index ON kine (name,id)`,
+		`CREATE INDEX IF NOT EXISTS kine_id_deleted_index ON kine (id,deleted)`,
+		`CREATE INDEX IF NOT EXISTS kine_prev_revision_index ON kine (prev_revision)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS kine_name_prev_revision_uindex ON kine (name, prev_revision)`,
+	}
+	// leaseSchema stores leases granted by LeaseGrant.
+	leaseSchema = []string{
+		`CREATE TABLE IF NOT EXISTS kine_lease
+			(
+				id BIGINT NOT NULL PRIMARY KEY,
+				ttl BIGINT NOT NULL,
+				expires BIGINT NOT NULL
+			)`,
+		`CREATE INDEX IF NOT EXISTS kine_lease_expires_index ON kine_lease (expires)`,
+	}
+	migrations = []generic.SchemaMigration{
+		{ID: 1, Stmts: schema},
+		{ID: 2, Stmts: leaseSchema},
+	}
+)
+
+// regionErrCodes are the codes of errors returned when TiKV regions are unavailable, such as while
+// their leaders are moved or elected, or TiKV or PD are overloaded. The statement has not been
+// applied, and succeeds once the region is available.
+var regionErrCodes = map[uint16]bool{
+	9001: true, // PD server timeout
+	9002: true, // TiKV server timeout
+	9003: true, // TiKV server is busy
+	9004: true, // resolve lock timeout
+	9005: true, // region is unavailable
+}
+
+func New(ctx context.Context, cfg *drivers.Config) (server.Backend, error) {
+	dsnCfg := *cfg
+	dsnCfg.DataSourceName = pessimisticDSN(cfg.DataSourceName)
+
+	backend, dialect, err := mysql.NewVariant(ctx, &dsnCfg, migrations)
+	if err != nil {
+		return nil, err
+	}
+
+	// TiDB reports write conflicts and retryable transaction errors with its own error codes.
+	dialect.RetriableErrCodes = append(dialect.RetriableErrCodes, "9007", "8022", "8028")
+	dialect.Retry = func(err error) bool {
+		if err, ok := err.(*gomysql.MySQLError); ok {
+			return regionErrCodes[err.Number]
+		}
+		return false
+	}
+
+	return backend, nil
+}
+
+// pessimisticDSN sets the tidb_txn_mode session variable to use pessimistic transactions, unless
+// the DSN sets it. Optimistic transactions, the default of clusters created before TiDB 3.0.8,
+// only detect write conflicts on commit, failing the compaction and lease transactions when
+// they conflict with writes instead of waiting for the locks. A default DSN is left unchanged.
+func pessimisticDSN(dataSourceName string) string {
+	if dataSourceName == "" || strings.Contains(dataSourceName, "tidb_txn_mode=") {
+		return dataSourceName
+	}
+	// the value of a session variable is sent as written, so it must be quoted
+	param := "tidb_txn_mode=%27pessimistic%27"
+	if strings.Contains(dataSourceName[strings.LastIndex(dataSourceName, "/")+1:], "?") {
+		return dataSourceName + "&" + param
+	}
+	return dataSourceName + "?" + param
+}
@@ -0,0 +1,91 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const debugPath = "/debug/kine"
+
+// debugStatus is the document served at the debug path.
+type debugStatus struct {
+	CurrentRevision int64     `json:"currentRevision"`
+	CompactRevision int64     `json:"compactRevision"`
+	LastCompact     time.Time `json:"lastCompact,omitempty"`
+	CompactStale    bool      `json:"compactStale"`
+	DBSize          int64     `json:"dbSize"`
+}
+
+// serveDebug starts a HTTP server on the given address, that serves the current state of the
+// backend as a JSON document. The server is shut down when the context is cancelled.
+func serveDebug(ctx context.Context, address string, backend server.Backend) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(debugPath, func(w http.ResponseWriter, r *http.Request) {
+		serveDebugStatus(w, r, backend)
+	})
+
+	httpServer := &http.Server{
+		Handler:  mux,
+		ErrorLog: log.New(logrus.StandardLogger().Writer(), "kinedebug ", log.LstdFlags),
+	}
+
+	go func() {
+		logrus.Infof("Kine debug server is listening at %s%s", address, debugPath)
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logrus.Errorf("Kine debug server shutdown: %v", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		if err := httpServer.Shutdown(context.Background()); err != nil {
+			logrus.Errorf("Failed to shut down kine debug server: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// serveDebugStatus responds with the current and compact revisions and the size of the datastore.
+func serveDebugStatus(w http.ResponseWriter, r *http.Request, backend server.Backend) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	health, err := backend.Health(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	status := debugStatus{
+		CurrentRevision: health.CurrentRevision,
+		CompactRevision: health.CompactRevision,
+		LastCompact:     health.LastCompact,
+		CompactStale:    health.CompactStale,
+	}
+
+	// not all datastores support size reporting
+	if size, err := backend.DbSize(r.Context()); err == nil {
+		status.DBSize = size
+	} else {
+		logrus.Debugf("Failed to get datastore size for debug status: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logrus.Errorf("Failed to write debug status: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// statusBackend is a backend that only reports its health and size.
+type statusBackend struct {
+	server.Backend
+	health *server.HealthStatus
+	size   int64
+}
+
+func (b *statusBackend) Health(ctx context.Context) (*server.HealthStatus, error) {
+	return b.health, nil
+}
+
+func (b *statusBackend) DbSize(ctx context.Context) (int64, error) {
+	return b.size, nil
+}
+
+func TestServeDebug(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	lastCompact := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	backend := &statusBackend{
+		health: &server.HealthStatus{CurrentRevision: 42, CompactRevision: 30, LastCompact: lastCompact},
+		size:   8192,
+	}
+	if err := serveDebug(ctx, address, backend); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + address + debugPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %q, want application/json", ct)
+	}
+
+	var status debugStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	want := debugStatus{CurrentRevision: 42, CompactRevision: 30, LastCompact: lastCompact, DBSize: 8192}
+	if status != want {
+		t.Errorf("debug status = %+v, want %+v", status, want)
+	}
+
+	resp, err = http.Post("http://"+address+debugPath, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+}
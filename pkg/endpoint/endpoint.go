@@ -3,16 +3,30 @@ package endpoint
 import (
 	"context"
 	"fmt"
+	"io"
 	"net"
 	"os"
+	"regexp"
 	"strings"
+	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/crdb"
 	"github.com/k3s-io/kine/pkg/drivers/dqlite"
+	"github.com/k3s-io/kine/pkg/drivers/dynamodb"
+	"github.com/k3s-io/kine/pkg/drivers/foundationdb"
 	"github.com/k3s-io/kine/pkg/drivers/generic"
 	"github.com/k3s-io/kine/pkg/drivers/jetstream"
+	"github.com/k3s-io/kine/pkg/drivers/memory"
 	"github.com/k3s-io/kine/pkg/drivers/mysql"
+	"github.com/k3s-io/kine/pkg/drivers/oracle"
 	"github.com/k3s-io/kine/pkg/drivers/pgsql"
+	"github.com/k3s-io/kine/pkg/drivers/spanner"
 	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/drivers/sqlserver"
+	"github.com/k3s-io/kine/pkg/drivers/tidb"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/k3s-io/kine/pkg/tls"
@@ -27,23 +41,99 @@ import (
 )
 
 const (
-	KineSocket       = "unix://kine.sock"
-	SQLiteBackend    = "sqlite"
-	DQLiteBackend    = "dqlite"
-	ETCDBackend      = "etcd3"
-	JetStreamBackend = "jetstream"
-	MySQLBackend     = "mysql"
-	PostgresBackend  = "postgres"
+	backendCloseTimeout = 10 * time.Second
+)
+
+var envVarRegexp = regexp.MustCompile(`\$\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+const (
+	KineSocket          = "unix://kine.sock"
+	SQLiteBackend       = "sqlite"
+	DQLiteBackend       = "dqlite"
+	ETCDBackend         = "etcd3"
+	JetStreamBackend    = "jetstream"
+	MySQLBackend        = "mysql"
+	PostgresBackend     = "postgres"
+	TiDBBackend         = "tidb"
+	SQLServerBackend    = "sqlserver"
+	CockroachBackend    = "cockroachdb"
+	OracleBackend       = "oracle"
+	DynamoDBBackend     = "dynamodb"
+	SpannerBackend      = "spanner"
+	FoundationDBBackend = "foundationdb"
+	MemoryBackend       = "memory"
 )
 
 type Config struct {
-	GRPCServer           *grpc.Server
+	GRPCServer *grpc.Server
+	// GRPCServerOptions, UnaryInterceptors, and StreamInterceptors are added to the GRPC
+	// server built when GRPCServer is not set. Interceptors are chained in the order given.
+	GRPCServerOptions    []grpc.ServerOption
+	UnaryInterceptors    []grpc.UnaryServerInterceptor
+	StreamInterceptors   []grpc.StreamServerInterceptor
 	Listener             string
 	Endpoint             string
 	ConnectionPoolConfig generic.ConnectionPoolConfig
 	ServerTLSConfig      tls.Config
 	BackendTLSConfig     tls.Config
-	MetricsRegisterer    prometheus.Registerer
+	// ClientCertAuth requires clients to present a certificate signed by the CA of ServerTLSConfig.
+	// If authentication is enabled through the Auth service, users are identified by the common
+	// name of their certificate.
+	ClientCertAuth bool
+	// AuthorizationPolicyFile is the path of a YAML file containing a server.Policy, which limits
+	// the keys clients may read and write by the common name of their client certificate. The file
+	// is reloaded when it changes.
+	AuthorizationPolicyFile string
+	MetricsRegisterer       prometheus.Registerer
+	ReadOnly                bool
+	MaxKeySize              int
+	MaxValueSize            int
+	KeyWriteRate            float64
+	KeyWriteBurst           int
+	CompactInterval         time.Duration
+	CompactBatchSize        int
+	CompactBatchDelay       time.Duration
+	CompactMinRetain        int64
+	CompactJitter           int
+	CompactDryRun           bool
+	CompactStrategy         string
+	NotifyInterval          time.Duration
+	WatchCacheSize          int
+	CacheSize               int
+	AutoCompactionMode      string
+	AutoCompactionRetention string
+	DebugAddress            string
+	DatabaseName            string
+	ValueCompression        string
+	ValueCompressionMinSize int
+	ValueEncryptionKey      string
+	CompressExistingValues  bool
+	FastCount               bool
+	SchemaEndpoint          string
+	ReadEndpoint            string
+	ReadEndpointMaxLag      int64
+	Dialer                  drivers.DialFunc
+	// TracingEndpoint is the address of an OTLP gRPC collector to export traces of RPCs and SQL
+	// statements to. Tracing is disabled if it is empty. TracingServiceName is the service name
+	// reported in traces, DefaultTracingServiceName if empty.
+	TracingEndpoint    string
+	TracingServiceName string
+	// JetStreamReplicas, JetStreamStorage, JetStreamPlacementCluster, and JetStreamPlacementTags
+	// configure the stream created for the JetStream bucket. See drivers.Config.
+	JetStreamReplicas         int
+	JetStreamStorage          string
+	JetStreamPlacementCluster string
+	JetStreamPlacementTags    []string
+	// SQLiteJournalMode, SQLiteSynchronous, SQLiteBusyTimeout, and SQLiteCheckpointInterval
+	// configure SQLite connections and the truncation of the WAL. See drivers.Config.
+	SQLiteJournalMode        string
+	SQLiteSynchronous        string
+	SQLiteBusyTimeout        time.Duration
+	SQLiteCheckpointInterval time.Duration
+	// SQLiteReplicateURL and SQLiteRestoreTime configure the replication of SQLite databases to
+	// object storage. See drivers.Config.
+	SQLiteReplicateURL string
+	SQLiteRestoreTime  string
 }
 
 type ETCDConfig struct {
@@ -62,6 +152,49 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		}, nil
 	}
 
+	dsn, err := expandEnv(dsn)
+	if err != nil {
+		return ETCDConfig{}, errors.Wrap(err, "expanding datastore endpoint")
+	}
+
+	if config.ClientCertAuth && (config.ServerTLSConfig.CertFile == "" || config.ServerTLSConfig.KeyFile == "") {
+		return ETCDConfig{}, errors.New("client certificate authentication requires a server certificate and key")
+	}
+
+	if config.TracingEndpoint != "" {
+		unary, stream, err := setupTracing(ctx, config)
+		if err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "setting up tracing")
+		}
+		// the tracing interceptors run first, so that the spans cover the other interceptors
+		config.UnaryInterceptors = append(unary, config.UnaryInterceptors...)
+		config.StreamInterceptors = append(stream, config.StreamInterceptors...)
+	}
+
+	if config.SchemaEndpoint != "" {
+		schemaDriver, schemaDSN := ParseStorageEndpoint(config.SchemaEndpoint)
+		if schemaDriver != driver {
+			return ETCDConfig{}, fmt.Errorf("schema endpoint driver %s does not match datastore endpoint driver %s", schemaDriver, driver)
+		}
+		// the driver is passed the DSN without the scheme, as for the datastore endpoint
+		if config.SchemaEndpoint, err = expandEnv(schemaDSN); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "expanding schema endpoint")
+		}
+	}
+
+	if config.ReadEndpoint != "" {
+		readDriver, readDSN := ParseStorageEndpoint(config.ReadEndpoint)
+		if readDriver != driver {
+			return ETCDConfig{}, fmt.Errorf("read endpoint driver %s does not match datastore endpoint driver %s", readDriver, driver)
+		}
+		if driver != PostgresBackend && driver != MySQLBackend {
+			return ETCDConfig{}, fmt.Errorf("read endpoint is not supported by the %s driver", driver)
+		}
+		if config.ReadEndpoint, err = expandEnv(readDSN); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "expanding read endpoint")
+		}
+	}
+
 	leaderelect, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
 	if err != nil {
 		return ETCDConfig{}, errors.Wrap(err, "building kine")
@@ -71,7 +204,18 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		config.MetricsRegisterer.MustRegister(
 			metrics.SQLTotal,
 			metrics.SQLTime,
+			metrics.SQLStatementTime,
+			metrics.SQLRetriesTotal,
+			metrics.SQLFailoversTotal,
+			metrics.SQLTranslatedErrorsTotal,
 			metrics.CompactTotal,
+			metrics.CompactDeletedRows,
+			metrics.WatchStreams,
+			metrics.WatchEventsTotal,
+			metrics.WatchLag,
+			metrics.CurrentRevision,
+			metrics.SQLReplicaLag,
+			metrics.TxnTotal,
 		)
 	}
 
@@ -79,8 +223,33 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 		return ETCDConfig{}, errors.Wrap(err, "starting kine backend")
 	}
 
+	// close the backend on shutdown, so that background tasks stop cleanly
+	go func() {
+		<-ctx.Done()
+		closeCtx, cancel := context.WithTimeout(context.Background(), backendCloseTimeout)
+		defer cancel()
+		if err := backend.Close(closeCtx); err != nil {
+			logrus.Errorf("Failed to close kine backend: %v", err)
+		}
+	}()
+
+	if config.DebugAddress != "" {
+		if err := serveDebug(ctx, config.DebugAddress, backend); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "starting debug server")
+		}
+	}
+
 	// set up GRPC server and register services
-	b := server.New(backend, endpointScheme(config))
+	var authorizer server.Authorizer
+	if config.AuthorizationPolicyFile != "" {
+		policy, err := server.NewPolicyFile(ctx, config.AuthorizationPolicyFile)
+		if err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "loading authorization policy")
+		}
+		authorizer = policy
+	}
+
+	b := server.New(backend, endpointScheme(config), config.NotifyInterval, driver, authorizer)
 	grpcServer, err := grpcServer(config)
 	if err != nil {
 		return ETCDConfig{}, errors.Wrap(err, "creating GRPC server")
@@ -88,7 +257,7 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 	b.Register(grpcServer)
 
 	// set up HTTP server with basic mux
-	httpServer := httpServer()
+	httpServer := httpServer(backend)
 
 	// Create raw listener and wrap in cmux for protocol switching
 	listener, err := createListener(config)
@@ -99,10 +268,13 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 
 	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
 		// If using TLS, wrap handler in GRPC/HTTP switching handler and serve TLS
+		if httpServer.TLSConfig, err = config.ServerTLSConfig.ServerConfig(config.ClientCertAuth); err != nil {
+			return ETCDConfig{}, errors.Wrap(err, "loading server TLS configuration")
+		}
 		httpServer.Handler = grpcHandlerFunc(grpcServer, httpServer.Handler)
 		anyl := m.Match(cmux.Any())
 		go func() {
-			if err := httpServer.ServeTLS(anyl, config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile); err != nil {
+			if err := httpServer.ServeTLS(anyl, "", ""); err != nil {
 				logrus.Errorf("Kine TLS server shutdown: %v", err)
 			}
 		}()
@@ -141,6 +313,78 @@ func Listen(ctx context.Context, config Config) (ETCDConfig, error) {
 
 // endpointURL returns a URI string suitable for use as a local etcd endpoint.
 // For TCP sockets, it is assumed that the port can be reached via the loopback address.
+// Restore loads a snapshot, as written by the Maintenance Snapshot call, into the empty datastore
+// for the configured endpoint, and returns the revision of the snapshot. The backend is not
+// started, so no requests are served and compaction does not run while restoring.
+func Restore(ctx context.Context, config Config, r io.Reader) (int64, error) {
+	driver, dsn := ParseStorageEndpoint(config.Endpoint)
+	if driver == ETCDBackend {
+		return 0, fmt.Errorf("snapshots cannot be restored into an etcd endpoint")
+	}
+
+	dsn, err := expandEnv(dsn)
+	if err != nil {
+		return 0, errors.Wrap(err, "expanding datastore endpoint")
+	}
+
+	_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+	if err != nil {
+		return 0, errors.Wrap(err, "building kine")
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), backendCloseTimeout)
+		defer cancel()
+		if err := backend.Close(closeCtx); err != nil {
+			logrus.Errorf("Failed to close kine backend: %v", err)
+		}
+	}()
+
+	snapshotter, ok := backend.(server.Snapshotter)
+	if !ok {
+		return 0, fmt.Errorf("storage backend %s does not support restoring snapshots", driver)
+	}
+	return snapshotter.Restore(ctx, r)
+}
+
+// Migrate copies the full history of the datastore for the source endpoint into the empty
+// datastore for the target endpoint, preserving revisions, and returns the current revision of
+// the target. Other than the endpoint, the config is used for both datastores. Neither backend
+// is started, and the source should not be in use while its rows are copied.
+func Migrate(ctx context.Context, config Config, sourceEndpoint, targetEndpoint string) (int64, error) {
+	var backends []server.Backend
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.Background(), backendCloseTimeout)
+		defer cancel()
+		for _, backend := range backends {
+			if err := backend.Close(closeCtx); err != nil {
+				logrus.Errorf("Failed to close kine backend: %v", err)
+			}
+		}
+	}()
+
+	for _, e := range []string{sourceEndpoint, targetEndpoint} {
+		driver, dsn := ParseStorageEndpoint(e)
+		if driver == ETCDBackend {
+			return 0, fmt.Errorf("cannot migrate to or from an etcd endpoint")
+		}
+		dsn, err := expandEnv(dsn)
+		if err != nil {
+			return 0, errors.Wrap(err, "expanding datastore endpoint")
+		}
+		_, backend, err := getKineStorageBackend(ctx, driver, dsn, config)
+		if err != nil {
+			return 0, errors.Wrapf(err, "building kine for %s", driver)
+		}
+		backends = append(backends, backend)
+	}
+
+	migrator, ok := backends[0].(server.Migrator)
+	if !ok {
+		return 0, fmt.Errorf("source storage backend does not support migration")
+	}
+	return migrator.MigrateTo(ctx, backends[1])
+}
+
 func endpointURL(config Config, listener net.Listener) string {
 	scheme := endpointScheme(config)
 	address := listener.Addr().String()
@@ -199,9 +443,13 @@ func createListener(config Config) (ret net.Listener, rerr error) {
 }
 
 // grpcServer returns either a preconfigured GRPC server, or builds a new GRPC
-// server using upstream keepalive defaults plus the local Server TLS configuration.
+// server using upstream keepalive defaults plus the local Server TLS configuration,
+// and any caller-provided server options and interceptors.
 func grpcServer(config Config) (*grpc.Server, error) {
 	if config.GRPCServer != nil {
+		if len(config.GRPCServerOptions) > 0 || len(config.UnaryInterceptors) > 0 || len(config.StreamInterceptors) > 0 {
+			logrus.Warnf("Ignoring GRPC server options and interceptors, as a preconfigured GRPC server was provided")
+		}
 		return config.GRPCServer, nil
 	}
 
@@ -217,13 +465,21 @@ func grpcServer(config Config) (*grpc.Server, error) {
 	}
 
 	if config.ServerTLSConfig.CertFile != "" && config.ServerTLSConfig.KeyFile != "" {
-		creds, err := credentials.NewServerTLSFromFile(config.ServerTLSConfig.CertFile, config.ServerTLSConfig.KeyFile)
+		tlsConfig, err := config.ServerTLSConfig.ServerConfig(config.ClientCertAuth)
 		if err != nil {
 			return nil, err
 		}
-		gopts = append(gopts, grpc.Creds(creds))
+		gopts = append(gopts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
 
+	if len(config.UnaryInterceptors) > 0 {
+		gopts = append(gopts, grpc.ChainUnaryInterceptor(config.UnaryInterceptors...))
+	}
+	if len(config.StreamInterceptors) > 0 {
+		gopts = append(gopts, grpc.ChainStreamInterceptor(config.StreamInterceptors...))
+	}
+	gopts = append(gopts, config.GRPCServerOptions...)
+
 	return grpc.NewServer(gopts...), nil
 }
 
@@ -235,19 +491,94 @@ func getKineStorageBackend(ctx context.Context, driver, dsn string, cfg Config)
 		backend     server.Backend
 		leaderElect = true
 		err         error
+		driverCfg   = &drivers.Config{
+			DataSourceName:          dsn,
+			BackendTLSConfig:        cfg.BackendTLSConfig,
+			ConnectionPoolConfig:    cfg.ConnectionPoolConfig,
+			MetricsRegisterer:       cfg.MetricsRegisterer,
+			DatabaseName:            cfg.DatabaseName,
+			ReadOnly:                cfg.ReadOnly,
+			MaxKeySize:              cfg.MaxKeySize,
+			MaxValueSize:            cfg.MaxValueSize,
+			KeyWriteRate:            cfg.KeyWriteRate,
+			KeyWriteBurst:           cfg.KeyWriteBurst,
+			CompactInterval:         cfg.CompactInterval,
+			CompactBatchSize:        cfg.CompactBatchSize,
+			CompactBatchDelay:       cfg.CompactBatchDelay,
+			CompactMinRetain:        cfg.CompactMinRetain,
+			CompactIntervalJitter:   cfg.CompactJitter,
+			CompactDryRun:           cfg.CompactDryRun,
+			CompactStrategy:         cfg.CompactStrategy,
+			AutoCompactionMode:      cfg.AutoCompactionMode,
+			AutoCompactionRetention: cfg.AutoCompactionRetention,
+			ValueCompression:        cfg.ValueCompression,
+			ValueCompressionMinSize: cfg.ValueCompressionMinSize,
+			ValueEncryptionKey:      cfg.ValueEncryptionKey,
+			CompressExistingValues:  cfg.CompressExistingValues,
+			FastCount:               cfg.FastCount,
+			WatchCacheSize:          cfg.WatchCacheSize,
+			CacheSize:               cfg.CacheSize,
+			Dialer:                  cfg.Dialer,
+			SchemaDataSourceName:    cfg.SchemaEndpoint,
+			ReadDataSourceName:      cfg.ReadEndpoint,
+			MaxReadLag:              cfg.ReadEndpointMaxLag,
+
+			JetStreamReplicas:         cfg.JetStreamReplicas,
+			JetStreamStorage:          cfg.JetStreamStorage,
+			JetStreamPlacementCluster: cfg.JetStreamPlacementCluster,
+			JetStreamPlacementTags:    cfg.JetStreamPlacementTags,
+
+			SQLiteJournalMode:        cfg.SQLiteJournalMode,
+			SQLiteSynchronous:        cfg.SQLiteSynchronous,
+			SQLiteBusyTimeout:        cfg.SQLiteBusyTimeout,
+			SQLiteCheckpointInterval: cfg.SQLiteCheckpointInterval,
+			SQLiteReplicateURL:       cfg.SQLiteReplicateURL,
+			SQLiteRestoreTime:        cfg.SQLiteRestoreTime,
+		}
 	)
+	if err := driverCfg.ParseDSNParams(); err != nil {
+		return false, nil, err
+	}
+	if _, err := logstructured.ValueCodecByName(cfg.ValueCompression); err != nil {
+		return false, nil, err
+	}
+	if _, err := logstructured.KeyWrapperByURL(cfg.ValueEncryptionKey); err != nil {
+		return false, nil, err
+	}
+	if _, err := sqllog.ParseAutoCompactionRetention(cfg.AutoCompactionMode, cfg.AutoCompactionRetention); err != nil {
+		return false, nil, err
+	}
+	if err := sqllog.ValidateCompactStrategy(cfg.CompactStrategy); err != nil {
+		return false, nil, err
+	}
 	switch driver {
 	case SQLiteBackend:
 		leaderElect = false
-		backend, err = sqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = sqlite.NewWithConfig(ctx, driverCfg)
 	case DQLiteBackend:
-		backend, err = dqlite.New(ctx, dsn, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = dqlite.NewWithConfig(ctx, driverCfg)
 	case PostgresBackend:
-		backend, err = pgsql.New(ctx, dsn, cfg.BackendTLSConfig, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = pgsql.NewWithConfig(ctx, driverCfg)
 	case MySQLBackend:
-		backend, err = mysql.New(ctx, dsn, cfg.BackendTLSConfig, cfg.ConnectionPoolConfig, cfg.MetricsRegisterer)
+		backend, err = mysql.NewWithConfig(ctx, driverCfg)
+	case TiDBBackend:
+		backend, err = tidb.New(ctx, driverCfg)
+	case SQLServerBackend:
+		backend, err = sqlserver.New(ctx, driverCfg)
+	case CockroachBackend:
+		backend, err = crdb.New(ctx, driverCfg)
+	case OracleBackend:
+		backend, err = oracle.New(ctx, driverCfg)
 	case JetStreamBackend:
-		backend, err = jetstream.New(ctx, dsn, cfg.BackendTLSConfig)
+		backend, err = jetstream.NewWithConfig(ctx, driverCfg)
+	case DynamoDBBackend:
+		backend, err = dynamodb.New(ctx, driverCfg)
+	case SpannerBackend:
+		backend, err = spanner.New(ctx, driverCfg)
+	case FoundationDBBackend:
+		backend, err = foundationdb.New(ctx, driverCfg)
+	case MemoryBackend:
+		backend, err = memory.New(ctx, driverCfg)
 	default:
 		return false, nil, fmt.Errorf("storage backend is not defined")
 	}
@@ -280,3 +611,22 @@ func networkAndAddress(str string) (string, string) {
 	}
 	return "", parts[0]
 }
+
+// expandEnv replaces ${VAR} references in the endpoint with the value of the named environment
+// variable, so that secrets such as passwords can be provided via the environment. Other uses of
+// the $ character are left as-is. An error is returned if a referenced variable is not set.
+func expandEnv(str string) (string, error) {
+	var missing []string
+	expanded := envVarRegexp.ReplaceAllStringFunc(str, func(ref string) string {
+		name := ref[2 : len(ref)-1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables referenced by endpoint are not set: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
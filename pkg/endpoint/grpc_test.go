@@ -0,0 +1,78 @@
+package endpoint
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// getBackend is a backend that only serves a single key.
+type getBackend struct {
+	server.Backend
+	kv *server.KeyValue
+}
+
+func (b *getBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (int64, *server.KeyValue, error) {
+	if key == b.kv.Key {
+		return b.kv.ModRevision, b.kv, nil
+	}
+	return b.kv.ModRevision, nil, nil
+}
+
+func TestGRPCServerInterceptors(t *testing.T) {
+	var ranges, streams int32
+	config := Config{
+		UnaryInterceptors: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				if info.FullMethod == "/etcdserverpb.KV/Range" {
+					atomic.AddInt32(&ranges, 1)
+				}
+				return handler(ctx, req)
+			},
+		},
+		StreamInterceptors: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				atomic.AddInt32(&streams, 1)
+				return handler(srv, ss)
+			},
+		},
+	}
+	srv, err := grpcServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &getBackend{kv: &server.KeyValue{Key: "/registry/a", Value: []byte("a"), CreateRevision: 5, ModRevision: 5}}
+	server.New(backend, "unix", 0, "test", nil).Register(srv)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	conn, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := etcdserverpb.NewKVClient(conn).Range(context.Background(), &etcdserverpb.RangeRequest{Key: []byte("/registry/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "a" {
+		t.Errorf("range returned %v, want /registry/a", resp.Kvs)
+	}
+	if got := atomic.LoadInt32(&ranges); got != 1 {
+		t.Errorf("interceptor observed %d ranges, want 1", got)
+	}
+	if got := atomic.LoadInt32(&streams); got != 0 {
+		t.Errorf("stream interceptor observed %d streams, want 0", got)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strings"
 
+	"github.com/k3s-io/kine/pkg/server"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
 )
@@ -12,13 +13,17 @@ import (
 var (
 	etcdVersion = []byte(`{"etcdserver":"3.5.0","etcdcluster":"3.5.0"}`)
 	versionPath = "/version"
+	healthzPath = "/healthz"
 )
 
 // httpServer returns a HTTP server with the basic mux handler.
-func httpServer() *http.Server {
+func httpServer(backend server.Backend) *http.Server {
 	// Set up root HTTP mux with basic response handlers
 	mux := http.NewServeMux()
 	handleBasic(mux)
+	mux.HandleFunc(healthzPath, func(w http.ResponseWriter, r *http.Request) {
+		serveHealthz(w, r, backend)
+	})
 
 	return &http.Server{
 		Handler:  mux,
@@ -40,6 +45,20 @@ func serveVersion(w http.ResponseWriter, r *http.Request) {
 	w.Write(etcdVersion)
 }
 
+// serveHealthz responds with ok if the datastore is reachable, or with ServiceUnavailable and
+// the error if it is not.
+func serveHealthz(w http.ResponseWriter, r *http.Request, backend server.Backend) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	if _, err := backend.Health(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
 // allowMethod returns true if a method is allowed, or false (after sending a
 // MethodNotAllowed error to the client) if it is not.
 func allowMethod(w http.ResponseWriter, r *http.Request, m string) bool {
@@ -0,0 +1,74 @@
+package endpoint
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpgrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	tracesdk "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/semconv"
+	"google.golang.org/grpc"
+)
+
+const (
+	// DefaultTracingServiceName is the service name reported in traces if none is configured.
+	DefaultTracingServiceName = "kine"
+
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// setupTracing exports traces to the OTLP collector at config.TracingEndpoint, and returns the
+// interceptors that start a span for each RPC. The trace context is propagated from clients using
+// W3C trace context headers. The tracer provider is also registered globally, so that the drivers
+// record a child span for each SQL statement.
+func setupTracing(ctx context.Context, config Config) ([]grpc.UnaryServerInterceptor, []grpc.StreamServerInterceptor, error) {
+	exporter, err := otlp.NewExporter(ctx,
+		otlpgrpc.NewDriver(
+			otlpgrpc.WithEndpoint(config.TracingEndpoint),
+			otlpgrpc.WithInsecure(),
+		))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serviceName := config.TracingServiceName
+	if serviceName == "" {
+		serviceName = DefaultTracingServiceName
+	}
+	provider := tracesdk.NewTracerProvider(
+		tracesdk.WithBatcher(exporter),
+		tracesdk.WithResource(resource.NewWithAttributes(semconv.ServiceNameKey.String(serviceName))),
+	)
+	propagator := propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagator)
+
+	// flush buffered spans on shutdown
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(shutdownCtx); err != nil {
+			logrus.Errorf("Failed to shut down tracing: %v", err)
+		}
+	}()
+
+	logrus.Infof("Exporting traces to %s as service %s", config.TracingEndpoint, serviceName)
+
+	options := []otelgrpc.Option{
+		otelgrpc.WithPropagators(propagator),
+		otelgrpc.WithTracerProvider(provider),
+	}
+	return []grpc.UnaryServerInterceptor{otelgrpc.UnaryServerInterceptor(options...)},
+		[]grpc.StreamServerInterceptor{otelgrpc.StreamServerInterceptor(options...)},
+		nil
+}
@@ -0,0 +1,62 @@
+// Package logging defines the logger used by the Postgres driver and the schema migrations
+// while they set up the datastore, so that applications embedding kine can send those messages,
+// with their structured fields, to their own logging library. Messages are logged with logrus
+// unless another logger is set. Other drivers, and kine once the datastore is set up, log with
+// logrus.
+package logging
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields are structured data attached to log messages.
+type Fields map[string]interface{}
+
+// Logger logs formatted messages at each level, with any fields added by WithFields.
+type Logger interface {
+	WithFields(fields Fields) Logger
+	Tracef(format string, args ...interface{})
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// Logrus returns a Logger that logs to the logrus entry.
+func Logrus(entry *logrus.Entry) Logger {
+	return logrusLogger{entry}
+}
+
+// Default returns a Logger that logs to the standard logrus logger.
+func Default() Logger {
+	return Logrus(logrus.NewEntry(logrus.StandardLogger()))
+}
+
+type logrusLogger struct {
+	*logrus.Entry
+}
+
+func (l logrusLogger) WithFields(fields Fields) Logger {
+	return logrusLogger{l.Entry.WithFields(logrus.Fields(fields))}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a context that carries the logger, which is used by setup functions called
+// with the context. If the logger is nil, the context is returned unchanged.
+func WithLogger(ctx context.Context, log Logger) context.Context {
+	if log == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// FromContext returns the logger carried by the context, or the default logger if there is none.
+func FromContext(ctx context.Context) Logger {
+	if log, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return log
+	}
+	return Default()
+}
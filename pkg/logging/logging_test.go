@@ -0,0 +1,31 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestFromContext(t *testing.T) {
+	ctx := context.Background()
+	if _, ok := FromContext(ctx).(logrusLogger); !ok {
+		t.Errorf("FromContext without a logger = %T, want the logrus logger", FromContext(ctx))
+	}
+	if WithLogger(ctx, nil) != ctx {
+		t.Error("WithLogger with a nil logger changed the context")
+	}
+
+	buf := &bytes.Buffer{}
+	l := logrus.New()
+	l.SetOutput(buf)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	ctx = WithLogger(ctx, Logrus(logrus.NewEntry(l)))
+
+	FromContext(ctx).WithFields(Fields{"index": "kine_name_index"}).Warnf("Index %s", "is missing")
+	if got := buf.String(); !strings.Contains(got, `msg="Index is missing"`) || !strings.Contains(got, "index=kine_name_index") {
+		t.Errorf("logged %q, want message with index field", got)
+	}
+}
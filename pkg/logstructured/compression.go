@@ -0,0 +1,436 @@
+package logstructured
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// compressedValueHeader prefixes compressed values, and is followed by a single byte
+// identifying the codec. Values without the header are stored uncompressed, so rows
+// written before compression was enabled can still be read.
+var compressedValueHeader = []byte{0x00, 'k', 'z'}
+
+// rawValueHeader prefixes values that are stored uncompressed and unencrypted, but start with
+// one of the value headers, so that they are read back as written instead of being decoded.
+var rawValueHeader = []byte{0x00, 'k', 'r'}
+
+// hasValueHeader returns true if the value starts with one of the headers of encoded values.
+func hasValueHeader(value []byte) bool {
+	return bytes.HasPrefix(value, compressedValueHeader) || bytes.HasPrefix(value, encryptedValueHeader) || bytes.HasPrefix(value, rawValueHeader)
+}
+
+// needsEscape returns true if the value of the key value must be escaped before it is stored.
+func needsEscape(kv *server.KeyValue) bool {
+	return kv != nil && hasValueHeader(kv.Value)
+}
+
+// ValueCodec compresses and decompresses values stored in the datastore.
+type ValueCodec interface {
+	ID() byte
+	Encode(value []byte) ([]byte, error)
+	Decode(value []byte) ([]byte, error)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() byte {
+	return 1
+}
+
+func (gzipCodec) Encode(value []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(value); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(value []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(value))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type zstdCodec struct {
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func newZstdCodec() *zstdCodec {
+	// encoders and decoders without a reader or writer are only used for EncodeAll and
+	// DecodeAll, which are safe for concurrent use, so creation cannot fail.
+	encoder, _ := zstd.NewWriter(nil)
+	decoder, _ := zstd.NewReader(nil)
+	return &zstdCodec{encoder: encoder, decoder: decoder}
+}
+
+func (*zstdCodec) ID() byte {
+	return 2
+}
+
+func (c *zstdCodec) Encode(value []byte) ([]byte, error) {
+	return c.encoder.EncodeAll(value, nil), nil
+}
+
+func (c *zstdCodec) Decode(value []byte) ([]byte, error) {
+	return c.decoder.DecodeAll(value, nil)
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) ID() byte {
+	return 3
+}
+
+func (snappyCodec) Encode(value []byte) ([]byte, error) {
+	return snappy.Encode(nil, value), nil
+}
+
+func (snappyCodec) Decode(value []byte) ([]byte, error) {
+	return snappy.Decode(nil, value)
+}
+
+var valueCodecs = map[string]ValueCodec{
+	"gzip":   gzipCodec{},
+	"snappy": snappyCodec{},
+	"zstd":   newZstdCodec(),
+}
+
+// ValueCodecByName returns the value codec with the given name, or nil if the name is empty.
+func ValueCodecByName(name string) (ValueCodec, error) {
+	if name == "" {
+		return nil, nil
+	}
+	codec, ok := valueCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported value compression %q: must be one of gzip, snappy, or zstd", name)
+	}
+	return codec, nil
+}
+
+// compressedLog wraps a Log, compressing values of at least minSize bytes with the codec
+// and then encrypting them, if encryption is set, when they are appended, and decrypting and
+// decompressing values as they are read. If codec is nil, values are only decompressed. Values
+// that are stored as written but start with a value header are escaped with rawValueHeader.
+type compressedLog struct {
+	Log
+	codec      ValueCodec
+	minSize    int
+	encryption *valueEncryption
+}
+
+func (c *compressedLog) Append(ctx context.Context, event *server.Event) (int64, error) {
+	if c.codec == nil && c.encryption == nil && !needsEscape(event.KV) && !needsEscape(event.PrevKV) {
+		return c.Log.Append(ctx, event)
+	}
+
+	// copy the event, as the caller may return the key values to the client
+	compressed := *event
+	var err error
+	if compressed.KV, err = c.encode(ctx, event.KV); err != nil {
+		return 0, err
+	}
+	if compressed.PrevKV, err = c.encode(ctx, event.PrevKV); err != nil {
+		return 0, err
+	}
+	return c.Log.Append(ctx, &compressed)
+}
+
+func (c *compressedLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeletes bool) (int64, []*server.Event, error) {
+	rev, events, err := c.Log.List(ctx, prefix, startKey, limit, revision, includeDeletes)
+	if err != nil {
+		return rev, events, err
+	}
+	return rev, events, c.decodeEvents(ctx, events)
+}
+
+func (c *compressedLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	rev, events, err := c.Log.After(ctx, prefix, revision, limit)
+	if err != nil {
+		return rev, events, err
+	}
+	return rev, events, c.decodeEvents(ctx, events)
+}
+
+// Watch decodes the events of the log's watch. If an event cannot be decoded, the watch is closed
+// instead of sending the value as stored.
+func (c *compressedLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
+	ctx, cancel := context.WithCancel(ctx)
+	events := c.Log.Watch(ctx, prefix)
+	result := make(chan []*server.Event, cap(events))
+	go func() {
+		defer close(result)
+		defer cancel()
+		for e := range events {
+			// events are shared between watchers, so copy them instead of decoding in place
+			decoded := make([]*server.Event, 0, len(e))
+			for _, event := range e {
+				copied := *event
+				decoded = append(decoded, &copied)
+			}
+			if err := c.decodeEvents(ctx, decoded); err != nil {
+				logrus.Errorf("Failed to decode watch event, closing watch of %s: %v", prefix, err)
+				cancel()
+				for range events {
+				}
+				return
+			}
+			result <- decoded
+		}
+	}()
+	return result
+}
+
+func (c *compressedLog) GetMany(ctx context.Context, keys []string) (int64, []*server.Event, error) {
+	getter, ok := c.Log.(BulkGetter)
+	if !ok {
+		return 0, nil, server.ErrNotSupported
+	}
+	rev, events, err := getter.GetMany(ctx, keys)
+	if err != nil {
+		return rev, events, err
+	}
+	return rev, events, c.decodeEvents(ctx, events)
+}
+
+func (c *compressedLog) GetAtRevision(ctx context.Context, key string, revision int64) (*server.KeyValue, error) {
+	reader, ok := c.Log.(ArchiveReader)
+	if !ok {
+		return nil, server.ErrNotSupported
+	}
+	kv, err := reader.GetAtRevision(ctx, key, revision)
+	if err != nil {
+		return nil, err
+	}
+	return c.decode(ctx, kv)
+}
+
+func (c *compressedLog) WatchProgressRevision() int64 {
+	if reporter, ok := c.Log.(server.WatchProgressReporter); ok {
+		return reporter.WatchProgressRevision()
+	}
+	return 0
+}
+
+func (c *compressedLog) Compact(ctx context.Context, revision int64) error {
+	compactor, ok := c.Log.(server.Compactor)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	return compactor.Compact(ctx, revision)
+}
+
+func (c *compressedLog) Defragment(ctx context.Context) error {
+	defragmenter, ok := c.Log.(server.Defragmenter)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	return defragmenter.Defragment(ctx)
+}
+
+// Lease operations do not read or write values, so they are passed through to the log.
+func (c *compressedLog) leaseLog() (LeaseLog, error) {
+	leases, ok := c.Log.(LeaseLog)
+	if !ok {
+		return nil, server.ErrNotSupported
+	}
+	return leases, nil
+}
+
+func (c *compressedLog) LeaseGrant(ctx context.Context, id, ttl int64) (int64, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	return leases.LeaseGrant(ctx, id, ttl)
+}
+
+func (c *compressedLog) LeaseRevoke(ctx context.Context, id int64) (int64, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	return leases.LeaseRevoke(ctx, id)
+}
+
+func (c *compressedLog) LeaseKeepAlive(ctx context.Context, id int64) (int64, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	return leases.LeaseKeepAlive(ctx, id)
+}
+
+func (c *compressedLog) LeaseTimeToLive(ctx context.Context, id int64, keys bool) (*server.Lease, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return nil, err
+	}
+	return leases.LeaseTimeToLive(ctx, id, keys)
+}
+
+func (c *compressedLog) LeaseLeases(ctx context.Context) ([]int64, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return nil, err
+	}
+	return leases.LeaseLeases(ctx)
+}
+
+func (c *compressedLog) ExpiredLeases(ctx context.Context) ([]int64, error) {
+	leases, err := c.leaseLog()
+	if err != nil {
+		return nil, err
+	}
+	return leases.ExpiredLeases(ctx)
+}
+
+// Snapshot and Restore pass values through as stored, without decoding or encoding them, so that
+// snapshots can be taken and restored without decompressing every value.
+func (c *compressedLog) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	snapshotter, ok := c.Log.(server.Snapshotter)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return snapshotter.Snapshot(ctx, w)
+}
+
+func (c *compressedLog) Restore(ctx context.Context, r io.Reader) (int64, error) {
+	snapshotter, ok := c.Log.(server.Snapshotter)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return snapshotter.Restore(ctx, r)
+}
+
+// CopyTo copies rows as stored, so values are copied without being decompressed.
+func (c *compressedLog) CopyTo(ctx context.Context, target Log) (int64, error) {
+	if t, ok := target.(*compressedLog); ok {
+		target = t.Log
+	}
+	copier, ok := c.Log.(RowCopier)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return copier.CopyTo(ctx, target)
+}
+
+func (c *compressedLog) encode(ctx context.Context, kv *server.KeyValue) (*server.KeyValue, error) {
+	if kv == nil || len(kv.Value) == 0 {
+		return kv, nil
+	}
+
+	value := kv.Value
+	if c.codec != nil && len(value) >= c.minSize {
+		compressed, err := c.codec.Encode(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to compress value of %s", kv.Key)
+		}
+		value = make([]byte, 0, len(compressedValueHeader)+1+len(compressed))
+		value = append(value, compressedValueHeader...)
+		value = append(value, c.codec.ID())
+		value = append(value, compressed...)
+	} else if hasValueHeader(value) {
+		value = make([]byte, 0, len(rawValueHeader)+len(kv.Value))
+		value = append(value, rawValueHeader...)
+		value = append(value, kv.Value...)
+	}
+	if c.encryption != nil {
+		encrypted, err := c.encryption.encrypt(ctx, kv.Key, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to encrypt value of %s", kv.Key)
+		}
+		value = encrypted
+	}
+
+	encoded := *kv
+	encoded.Value = value
+	return &encoded, nil
+}
+
+// decodeError is returned when a stored value cannot be decrypted or decompressed.
+type decodeError struct {
+	error
+}
+
+func (e decodeError) Unwrap() error {
+	return e.error
+}
+
+// isDecodeError returns true if the error is a failure to decode a stored value, which is not
+// resolved by retrying the read.
+func isDecodeError(err error) bool {
+	var derr decodeError
+	return errors.As(err, &derr)
+}
+
+// decodeEvents replaces the key values of the events with decrypted and decompressed copies, if
+// encrypted or compressed.
+func (c *compressedLog) decodeEvents(ctx context.Context, events []*server.Event) error {
+	for _, event := range events {
+		kv, err := c.decode(ctx, event.KV)
+		if err != nil {
+			return decodeError{err}
+		}
+		prevKV, err := c.decode(ctx, event.PrevKV)
+		if err != nil {
+			return decodeError{err}
+		}
+		event.KV, event.PrevKV = kv, prevKV
+	}
+	return nil
+}
+
+func (c *compressedLog) decode(ctx context.Context, kv *server.KeyValue) (*server.KeyValue, error) {
+	if kv != nil && bytes.HasPrefix(kv.Value, encryptedValueHeader) {
+		value, err := c.encryption.decrypt(ctx, kv.Key, kv.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decrypt value of %s", kv.Key)
+		}
+		decrypted := *kv
+		decrypted.Value = value
+		kv = &decrypted
+	}
+
+	if kv != nil && bytes.HasPrefix(kv.Value, rawValueHeader) {
+		raw := *kv
+		raw.Value = kv.Value[len(rawValueHeader):]
+		return &raw, nil
+	}
+
+	if kv == nil || !bytes.HasPrefix(kv.Value, compressedValueHeader) || len(kv.Value) == len(compressedValueHeader) {
+		return kv, nil
+	}
+
+	id := kv.Value[len(compressedValueHeader)]
+	for _, codec := range valueCodecs {
+		if codec.ID() != id {
+			continue
+		}
+		value, err := codec.Decode(kv.Value[len(compressedValueHeader)+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to decompress value of %s", kv.Key)
+		}
+		decoded := *kv
+		decoded.Value = value
+		return &decoded, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %d for value of %s", id, kv.Key)
+}
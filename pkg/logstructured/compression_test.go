@@ -0,0 +1,48 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestValueEncoding(t *testing.T) {
+	ctx := context.Background()
+	values := [][]byte{
+		nil,
+		[]byte("value"),
+		bytes.Repeat([]byte("value"), 100),
+		append(append([]byte{}, compressedValueHeader...), 1, 'x'),
+		append(append([]byte{}, compressedValueHeader...), 9),
+		append(append([]byte{}, encryptedValueHeader...), 0, 1, 'x'),
+		append(append([]byte{}, rawValueHeader...), 'x'),
+		{0x00, 'k'},
+	}
+	logs := map[string]*compressedLog{
+		"uncompressed": {},
+		"compressed":   {codec: gzipCodec{}, minSize: 16},
+	}
+	for name, c := range logs {
+		t.Run(name, func(t *testing.T) {
+			for _, value := range values {
+				kv := &server.KeyValue{Key: "/a", Value: value}
+				encoded, err := c.encode(ctx, kv)
+				if err != nil {
+					t.Fatalf("encode %q: %v", value, err)
+				}
+				if !bytes.Equal(kv.Value, value) {
+					t.Fatalf("encode %q changed the key value", value)
+				}
+				decoded, err := c.decode(ctx, encoded)
+				if err != nil {
+					t.Fatalf("decode %q stored as %q: %v", value, encoded.Value, err)
+				}
+				if !bytes.Equal(decoded.Value, value) {
+					t.Errorf("decode %q stored as %q = %q", value, encoded.Value, decoded.Value)
+				}
+			}
+		})
+	}
+}
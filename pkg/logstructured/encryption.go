@@ -0,0 +1,288 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// encryptedValueHeader prefixes encrypted values. It is followed by the length of the wrapped
+// data key as two bytes, the wrapped data key, the nonce, and the sealed value. Values are
+// compressed, if enabled, before they are encrypted.
+var encryptedValueHeader = []byte{0x00, 'k', 'e'}
+
+const (
+	dataKeySize = 32
+
+	// A new data key is generated once the current key has been used to encrypt dataKeyMaxUses
+	// values, or is older than dataKeyMaxAge, so that a rotated key encryption key is used for
+	// new writes without restarting. Rows are re-encrypted with the current keys as they are
+	// written, and rows encrypted with older keys are removed by compaction.
+	dataKeyMaxUses = 1 << 24
+	dataKeyMaxAge  = time.Hour
+
+	// dataKeyCacheSize is the maximum number of unwrapped data keys kept to decrypt values.
+	dataKeyCacheSize = 1024
+)
+
+// KeyWrapper wraps the data keys used to encrypt values with a key encryption key, such as a key
+// held by a KMS. Wrapped keys are stored with each value, so must identify the key encryption key
+// used, so that they can still be unwrapped after the key is rotated.
+type KeyWrapper interface {
+	Wrap(ctx context.Context, key []byte) ([]byte, error)
+	Unwrap(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// KeyWrapperByURL returns the key wrapper for the URL, or nil if the URL is empty. Supported URLs are:
+//
+//	file:///path/to/keys    a file of base64-encoded 32 byte AES keys, one per line; the first
+//	                        wraps new data keys, and all can unwrap them
+//	awskms://key-id         an AWS KMS key, with the region set by the region query parameter or
+//	                        AWS_REGION, and credentials by AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY,
+//	                        and AWS_SESSION_TOKEN
+//	vault://key-name        a Vault transit key, with the mount set by the mount query parameter,
+//	                        transit if not set, and the server by VAULT_ADDR and VAULT_TOKEN
+func KeyWrapperByURL(keyURL string) (KeyWrapper, error) {
+	if keyURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(keyURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing value encryption key URL")
+	}
+	switch u.Scheme {
+	case "file":
+		return newFileKeyWrapper(u.Path)
+	case "awskms":
+		return newAWSKMSKeyWrapper(u.Host+u.Path, u.Query().Get("region"))
+	case "vault":
+		return newVaultKeyWrapper(u.Host+u.Path, u.Query().Get("mount"))
+	}
+	return nil, fmt.Errorf("unsupported value encryption key URL scheme %q: must be one of file, awskms, or vault", u.Scheme)
+}
+
+// fileKeyWrapper wraps data keys with AES-GCM, using keys read from a file. Wrapped keys are
+// prefixed with the first four bytes of the SHA-256 hash of the key that wrapped them.
+type fileKeyWrapper struct {
+	keys []fileKey
+}
+
+type fileKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+func newFileKeyWrapper(path string) (*fileKeyWrapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading value encryption keys")
+	}
+	w := &fileKeyWrapper{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decoding value encryption key in %s", path)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("value encryption key in %s is %d bytes, must be %d", path, len(key), dataKeySize)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		id := sha256.Sum256(key)
+		w.keys = append(w.keys, fileKey{id: id[:4], aead: aead})
+	}
+	if len(w.keys) == 0 {
+		return nil, fmt.Errorf("no value encryption keys found in %s", path)
+	}
+	return w, nil
+}
+
+func (w *fileKeyWrapper) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	current := w.keys[0]
+	nonce := make([]byte, current.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	wrapped := append(append([]byte{}, current.id...), nonce...)
+	return current.aead.Seal(wrapped, nonce, key, current.id), nil
+}
+
+func (w *fileKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	for _, k := range w.keys {
+		if !bytes.HasPrefix(wrapped, k.id) {
+			continue
+		}
+		sealed := wrapped[len(k.id):]
+		if len(sealed) < k.aead.NonceSize() {
+			return nil, fmt.Errorf("wrapped data key is too short")
+		}
+		return k.aead.Open(nil, sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():], k.id)
+	}
+	return nil, fmt.Errorf("wrapped data key was not wrapped by any of the configured keys")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// valueEncryption encrypts values with data keys wrapped by a KeyWrapper. The key of each value is
+// used as additional data, so that encrypted values cannot be moved between keys.
+type valueEncryption struct {
+	wrapper KeyWrapper
+
+	mu      sync.Mutex
+	current *dataKey
+	// keys holds unwrapped data keys, by wrapped key
+	keys map[string]cipher.AEAD
+}
+
+type dataKey struct {
+	wrapped []byte
+	aead    cipher.AEAD
+	created time.Time
+	uses    int64
+}
+
+// newValueEncryption returns the encryption of values with the key at the URL, or nil if the
+// URL is empty.
+func newValueEncryption(keyURL string) (*valueEncryption, error) {
+	if keyURL == "" {
+		return nil, nil
+	}
+	wrapper, err := KeyWrapperByURL(keyURL)
+	if err != nil {
+		return nil, err
+	}
+	return &valueEncryption{
+		wrapper: wrapper,
+		keys:    map[string]cipher.AEAD{},
+	}, nil
+}
+
+// dataKey returns the data key used to encrypt values, generating a new key if the current key
+// has reached its maximum uses or age.
+func (e *valueEncryption) dataKey(ctx context.Context) (*dataKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.current != nil && e.current.uses < dataKeyMaxUses && time.Since(e.current.created) < dataKeyMaxAge {
+		e.current.uses++
+		return e.current, nil
+	}
+
+	key := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := e.wrapper.Wrap(ctx, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrapping data key")
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("wrapped data key is %d bytes, must be less than 64KiB", len(wrapped))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	e.current = &dataKey{wrapped: wrapped, aead: aead, created: time.Now(), uses: 1}
+	e.cacheLocked(wrapped, aead)
+	return e.current, nil
+}
+
+func (e *valueEncryption) cacheLocked(wrapped []byte, aead cipher.AEAD) {
+	if len(e.keys) >= dataKeyCacheSize {
+		e.keys = map[string]cipher.AEAD{}
+	}
+	e.keys[string(wrapped)] = aead
+}
+
+// unwrap returns the data key for the wrapped key, unwrapping it if it is not cached.
+func (e *valueEncryption) unwrap(ctx context.Context, wrapped []byte) (cipher.AEAD, error) {
+	e.mu.Lock()
+	aead, ok := e.keys[string(wrapped)]
+	e.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := e.wrapper.Unwrap(ctx, wrapped)
+	if err != nil {
+		return nil, errors.Wrap(err, "unwrapping data key")
+	}
+	if aead, err = newAEAD(key); err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.cacheLocked(wrapped, aead)
+	return aead, nil
+}
+
+func (e *valueEncryption) encrypt(ctx context.Context, key string, value []byte) ([]byte, error) {
+	dk, err := e.dataKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, dk.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	encrypted := make([]byte, 0, len(encryptedValueHeader)+2+len(dk.wrapped)+len(nonce)+len(value)+dk.aead.Overhead())
+	encrypted = append(encrypted, encryptedValueHeader...)
+	encrypted = binary.BigEndian.AppendUint16(encrypted, uint16(len(dk.wrapped)))
+	encrypted = append(encrypted, dk.wrapped...)
+	encrypted = append(encrypted, nonce...)
+	return dk.aead.Seal(encrypted, nonce, value, []byte(key)), nil
+}
+
+func (e *valueEncryption) decrypt(ctx context.Context, key string, value []byte) ([]byte, error) {
+	if e == nil {
+		return nil, fmt.Errorf("value is encrypted, but no value encryption key is configured")
+	}
+
+	value = value[len(encryptedValueHeader):]
+	if len(value) < 2 {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	n := int(binary.BigEndian.Uint16(value))
+	value = value[2:]
+	if len(value) < n {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	aead, err := e.unwrap(ctx, value[:n])
+	if err != nil {
+		return nil, err
+	}
+	value = value[n:]
+	if len(value) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is too short")
+	}
+	return aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], []byte(key))
+}
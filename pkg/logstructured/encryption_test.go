@@ -0,0 +1,354 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func newTestKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeKeys writes the keys to a key file, the first of which wraps new data keys, and returns
+// the value encryption using the file.
+func writeKeys(t *testing.T, path string, keys ...[]byte) *valueEncryption {
+	t.Helper()
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, base64.StdEncoding.EncodeToString(key))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newValueEncryption("file://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// wrappedBy returns true if the data key of the encrypted value was wrapped by the file key.
+func wrappedBy(encrypted, key []byte) bool {
+	id := sha256.Sum256(key)
+	wrapped := encrypted[len(encryptedValueHeader)+2:]
+	return bytes.HasPrefix(wrapped, id[:4])
+}
+
+func TestFileKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	value := []byte("value")
+
+	encrypted, err := writeKeys(t, path, oldKey).encrypt(ctx, "/a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// after rotation new data keys are wrapped by the new key, and the old key still unwraps
+	rotated := writeKeys(t, path, newKey, oldKey)
+	decrypted, err := rotated.decrypt(ctx, "/a", encrypted)
+	if err != nil {
+		t.Fatalf("decrypt with rotated keys: %v", err)
+	}
+	if !bytes.Equal(decrypted, value) {
+		t.Errorf("decrypt with rotated keys = %q, want %q", decrypted, value)
+	}
+	reencrypted, err := rotated.encrypt(ctx, "/a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wrappedBy(reencrypted, newKey) {
+		t.Error("data key is not wrapped by the new key after rotation")
+	}
+
+	// once the old key is removed, values it wrapped cannot be decrypted
+	current := writeKeys(t, path, newKey)
+	if _, err := current.decrypt(ctx, "/a", encrypted); err == nil {
+		t.Error("value wrapped by a removed key was decrypted")
+	}
+	if _, err := current.decrypt(ctx, "/a", reencrypted); err != nil {
+		t.Errorf("decrypt value wrapped by the current key: %v", err)
+	}
+}
+
+func TestRewriteAfterRotation(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	value := bytes.Repeat([]byte("value"), 100)
+
+	old := &compressedLog{codec: gzipCodec{}, encryption: writeKeys(t, path, oldKey)}
+	stored, err := old.encode(ctx, &server.KeyValue{Key: "/a", Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := &compressedLog{codec: gzipCodec{}, encryption: writeKeys(t, path, newKey, oldKey)}
+	rewritten, err := rotated.reencode(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wrappedBy(rewritten, newKey) {
+		t.Error("rewritten value is not wrapped by the new key")
+	}
+	decoded, err := rotated.decode(ctx, &server.KeyValue{Key: "/a", Value: rewritten})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Value, value) {
+		t.Error("rewritten value does not decode to the original value")
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	ctx := context.Background()
+	e := writeKeys(t, filepath.Join(t.TempDir(), "keys"), newTestKey(t))
+	encrypted, err := e.encrypt(ctx, "/a", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unknownKeyID := append([]byte{}, encrypted...)
+	unknownKeyID[len(encryptedValueHeader)+2] ^= 0xff
+	n := len(encryptedValueHeader) + 2 + int(binary.BigEndian.Uint16(encrypted[len(encryptedValueHeader):]))
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name  string
+		key   string
+		value []byte
+	}{
+		{name: "other key", key: "/b", value: encrypted},
+		{name: "unknown key id", key: "/a", value: unknownKeyID},
+		{name: "tampered value", key: "/a", value: tampered},
+		{name: "truncated wrapped key", key: "/a", value: encrypted[:n-1]},
+		{name: "truncated length", key: "/a", value: encrypted[:len(encryptedValueHeader)+1]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a new encryption does not have the data key cached
+			e := &valueEncryption{wrapper: e.wrapper, keys: map[string]cipher.AEAD{}}
+			if _, err := e.decrypt(ctx, tt.key, tt.value); err == nil {
+				t.Error("decrypt succeeded")
+			}
+		})
+	}
+
+	var unconfigured *valueEncryption
+	if _, err := unconfigured.decrypt(ctx, "/a", encrypted); err == nil {
+		t.Error("decrypt without a key succeeded")
+	}
+}
+
+// fakeTransit is a Vault transit engine whose key versions are file keys.
+type fakeTransit struct {
+	mu       sync.Mutex
+	versions []*fileKeyWrapper
+}
+
+func (f *fakeTransit) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "token" {
+		http.Error(w, "permission denied", http.StatusForbidden)
+		return
+	}
+	var req map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var data map[string]string
+	switch r.URL.Path {
+	case "/v1/transit/encrypt/kine":
+		key, _ := base64.StdEncoding.DecodeString(req["plaintext"])
+		version := len(f.versions)
+		wrapped, _ := f.versions[version-1].Wrap(r.Context(), key)
+		data = map[string]string{"ciphertext": fmt.Sprintf("vault:v%d:%s", version, base64.StdEncoding.EncodeToString(wrapped))}
+	case "/v1/transit/decrypt/kine":
+		parts := strings.SplitN(req["ciphertext"], ":", 3)
+		if len(parts) != 3 {
+			http.Error(w, "invalid ciphertext", http.StatusBadRequest)
+			return
+		}
+		version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+		if err != nil || version < 1 || version > len(f.versions) {
+			http.Error(w, "invalid key version", http.StatusBadRequest)
+			return
+		}
+		wrapped, _ := base64.StdEncoding.DecodeString(parts[2])
+		key, err := f.versions[version-1].Unwrap(r.Context(), wrapped)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data = map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func (f *fakeTransit) rotate(t *testing.T) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	writeKeys(t, path, newTestKey(t))
+	w, err := newFileKeyWrapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions = append(f.versions, w)
+}
+
+func TestVaultKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	transit := &fakeTransit{}
+	transit.rotate(t)
+	srv := httptest.NewServer(transit)
+	defer srv.Close()
+	t.Setenv("VAULT_ADDR", srv.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+
+	e, err := newValueEncryption("vault://kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := []byte("value")
+	encrypted, err := e.encrypt(ctx, "/a", value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new encryption does not have the data key cached, so unwraps it with the old version
+	transit.rotate(t)
+	e, err = newValueEncryption("vault://kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decrypted, err := e.decrypt(ctx, "/a", encrypted)
+	if err != nil {
+		t.Fatalf("decrypt after rotation: %v", err)
+	}
+	if !bytes.Equal(decrypted, value) {
+		t.Errorf("decrypt after rotation = %q, want %q", decrypted, value)
+	}
+	if _, err := e.decrypt(ctx, "/b", encrypted); err == nil {
+		t.Error("value of /a was decrypted as the value of /b")
+	}
+
+	t.Setenv("VAULT_TOKEN", "other")
+	e, err = newValueEncryption("vault://kine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.decrypt(ctx, "/a", encrypted); err == nil {
+		t.Error("decrypt with an invalid token succeeded")
+	}
+}
+
+// fakeKMS is an AWS KMS whose key is a file key, which checks that requests are signed for KMS in
+// eu-west-1, including the target operation and session token.
+type fakeKMS struct {
+	key *fileKeyWrapper
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.Contains(auth, "/eu-west-1/kms/aws4_request") || !strings.Contains(auth, "x-amz-target") ||
+		r.Header.Get("X-Amz-Security-Token") != "token" {
+		http.Error(w, "invalid authorization "+auth, http.StatusForbidden)
+		return
+	}
+	var req struct {
+		KeyID          string `json:"KeyId"`
+		Plaintext      []byte
+		CiphertextBlob []byte
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.KeyID != "alias/kine" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	switch r.Header.Get("X-Amz-Target") {
+	case "TrentService.Encrypt":
+		wrapped, _ := f.key.Wrap(r.Context(), req.Plaintext)
+		json.NewEncoder(w).Encode(map[string][]byte{"CiphertextBlob": wrapped})
+	case "TrentService.Decrypt":
+		key, err := f.key.Unwrap(r.Context(), req.CiphertextBlob)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": key})
+	default:
+		http.Error(w, "unknown operation", http.StatusBadRequest)
+	}
+}
+
+func TestAWSKMSKeyWrapper(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "key")
+	writeKeys(t, path, newTestKey(t))
+	key, err := newFileKeyWrapper(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(&fakeKMS{key: key})
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "kine")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "token")
+
+	w, err := newAWSKMSKeyWrapper("alias/kine", "eu-west-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.endpoint = srv.URL
+
+	dataKey := newTestKey(t)
+	wrapped, err := w.Wrap(ctx, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := w.Unwrap(ctx, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, dataKey) {
+		t.Error("Unwrap did not return the wrapped data key")
+	}
+	if _, err := w.Unwrap(ctx, dataKey); err == nil {
+		t.Error("Unwrap of a key not wrapped by KMS succeeded")
+	}
+
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	if _, err := newAWSKMSKeyWrapper("alias/kine", "eu-west-1"); err == nil {
+		t.Error("newAWSKMSKeyWrapper without credentials succeeded")
+	}
+}
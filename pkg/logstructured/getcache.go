@@ -0,0 +1,178 @@
+package logstructured
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+// getCache is an LRU cache of the results of gets of single keys, keyed by the key and the
+// requested revision. Results at a given revision never change, while results at the current
+// revision are invalidated when the key is written, as seen by watching the log.
+type getCache struct {
+	mu   sync.Mutex
+	size int
+	// active is set while the log is watched for invalidation; the cache is not used otherwise
+	active bool
+	// revision is the most recent revision of the events used to invalidate the cache
+	revision int64
+	entries  map[getCacheKey]*list.Element
+	lru      *list.List
+}
+
+type getCacheKey struct {
+	key      string
+	revision int64
+}
+
+type getCacheEntry struct {
+	getCacheKey
+	// rev is the revision at which the key was read
+	rev int64
+	kv  *server.KeyValue
+}
+
+// newGetCache returns a cache of up to size results. nil is returned if size is not
+// positive, which disables the cache.
+func newGetCache(size int) *getCache {
+	if size <= 0 {
+		return nil
+	}
+	return &getCache{
+		size:    size,
+		entries: map[getCacheKey]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// cacheable reports whether gets of the key are cached. Only keys that are seen by watching the
+// log for invalidation are cached.
+func cacheable(key, rangeEnd string) bool {
+	return rangeEnd == "" && strings.HasPrefix(key, "/")
+}
+
+// get returns the cached result of a get of the key at the revision, and the revision to report.
+func (c *getCache) get(key string, revision int64) (int64, *server.KeyValue, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active {
+		return 0, nil, false
+	}
+	e, ok := c.entries[getCacheKey{key: key, revision: revision}]
+	if !ok {
+		return 0, nil, false
+	}
+	c.lru.MoveToFront(e)
+	entry := e.Value.(*getCacheEntry)
+	rev := entry.rev
+	if revision == 0 && c.revision > rev {
+		// the key has not changed since it was read, so it is current as of the latest event
+		rev = c.revision
+	}
+	return rev, entry.kv, true
+}
+
+// put caches the result of a get of the key at the revision, which was read at revision rev. A
+// result at the current revision is not cached if events after it have already been applied to
+// the cache, as a write to the key after it was read may have been missed.
+func (c *getCache) put(key string, revision, rev int64, kv *server.KeyValue) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active || (revision == 0 && c.revision > rev) {
+		return
+	}
+	k := getCacheKey{key: key, revision: revision}
+	if e, ok := c.entries[k]; ok {
+		c.lru.MoveToFront(e)
+		e.Value = &getCacheEntry{getCacheKey: k, rev: rev, kv: kv}
+		return
+	}
+	if c.lru.Len() >= c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*getCacheEntry).getCacheKey)
+	}
+	c.entries[k] = c.lru.PushFront(&getCacheEntry{getCacheKey: k, rev: rev, kv: kv})
+}
+
+// remove invalidates the cached result of a get of the key at the current revision.
+func (c *getCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *getCache) removeLocked(key string) {
+	k := getCacheKey{key: key}
+	if e, ok := c.entries[k]; ok {
+		c.lru.Remove(e)
+		delete(c.entries, k)
+	}
+}
+
+// removeLease invalidates the cached results of gets at the current revision of keys attached to
+// the lease, as the keys deleted when a lease expires or is revoked are not known individually.
+func (c *getCache) removeLease(lease int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, e := range c.entries {
+		if entry := e.Value.(*getCacheEntry); k.revision == 0 && entry.kv != nil && entry.kv.Lease == lease {
+			c.lru.Remove(e)
+			delete(c.entries, k)
+		}
+	}
+}
+
+// apply invalidates the keys written by the events.
+func (c *getCache) apply(events []*server.Event) {
+	if len(events) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, event := range events {
+		c.removeLocked(event.KV.Key)
+	}
+	if rev := events[len(events)-1].KV.ModRevision; rev > c.revision {
+		c.revision = rev
+	}
+}
+
+// reset empties the cache, and sets whether it is used.
+func (c *getCache) reset(active bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = active
+	c.revision = 0
+	c.entries = map[getCacheKey]*list.Element{}
+	c.lru.Init()
+}
+
+// invalidate watches the log for writes, and invalidates the cached results of the keys written.
+// The cache is emptied and not used while the watch is interrupted, as writes may be missed.
+func (l *LogStructured) invalidate(ctx context.Context) {
+	for {
+		events := l.log.Watch(ctx, "/")
+		l.getCache.reset(true)
+		for e := range events {
+			l.getCache.apply(e)
+		}
+		l.getCache.reset(false)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logrus.Warnf("Watch for get cache invalidation was interrupted, disabling cache until it resumes")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
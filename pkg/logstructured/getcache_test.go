@@ -0,0 +1,26 @@
+package logstructured
+
+import (
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestGetCacheRemoveLease(t *testing.T) {
+	c := newGetCache(10)
+	c.reset(true)
+	c.put("/a", 0, 5, &server.KeyValue{Key: "/a", Lease: 1})
+	c.put("/a", 3, 3, &server.KeyValue{Key: "/a", Lease: 1})
+	c.put("/b", 0, 5, &server.KeyValue{Key: "/b", Lease: 2})
+	c.put("/c", 0, 5, nil)
+
+	c.removeLease(1)
+	if _, _, ok := c.get("/a", 0); ok {
+		t.Error("current revision of key attached to the lease is still cached")
+	}
+	for _, k := range []getCacheKey{{key: "/a", revision: 3}, {key: "/b"}, {key: "/c"}} {
+		if _, _, ok := c.get(k.key, k.revision); !ok {
+			t.Errorf("%s at revision %d is no longer cached", k.key, k.revision)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/sigv4"
+	"github.com/pkg/errors"
+)
+
+// kmsRequestTimeout bounds each request to a KMS, as values cannot be read or written while a
+// data key is being wrapped or unwrapped.
+const kmsRequestTimeout = 10 * time.Second
+
+var kmsClient = &http.Client{Timeout: kmsRequestTimeout}
+
+// doJSON sends the request, and decodes the JSON response into result.
+func doJSON(req *http.Request, result interface{}) error {
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to %s failed with status %s: %s", req.URL, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, result)
+}
+
+// awsKMSKeyWrapper wraps data keys with the Encrypt and Decrypt operations of AWS KMS. The
+// ciphertext returned by KMS identifies the key and its version, so keys can be rotated in KMS.
+type awsKMSKeyWrapper struct {
+	keyID    string
+	endpoint string
+	signer   *sigv4.Signer
+}
+
+func newAWSKMSKeyWrapper(keyID, region string) (*awsKMSKeyWrapper, error) {
+	if keyID == "" {
+		return nil, fmt.Errorf("AWS KMS key ID is not set")
+	}
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		return nil, fmt.Errorf("AWS KMS region is not set")
+	}
+	signer, err := sigv4.New("kms", region)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure AWS KMS")
+	}
+	return &awsKMSKeyWrapper{
+		keyID:    keyID,
+		endpoint: "https://kms." + region + ".amazonaws.com",
+		signer:   signer,
+	}, nil
+}
+
+func (w *awsKMSKeyWrapper) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		CiphertextBlob []byte
+	}
+	if err := w.call(ctx, "Encrypt", map[string]interface{}{"KeyId": w.keyID, "Plaintext": key}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.CiphertextBlob, nil
+}
+
+func (w *awsKMSKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Plaintext []byte
+	}
+	if err := w.call(ctx, "Decrypt", map[string]interface{}{"KeyId": w.keyID, "CiphertextBlob": wrapped}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Plaintext, nil
+}
+
+// call calls the KMS operation, signing the request with AWS Signature Version 4. Byte slices
+// in the request and response are base64 encoded by encoding/json, as KMS expects.
+func (w *awsKMSKeyWrapper) call(ctx context.Context, operation string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+operation)
+	if err := w.signer.Sign(ctx, req, body); err != nil {
+		return err
+	}
+	if err := doJSON(req, result); err != nil {
+		return errors.Wrapf(err, "AWS KMS %s", operation)
+	}
+	return nil
+}
+
+// vaultKeyWrapper wraps data keys with the encrypt and decrypt endpoints of a Vault transit key.
+// The ciphertext returned by Vault identifies the version of the key, so the key can be rotated
+// in Vault.
+type vaultKeyWrapper struct {
+	addr  string
+	token string
+	mount string
+	key   string
+}
+
+func newVaultKeyWrapper(key, mount string) (*vaultKeyWrapper, error) {
+	if key == "" {
+		return nil, fmt.Errorf("Vault transit key name is not set")
+	}
+	if mount == "" {
+		mount = "transit"
+	}
+	w := &vaultKeyWrapper{
+		addr:  strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token: os.Getenv("VAULT_TOKEN"),
+		mount: strings.Trim(mount, "/"),
+		key:   key,
+	}
+	if w.addr == "" || w.token == "" {
+		return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set to use Vault transit")
+	}
+	return w, nil
+}
+
+func (w *vaultKeyWrapper) Wrap(ctx context.Context, key []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := w.call(ctx, "encrypt", map[string]string{"plaintext": base64.StdEncoding.EncodeToString(key)}, &resp); err != nil {
+		return nil, err
+	}
+	return []byte(resp.Data.Ciphertext), nil
+}
+
+func (w *vaultKeyWrapper) Unwrap(ctx context.Context, wrapped []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := w.call(ctx, "decrypt", map[string]string{"ciphertext": string(wrapped)}, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+func (w *vaultKeyWrapper) call(ctx context.Context, operation string, request, result interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.addr+"/v1/"+w.mount+"/"+operation+"/"+w.key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", w.token)
+	if err := doJSON(req, result); err != nil {
+		return errors.Wrapf(err, "Vault transit %s", operation)
+	}
+	return nil
+}
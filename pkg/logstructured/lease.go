@@ -0,0 +1,139 @@
+package logstructured
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// leaseExpiryInterval is the interval at which expired leases are revoked.
+	leaseExpiryInterval = time.Second
+	// managedLeaseCacheSize is the number of leases for which the TTL loop remembers whether
+	// the lease is stored by the log.
+	managedLeaseCacheSize = 10000
+)
+
+// LeaseLog is implemented by logs that store leases. Keys attached to a lease that is not
+// stored by the log are expired by the TTL loop, treating the lease as a TTL in seconds.
+type LeaseLog interface {
+	server.Leaser
+	ExpiredLeases(ctx context.Context) ([]int64, error)
+}
+
+func (l *LogStructured) leaseLog() (LeaseLog, error) {
+	leases, ok := l.log.(LeaseLog)
+	if !ok {
+		return nil, server.ErrNotSupported
+	}
+	return leases, nil
+}
+
+func (l *LogStructured) LeaseGrant(ctx context.Context, id, ttl int64) (int64, error) {
+	if l.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	leases, err := l.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	return leases.LeaseGrant(ctx, id, ttl)
+}
+
+func (l *LogStructured) LeaseRevoke(ctx context.Context, id int64) (int64, error) {
+	if l.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	leases, err := l.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	rev, err := leases.LeaseRevoke(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	l.invalidateLease(id)
+	return rev, nil
+}
+
+func (l *LogStructured) LeaseKeepAlive(ctx context.Context, id int64) (int64, error) {
+	if l.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	leases, err := l.leaseLog()
+	if err != nil {
+		return 0, err
+	}
+	return leases.LeaseKeepAlive(ctx, id)
+}
+
+func (l *LogStructured) LeaseTimeToLive(ctx context.Context, id int64, keys bool) (*server.Lease, error) {
+	leases, err := l.leaseLog()
+	if err != nil {
+		return nil, err
+	}
+	return leases.LeaseTimeToLive(ctx, id, keys)
+}
+
+func (l *LogStructured) LeaseLeases(ctx context.Context) ([]int64, error) {
+	leases, err := l.leaseLog()
+	if err != nil {
+		return nil, err
+	}
+	return leases.LeaseLeases(ctx)
+}
+
+// expireLeases periodically revokes leases that have not been kept alive, deleting the keys
+// attached to them.
+func (l *LogStructured) expireLeases(ctx context.Context) {
+	leases, ok := l.log.(LeaseLog)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(leaseExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := leases.ExpiredLeases(ctx)
+		if err != nil {
+			logrus.Errorf("Failed to list expired leases: %v", err)
+			continue
+		}
+		for _, id := range ids {
+			// Another replica may have revoked the lease already.
+			if _, err := leases.LeaseRevoke(ctx, id); err != nil && err != server.ErrLeaseNotFound {
+				logrus.Errorf("Failed to revoke expired lease %d: %v", id, err)
+				continue
+			}
+			l.invalidateLease(id)
+			logrus.Tracef("LEASE EXPIRED id=%d", id)
+		}
+	}
+}
+
+// isManagedLease returns true if the lease is stored by the log, and so is expired by
+// expireLeases rather than by the TTL loop.
+func (l *LogStructured) isManagedLease(ctx context.Context, lease int64) (bool, error) {
+	leases, ok := l.log.(LeaseLog)
+	if !ok {
+		return false, nil
+	}
+	_, err := leases.LeaseTimeToLive(ctx, lease, false)
+	if err == server.ErrLeaseNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// maxLegacyLeaseTTL is the largest lease that can be treated as a TTL in seconds without
+// overflowing a time.Duration.
+const maxLegacyLeaseTTL = math.MaxInt64 / int64(time.Second)
@@ -2,13 +2,24 @@ package logstructured
 
 import (
 	"context"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	watchRetryInterval = time.Second
+
+	// watchCatchUpLimit is the maximum number of events fetched by a single query when
+	// a watch is catching up on events that occurred before it was started.
+	watchCatchUpLimit = 1000
+)
+
 type Log interface {
 	Start(ctx context.Context) error
 	CurrentRevision(ctx context.Context) (int64, error)
@@ -17,30 +28,173 @@ type Log interface {
 	Watch(ctx context.Context, prefix string) <-chan []*server.Event
 	Count(ctx context.Context, prefix string) (int64, int64, error)
 	Append(ctx context.Context, event *server.Event) (int64, error)
+	DeleteLease(ctx context.Context, lease, revision int64) (int64, error)
 	DbSize(ctx context.Context) (int64, error)
+	Health(ctx context.Context) (*server.HealthStatus, error)
+	Close(ctx context.Context) error
+}
+
+// ArchiveReader is implemented by logs that can read revisions of keys that have been
+// removed from the log by compaction.
+type ArchiveReader interface {
+	GetAtRevision(ctx context.Context, key string, revision int64) (*server.KeyValue, error)
+}
+
+// BulkGetter is implemented by logs that can get the current revision of many keys at once.
+type BulkGetter interface {
+	GetMany(ctx context.Context, keys []string) (int64, []*server.Event, error)
+}
+
+// RowCopier is implemented by logs that can copy every row, including deleted and replaced
+// revisions, to another log of the same type.
+type RowCopier interface {
+	CopyTo(ctx context.Context, target Log) (int64, error)
 }
 
 type LogStructured struct {
-	log Log
+	log          Log
+	cancel       context.CancelFunc
+	wg           sync.WaitGroup
+	readOnly     bool
+	maxKeySize   int
+	maxValueSize int
+	// keyLimiter limits the rate of writes to each key, or is nil if writes are not limited
+	keyLimiter *keyRateLimiter
+	// getCache caches gets of single keys, or is nil if disabled
+	getCache *getCache
+	// rewriteValues enables the background rewrite of values stored before compression or
+	// encryption was enabled
+	rewriteValues bool
 }
 
-func New(log Log) *LogStructured {
-	return &LogStructured{
-		log: log,
+// New returns a backend storing keys in the log. An error is returned if the value compression
+// configured is not supported, or the value encryption key cannot be used.
+func New(log Log, cfg *drivers.Config) (server.Backend, error) {
+	codec, err := ValueCodecByName(cfg.ValueCompression)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := newValueEncryption(cfg.ValueEncryptionKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "values cannot be encrypted or decrypted")
 	}
+	return &LogStructured{
+		log: &compressedLog{
+			Log:        log,
+			codec:      codec,
+			minSize:    cfg.ValueCompressionMinSize,
+			encryption: encryption,
+		},
+		readOnly:      cfg.ReadOnly,
+		maxKeySize:    cfg.MaxKeySize,
+		maxValueSize:  cfg.MaxValueSize,
+		keyLimiter:    newKeyRateLimiter(cfg.KeyWriteRate, cfg.KeyWriteBurst, keyRateLimiterSize),
+		getCache:      newGetCache(cfg.CacheSize),
+		rewriteValues: cfg.CompressExistingValues,
+	}, nil
 }
 
 func (l *LogStructured) Start(ctx context.Context) error {
+	ctx, l.cancel = context.WithCancel(ctx)
 	if err := l.log.Start(ctx); err != nil {
 		return err
 	}
+	if l.getCache != nil {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.invalidate(ctx)
+		}()
+	}
+	if l.readOnly {
+		logrus.Infof("Starting in read-only mode; writes and lease expiry are disabled")
+		return nil
+	}
 	// See https://github.com/kubernetes/kubernetes/blob/442a69c3bdf6fe8e525b05887e57d89db1e2f3a5/staging/src/k8s.io/apiserver/pkg/storage/storagebackend/factory/etcd3.go#L97
 	if _, err := l.Create(ctx, "/registry/health", []byte(`{"health":"true"}`), 0); err != nil {
 		if err != server.ErrKeyExists {
 			logrus.Errorf("Failed to create health check key: %v", err)
 		}
 	}
-	go l.ttl(ctx)
+	if c, ok := l.log.(*compressedLog); ok && l.rewriteValues {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			if err := c.rewriteValues(ctx); err != nil && ctx.Err() == nil {
+				logrus.Errorf("Failed to rewrite existing values: %v", err)
+			}
+		}()
+	}
+	l.wg.Add(2)
+	go func() {
+		defer l.wg.Done()
+		l.ttl(ctx)
+	}()
+	go func() {
+		defer l.wg.Done()
+		l.expireLeases(ctx)
+	}()
+	return nil
+}
+
+// Close stops background processing of leases, and then closes the log. If ctx is
+// done before the lease processing has stopped, the log is closed anyway.
+func (l *LogStructured) Close(ctx context.Context) error {
+	if l.cancel != nil {
+		l.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for lease processing to stop: %v", ctx.Err())
+	}
+
+	return l.log.Close(ctx)
+}
+
+// invalidateKey removes the current revision of a key written by this server from the get cache,
+// so that it is not read back from the cache before the write is seen by the watch.
+func (l *LogStructured) invalidateKey(key string) {
+	if l.getCache != nil {
+		l.getCache.remove(key)
+	}
+}
+
+// invalidateLease removes the current revision of keys attached to a lease from the get cache, once
+// the keys have been deleted by this server.
+func (l *LogStructured) invalidateLease(lease int64) {
+	if l.getCache != nil {
+		l.getCache.removeLease(lease)
+	}
+}
+
+// checkRate rejects writes to keys that are being written faster than the configured rate limit,
+// so that a single misbehaving client cannot dominate the revision space.
+func (l *LogStructured) checkRate(key string) error {
+	if l.keyLimiter != nil && !l.keyLimiter.allow(key, time.Now()) {
+		logrus.Warnf("Rejecting write to %s exceeding rate limit of %g writes per second", key, l.keyLimiter.rate)
+		return server.ErrTooManyRequests
+	}
+	return nil
+}
+
+// checkSize rejects keys and values that exceed the configured size limits, so that
+// oversized data is never written to the datastore.
+func (l *LogStructured) checkSize(key string, value []byte) error {
+	if l.maxKeySize > 0 && len(key) > l.maxKeySize {
+		logrus.Warnf("Rejecting write of key with size %d exceeding limit of %d", len(key), l.maxKeySize)
+		return server.ErrTooLarge
+	}
+	if l.maxValueSize > 0 && len(value) > l.maxValueSize {
+		logrus.Warnf("Rejecting write to %s with value size %d exceeding limit of %d", key, len(value), l.maxValueSize)
+		return server.ErrTooLarge
+	}
 	return nil
 }
 
@@ -50,19 +204,28 @@ func (l *LogStructured) Get(ctx context.Context, key, rangeEnd string, limit, re
 		logrus.Tracef("GET %s, rev=%d => rev=%d, kv=%v, err=%v", key, revision, revRet, kvRet != nil, errRet)
 	}()
 
+	useCache := l.getCache != nil && cacheable(key, rangeEnd)
+	if useCache {
+		if rev, kv, ok := l.getCache.get(key, revision); ok {
+			return rev, kv, nil
+		}
+	}
+
 	rev, event, err := l.get(ctx, key, rangeEnd, limit, revision, false)
-	if event == nil {
-		return rev, nil, err
+	var kv *server.KeyValue
+	if event != nil {
+		kv = event.KV
+	}
+	if useCache && err == nil && rev != 0 {
+		l.getCache.put(key, revision, rev, kv)
 	}
-	return rev, event.KV, err
+	return rev, kv, err
 }
 
 func (l *LogStructured) get(ctx context.Context, key, rangeEnd string, limit, revision int64, includeDeletes bool) (int64, *server.Event, error) {
+	// Reading at a revision older than the compact revision returns ErrCompacted, as in etcd, so that
+	// clients know to relist instead of receiving a result that may be missing keys.
 	rev, events, err := l.log.List(ctx, key, rangeEnd, limit, revision, includeDeletes)
-	if err == server.ErrCompacted {
-		// ignore compacted when getting by revision
-		err = nil
-	}
 	if err != nil {
 		return 0, nil, err
 	}
@@ -91,6 +254,16 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 		logrus.Tracef("CREATE %s, size=%d, lease=%d => rev=%d, err=%v", key, len(value), lease, revRet, errRet)
 	}()
 
+	if l.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	if err := l.checkSize(key, value); err != nil {
+		return 0, err
+	}
+	if err := l.checkRate(key); err != nil {
+		return 0, err
+	}
+
 	rev, prevEvent, err := l.get(ctx, key, "", 1, 0, true)
 	if err != nil {
 		return 0, err
@@ -114,6 +287,7 @@ func (l *LogStructured) Create(ctx context.Context, key string, value []byte, le
 	}
 
 	revRet, errRet = l.log.Append(ctx, createEvent)
+	l.invalidateKey(key)
 	return
 }
 
@@ -123,6 +297,13 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 		logrus.Tracef("DELETE %s, rev=%d => rev=%d, kv=%v, deleted=%v, err=%v", key, revision, revRet, kvRet != nil, deletedRet, errRet)
 	}()
 
+	if l.readOnly {
+		return 0, nil, false, server.ErrReadOnly
+	}
+	if err := l.checkRate(key); err != nil {
+		return 0, nil, false, err
+	}
+
 	rev, event, err := l.get(ctx, key, "", 1, 0, true)
 	if err != nil {
 		return 0, nil, false, err
@@ -147,6 +328,7 @@ func (l *LogStructured) Delete(ctx context.Context, key string, revision int64)
 	}
 
 	rev, err = l.log.Append(ctx, deleteEvent)
+	l.invalidateKey(key)
 	if err != nil {
 		// If error on Append we assume it's a UNIQUE constraint error, so we fetch the latest (if we can)
 		// and return that the delete failed
@@ -189,6 +371,86 @@ func (l *LogStructured) List(ctx context.Context, prefix, startKey string, limit
 	return rev, kvs, nil
 }
 
+// GetMany returns the current value of each of the keys that exists, ordered by key, along with
+// the current revision. Keys that do not exist or have been deleted are omitted.
+// server.ErrNotSupported is returned if the log cannot get keys in bulk.
+func (l *LogStructured) GetMany(ctx context.Context, keys []string) (revRet int64, kvRet []*server.KeyValue, errRet error) {
+	defer func() {
+		l.adjustRevision(ctx, &revRet)
+		logrus.Tracef("GETMANY keys=%d => rev=%d, kvs=%d, err=%v", len(keys), revRet, len(kvRet), errRet)
+	}()
+
+	getter, ok := l.log.(BulkGetter)
+	if !ok {
+		return 0, nil, server.ErrNotSupported
+	}
+	if len(keys) == 0 {
+		return 0, nil, nil
+	}
+
+	rev, events, err := getter.GetMany(ctx, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+	kvs := make([]*server.KeyValue, 0, len(events))
+	for _, event := range events {
+		kvs = append(kvs, event.KV)
+	}
+	return rev, kvs, nil
+}
+
+// GetAtRevision returns the key as it was at the given revision, even if the revision has been
+// compacted, if the datastore archives compacted revisions. nil is returned if the key did not
+// exist at the revision, and server.ErrNotSupported if compacted revisions are not archived.
+func (l *LogStructured) GetAtRevision(ctx context.Context, key string, revision int64) (*server.KeyValue, error) {
+	reader, ok := l.log.(ArchiveReader)
+	if !ok {
+		return nil, server.ErrNotSupported
+	}
+	return reader.GetAtRevision(ctx, key, revision)
+}
+
+// Snapshot writes a snapshot of the current revision of each key to w, if the log supports
+// snapshots, and returns the revision of the snapshot. Values are written as stored, so values
+// compressed by kine remain compressed in the snapshot.
+func (l *LogStructured) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	snapshotter, ok := l.log.(server.Snapshotter)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return snapshotter.Snapshot(ctx, w)
+}
+
+// Restore loads a snapshot written by Snapshot into an empty datastore, if the log supports
+// snapshots, and returns the revision of the snapshot.
+func (l *LogStructured) Restore(ctx context.Context, r io.Reader) (int64, error) {
+	if l.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	snapshotter, ok := l.log.(server.Snapshotter)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return snapshotter.Restore(ctx, r)
+}
+
+// MigrateTo copies the full history of the datastore into the empty target datastore, preserving
+// revisions, if the logs of both support it. The current revision of the target is returned.
+func (l *LogStructured) MigrateTo(ctx context.Context, target server.Backend) (int64, error) {
+	t, ok := target.(*LogStructured)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	if t.readOnly {
+		return 0, server.ErrReadOnly
+	}
+	copier, ok := l.log.(RowCopier)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return copier.CopyTo(ctx, t.log)
+}
+
 func (l *LogStructured) Count(ctx context.Context, prefix string) (revRet int64, count int64, err error) {
 	defer func() {
 		logrus.Tracef("COUNT %s => rev=%d, count=%d, err=%v", prefix, revRet, count, err)
@@ -220,6 +482,16 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 		logrus.Tracef("UPDATE %s, value=%d, rev=%d, lease=%v => rev=%d, kvrev=%d, updated=%v, err=%v", key, len(value), revision, lease, revRet, kvRev, updateRet, errRet)
 	}()
 
+	if l.readOnly {
+		return 0, nil, false, server.ErrReadOnly
+	}
+	if err := l.checkSize(key, value); err != nil {
+		return 0, nil, false, err
+	}
+	if err := l.checkRate(key); err != nil {
+		return 0, nil, false, err
+	}
+
 	rev, event, err := l.get(ctx, key, "", 1, 0, false)
 	if err != nil {
 		return 0, nil, false, err
@@ -244,6 +516,7 @@ func (l *LogStructured) Update(ctx context.Context, key string, value []byte, re
 	}
 
 	rev, err = l.log.Append(ctx, updateEvent)
+	l.invalidateKey(key)
 	if err != nil {
 		rev, event, err := l.get(ctx, key, "", 1, 0, false)
 		if event == nil {
@@ -302,7 +575,31 @@ func (l *LogStructured) ttlEvents(ctx context.Context) chan *server.Event {
 func (l *LogStructured) ttl(ctx context.Context) {
 	// vary naive TTL support
 	mutex := &sync.Mutex{}
+	// the highest revision up to which each lease has already been expired
+	expired := map[int64]int64{}
+	// whether each lease is stored by the log, and so expired by expireLeases instead
+	managed := map[int64]bool{}
 	for event := range l.ttlEvents(ctx) {
+		lease := event.KV.Lease
+		isManaged, ok := managed[lease]
+		if !ok {
+			var err error
+			if isManaged, err = l.isManagedLease(ctx, lease); err != nil {
+				logrus.Warnf("Failed to look up lease %d: %v", lease, err)
+			} else {
+				if len(managed) >= managedLeaseCacheSize {
+					managed = map[int64]bool{}
+				}
+				managed[lease] = isManaged
+			}
+		}
+		if isManaged {
+			continue
+		}
+		if lease > maxLegacyLeaseTTL {
+			logrus.Warnf("Not expiring %s: lease %d does not exist", event.KV.Key, lease)
+			continue
+		}
 		go func(event *server.Event) {
 			select {
 			case <-ctx.Done():
@@ -310,10 +607,24 @@ func (l *LogStructured) ttl(ctx context.Context) {
 			case <-time.After(time.Duration(event.KV.Lease) * time.Second):
 			}
 			mutex.Lock()
-			if _, _, _, err := l.Delete(ctx, event.KV.Key, event.KV.ModRevision); err != nil {
-				logrus.Errorf("failed to delete expired key: %v", err)
+			defer mutex.Unlock()
+
+			// Any key with the same lease and an older revision has also expired, so
+			// delete them all at once. Keys handled by a previous batch can be skipped.
+			if expired[event.KV.Lease] >= event.KV.ModRevision {
+				return
 			}
-			mutex.Unlock()
+			count, err := l.log.DeleteLease(ctx, event.KV.Lease, event.KV.ModRevision)
+			if err != nil {
+				logrus.Warnf("failed to delete expired keys for lease %d, falling back to deleting %s: %v", event.KV.Lease, event.KV.Key, err)
+				if _, _, _, err := l.Delete(ctx, event.KV.Key, event.KV.ModRevision); err != nil {
+					logrus.Errorf("failed to delete expired key: %v", err)
+				}
+				return
+			}
+			l.invalidateLease(event.KV.Lease)
+			expired[event.KV.Lease] = event.KV.ModRevision
+			logrus.Tracef("TTL lease=%d, rev=%d => deleted=%d", event.KV.Lease, event.KV.ModRevision, count)
 		}(event)
 	}
 }
@@ -321,9 +632,7 @@ func (l *LogStructured) ttl(ctx context.Context) {
 func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64) <-chan []*server.Event {
 	logrus.Tracef("WATCH %s, revision=%d", prefix, revision)
 
-	// starting watching right away so we don't miss anything
 	ctx, cancel := context.WithCancel(ctx)
-	readChan := l.log.Watch(ctx, prefix)
 
 	// include the current revision in list
 	if revision > 0 {
@@ -331,36 +640,123 @@ func (l *LogStructured) Watch(ctx context.Context, prefix string, revision int64
 	}
 
 	result := make(chan []*server.Event, 100)
-
-	rev, kvs, err := l.log.After(ctx, prefix, revision, 0)
-	if err != nil {
-		logrus.Errorf("failed to list %s for revision %d", prefix, revision)
-		cancel()
-	}
-
-	logrus.Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, revision, rev, len(kvs))
+	exclude := server.WatchExclusions(ctx)
 
 	go func() {
+		defer cancel()
+		defer close(result)
+
+		// Track the last revision delivered on this watch, so that if the event stream is
+		// interrupted the watch can resume from where it left off without dropping events.
 		lastRevision := revision
-		if len(kvs) > 0 {
-			lastRevision = rev
-		}
+		for {
+			// starting watching right away so we don't miss anything
+			readChan := l.log.Watch(ctx, prefix)
+
+			// Catch up on past events in bounded chunks, so that a large backlog does not
+			// require a single enormous query.
+			for {
+				rev, kvs, err := l.watchAfter(ctx, prefix, lastRevision, watchCatchUpLimit)
+				if err != nil {
+					logrus.Errorf("failed to list %s for revision %d: %v", prefix, lastRevision, err)
+					return
+				}
 
-		if len(kvs) > 0 {
-			result <- kvs
-		}
+				logrus.Tracef("WATCH LIST key=%s rev=%d => rev=%d kvs=%d", prefix, lastRevision, rev, len(kvs))
+
+				if len(kvs) == 0 {
+					break
+				}
+				if events := server.ExcludeEvents(kvs, exclude); len(events) > 0 {
+					result <- events
+				}
+				if len(kvs) < watchCatchUpLimit {
+					lastRevision = rev
+					break
+				}
+				lastRevision = kvs[len(kvs)-1].KV.ModRevision
+			}
 
-		// always ensure we fully read the channel
-		for i := range readChan {
-			result <- filter(i, lastRevision)
+			// always ensure we fully read the channel
+			for i := range readChan {
+				events := filter(i, lastRevision)
+				if len(events) == 0 {
+					continue
+				}
+				lastRevision = events[len(events)-1].KV.ModRevision
+				if events := server.ExcludeEvents(events, exclude); len(events) > 0 {
+					result <- events
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			logrus.Warnf("Watch stream for %s was interrupted, resuming after revision %d", prefix, lastRevision)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetryInterval):
+			}
 		}
-		close(result)
-		cancel()
 	}()
 
 	return result
 }
 
+// WatchProgressRevision returns the revision up to which the log has dispatched events to
+// watches, or zero if the log cannot report it.
+func (l *LogStructured) WatchProgressRevision() int64 {
+	if reporter, ok := l.log.(server.WatchProgressReporter); ok {
+		return reporter.WatchProgressRevision()
+	}
+	return 0
+}
+
+// Compact schedules compaction of the log to the given revision, if the log supports it.
+func (l *LogStructured) Compact(ctx context.Context, revision int64) error {
+	if l.readOnly {
+		return server.ErrReadOnly
+	}
+	compactor, ok := l.log.(server.Compactor)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	return compactor.Compact(ctx, revision)
+}
+
+// Defragment reclaims the space freed by compaction, if the log supports it.
+func (l *LogStructured) Defragment(ctx context.Context) error {
+	if l.readOnly {
+		return server.ErrReadOnly
+	}
+	defragmenter, ok := l.log.(server.Defragmenter)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	return defragmenter.Defragment(ctx)
+}
+
+// watchAfter returns up to limit events after the given revision, retrying until the datastore
+// is available again. An error is only returned if the revision has been compacted, a value
+// cannot be decoded, or the context is cancelled.
+func (l *LogStructured) watchAfter(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	for {
+		rev, kvs, err := l.log.After(ctx, prefix, revision, limit)
+		if err == nil || err == server.ErrCompacted || isDecodeError(err) {
+			return rev, kvs, err
+		}
+
+		logrus.Errorf("failed to list %s for revision %d, retrying: %v", prefix, revision, err)
+		select {
+		case <-ctx.Done():
+			return 0, nil, ctx.Err()
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
 func filter(events []*server.Event, rev int64) []*server.Event {
 	for len(events) > 0 && events[0].KV.ModRevision <= rev {
 		events = events[1:]
@@ -372,3 +768,7 @@ func filter(events []*server.Event, rev int64) []*server.Event {
 func (l *LogStructured) DbSize(ctx context.Context) (int64, error) {
 	return l.log.DbSize(ctx)
 }
+
+func (l *LogStructured) Health(ctx context.Context) (*server.HealthStatus, error) {
+	return l.log.Health(ctx)
+}
@@ -0,0 +1,78 @@
+package logstructured
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// keyRateLimiterSize is the maximum number of keys for which write rate state is kept. When
+// the limit is reached, the state of the least recently written key is discarded.
+const keyRateLimiterSize = 10000
+
+// keyRateLimiter limits the rate of writes to each key using a token bucket per key. Buckets are
+// kept in an LRU list, so that memory use is bounded regardless of the number of keys written.
+type keyRateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	size    int
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type keyBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// newKeyRateLimiter returns a limiter allowing rate writes per second to each key, with bursts
+// of up to burst writes. nil is returned if rate is not positive, which disables the limit.
+func newKeyRateLimiter(rate float64, burst, size int) *keyRateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &keyRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		size:    size,
+		buckets: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+// allow reports whether a write to the key is allowed at the given time, consuming a token from
+// the key's bucket if so.
+func (r *keyRateLimiter) allow(key string, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b *keyBucket
+	if e, ok := r.buckets[key]; ok {
+		r.lru.MoveToFront(e)
+		b = e.Value.(*keyBucket)
+		b.tokens += now.Sub(b.last).Seconds() * r.rate
+		if b.tokens > r.burst {
+			b.tokens = r.burst
+		}
+		b.last = now
+	} else {
+		if r.lru.Len() >= r.size {
+			oldest := r.lru.Back()
+			r.lru.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*keyBucket).key)
+		}
+		b = &keyBucket{key: key, tokens: r.burst, last: now}
+		r.buckets[key] = r.lru.PushFront(b)
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
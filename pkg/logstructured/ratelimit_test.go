@@ -0,0 +1,91 @@
+package logstructured
+
+import (
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestKeyRateLimiter(t *testing.T) {
+	if newKeyRateLimiter(0, 10, 10) != nil {
+		t.Error("limiter returned without a rate")
+	}
+
+	now := time.Now()
+	r := newKeyRateLimiter(2, 3, 2)
+	// a burst of writes is allowed, after which writes are rejected until tokens are added
+	for i := 0; i < 3; i++ {
+		if !r.allow("/a", now) {
+			t.Fatalf("write %d of burst rejected", i+1)
+		}
+	}
+	if r.allow("/a", now) {
+		t.Error("write exceeding burst allowed")
+	}
+	if !r.allow("/b", now) {
+		t.Error("write to other key rejected")
+	}
+
+	// at 2 writes per second, a token is added every 500ms
+	if r.allow("/a", now.Add(400*time.Millisecond)) {
+		t.Error("write allowed before a token was added")
+	}
+	if !r.allow("/a", now.Add(600*time.Millisecond)) {
+		t.Error("write rejected after a token was added")
+	}
+	if r.allow("/a", now.Add(600*time.Millisecond)) {
+		t.Error("write allowed after the added token was used")
+	}
+
+	// tokens do not accumulate beyond the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !r.allow("/a", later) {
+			t.Fatalf("write %d of burst rejected after idling", i+1)
+		}
+	}
+	if r.allow("/a", later) {
+		t.Error("write exceeding burst allowed after idling")
+	}
+
+	// writing a third key discards the state of the least recently written key
+	r.allow("/c", later)
+	if _, ok := r.buckets["/b"]; ok {
+		t.Error("least recently written key was not discarded")
+	}
+	if len(r.buckets) != 2 || r.lru.Len() != 2 {
+		t.Errorf("limiter holds %d buckets and %d list elements, want 2", len(r.buckets), r.lru.Len())
+	}
+	if r.allow("/a", later) {
+		t.Error("state of recently written key was discarded")
+	}
+}
+
+func TestKeyRateLimiterMinimumBurst(t *testing.T) {
+	now := time.Now()
+	r := newKeyRateLimiter(1, 0, 10)
+	if !r.allow("/a", now) {
+		t.Error("first write rejected")
+	}
+	if r.allow("/a", now) {
+		t.Error("second write allowed")
+	}
+}
+
+func TestCheckRate(t *testing.T) {
+	l := &LogStructured{keyLimiter: newKeyRateLimiter(0.001, 1, 10)}
+	if err := l.checkRate("/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.checkRate("/a"); err != server.ErrTooManyRequests {
+		t.Errorf("checkRate = %v, want %v", err, server.ErrTooManyRequests)
+	}
+
+	l = &LogStructured{}
+	for i := 0; i < 10; i++ {
+		if err := l.checkRate("/a"); err != nil {
+			t.Fatalf("checkRate without a limit = %v", err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package logstructured
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rewriteBatchSize is the number of revisions read by each batch of the rewrite of existing
+	// values, and rewriteBatchInterval the delay between batches, so that the rewrite does not
+	// compete with clients for the datastore.
+	rewriteBatchSize     = 500
+	rewriteBatchInterval = 100 * time.Millisecond
+)
+
+// ValueRewriter is implemented by logs that can replace the stored values of a revision, without
+// changing the revision or notifying watchers.
+type ValueRewriter interface {
+	RewriteValue(ctx context.Context, revision int64, value, prevValue []byte) error
+}
+
+func (c *compressedLog) RewriteValue(ctx context.Context, revision int64, value, prevValue []byte) error {
+	rewriter, ok := c.Log.(ValueRewriter)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	return rewriter.RewriteValue(ctx, revision, value, prevValue)
+}
+
+// rewriteValues compresses, and encrypts, the values of revisions that were stored before
+// compression or encryption was enabled, up to the current revision. Revisions written later are
+// already encoded as they are appended.
+func (c *compressedLog) rewriteValues(ctx context.Context) error {
+	if c.codec == nil && c.encryption == nil {
+		return nil
+	}
+	rewriter, ok := c.Log.(ValueRewriter)
+	if !ok {
+		return server.ErrNotSupported
+	}
+	current, err := c.Log.CurrentRevision(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Rewriting values stored before compression or encryption was enabled, up to revision %d", current)
+	var revision, rewritten int64
+	for revision < current {
+		// the values of the log are read as stored, so that only those not yet encoded are rewritten
+		_, events, err := c.Log.After(ctx, "/", revision, rewriteBatchSize)
+		if err != nil && err != server.ErrCompacted {
+			return err
+		}
+		if len(events) == 0 {
+			break
+		}
+		for _, event := range events {
+			revision = event.KV.ModRevision
+			if !c.needsEncode(event.KV) && !c.needsEncode(event.PrevKV) {
+				continue
+			}
+			value, err := c.reencode(ctx, event.KV)
+			if err != nil {
+				return err
+			}
+			prevValue, err := c.reencode(ctx, event.PrevKV)
+			if err != nil {
+				return err
+			}
+			if err := rewriter.RewriteValue(ctx, revision, value, prevValue); err != nil {
+				return err
+			}
+			rewritten++
+		}
+		logrus.Debugf("Rewrote values of %d revisions, up to revision %d of %d", rewritten, revision, current)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(rewriteBatchInterval):
+		}
+	}
+	logrus.Infof("Rewrote values of %d revisions", rewritten)
+	return nil
+}
+
+// needsEncode returns true if the stored value is not encrypted, or not compressed, as configured.
+func (c *compressedLog) needsEncode(kv *server.KeyValue) bool {
+	if kv == nil || len(kv.Value) == 0 {
+		return false
+	}
+	if c.encryption != nil {
+		return !bytes.HasPrefix(kv.Value, encryptedValueHeader)
+	}
+	return c.codec != nil && len(kv.Value) >= c.minSize && !bytes.HasPrefix(kv.Value, compressedValueHeader)
+}
+
+// reencode returns the stored value encoded as configured, or nil if there is no key value.
+func (c *compressedLog) reencode(ctx context.Context, kv *server.KeyValue) ([]byte, error) {
+	if kv == nil {
+		return nil, nil
+	}
+	decoded, err := c.decode(ctx, kv)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := c.encode(ctx, decoded)
+	if err != nil {
+		return nil, err
+	}
+	if encoded.Value == nil {
+		// nil leaves the previous value unchanged, so empty values are rewritten as empty
+		return []byte{}, nil
+	}
+	return encoded.Value, nil
+}
@@ -0,0 +1,89 @@
+package sqllog_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// afterRecorder is a log that records the limit of each After query.
+type afterRecorder struct {
+	logstructured.Log
+	mu     sync.Mutex
+	limits []int64
+}
+
+func (r *afterRecorder) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
+	r.mu.Lock()
+	r.limits = append(r.limits, limit)
+	r.mu.Unlock()
+	return r.Log.After(ctx, prefix, revision, limit)
+}
+
+func TestWatchCatchUpBacklog(t *testing.T) {
+	const backlog = 50000
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dialect := newTestDialect(t)
+
+	tx, err := dialect.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < backlog; i++ {
+		if _, err := tx.Exec(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+			VALUES (?, 1, 0, 0, 0, 0, ?, NULL)`, fmt.Sprintf("/backlog/%d", i), []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &drivers.Config{}
+	recorder := &afterRecorder{Log: sqllog.New(dialect, cfg)}
+	backend, err := logstructured.New(recorder, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var received int
+	var lastRev int64
+	events := backend.Watch(ctx, "/backlog/", 1)
+	timeout := time.After(time.Minute)
+	for received < backlog {
+		select {
+		case batch := <-events:
+			for _, event := range batch {
+				if event.KV.ModRevision <= lastRev {
+					t.Fatalf("revision %d received after %d", event.KV.ModRevision, lastRev)
+				}
+				lastRev = event.KV.ModRevision
+			}
+			received += len(batch)
+		case <-timeout:
+			t.Fatalf("timed out after receiving %d of %d events", received, backlog)
+		}
+	}
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	if len(recorder.limits) < 2 {
+		t.Fatalf("backlog was fetched by %d queries, want more than one", len(recorder.limits))
+	}
+	for i, limit := range recorder.limits {
+		if limit <= 0 || limit >= backlog {
+			t.Errorf("query %d has limit %d, want a bounded limit below %d", i, limit, backlog)
+		}
+	}
+}
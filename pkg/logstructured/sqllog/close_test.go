@@ -0,0 +1,82 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// createRevisions creates the key and updates it until it has the given number of revisions,
+// returning the revision of the last update.
+func createRevisions(t *testing.T, backend server.Backend, key string, revisions int) int64 {
+	t.Helper()
+	ctx := context.Background()
+	rev, err := backend.Create(ctx, key, []byte("0"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < revisions; i++ {
+		rev, _, _, err = backend.Update(ctx, key, []byte{byte(i)}, rev, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rev
+}
+
+func TestCloseDuringCompaction(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	var finished int32
+	backend, _ := openHookedBackend(t, &drivers.Config{DataSourceName: newTestDSN(t), CompactMinRetain: 1}, func() error {
+		once.Do(func() { close(started) })
+		<-release
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	})
+
+	ctx := context.Background()
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rev := createRevisions(t, backend, "/a", 5)
+	if err := backend.(server.Compactor).Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-started:
+	case <-time.After(10 * time.Second):
+		t.Fatal("compaction did not start")
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closeCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+		closed <- backend.Close(closeCtx)
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned %v while compaction was running", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close did not return once compaction stopped")
+	}
+	if atomic.LoadInt32(&finished) == 0 {
+		t.Error("Close returned before compaction stopped")
+	}
+}
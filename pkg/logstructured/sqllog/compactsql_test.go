@@ -0,0 +1,159 @@
+package sqllog_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+)
+
+// unboundedCompactSQL is the compaction query used before compaction was limited to the rows
+// after the previous compact revision. Every superseded and deleted row up to the revision is
+// scanned on each compaction.
+const unboundedCompactSQL = `
+	DELETE FROM kine AS kv
+	WHERE
+		kv.id IN (
+			SELECT kp.prev_revision AS id
+			FROM kine AS kp
+			WHERE
+				kp.name != 'compact_rev_key' AND
+				kp.prev_revision != 0 AND
+				kp.id <= ?
+			UNION
+			SELECT kd.id AS id
+			FROM kine AS kd
+			WHERE
+				kd.deleted != 0 AND
+				kd.id <= ?
+		)`
+
+// seedHistory writes the given number of revisions of each key, deleting every tenth key in
+// its final revision, and returns the current revision.
+func seedHistory(t testing.TB, d *generic.Generic, keys, revisions int) int64 {
+	t.Helper()
+	tx, err := d.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := make([]int64, keys)
+	var rev int64
+	for r := 0; r < revisions; r++ {
+		for k := 0; k < keys; k++ {
+			created, deleted := 0, 0
+			if r == 0 {
+				created = 1
+			}
+			if r == revisions-1 && k%10 == 0 {
+				deleted = 1
+			}
+			res, err := tx.Exec(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+				VALUES (?, ?, ?, 0, ?, 0, ?, NULL)`, fmt.Sprintf("/history/%d", k), created, deleted, prev[k], []byte("v"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rev, err = res.LastInsertId(); err != nil {
+				t.Fatal(err)
+			}
+			prev[k] = rev
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	return rev
+}
+
+func remainingIDs(t testing.TB, d *generic.Generic) []int64 {
+	t.Helper()
+	rows, err := d.DB.Query(`SELECT id FROM kine ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func TestCompactSQLMatchesUnbounded(t *testing.T) {
+	ctx := context.Background()
+	unbounded, bounded := newTestDialect(t), newTestDialect(t)
+	currentRev := seedHistory(t, unbounded, 100, 10)
+	if rev := seedHistory(t, bounded, 100, 10); rev != currentRev {
+		t.Fatalf("seeded revision %d, want %d", rev, currentRev)
+	}
+
+	// Both are compacted in the same steps, first to the middle of the history, and then to
+	// near its end.
+	var compactRev int64
+	for _, rev := range []int64{currentRev / 2, currentRev - 10} {
+		res, err := unbounded.DB.Exec(unboundedCompactSQL, rev, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := res.RowsAffected()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := bounded.Compact(ctx, compactRev, rev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != want {
+			t.Errorf("compaction from %d to %d deleted %d rows, want %d", compactRev, rev, deleted, want)
+		}
+		if got, want := remainingIDs(t, bounded), remainingIDs(t, unbounded); !reflect.DeepEqual(got, want) {
+			t.Errorf("compaction from %d to %d left %d rows, want %d", compactRev, rev, len(got), len(want))
+		}
+		compactRev = rev
+	}
+}
+
+// BenchmarkCompactSQL compares the unbounded and bounded compaction queries on a large table
+// whose history has mostly been compacted already, as is usual for a periodic compaction.
+// Each compaction is rolled back, so that every iteration deletes the same rows.
+func BenchmarkCompactSQL(b *testing.B) {
+	d := newTestDialect(b)
+	currentRev := seedHistory(b, d, 1000, 100)
+	compactRev := currentRev - currentRev/10
+	if _, err := d.DB.Exec(unboundedCompactSQL, compactRev, compactRev); err != nil {
+		b.Fatal(err)
+	}
+	targetRev := currentRev - 100
+
+	for _, bm := range []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{name: "unbounded", query: unboundedCompactSQL, args: []interface{}{targetRev, targetRev}},
+		{name: "bounded", query: d.CompactSQL, args: []interface{}{compactRev, targetRev, compactRev, targetRev}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				tx, err := d.DB.Begin()
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := tx.Exec(bm.query, bm.args...); err != nil {
+					b.Fatal(err)
+				}
+				if err := tx.Rollback(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+)
+
+func TestCompactDryRun(t *testing.T) {
+	ctx := context.Background()
+	cfg := &drivers.Config{DataSourceName: newTestDSN(t), CompactMinRetain: 1}
+	backend, dialect := openTestBackend(t, cfg)
+
+	aRev := createRevisions(t, backend, "/a", 5)
+	bRev, err := backend.Create(ctx, "/b", []byte("b"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.Delete(ctx, "/b", bRev); err != nil {
+		t.Fatal(err)
+	}
+	countRows := func() int64 {
+		var count int64
+		if err := dialect.DB.QueryRow("SELECT COUNT(*) FROM kine").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	rows := countRows()
+
+	result, err := sqllog.New(dialect, cfg).CompactDryRun(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The most recent revision, the delete of /b, is retained, so only the four superseded
+	// revisions of /a are eligible; the created revision of /b is still current as of bRev.
+	want := sqllog.CompactDryRunResult{
+		TargetRevision: bRev,
+		Rows:           4,
+		MinID:          aRev - 4,
+		MaxID:          aRev - 1,
+	}
+	if *result != want {
+		t.Errorf("dry run = %+v, want %+v", *result, want)
+	}
+
+	if got := countRows(); got != rows {
+		t.Errorf("rows after dry run = %d, want %d", got, rows)
+	}
+	if compactRev, err := dialect.GetCompactRevision(ctx); err != nil {
+		t.Fatal(err)
+	} else if compactRev != 0 {
+		t.Errorf("compact revision after dry run = %d, want 0", compactRev)
+	}
+}
@@ -0,0 +1,101 @@
+package sqllog
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// eventCache is a ring buffer of the most recent events read by the poll loop. Watches that
+// start from a revision within the buffered window catch up from the cache instead of querying
+// the database, which avoids a burst of queries when many watches are started at once, such as
+// when the apiserver restarts.
+type eventCache struct {
+	sync.RWMutex
+	events []*server.Event
+	// start is the index of the oldest event, and count the number of events buffered
+	start int
+	count int
+	// from is the revision after which all events are buffered, and to the most recent
+	// revision read by the poll loop
+	from int64
+	to   int64
+}
+
+func newEventCache(size int) *eventCache {
+	return &eventCache{
+		events: make([]*server.Event, size),
+	}
+}
+
+// reset empties the cache, which then buffers events after the given revision.
+func (c *eventCache) reset(revision int64) {
+	c.Lock()
+	defer c.Unlock()
+	for i := range c.events {
+		c.events[i] = nil
+	}
+	c.start, c.count = 0, 0
+	c.from, c.to = revision, revision
+}
+
+// add buffers the events read by the poll loop up to the given revision, evicting the oldest
+// events if the cache is full.
+func (c *eventCache) add(revision int64, events []*server.Event) {
+	c.Lock()
+	defer c.Unlock()
+	for _, event := range events {
+		if c.count == len(c.events) {
+			c.from = c.events[c.start].KV.ModRevision
+			c.events[c.start] = nil
+			c.start = (c.start + 1) % len(c.events)
+			c.count--
+		}
+		c.events[(c.start+c.count)%len(c.events)] = event
+		c.count++
+	}
+	c.to = revision
+}
+
+// after returns up to limit buffered events after the given revision that match the prefix and
+// are not excluded, and the most recent revision read by the poll loop. False is returned if
+// events after the revision are no longer buffered.
+func (c *eventCache) after(prefix string, exclude []string, revision, limit int64) (int64, []*server.Event, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	if revision < c.from {
+		return 0, nil, false
+	}
+
+	checkPrefix := strings.HasSuffix(prefix, "/")
+	var result []*server.Event
+	for i := 0; i < c.count; i++ {
+		event := c.events[(c.start+i)%len(c.events)]
+		if event.KV.ModRevision <= revision {
+			continue
+		}
+		if !(checkPrefix && strings.HasPrefix(event.KV.Key, prefix)) && event.KV.Key != prefix {
+			continue
+		}
+		if isExcluded(event.KV.Key, exclude) {
+			continue
+		}
+		// events are shared with the poll loop and watches, so return copies that the caller may modify
+		copied := *event
+		result = append(result, &copied)
+		if limit > 0 && int64(len(result)) >= limit {
+			break
+		}
+	}
+	return c.to, result, true
+}
+
+func isExcluded(key string, exclude []string) bool {
+	for _, excluded := range exclude {
+		if strings.HasPrefix(key, excluded) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,114 @@
+package sqllog_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+// queryCounter is a dialect that counts the queries used to get keys in bulk.
+type queryCounter struct {
+	server.Dialect
+	mu         sync.Mutex
+	keyQueries int
+}
+
+func (c *queryCounter) GetCurrentKeys(ctx context.Context, keys []string) (server.Rows, error) {
+	c.mu.Lock()
+	c.keyQueries++
+	c.mu.Unlock()
+	return c.Dialect.GetCurrentKeys(ctx, keys)
+}
+
+func (c *queryCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keyQueries = 0
+}
+
+type bulkGetter interface {
+	GetMany(ctx context.Context, keys []string) (int64, []*server.KeyValue, error)
+}
+
+func TestGetMany(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &drivers.Config{}
+	counter := &queryCounter{Dialect: newTestDialect(t)}
+	backend, err := logstructured.New(sqllog.New(counter, cfg), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 50 keys: some updated, some deleted, and some never created
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("/many/%02d", i)
+		keys = append(keys, key)
+		if i%10 == 9 {
+			continue
+		}
+		rev, err := backend.Create(ctx, key, []byte(fmt.Sprintf("%d", i)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch i % 3 {
+		case 1:
+			if _, _, _, err := backend.Update(ctx, key, []byte(fmt.Sprintf("%d-updated", i)), rev, 0); err != nil {
+				t.Fatal(err)
+			}
+		case 2:
+			if _, _, _, err := backend.Delete(ctx, key, rev); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var (
+		want       []*server.KeyValue
+		currentRev int64
+	)
+	for _, key := range keys {
+		rev, kv, err := backend.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		currentRev = rev
+		if kv != nil {
+			want = append(want, kv)
+		}
+	}
+
+	counter.reset()
+	rev, kvs, err := backend.(bulkGetter).GetMany(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counter.mu.Lock()
+	keyQueries := counter.keyQueries
+	counter.mu.Unlock()
+	if keyQueries != 1 {
+		t.Errorf("bulk get used %d queries, want 1", keyQueries)
+	}
+	if rev != currentRev {
+		t.Errorf("bulk get revision = %d, want %d", rev, currentRev)
+	}
+	if len(kvs) != len(want) {
+		t.Fatalf("bulk get returned %d keys, want %d", len(kvs), len(want))
+	}
+	for i, kv := range kvs {
+		w := want[i]
+		if kv.Key != w.Key || string(kv.Value) != string(w.Value) || kv.ModRevision != w.ModRevision || kv.CreateRevision != w.CreateRevision {
+			t.Errorf("bulk get %s = %s at %d, want %s = %s at %d", kv.Key, kv.Value, kv.ModRevision, w.Key, w.Value, w.ModRevision)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+)
+
+func TestHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, dialect := newTestBackend(t)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rev := createRevisions(t, backend, "/a", 3)
+
+	status, err := backend.Health(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.CurrentRevision != rev {
+		t.Errorf("current revision = %d, want %d", status.CurrentRevision, rev)
+	}
+	if status.CompactStale {
+		t.Error("compaction reported stale on a new datastore")
+	}
+
+	// The datastore is unreachable once the database is closed.
+	if err := dialect.DB.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Health(ctx); err == nil {
+		t.Error("expected an error once the database is unreachable")
+	}
+}
+
+func TestHealthStaleCompaction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := &drivers.Config{DataSourceName: newTestDSN(t), CompactInterval: 20 * time.Millisecond, CompactMinRetain: 1}
+	backend, _ := openHookedBackend(t, cfg, func() error {
+		return errors.New("compaction is stuck")
+	})
+	// There must be revisions to compact when the compactor starts, or there is nothing to fail.
+	createRevisions(t, backend, "/a", 5)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status, err := backend.Health(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status.CompactStale {
+			if status.LastCompact.IsZero() {
+				t.Error("stale compaction reported without the time it last completed")
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compaction not reported stale, last compacted at %v", status.LastCompact)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
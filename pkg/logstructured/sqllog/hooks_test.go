@@ -0,0 +1,61 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"database/sql"
+	"sync"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/mattn/go-sqlite3"
+)
+
+// hookedDriverName is a sqlite driver whose connections provide the compact_hook() SQL function,
+// which calls the hook set by the running test.
+const hookedDriverName = "sqlite3_hooked"
+
+var (
+	compactHookMu sync.Mutex
+	compactHook   func() error
+)
+
+func init() {
+	sql.Register(hookedDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return conn.RegisterFunc("compact_hook", func() (int64, error) {
+				compactHookMu.Lock()
+				hook := compactHook
+				compactHookMu.Unlock()
+				if hook != nil {
+					if err := hook(); err != nil {
+						return 0, err
+					}
+				}
+				return 1, nil
+			}, false)
+		},
+	})
+}
+
+// openHookedBackend returns the backend and dialect of the sqlite datastore configured by cfg,
+// whose compaction calls hook before deleting any rows. Compaction fails with any error returned
+// by the hook.
+func openHookedBackend(t *testing.T, cfg *drivers.Config, hook func() error) (server.Backend, *generic.Generic) {
+	t.Helper()
+	compactHookMu.Lock()
+	compactHook = hook
+	compactHookMu.Unlock()
+	t.Cleanup(func() {
+		compactHookMu.Lock()
+		compactHook = nil
+		compactHookMu.Unlock()
+	})
+
+	backend, dialect := openTestBackendWithDriver(t, hookedDriverName, cfg)
+	dialect.CompactSQL = `SELECT compact_hook();` + dialect.CompactSQL
+	return backend, dialect
+}
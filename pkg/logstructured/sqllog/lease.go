@@ -0,0 +1,128 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+)
+
+const (
+	// minLeaseID is the smallest lease id chosen by LeaseGrant. Before leases were managed, the
+	// lease of a key was its TTL in seconds; ids are chosen above any plausible TTL so that keys
+	// written with such leases continue to expire after their TTL.
+	minLeaseID = 1 << 24
+	// maxLeaseID is the largest lease id that can be stored in the 32-bit lease columns used
+	// by some schemas.
+	maxLeaseID = math.MaxInt32
+	// maxLeaseTTL is the maximum lease TTL, in seconds, as in etcd.
+	maxLeaseTTL = 9000000000
+
+	leaseGrantAttempts = 5
+)
+
+// LeaseGrant stores a lease, choosing an unused id if id is zero.
+func (s *SQLLog) LeaseGrant(ctx context.Context, id, ttl int64) (int64, error) {
+	if ttl > maxLeaseTTL {
+		return 0, server.ErrLeaseTTLTooLarge
+	}
+	if id < 0 || id > maxLeaseID {
+		return 0, errors.Errorf("lease id %d is out of range: must be between 1 and %d", id, maxLeaseID)
+	}
+
+	for i := 0; ; i++ {
+		leaseID := id
+		if leaseID == 0 {
+			leaseID = minLeaseID + rand.Int63n(maxLeaseID-minLeaseID+1)
+		}
+
+		// Not all drivers translate primary key violations, so check for an existing lease first.
+		_, _, err := s.d.GetLease(ctx, leaseID)
+		if err == nil {
+			if id == 0 && i < leaseGrantAttempts {
+				continue
+			}
+			return 0, server.ErrLeaseExist
+		} else if err != sql.ErrNoRows {
+			return 0, err
+		}
+
+		err = s.d.GrantLease(ctx, leaseID, ttl, time.Now().Unix()+ttl)
+		if err == server.ErrKeyExists {
+			if id == 0 && i < leaseGrantAttempts {
+				continue
+			}
+			return 0, server.ErrLeaseExist
+		}
+		return leaseID, err
+	}
+}
+
+// LeaseRevoke deletes the keys attached to a lease, and then the lease itself.
+func (s *SQLLog) LeaseRevoke(ctx context.Context, id int64) (int64, error) {
+	if _, _, err := s.d.GetLease(ctx, id); err == sql.ErrNoRows {
+		return 0, server.ErrLeaseNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	if _, err := s.DeleteLease(ctx, id, math.MaxInt64); err != nil {
+		return 0, errors.Wrapf(err, "failed to delete keys attached to lease %d", id)
+	}
+	if err := s.d.RevokeLease(ctx, id); err != nil {
+		return 0, err
+	}
+	return s.d.CurrentRevision(ctx)
+}
+
+// LeaseKeepAlive renews a lease, so that it expires one TTL from now.
+func (s *SQLLog) LeaseKeepAlive(ctx context.Context, id int64) (int64, error) {
+	renewed, err := s.d.RenewLease(ctx, id, time.Now().Unix())
+	if err != nil {
+		return 0, err
+	}
+	if !renewed {
+		return 0, server.ErrLeaseNotFound
+	}
+	ttl, _, err := s.d.GetLease(ctx, id)
+	if err == sql.ErrNoRows {
+		return 0, server.ErrLeaseNotFound
+	}
+	return ttl, err
+}
+
+func (s *SQLLog) LeaseTimeToLive(ctx context.Context, id int64, keys bool) (*server.Lease, error) {
+	ttl, expires, err := s.d.GetLease(ctx, id)
+	if err == sql.ErrNoRows {
+		return nil, server.ErrLeaseNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	lease := &server.Lease{
+		ID:         id,
+		TTL:        expires - time.Now().Unix(),
+		GrantedTTL: ttl,
+	}
+	if lease.TTL < 0 {
+		lease.TTL = 0
+	}
+	if keys {
+		if lease.Keys, err = s.d.LeaseKeys(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return lease, nil
+}
+
+func (s *SQLLog) LeaseLeases(ctx context.Context) ([]int64, error) {
+	return s.d.ListLeases(ctx)
+}
+
+// ExpiredLeases returns the ids of leases that have expired and not yet been revoked.
+func (s *SQLLog) ExpiredLeases(ctx context.Context) ([]int64, error) {
+	return s.d.ExpiredLeases(ctx, time.Now().Unix())
+}
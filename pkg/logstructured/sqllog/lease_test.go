@@ -0,0 +1,64 @@
+package sqllog_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+)
+
+func TestDeleteLease(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDialect(t)
+	insert := func(key string, create bool, createRevision, prevRevision, lease int64) int64 {
+		t.Helper()
+		rev, err := d.Insert(ctx, key, create, false, createRevision, prevRevision, lease, []byte(key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+
+	const keys = 1000
+	for i := 0; i < keys; i++ {
+		insert(fmt.Sprintf("/leased/%04d", i), true, 0, 0, 5)
+	}
+	insert("/other", true, 0, 0, 6)
+	// a key that was attached to the lease, but is no longer
+	moved := insert("/moved", true, 0, 0, 5)
+	insert("/moved", false, moved, moved, 0)
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := d.DeleteLease(ctx, 5, rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != keys {
+		t.Errorf("deleted %d keys, want %d", count, keys)
+	}
+
+	rows, err := d.ListCurrent(ctx, "/%", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, events, err := sqllog.RowsToEvents(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var remaining []string
+	for _, event := range events {
+		remaining = append(remaining, event.KV.Key)
+	}
+	if len(remaining) != 2 || remaining[0] != "/moved" || remaining[1] != "/other" {
+		t.Errorf("remaining keys = %v, want [/moved /other]", remaining)
+	}
+
+	// keys are only deleted once
+	if count, err := d.DeleteLease(ctx, 5, rev+keys); err != nil || count != 0 {
+		t.Errorf("second delete = %d, %v, want 0", count, err)
+	}
+}
@@ -0,0 +1,110 @@
+package sqllog_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestListEscapesWildcards(t *testing.T) {
+	ctx := context.Background()
+	d := newTestDialect(t)
+	for _, key := range []string{"/a_b/1", "/axb/1", "/a%b/1", "/a%%b/1", "/a!b/1", "/a!!b/1", "/ab/1"} {
+		if _, err := d.Insert(ctx, key, true, false, 0, 0, 0, []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := sqllog.New(d, &drivers.Config{})
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{prefix: "/a_b/", want: []string{"/a_b/1"}},
+		{prefix: "/a%b/", want: []string{"/a%b/1"}},
+		{prefix: "/a!b/", want: []string{"/a!b/1"}},
+		{prefix: "/a_b/1", want: []string{"/a_b/1"}},
+	}
+	for _, tt := range tests {
+		for _, revision := range []int64{0, 100} {
+			_, events, err := l.List(ctx, tt.prefix, "", 0, revision, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			for _, event := range events {
+				keys = append(keys, event.KV.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.want) {
+				t.Errorf("List(%q) at revision %d = %q, want %q", tt.prefix, revision, keys, tt.want)
+			}
+		}
+
+		_, count, err := l.Count(ctx, tt.prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != int64(len(tt.want)) {
+			t.Errorf("Count(%q) = %d, want %d", tt.prefix, count, len(tt.want))
+		}
+	}
+}
+
+func TestGetCompactedRevision(t *testing.T) {
+	ctx := context.Background()
+	backend, d := newTestBackend(t)
+	insert := func(key string, create bool, createRevision, prevRevision int64, value string) int64 {
+		t.Helper()
+		rev, err := d.Insert(ctx, key, create, false, createRevision, prevRevision, 0, []byte(value), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rev
+	}
+
+	insert("compact_rev_key", true, 0, 0, "")
+	created := insert("/a", true, 0, 0, "1")
+	prev := created
+	for _, value := range []string{"2", "3", "4"} {
+		prev = insert("/a", false, created, prev, value)
+	}
+	// compact to the revision before the latest
+	compact := prev - 1
+	if err := d.SetCompactRevision(ctx, compact); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		revision int64
+		want     string
+		err      error
+	}{
+		{name: "below", key: "/a", revision: compact - 1, err: server.ErrCompacted},
+		{name: "below without result", key: "/b", revision: compact - 1, err: server.ErrCompacted},
+		{name: "at", key: "/a", revision: compact, want: "3"},
+		{name: "above", key: "/a", revision: prev, want: "4"},
+		{name: "current", key: "/a", want: "4"},
+		{name: "at without result", key: "/b", revision: compact},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, kv, err := backend.Get(ctx, tt.key, "", 1, tt.revision)
+			if err != tt.err {
+				t.Fatalf("Get = %v, want %v", err, tt.err)
+			}
+			var got string
+			if kv != nil {
+				got = string(kv.Value)
+			}
+			if got != tt.want {
+				t.Errorf("value = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
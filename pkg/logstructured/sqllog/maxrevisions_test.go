@@ -0,0 +1,57 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+)
+
+func TestMaxRevisions(t *testing.T) {
+	const maxRevisions = 20
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the interval is long enough that only the cap can trigger compaction
+	backend, dialect := openTestBackend(t, &drivers.Config{
+		DataSourceName:   newTestDSN(t),
+		CompactInterval:  time.Hour,
+		CompactMinRetain: 1,
+		MaxRevisions:     maxRevisions,
+	})
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rev := createRevisions(t, backend, "/a", 50)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		compactRev, err := dialect.GetCompactRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev-compactRev <= maxRevisions {
+			if compactRev <= 0 {
+				t.Fatalf("compact revision = %d, want above 0", compactRev)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history from %d to %d still exceeds %d revisions", compactRev, rev, maxRevisions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// compaction only went as far as the cap requires
+	var rows int64
+	if err := dialect.DB.QueryRow("SELECT COUNT(*) FROM kine WHERE name = '/a'").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows <= 1 || rows >= 50 {
+		t.Errorf("rows of /a after capped compaction = %d, want between 2 and 49", rows)
+	}
+}
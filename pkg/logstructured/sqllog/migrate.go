@@ -0,0 +1,106 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/k3s-io/kine/pkg/logstructured"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const migratePageSize = 1000
+
+// explicit interface check
+var _ logstructured.RowCopier = (*SQLLog)(nil)
+
+// CopyTo copies every row of the log to the target log, which must also be a SQLLog.
+func (s *SQLLog) CopyTo(ctx context.Context, target logstructured.Log) (int64, error) {
+	t, ok := target.(*SQLLog)
+	if !ok {
+		return 0, server.ErrNotSupported
+	}
+	return Migrate(ctx, s.d, t.d)
+}
+
+// Migrate copies every row from the source datastore into the empty target datastore, including
+// deleted and replaced revisions, gap rows, and the compact revision, preserving their ids so
+// that the target has the same history and revision as the source. The source should not be
+// written to while rows are being copied. The current revision of the target is returned.
+func Migrate(ctx context.Context, source, target server.Dialect) (rev int64, err error) {
+	currentRev, err := target.CurrentRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get target current revision")
+	}
+	if currentRev != 0 {
+		return 0, fmt.Errorf("cannot migrate into a datastore that is not empty: current revision is %d", currentRev)
+	}
+
+	if err := target.PreRestore(ctx); err != nil {
+		return 0, errors.Wrap(err, "pre-restore operations failed")
+	}
+	defer func() {
+		if err != nil {
+			if perr := target.PostRestore(ctx); perr != nil {
+				logrus.Errorf("Failed to run post-restore operations after failed migration: %v", perr)
+			}
+		}
+	}()
+
+	var count int64
+	for {
+		rows, err := source.After(ctx, "%", nil, rev, migratePageSize)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to read rows after %d", rev)
+		}
+		n, lastRev, err := copyRows(ctx, rows, target)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+		if lastRev > rev {
+			rev = lastRev
+		}
+		if n < migratePageSize {
+			break
+		}
+		logrus.Infof("Migrated %d rows up to revision %d", count, rev)
+	}
+
+	if err := target.PostRestore(ctx); err != nil {
+		return 0, errors.Wrap(err, "post-restore operations failed")
+	}
+
+	logrus.Infof("Migration of %d rows up to revision %d complete", count, rev)
+	return rev, nil
+}
+
+// copyRows inserts the rows into the target as stored, and returns the number of rows inserted
+// and the id of the last row. Unlike scan, the columns are not adjusted for use as events.
+func copyRows(ctx context.Context, rows server.Rows, target server.Dialect) (int64, int64, error) {
+	defer rows.Close()
+
+	var count, id int64
+	for rows.Next() {
+		var (
+			rev, compact                        sql.NullInt64
+			name                                string
+			created, deleted                    bool
+			createRevision, prevRevision, lease int64
+			value, oldValue                     []byte
+		)
+		if err := rows.Scan(&rev, &compact, &id, &name, &created, &deleted, &createRevision, &prevRevision, &lease, &value, &oldValue); err != nil {
+			return 0, 0, errors.Wrap(err, "failed to read row")
+		}
+		if err := target.InsertRevision(ctx, id, name, created, deleted, createRevision, prevRevision, lease, value, oldValue); err != nil {
+			return 0, 0, errors.Wrapf(err, "failed to copy %s at revision %d", name, id)
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, 0, errors.Wrap(err, "failed to read rows")
+	}
+	return count, id, nil
+}
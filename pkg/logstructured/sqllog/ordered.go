@@ -0,0 +1,101 @@
+package sqllog
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Compaction strategies, selecting how rows are deleted by compaction.
+const (
+	// CompactStrategyBatch deletes the rows compacted by each batch of revisions with a single
+	// statement, in a serializable transaction.
+	CompactStrategyBatch = "batch"
+	// CompactStrategyOrdered deletes the rows compacted by each batch of revisions one at a time
+	// in ascending id order, in a smaller read-committed transaction. As row locks are always
+	// acquired in the same order, compaction cannot deadlock against inserts or other compactions.
+	CompactStrategyOrdered = "ordered"
+)
+
+// compactOrderedBatchSize is the number of revisions compacted by each transaction when using
+// the ordered compaction strategy.
+const compactOrderedBatchSize = 100
+
+// ValidateCompactStrategy returns an error if the compaction strategy is not supported. If the
+// strategy is empty, the batch strategy is used.
+func ValidateCompactStrategy(strategy string) error {
+	switch strategy {
+	case "", CompactStrategyBatch, CompactStrategyOrdered:
+		return nil
+	default:
+		return fmt.Errorf("invalid compact strategy %q: must be one of %s or %s", strategy, CompactStrategyBatch, CompactStrategyOrdered)
+	}
+}
+
+// compactOrdered is the ordered strategy equivalent of compact. Instead of deleting rows with a
+// single statement, whose locking order is chosen by the database, the ids of the rows to delete
+// are listed and deleted one at a time in ascending order. The compact revision is updated last;
+// as the compact_rev_key row is never deleted, it is always the last lock acquired.
+func (s *SQLLog) compactOrdered(compactRev int64, targetCompactRev int64) (int64, int64, error) {
+	ctx, cancel := context.WithTimeout(s.ctx, compactTimeout)
+	defer cancel()
+
+	t, err := s.d.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return compactRev, targetCompactRev, errors.Wrap(err, "failed to begin transaction")
+	}
+	defer t.MustRollback()
+
+	currentRev, err := t.CurrentRevision(ctx)
+	if err != nil {
+		return compactRev, targetCompactRev, errors.Wrap(err, "failed to get current revision")
+	}
+
+	dbCompactRev, err := t.GetCompactRevision(ctx)
+	if err != nil {
+		return compactRev, targetCompactRev, errors.Wrap(err, "failed to get compact revision")
+	}
+
+	if compactRev != dbCompactRev {
+		logrus.Tracef("COMPACT compact revision changed since last iteration: %d => %d", compactRev, dbCompactRev)
+		return dbCompactRev, currentRev, server.ErrCompacted
+	}
+
+	// Ensure that we never compact the most recent compactMinRetain revisions
+	targetCompactRev = s.safeCompactRev(targetCompactRev, currentRev)
+
+	// Don't bother compacting to a revision that has already been compacted
+	if targetCompactRev <= compactRev {
+		logrus.Tracef("COMPACT revision %d has already been compacted", targetCompactRev)
+		return dbCompactRev, currentRev, server.ErrCompacted
+	}
+
+	logrus.Tracef("COMPACT ordered compactRev=%d targetCompactRev=%d currentRev=%d", compactRev, targetCompactRev, currentRev)
+
+	start := time.Now()
+	ids, err := t.CompactIDs(ctx, compactRev, targetCompactRev)
+	if err != nil {
+		return compactRev, targetCompactRev, errors.Wrapf(err, "failed to list rows to compact to revision %d", targetCompactRev)
+	}
+
+	for _, id := range ids {
+		if err := t.DeleteRevision(ctx, id); err != nil {
+			return compactRev, targetCompactRev, errors.Wrapf(err, "failed to delete revision %d", id)
+		}
+	}
+
+	if err := t.SetCompactRevision(ctx, targetCompactRev); err != nil {
+		return compactRev, targetCompactRev, errors.Wrap(err, "failed to record compact revision")
+	}
+
+	t.MustCommit()
+	s.compactedRows += int64(len(ids))
+	logrus.Debugf("COMPACT deleted %d rows in id order from %d revisions in %s - compacted to %d/%d", len(ids), (targetCompactRev - compactRev), time.Since(start), targetCompactRev, currentRev)
+
+	return targetCompactRev, currentRev, nil
+}
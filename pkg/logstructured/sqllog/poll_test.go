@@ -0,0 +1,55 @@
+package sqllog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+)
+
+func TestPollInterval(t *testing.T) {
+	tests := []struct {
+		name     string
+		interval time.Duration
+		// whether the row is expected to be polled within the wait
+		wantPolled bool
+	}{
+		{name: "short", interval: 20 * time.Millisecond, wantPolled: true},
+		{name: "long", interval: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			dialect := newTestDialect(t)
+			log := sqllog.New(dialect, &drivers.Config{PollInterval: tt.interval})
+			if err := log.Start(ctx); err != nil {
+				t.Fatal(err)
+			}
+			events := log.Watch(ctx, "/")
+			// let the poll triggered by starting the log complete, so that the next is timed
+			time.Sleep(100 * time.Millisecond)
+
+			// Rows inserted by another client are only found by polling, as the log is not notified.
+			if _, err := dialect.DB.Exec(`INSERT INTO kine(name, created, deleted, create_revision, prev_revision, lease, value, old_value)
+				VALUES ('/a', 1, 0, 0, 0, 0, 'a', NULL)`); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case batch := <-events:
+				if !tt.wantPolled {
+					t.Fatalf("received %d events before the poll interval elapsed", len(batch))
+				}
+				if len(batch) != 1 || batch[0].KV.Key != "/a" {
+					t.Fatalf("received %v, want the event for /a", batch)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.wantPolled {
+					t.Fatal("row was not polled within the poll interval")
+				}
+			}
+		})
+	}
+}
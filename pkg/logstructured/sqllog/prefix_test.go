@@ -0,0 +1,76 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+)
+
+func TestCompactPrefix(t *testing.T) {
+	ctx := context.Background()
+	cfg := &drivers.Config{DataSourceName: newTestDSN(t), CompactMinRetain: 1}
+	backend, dialect := openTestBackend(t, cfg)
+
+	// The underscore in the churned prefix must not match any character in the other prefix.
+	for _, key := range []string{"/churn_1/a", "/churn_1/b", "/churnx1/a", "/other/a"} {
+		createRevisions(t, backend, key, 5)
+	}
+	if _, err := backend.Create(ctx, "/churn_1/c", []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	deleteRev, err := backend.Create(ctx, "/churn_1/deleted", []byte("d"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, err := backend.Delete(ctx, "/churn_1/deleted", deleteRev); err != nil {
+		t.Fatal(err)
+	}
+	// the most recent revision is never compacted
+	if _, err := backend.Create(ctx, "/other/b", []byte("b"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted, err := sqllog.New(dialect, cfg).CompactPrefix(ctx, "/churn_1/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// four superseded revisions each of a and b, and both revisions of the deleted key
+	if deleted != 10 {
+		t.Errorf("deleted rows = %d, want 10", deleted)
+	}
+
+	for key, want := range map[string]int{
+		"/churn_1/a":       1,
+		"/churn_1/b":       1,
+		"/churn_1/c":       1,
+		"/churn_1/deleted": 0,
+		"/churnx1/a":       5,
+		"/other/a":         5,
+		"/other/b":         1,
+	} {
+		var rows int
+		if err := dialect.DB.QueryRow("SELECT COUNT(*) FROM kine WHERE name = ?", key).Scan(&rows); err != nil {
+			t.Fatal(err)
+		}
+		if rows != want {
+			t.Errorf("rows of %s = %d, want %d", key, rows, want)
+		}
+	}
+
+	// the latest revision of each key is still readable
+	for _, key := range []string{"/churn_1/a", "/churn_1/b"} {
+		_, kv, err := backend.Get(ctx, key, "", 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kv == nil || !bytes.Equal(kv.Value, []byte{4}) {
+			t.Errorf("latest value of %s = %v, want revision 4", key, kv)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package sqllog_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc/status"
+)
+
+func TestReadOnly(t *testing.T) {
+	ctx := context.Background()
+	dsn := newTestDSN(t)
+	writable, dialect := openTestBackend(t, &drivers.Config{DataSourceName: dsn})
+	rev, err := writable.Create(ctx, "/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialect.Close()
+
+	backend, _ := openTestBackend(t, &drivers.Config{DataSourceName: dsn, ReadOnly: true})
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	kv := server.New(backend, "sqlite", 0, "sqlite", nil)
+
+	put := func(key string, modRevision int64) *etcdserverpb.TxnRequest {
+		return &etcdserverpb.TxnRequest{
+			Compare: []*etcdserverpb.Compare{{
+				Key:         []byte(key),
+				Target:      etcdserverpb.Compare_MOD,
+				Result:      etcdserverpb.Compare_EQUAL,
+				TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: modRevision},
+			}},
+			Success: []*etcdserverpb.RequestOp{{
+				Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("b")}},
+			}},
+		}
+	}
+	for name, txn := range map[string]*etcdserverpb.TxnRequest{
+		"create": put("/b", 0),
+		"update": put("/a", rev),
+	} {
+		if _, err := kv.Txn(ctx, txn); status.Code(err) != status.Code(server.ErrReadOnly) || status.Convert(err).Message() != status.Convert(server.ErrReadOnly).Message() {
+			t.Errorf("%s = %v, want %v", name, err, server.ErrReadOnly)
+		}
+	}
+	if _, _, _, err := backend.Delete(ctx, "/a", rev); err != server.ErrReadOnly {
+		t.Errorf("delete = %v, want %v", err, server.ErrReadOnly)
+	}
+
+	resp, err := kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/a")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) != 1 || string(resp.Kvs[0].Value) != "a" {
+		t.Errorf("range of /a = %v, want value a", resp.Kvs)
+	}
+	resp, err = kv.Range(ctx, &etcdserverpb.RangeRequest{Key: []byte("/"), RangeEnd: []byte("0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Count != 1 || len(resp.Kvs) != 1 {
+		t.Errorf("range of / = %d keys, want 1", resp.Count)
+	}
+}
@@ -0,0 +1,64 @@
+package sqllog_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestValuesNotLogged(t *testing.T) {
+	level := logrus.GetLevel()
+	threshold := metrics.SlowSQLThreshold
+	defer func() {
+		logrus.SetLevel(level)
+		metrics.SlowSQLThreshold = threshold
+	}()
+	// Log at every level, and report every statement as slow so that its arguments are logged too.
+	logrus.SetLevel(logrus.TraceLevel)
+	metrics.SlowSQLThreshold = time.Nanosecond
+	hook := test.NewGlobal()
+	defer hook.Reset()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, _ := newTestBackend(t)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "s3cr3t-token-value"
+	rev, err := backend.Create(ctx, "/registry/secrets/default/token", []byte(secret+"-1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rev, _, ok, err := backend.Update(ctx, "/registry/secrets/default/token", []byte(secret+"-2"), rev, 0)
+	if err != nil || !ok {
+		t.Fatalf("update: ok=%v, err=%v", ok, err)
+	}
+	if _, _, err := backend.Get(ctx, "/registry/secrets/default/token", "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := backend.List(ctx, "/registry/secrets/", "", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchKeys(t, backend.Watch(ctx, "/registry/secrets/", rev), "/registry/secrets/default/token")
+	if _, _, _, err := backend.Delete(ctx, "/registry/secrets/default/token", rev); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hook.AllEntries()) == 0 {
+		t.Fatal("no log entries were captured")
+	}
+	for _, entry := range hook.AllEntries() {
+		line := entry.Message + fmt.Sprint(entry.Data)
+		if strings.Contains(line, secret) {
+			t.Errorf("secret value logged at %s level: %s", entry.Level, line)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package sqllog
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Auto-compaction modes, matching the values accepted by etcd's --auto-compaction-mode flag.
+const (
+	AutoCompactionPeriodic = "periodic"
+	AutoCompactionRevision = "revision"
+)
+
+const (
+	// revisionCompactInterval is the interval at which revision-based compaction runs, as in etcd.
+	revisionCompactInterval = 5 * time.Minute
+	// maxPeriodicCompactInterval is the longest interval at which periodic compaction runs, as in etcd.
+	maxPeriodicCompactInterval = time.Hour
+)
+
+// AutoCompactionRetention is the amount of history retained by compaction. Exactly one of
+// Period and Revisions is set.
+type AutoCompactionRetention struct {
+	// Period is the duration for which revisions are retained, in periodic mode.
+	Period time.Duration
+	// Revisions is the number of revisions retained, in revision mode.
+	Revisions int64
+}
+
+type revisionSample struct {
+	time     time.Time
+	revision int64
+}
+
+// ParseAutoCompactionRetention parses the retention using the same semantics as etcd's
+// --auto-compaction-retention flag. In periodic mode, the value is a duration, or an integer
+// number of hours; in revision mode it is the number of revisions to keep. If mode is empty,
+// periodic mode is used. nil is returned if the value is empty or zero, in which case
+// compaction retains only the revisions written since the previous compaction.
+func ParseAutoCompactionRetention(mode, value string) (*AutoCompactionRetention, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	switch mode {
+	case "", AutoCompactionPeriodic:
+		period, err := time.ParseDuration(value)
+		if err != nil {
+			hours, herr := strconv.ParseInt(value, 10, 64)
+			if herr != nil {
+				return nil, fmt.Errorf("invalid auto-compaction retention %q: must be a duration or a number of hours", value)
+			}
+			period = time.Duration(hours) * time.Hour
+		}
+		if period < 0 {
+			return nil, fmt.Errorf("invalid auto-compaction retention %q: must not be negative", value)
+		}
+		if period == 0 {
+			return nil, nil
+		}
+		return &AutoCompactionRetention{Period: period}, nil
+	case AutoCompactionRevision:
+		revisions, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || revisions < 0 {
+			return nil, fmt.Errorf("invalid auto-compaction retention %q: must be a non-negative number of revisions", value)
+		}
+		if revisions == 0 {
+			return nil, nil
+		}
+		return &AutoCompactionRetention{Revisions: revisions}, nil
+	default:
+		return nil, fmt.Errorf("invalid auto-compaction mode %q: must be one of %s or %s", mode, AutoCompactionPeriodic, AutoCompactionRevision)
+	}
+}
+
+// interval returns the interval at which the compactor should run. As in etcd, revision-based
+// compaction runs every five minutes, and periodic compaction records the current revision
+// every tenth of the retention period, up to a maximum of one hour, so that the window of
+// retained revisions slides forward in small steps.
+func (r *AutoCompactionRetention) interval() time.Duration {
+	if r.Revisions > 0 {
+		return revisionCompactInterval
+	}
+	period := r.Period
+	if period > maxPeriodicCompactInterval {
+		period = maxPeriodicCompactInterval
+	}
+	return period / 10
+}
+
+// retentionTarget returns the revision that compaction should compact to, so that the
+// configured retention is kept. In periodic mode the current revision is recorded, and the
+// most recent revision recorded at least one retention period ago is returned; zero is
+// returned until the first period has passed.
+func (s *SQLLog) retentionTarget(now time.Time, currentRev int64) int64 {
+	if s.retention.Revisions > 0 {
+		if currentRev <= s.retention.Revisions {
+			return 0
+		}
+		return currentRev - s.retention.Revisions
+	}
+
+	s.retentionSamples = append(s.retentionSamples, revisionSample{time: now, revision: currentRev})
+
+	var (
+		target int64
+		i      int
+	)
+	cutoff := now.Add(-s.retention.Period)
+	for ; i < len(s.retentionSamples) && !s.retentionSamples[i].time.After(cutoff); i++ {
+		target = s.retentionSamples[i].revision
+	}
+
+	// Discard samples older than the target. The target itself is kept, in case compaction fails.
+	if i > 1 {
+		s.retentionSamples = s.retentionSamples[i-1:]
+	}
+	return target
+}
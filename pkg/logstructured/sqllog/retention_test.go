@@ -0,0 +1,89 @@
+package sqllog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAutoCompactionRetention(t *testing.T) {
+	tests := []struct {
+		mode, value string
+		want        *AutoCompactionRetention
+		wantErr     bool
+	}{
+		{mode: "", value: "", want: nil},
+		{mode: "", value: "1h", want: &AutoCompactionRetention{Period: time.Hour}},
+		{mode: AutoCompactionPeriodic, value: "30m", want: &AutoCompactionRetention{Period: 30 * time.Minute}},
+		// an integer is a number of hours in periodic mode
+		{mode: AutoCompactionPeriodic, value: "2", want: &AutoCompactionRetention{Period: 2 * time.Hour}},
+		{mode: AutoCompactionPeriodic, value: "0", want: nil},
+		{mode: AutoCompactionPeriodic, value: "-1h", wantErr: true},
+		{mode: AutoCompactionPeriodic, value: "soon", wantErr: true},
+		{mode: AutoCompactionRevision, value: "1000", want: &AutoCompactionRetention{Revisions: 1000}},
+		{mode: AutoCompactionRevision, value: "0", want: nil},
+		{mode: AutoCompactionRevision, value: "1h", wantErr: true},
+		{mode: AutoCompactionRevision, value: "-5", wantErr: true},
+		{mode: "weekly", value: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseAutoCompactionRetention(tt.mode, tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseAutoCompactionRetention(%q, %q) error = %v, want error %v", tt.mode, tt.value, err, tt.wantErr)
+			continue
+		}
+		if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+			t.Errorf("ParseAutoCompactionRetention(%q, %q) = %+v, want %+v", tt.mode, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRetentionTargetRevisions(t *testing.T) {
+	s := &SQLLog{retention: &AutoCompactionRetention{Revisions: 100}}
+	now := time.Now()
+	for _, tt := range []struct{ current, want int64 }{
+		{current: 50, want: 0},
+		{current: 100, want: 0},
+		{current: 101, want: 1},
+		{current: 1500, want: 1400},
+	} {
+		if got := s.retentionTarget(now, tt.current); got != tt.want {
+			t.Errorf("target at revision %d = %d, want %d", tt.current, got, tt.want)
+		}
+	}
+	if got := s.retention.interval(); got != revisionCompactInterval {
+		t.Errorf("interval = %v, want %v", got, revisionCompactInterval)
+	}
+}
+
+func TestRetentionTargetPeriod(t *testing.T) {
+	s := &SQLLog{retention: &AutoCompactionRetention{Period: time.Hour}}
+	if got := s.retention.interval(); got != 6*time.Minute {
+		t.Errorf("interval = %v, want %v", got, 6*time.Minute)
+	}
+
+	// the current revision is sampled every six minutes, advancing by 10 revisions each time
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	target := func(step int) int64 {
+		return s.retentionTarget(start.Add(time.Duration(step)*6*time.Minute), int64(step*10))
+	}
+	for step := 0; step < 10; step++ {
+		if got := target(step); got != 0 {
+			t.Fatalf("target %v after start = %d, want 0 until an hour has passed", time.Duration(step)*6*time.Minute, got)
+		}
+	}
+	// after an hour the revision recorded an hour ago is retained
+	if got := target(10); got != 0 {
+		t.Errorf("target after an hour = %d, want 0", got)
+	}
+	if got := target(11); got != 10 {
+		t.Errorf("target after 66m = %d, want 10", got)
+	}
+	// without samples in between, the latest revision recorded over an hour ago is retained
+	if got := target(25); got != 110 {
+		t.Errorf("target after 150m = %d, want 110", got)
+	}
+	// samples before the target are discarded
+	if len(s.retentionSamples) != 2 {
+		t.Errorf("%d samples retained, want 2", len(s.retentionSamples))
+	}
+}
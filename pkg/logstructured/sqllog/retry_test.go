@@ -0,0 +1,78 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCompactRetriesDeadlock(t *testing.T) {
+	var calls int32
+	backend, dialect := openHookedBackend(t, &drivers.Config{DataSourceName: newTestDSN(t), CompactMinRetain: 1}, func() error {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			return errors.New("deadlock detected")
+		}
+		return nil
+	})
+	// report the hook's error as a Postgres deadlock, which is retriable
+	errCode := dialect.ErrCode
+	dialect.ErrCode = func(err error) string {
+		if err != nil && strings.Contains(err.Error(), "deadlock detected") {
+			return "40P01"
+		}
+		return errCode(err)
+	}
+	dialect.RetriableErrCodes = []string{"40P01"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	rev := createRevisions(t, backend, "/a", 5)
+	failures := testutil.ToFloat64(metrics.CompactTotal.WithLabelValues(metrics.ResultError))
+	if err := backend.(server.Compactor).Compact(ctx, rev); err != nil {
+		t.Fatal(err)
+	}
+
+	// The requested compaction is only run once, so it must succeed by retrying.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		compactRev, err := dialect.GetCompactRevision(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compactRev > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("compaction did not complete after %d attempts", atomic.LoadInt32(&calls))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Errorf("compaction attempts = %d, want 3", got)
+	}
+	if got := testutil.ToFloat64(metrics.CompactTotal.WithLabelValues(metrics.ResultError)); got != failures {
+		t.Errorf("failed compactions = %v, want %v", got, failures)
+	}
+	var rows int
+	if err := dialect.DB.QueryRow("SELECT COUNT(*) FROM kine WHERE name = '/a'").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows >= 5 {
+		t.Errorf("rows of /a after compaction = %d, want fewer than 5", rows)
+	}
+}
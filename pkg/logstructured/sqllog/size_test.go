@@ -0,0 +1,46 @@
+package sqllog_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestSizeLimits(t *testing.T) {
+	ctx := context.Background()
+	backend, dialect := openTestBackend(t, &drivers.Config{DataSourceName: newTestDSN(t), MaxKeySize: 16, MaxValueSize: 64})
+	rev, err := backend.Create(ctx, "/a", []byte("a"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	longKey := "/" + strings.Repeat("k", 16)
+	largeValue := bytes.Repeat([]byte("v"), 65)
+	if _, err := backend.Create(ctx, longKey, []byte("a"), 0); err != server.ErrTooLarge {
+		t.Errorf("create with oversized key = %v, want %v", err, server.ErrTooLarge)
+	}
+	if _, err := backend.Create(ctx, "/b", largeValue, 0); err != server.ErrTooLarge {
+		t.Errorf("create with oversized value = %v, want %v", err, server.ErrTooLarge)
+	}
+	if _, _, _, err := backend.Update(ctx, "/a", largeValue, rev, 0); err != server.ErrTooLarge {
+		t.Errorf("update with oversized value = %v, want %v", err, server.ErrTooLarge)
+	}
+
+	// the rejected writes never reached the datastore
+	var rows int
+	if err := dialect.DB.QueryRow("SELECT COUNT(*) FROM kine WHERE name != 'compact_rev_key'").Scan(&rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 {
+		t.Errorf("kine table has %d rows, want 1", rows)
+	}
+
+	// writes at the limits are allowed
+	if _, err := backend.Create(ctx, longKey[:16], bytes.Repeat([]byte("v"), 64), 0); err != nil {
+		t.Errorf("create at the size limits = %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package sqllog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/k3s-io/kine/pkg/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	snapshotPageSize = 1000
+	snapshotVersion  = 1
+
+	frameRecord byte = 'R'
+	frameEnd    byte = 'E'
+)
+
+var snapshotMagic = []byte("KINESNAP")
+
+// SnapshotRecord is a single key/value pair as stored in a snapshot.
+type SnapshotRecord struct {
+	Key            string
+	CreateRevision int64
+	ModRevision    int64
+	Lease          int64
+	Value          []byte
+}
+
+// Snapshot streams the logical state of the datastore at the current revision to w.
+// Only the latest non-deleted revision of each key is written, so the snapshot does
+// not include any history. Rows are read in pages to avoid buffering the entire
+// dataset in memory. The revision that the snapshot represents is returned.
+func Snapshot(ctx context.Context, d server.Dialect, w io.Writer) (int64, error) {
+	rev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get current revision")
+	}
+
+	sw, err := NewSnapshotWriter(w, rev)
+	if err != nil {
+		return 0, err
+	}
+
+	startKey := ""
+	for {
+		rows, err := d.List(ctx, "%", startKey, snapshotPageSize, rev, false)
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to list keys after %q", startKey)
+		}
+
+		_, _, events, err := RowsToEvents(rows)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to read rows")
+		}
+
+		for _, event := range events {
+			if err := sw.Write(&SnapshotRecord{
+				Key:            event.KV.Key,
+				CreateRevision: event.KV.CreateRevision,
+				ModRevision:    event.KV.ModRevision,
+				Lease:          event.KV.Lease,
+				Value:          event.KV.Value,
+			}); err != nil {
+				return 0, err
+			}
+		}
+
+		if len(events) < snapshotPageSize {
+			break
+		}
+		startKey = events[len(events)-1].KV.Key
+	}
+
+	if err := sw.Close(); err != nil {
+		return 0, err
+	}
+
+	logrus.Infof("Snapshot of %d keys at revision %d complete", sw.count, rev)
+	return rev, nil
+}
+
+// Restore loads a snapshot written by Snapshot into an empty datastore. Rows are inserted
+// with their original revisions, and the compact revision is advanced to the snapshot
+// revision so that requests for older revisions fail instead of returning partial results.
+// The current revision of the restored datastore is returned, which is the snapshot revision
+// unless the compact revision row had to be added after it.
+// Indexes that the dialect drops before restoring are rebuilt once all rows are inserted,
+// or if the restore fails, so that normal operation is unaffected afterwards.
+func Restore(ctx context.Context, d server.Dialect, r io.Reader) (rev int64, err error) {
+	currentRev, err := d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get current revision")
+	}
+	if currentRev != 0 {
+		return 0, fmt.Errorf("cannot restore into a datastore that is not empty: current revision is %d", currentRev)
+	}
+
+	sr, err := NewSnapshotReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := d.PreRestore(ctx); err != nil {
+		return 0, errors.Wrap(err, "pre-restore operations failed")
+	}
+	defer func() {
+		if err != nil {
+			if perr := d.PostRestore(ctx); perr != nil {
+				logrus.Errorf("Failed to run post-restore operations after failed restore: %v", perr)
+			}
+		}
+	}()
+
+	var (
+		count      int64
+		maxRev     int64
+		hasCompact bool
+	)
+	for {
+		record, err := sr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+
+		create := record.CreateRevision == record.ModRevision
+		if err := d.InsertRevision(ctx, record.ModRevision, record.Key, create, false, record.CreateRevision, 0, record.Lease, record.Value, nil); err != nil {
+			return 0, errors.Wrapf(err, "failed to restore key %q at revision %d", record.Key, record.ModRevision)
+		}
+		if record.ModRevision > maxRev {
+			maxRev = record.ModRevision
+		}
+		if record.Key == "compact_rev_key" {
+			hasCompact = true
+		}
+		count++
+	}
+
+	// The row recording the compact revision is otherwise only created when the log is started,
+	// which the target of a restore has not been. It is inserted with an explicit id before the
+	// post-restore operations, so that the id sequence is advanced past it: at the snapshot
+	// revision if no key was written at that revision, or else at the next revision, which then
+	// becomes the revision of the restored datastore.
+	rev = sr.Revision()
+	if !hasCompact {
+		if maxRev >= rev {
+			rev = maxRev + 1
+		}
+		if err := d.InsertRevision(ctx, rev, "compact_rev_key", true, false, 0, 0, 0, []byte(""), nil); err != nil {
+			return 0, errors.Wrap(err, "failed to create compact revision")
+		}
+	} else if maxRev < rev {
+		// ensure that the current revision matches the revision the snapshot was taken at
+		if err := d.Fill(ctx, rev); err != nil {
+			return 0, errors.Wrapf(err, "failed to fill revision %d", rev)
+		}
+	}
+
+	if err := d.PostRestore(ctx); err != nil {
+		return 0, errors.Wrap(err, "post-restore operations failed")
+	}
+
+	if err := d.SetCompactRevision(ctx, rev); err != nil {
+		return 0, errors.Wrap(err, "failed to record compact revision")
+	}
+
+	logrus.Infof("Restore of %d keys at revision %d complete", count, rev)
+	return rev, nil
+}
+
+// SnapshotWriter writes snapshot records using a simple length-prefixed framing.
+// The stream starts with a magic string, a format version, and the revision the
+// snapshot represents, followed by any number of records and an end frame.
+type SnapshotWriter struct {
+	w     *bufio.Writer
+	buf   []byte
+	count int64
+}
+
+func NewSnapshotWriter(w io.Writer, revision int64) (*SnapshotWriter, error) {
+	sw := &SnapshotWriter{
+		w:   bufio.NewWriter(w),
+		buf: make([]byte, binary.MaxVarintLen64),
+	}
+	if _, err := sw.w.Write(snapshotMagic); err != nil {
+		return nil, err
+	}
+	if err := sw.w.WriteByte(snapshotVersion); err != nil {
+		return nil, err
+	}
+	if err := sw.writeInt(revision); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (sw *SnapshotWriter) Write(record *SnapshotRecord) error {
+	if err := sw.w.WriteByte(frameRecord); err != nil {
+		return err
+	}
+	if err := sw.writeBytes([]byte(record.Key)); err != nil {
+		return err
+	}
+	for _, i := range []int64{record.CreateRevision, record.ModRevision, record.Lease} {
+		if err := sw.writeInt(i); err != nil {
+			return err
+		}
+	}
+	if err := sw.writeBytes(record.Value); err != nil {
+		return err
+	}
+	sw.count++
+	return nil
+}
+
+// Close writes the end frame and flushes any buffered data. It does not close the underlying writer.
+func (sw *SnapshotWriter) Close() error {
+	if err := sw.w.WriteByte(frameEnd); err != nil {
+		return err
+	}
+	if err := sw.writeInt(sw.count); err != nil {
+		return err
+	}
+	return sw.w.Flush()
+}
+
+func (sw *SnapshotWriter) writeInt(i int64) error {
+	n := binary.PutVarint(sw.buf, i)
+	_, err := sw.w.Write(sw.buf[:n])
+	return err
+}
+
+func (sw *SnapshotWriter) writeBytes(b []byte) error {
+	if err := sw.writeInt(int64(len(b))); err != nil {
+		return err
+	}
+	_, err := sw.w.Write(b)
+	return err
+}
+
+// SnapshotReader reads records written by a SnapshotWriter.
+type SnapshotReader struct {
+	r        *bufio.Reader
+	revision int64
+	count    int64
+}
+
+func NewSnapshotReader(r io.Reader) (*SnapshotReader, error) {
+	sr := &SnapshotReader{
+		r: bufio.NewReader(r),
+	}
+
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr.r, magic); err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot header")
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return nil, errors.New("invalid snapshot header")
+	}
+
+	version, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot version")
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	sr.revision, err = binary.ReadVarint(sr.r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot revision")
+	}
+	return sr, nil
+}
+
+// Revision returns the revision that the snapshot represents.
+func (sr *SnapshotReader) Revision() int64 {
+	return sr.revision
+}
+
+// Next returns the next record in the snapshot, or io.EOF once the end frame has been
+// read and the record count has been verified.
+func (sr *SnapshotReader) Next() (*SnapshotRecord, error) {
+	frame, err := sr.r.ReadByte()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot frame")
+	}
+
+	switch frame {
+	case frameEnd:
+		count, err := binary.ReadVarint(sr.r)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read snapshot record count")
+		}
+		if count != sr.count {
+			return nil, fmt.Errorf("snapshot is truncated: expected %d records, read %d", count, sr.count)
+		}
+		return nil, io.EOF
+	case frameRecord:
+	default:
+		return nil, fmt.Errorf("invalid snapshot frame type %q", frame)
+	}
+
+	record := &SnapshotRecord{}
+	key, err := sr.readBytes()
+	if err != nil {
+		return nil, err
+	}
+	record.Key = string(key)
+	for _, i := range []*int64{&record.CreateRevision, &record.ModRevision, &record.Lease} {
+		if *i, err = binary.ReadVarint(sr.r); err != nil {
+			return nil, errors.Wrap(err, "failed to read snapshot record")
+		}
+	}
+	if record.Value, err = sr.readBytes(); err != nil {
+		return nil, err
+	}
+
+	sr.count++
+	return record, nil
+}
+
+func (sr *SnapshotReader) readBytes() ([]byte, error) {
+	n, err := binary.ReadVarint(sr.r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot record")
+	}
+	if n < 0 {
+		return nil, fmt.Errorf("invalid snapshot field length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(sr.r, b); err != nil {
+		return nil, errors.Wrap(err, "failed to read snapshot record")
+	}
+	return b, nil
+}
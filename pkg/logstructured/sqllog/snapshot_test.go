@@ -0,0 +1,296 @@
+package sqllog_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/drivers/sqlite"
+	"github.com/k3s-io/kine/pkg/logstructured/sqllog"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+var testRecords = []*sqllog.SnapshotRecord{
+	{Key: "/a", CreateRevision: 1, ModRevision: 1, Value: []byte("a")},
+	{Key: "/b", CreateRevision: 2, ModRevision: 5, Lease: 7, Value: []byte{}},
+	{Key: "/c", CreateRevision: 3, ModRevision: 6, Value: bytes.Repeat([]byte("c"), 5000)},
+}
+
+func writeSnapshot(t *testing.T, revision int64, records []*sqllog.SnapshotRecord) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	sw, err := sqllog.NewSnapshotWriter(buf, revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := sw.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readSnapshot reads all records of the snapshot, returning the first error other than io.EOF.
+func readSnapshot(data []byte) (int64, []*sqllog.SnapshotRecord, error) {
+	sr, err := sqllog.NewSnapshotReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, err
+	}
+	var records []*sqllog.SnapshotRecord
+	for {
+		record, err := sr.Next()
+		if err == io.EOF {
+			return sr.Revision(), records, nil
+		} else if err != nil {
+			return 0, nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, records := range [][]*sqllog.SnapshotRecord{nil, testRecords} {
+		data := writeSnapshot(t, 10, records)
+		rev, got, err := readSnapshot(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rev != 10 {
+			t.Errorf("revision = %d, want 10", rev)
+		}
+		if !reflect.DeepEqual(got, records) {
+			t.Errorf("records = %+v, want %+v", got, records)
+		}
+	}
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+	data := writeSnapshot(t, 10, testRecords)
+	for i := 0; i < len(data); i++ {
+		if _, _, err := readSnapshot(data[:i]); err == nil {
+			t.Fatalf("snapshot truncated to %d of %d bytes was read", i, len(data))
+		}
+	}
+}
+
+func TestSnapshotCorrupt(t *testing.T) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	binary.PutVarint(buf, -1)
+	negativeOne := buf[0]
+
+	data := writeSnapshot(t, 10, testRecords[:1])
+	// the magic string, version, and revision, which is a single byte varint
+	header := len("KINESNAP") + 1 + 1
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "magic", data: corrupt(func(b []byte) []byte { b[0] = 'X'; return b })},
+		{name: "version", data: corrupt(func(b []byte) []byte { b[len("KINESNAP")] = 9; return b })},
+		{name: "frame type", data: corrupt(func(b []byte) []byte { b[header] = 'X'; return b })},
+		{name: "negative key length", data: corrupt(func(b []byte) []byte { b[header+1] = negativeOne; return b })},
+		{name: "record count", data: corrupt(func(b []byte) []byte { b[len(b)-1] = 4; return b })},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := readSnapshot(tt.data); err == nil {
+				t.Error("corrupt snapshot was read")
+			}
+		})
+	}
+}
+
+// newTestBackend returns the backend and dialect of an empty sqlite datastore.
+func newTestBackend(t testing.TB) (server.Backend, *generic.Generic) {
+	t.Helper()
+	return openTestBackend(t, &drivers.Config{DataSourceName: newTestDSN(t)})
+}
+
+// newTestDSN returns the DSN of a new sqlite database.
+func newTestDSN(t testing.TB) string {
+	return filepath.Join(t.TempDir(), "state.db") + "?_journal=WAL&cache=shared"
+}
+
+// openTestBackend returns the backend and dialect of the sqlite datastore configured by cfg.
+func openTestBackend(t testing.TB, cfg *drivers.Config) (server.Backend, *generic.Generic) {
+	t.Helper()
+	return openTestBackendWithDriver(t, "sqlite3", cfg)
+}
+
+// openTestBackendWithDriver returns the backend and dialect of the sqlite datastore configured by
+// cfg, opened with the named database/sql driver.
+func openTestBackendWithDriver(t testing.TB, driverName string, cfg *drivers.Config) (server.Backend, *generic.Generic) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	backend, dialect, err := sqlite.NewVariantWithConfig(ctx, driverName, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dialect.Close() })
+	return backend, dialect
+}
+
+// newTestDialect returns the dialect of an empty sqlite datastore.
+func newTestDialect(t testing.TB) *generic.Generic {
+	t.Helper()
+	_, dialect := newTestBackend(t)
+	return dialect
+}
+
+func TestRestoreIntoEmptyDatastore(t *testing.T) {
+	ctx := context.Background()
+	source := newTestDialect(t)
+	for _, key := range []string{"/a", "/b", "/c"} {
+		if _, err := source.Insert(ctx, key, true, false, 0, 0, 0, []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := &bytes.Buffer{}
+	rev, err := sqllog.Snapshot(ctx, source, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := newTestDialect(t)
+	restored, err := sqllog.Restore(ctx, target, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the source was never started, so the compact revision row is added after the keys
+	if restored != rev+1 {
+		t.Errorf("restored revision = %d, want %d", restored, rev+1)
+	}
+	checkRestored(t, target, restored)
+
+	rows, err := target.ListCurrent(ctx, "/%", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, events, err := sqllog.RowsToEvents(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("restored %d keys, want 3", len(events))
+	}
+	for _, event := range events {
+		if string(event.KV.Value) != event.KV.Key {
+			t.Errorf("value of %s = %q", event.KV.Key, event.KV.Value)
+		}
+	}
+}
+
+func TestRestoreCompactRevisionRow(t *testing.T) {
+	compactRow := &sqllog.SnapshotRecord{Key: "compact_rev_key", CreateRevision: 1, ModRevision: 1, Value: []byte{}}
+	tests := []struct {
+		name     string
+		revision int64
+		records  []*sqllog.SnapshotRecord
+		want     int64
+	}{
+		{name: "without row", revision: 10, records: testRecords, want: 10},
+		{name: "without row or free revision", revision: 6, records: testRecords, want: 7},
+		{name: "with row", revision: 10, records: append([]*sqllog.SnapshotRecord{compactRow}, testRecords[1:]...), want: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTestDialect(t)
+			restored, err := sqllog.Restore(context.Background(), target, bytes.NewReader(writeSnapshot(t, tt.revision, tt.records)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if restored != tt.want {
+				t.Errorf("restored revision = %d, want %d", restored, tt.want)
+			}
+			checkRestored(t, target, restored)
+		})
+	}
+}
+
+// checkRestored checks that the current and compact revisions of the restored datastore are the
+// restored revision, and that it has a single compact revision row.
+func checkRestored(t *testing.T, d *generic.Generic, restored int64) {
+	t.Helper()
+	ctx := context.Background()
+	current, err := d.CurrentRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != restored {
+		t.Errorf("current revision = %d, want restored revision %d", current, restored)
+	}
+	compactRev, err := d.GetCompactRevision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compactRev != restored {
+		t.Errorf("compact revision = %d, want %d", compactRev, restored)
+	}
+	rows, err := d.After(ctx, "compact_rev_key", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, events, err := sqllog.RowsToEvents(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Errorf("datastore has %d compact revision rows, want 1", len(events))
+	}
+}
+
+func TestRestoreRebuildsIndex(t *testing.T) {
+	const keys = 3000
+	ctx := context.Background()
+	records := make([]*sqllog.SnapshotRecord, 0, keys)
+	for i := 0; i < keys; i++ {
+		rev := int64(i + 1)
+		records = append(records, &sqllog.SnapshotRecord{Key: fmt.Sprintf("/k/%04d", i), CreateRevision: rev, ModRevision: rev, Value: []byte("v")})
+	}
+
+	target := newTestDialect(t)
+	restored, err := sqllog.Restore(ctx, target, bytes.NewReader(writeSnapshot(t, keys+1, records)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRestored(t, target, restored)
+
+	var indexes int
+	if err := target.DB.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND name = 'kine_name_prev_revision_uindex'`).Scan(&indexes); err != nil {
+		t.Fatal(err)
+	}
+	if indexes != 1 {
+		t.Fatal("unique index was not rebuilt after restore")
+	}
+	// the rebuilt index enforces uniqueness again
+	if _, err := target.Insert(ctx, "/k/0000", true, false, 0, 0, 0, []byte("v"), nil); err != server.ErrKeyExists {
+		t.Errorf("creating a restored key returned %v, want %v", err, server.ErrKeyExists)
+	}
+
+	rows, err := target.ListCurrent(ctx, "/k/%", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, events, err := sqllog.RowsToEvents(rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != keys {
+		t.Errorf("listed %d restored keys, want %d", len(events), keys)
+	}
+}
@@ -3,10 +3,15 @@ package sqllog
 import (
 	"context"
 	"database/sql"
+	"io"
+	"math/rand"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/k3s-io/kine/pkg/broadcaster"
+	"github.com/k3s-io/kine/pkg/drivers"
 	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/k3s-io/kine/pkg/server"
 	"github.com/pkg/errors"
@@ -14,37 +19,141 @@ import (
 )
 
 const (
-	compactInterval  = 5 * time.Minute
-	compactTimeout   = 5 * time.Second
-	compactMinRetain = 1000
-	compactBatchSize = 1000
-	pollBatchSize    = 500
+	compactInterval   = 5 * time.Minute
+	compactTimeout    = 5 * time.Second
+	compactMinRetain  = 1000
+	compactBatchSize  = 1000
+	compactRetries    = 3
+	compactRetryDelay = 100 * time.Millisecond
+	pollInterval      = time.Second
+	pollBatchSize     = 500
+	getManyBatchSize  = 500
+
+	// compactStaleIntervals is the number of compaction intervals without a successful
+	// compaction after which compaction is reported as stale.
+	compactStaleIntervals = 3
 )
 
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
 type SQLLog struct {
 	d           server.Dialect
 	broadcaster broadcaster.Broadcaster
 	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
 	notify      chan int64
+	readOnly    bool
+
+	// pollRevision is the most recent revision read by the poll loop
+	pollRevision int64
+	// lastCompact is the time in unix nanoseconds at which compaction last completed
+	lastCompact int64
+	// revisionWarned is set once the revision has crossed 90% of the maximum revision of the dialect
+	revisionWarned bool
+	// compactedRows is the number of rows deleted by compaction since post-compact operations were last run
+	compactedRows int64
+	// compactRevision is the revision most recently compacted to by the compactor
+	compactRevision int64
+	// compactNow triggers compaction before the next interval, when history exceeds maxRevisions
+	compactNow chan struct{}
+	// compactTo triggers compaction to the requested revision before the next interval
+	compactTo chan int64
+	// eventCache buffers recent events for watches to catch up from, or is nil if disabled
+	eventCache *eventCache
+
+	compactJitter   int
+	compactDryRun   bool
+	orderedCompact  bool
+	compactInterval time.Duration
+	// compactBatchSize is the number of revisions compacted by each batch, or zero to use the
+	// default for the compaction strategy
+	compactBatchSize int64
+	// compactBatchDelay is the pause between compaction batches
+	compactBatchDelay time.Duration
+	// compactMinRetain is the number of most recent revisions that are never compacted
+	compactMinRetain int64
+	// retention is the history retained by compaction, or nil to retain only the revisions
+	// written since the previous compaction
+	retention        *AutoCompactionRetention
+	retentionSamples []revisionSample
+	maxRevisions     int64
+	pollInterval     time.Duration
+	pollBatchSize    int64
+}
+
+// CompactDryRunResult describes the rows that would be deleted by compaction.
+type CompactDryRunResult struct {
+	CompactRevision int64
+	TargetRevision  int64
+	Rows            int64
+	MinID           int64
+	MaxID           int64
 }
 
-func New(d server.Dialect) *SQLLog {
+func New(d server.Dialect, cfg *drivers.Config) *SQLLog {
 	l := &SQLLog{
-		d:      d,
-		notify: make(chan int64, 1024),
+		d:          d,
+		notify:     make(chan int64, 1024),
+		compactNow: make(chan struct{}, 1),
+		compactTo:  make(chan int64, 1),
+		readOnly:   cfg.ReadOnly,
+
+		compactJitter:     cfg.CompactIntervalJitter,
+		compactDryRun:     cfg.CompactDryRun,
+		orderedCompact:    cfg.CompactStrategy == CompactStrategyOrdered,
+		compactInterval:   compactInterval,
+		compactBatchSize:  int64(cfg.CompactBatchSize),
+		compactBatchDelay: cfg.CompactBatchDelay,
+		compactMinRetain:  compactMinRetain,
+		pollInterval:      pollInterval,
+		pollBatchSize:     pollBatchSize,
+	}
+	retention, err := ParseAutoCompactionRetention(cfg.AutoCompactionMode, cfg.AutoCompactionRetention)
+	if err != nil {
+		logrus.Errorf("Ignoring auto-compaction retention: %v", err)
+	} else if retention != nil {
+		l.retention = retention
+		l.compactInterval = retention.interval()
+	}
+	if cfg.CompactInterval > 0 {
+		l.compactInterval = cfg.CompactInterval
+	}
+	if cfg.CompactMinRetain > 0 {
+		l.compactMinRetain = cfg.CompactMinRetain
+	}
+	if cfg.MaxRevisions > 0 {
+		l.maxRevisions = cfg.MaxRevisions
+		if l.maxRevisions < l.compactMinRetain {
+			logrus.Warnf("Raising max revisions from %d to %d, as the most recent %d revisions are never compacted", cfg.MaxRevisions, l.compactMinRetain, l.compactMinRetain)
+			l.maxRevisions = l.compactMinRetain
+		}
+	}
+	if cfg.PollInterval > 0 {
+		l.pollInterval = cfg.PollInterval
+	}
+	if cfg.PollBatchSize > 0 {
+		l.pollBatchSize = int64(cfg.PollBatchSize)
+	}
+	if cfg.WatchCacheSize > 0 {
+		l.eventCache = newEventCache(cfg.WatchCacheSize)
 	}
 	return l
 }
 
 func (s *SQLLog) Start(ctx context.Context) error {
-	s.ctx = ctx
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	if s.readOnly {
+		logrus.Infof("Compaction is disabled in read-only mode")
+		return nil
+	}
 	return s.compactStart(s.ctx)
 }
 
 func (s *SQLLog) compactStart(ctx context.Context) error {
 	logrus.Tracef("COMPACTSTART")
 
-	rows, err := s.d.After(ctx, "compact_rev_key", 0, 0)
+	rows, err := s.d.After(ctx, "compact_rev_key", nil, 0, 0)
 	if err != nil {
 		return err
 	}
@@ -99,24 +208,89 @@ func (s *SQLLog) compactStart(ctx context.Context) error {
 	return t.Commit()
 }
 
+// jitterInterval returns the interval randomly adjusted by up to +/- jitter percent,
+// so that compaction on replicas started at the same time does not stay in lockstep.
+func jitterInterval(r *rand.Rand, interval time.Duration, jitter int) time.Duration {
+	if jitter <= 0 {
+		return interval
+	}
+	if jitter > 100 {
+		jitter = 100
+	}
+	maxJitter := int64(interval) * int64(jitter) / 100
+	if maxJitter <= 0 {
+		return interval
+	}
+	return interval + time.Duration(r.Int63n(2*maxJitter+1)-maxJitter)
+}
+
 // compactor periodically compacts historical versions of keys.
-// It will compact keys with versions older than given interval, but never within the last 1000 revisions.
+// It will compact keys with versions older than given interval, but never within the most recent compactMinRetain revisions.
 // In other words, after compaction, it will only contain key revisions set during last interval.
 // Any API call for the older versions of keys will return error.
 // Interval is the time interval between each compaction. The first compaction happens after "interval".
 // This logic is directly cribbed from k8s.io/apiserver/pkg/storage/etcd3/compact.go
 func (s *SQLLog) compactor(interval time.Duration) {
-	t := time.NewTicker(interval)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	t := time.NewTimer(jitterInterval(r, interval, s.compactJitter))
+	defer t.Stop()
+	atomic.StoreInt64(&s.lastCompact, time.Now().UnixNano())
 	compactRev, _ := s.d.GetCompactRevision(s.ctx)
 	targetCompactRev, _ := s.d.CurrentRevision(s.ctx)
+	atomic.StoreInt64(&s.compactRevision, compactRev)
 	logrus.Tracef("COMPACT starting compactRev=%d targetCompactRev=%d", compactRev, targetCompactRev)
 
 outer:
 	for {
+		capped := false
+		requested := int64(0)
 		select {
 		case <-s.ctx.Done():
 			return
 		case <-t.C:
+			t.Reset(jitterInterval(r, interval, s.compactJitter))
+		case <-s.compactNow:
+			capped = true
+		case rev := <-s.compactTo:
+			if rev <= compactRev {
+				continue
+			}
+			logrus.Infof("COMPACT requested to revision %d", rev)
+			requested = rev
+		}
+
+		if s.compactDryRun {
+			if _, err := s.CompactDryRun(s.ctx); err != nil {
+				logrus.Errorf("Compact dry run failed: %v", err)
+			}
+			continue
+		}
+
+		if requested > 0 {
+			targetCompactRev = requested
+		} else if capped {
+			// compact only as far as is needed to bring the history under the cap, leaving the
+			// rest to the regularly scheduled compaction
+			currentRev, err := s.d.CurrentRevision(s.ctx)
+			if err != nil {
+				logrus.Errorf("Compact failed to get current revision: %v", err)
+				metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+				continue
+			}
+			capRev := currentRev - s.maxRevisions
+			if capRev <= compactRev {
+				continue
+			}
+			logrus.Infof("COMPACT history from revision %d to %d exceeds max revisions %d, compacting to %d", compactRev, currentRev, s.maxRevisions, capRev)
+			targetCompactRev = capRev
+		} else if s.retention != nil {
+			currentRev, err := s.d.CurrentRevision(s.ctx)
+			if err != nil {
+				logrus.Errorf("Compact failed to get current revision: %v", err)
+				metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+				continue
+			}
+			targetCompactRev = s.retentionTarget(time.Now(), currentRev)
 		}
 
 		// Break up the compaction into smaller batches to avoid locking the database with excessively
@@ -133,17 +307,34 @@ outer:
 
 		iterCompactRev = compactRev
 		compactedRev = compactRev
+		startRows := s.compactedRows
+
+		batchSize := int64(compactBatchSize)
+		if s.orderedCompact {
+			batchSize = compactOrderedBatchSize
+		}
+		if s.compactBatchSize > 0 {
+			batchSize = s.compactBatchSize
+		}
 
 		for iterCompactRev < targetCompactRev {
-			// Set move iteration target compactBatchSize revisions forward, or
+			if iterCompactRev > compactRev && s.compactBatchDelay > 0 {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-time.After(s.compactBatchDelay):
+				}
+			}
+
+			// Set move iteration target batchSize revisions forward, or
 			// just as far as we need to hit the compaction target if that would
 			// overshoot it.
-			iterCompactRev += compactBatchSize
+			iterCompactRev += batchSize
 			if iterCompactRev > targetCompactRev {
 				iterCompactRev = targetCompactRev
 			}
 
-			compactedRev, currentRev, err = s.compact(compactedRev, iterCompactRev)
+			compactedRev, currentRev, err = s.compactWithRetry(compactedRev, iterCompactRev)
 			if err != nil {
 				// ErrCompacted indicates that no further work is necessary - either compactRev changed since the
 				// last iteration because another client has compacted, or the requested revision has already been compacted.
@@ -152,11 +343,13 @@ outer:
 				} else {
 					logrus.Errorf("Compact failed: %v", err)
 					metrics.CompactTotal.WithLabelValues(metrics.ResultError).Inc()
+					metrics.CompactDeletedRows.Observe(float64(s.compactedRows - startRows))
 					continue outer
 				}
 			}
 		}
 
+		metrics.CompactDeletedRows.Observe(float64(s.compactedRows - startRows))
 		if err := s.postCompact(); err != nil {
 			logrus.Errorf("Post-compact operations failed: %v", err)
 		}
@@ -164,8 +357,84 @@ outer:
 		// Record the final results for the outer loop
 		compactRev = compactedRev
 		targetCompactRev = currentRev
+		atomic.StoreInt64(&s.compactRevision, compactRev)
 
 		metrics.CompactTotal.WithLabelValues(metrics.ResultSuccess).Inc()
+		atomic.StoreInt64(&s.lastCompact, time.Now().UnixNano())
+	}
+}
+
+// CompactDryRun reports how many rows would be deleted by compacting to the most recent revision
+// that compaction is allowed to remove, without deleting anything.
+func (s *SQLLog) CompactDryRun(ctx context.Context) (*CompactDryRunResult, error) {
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current revision")
+	}
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get compact revision")
+	}
+
+	result := &CompactDryRunResult{
+		CompactRevision: compactRev,
+		TargetRevision:  s.safeCompactRev(currentRev, currentRev),
+	}
+	if result.TargetRevision > compactRev {
+		result.Rows, result.MinID, result.MaxID, err = s.d.CompactDryRun(ctx, result.TargetRevision)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to check compaction to revision %d", result.TargetRevision)
+		}
+	}
+
+	logrus.Infof("COMPACT dry run: compacting from revision %d to %d would delete %d rows with ids %d-%d",
+		result.CompactRevision, result.TargetRevision, result.Rows, result.MinID, result.MaxID)
+	return result, nil
+}
+
+// CompactPrefix deletes the history of keys matching the prefix, up to the most recent revision
+// that compaction is allowed to remove. The latest revision of each key is never removed.
+// Unlike regular compaction, the compact revision is not advanced, so requests for older
+// revisions of keys matching the prefix will return incomplete results instead of an error.
+func (s *SQLLog) CompactPrefix(ctx context.Context, prefix string) (int64, error) {
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get current revision")
+	}
+
+	targetRev := s.safeCompactRev(currentRev, currentRev)
+	deletedRows, err := s.d.CompactPrefix(ctx, escapeLike(prefix)+"%", targetRev)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to compact prefix %s to revision %d", prefix, targetRev)
+	}
+
+	logrus.Infof("COMPACT deleted %d rows for prefix %s up to revision %d", deletedRows, prefix, targetRev)
+	return deletedRows, nil
+}
+
+// compactWithRetry calls compact, or compactOrdered if the ordered strategy is selected, retrying with exponential backoff if compaction fails due to a
+// transient error such as a deadlock or serialization failure. Other errors are returned immediately.
+func (s *SQLLog) compactWithRetry(compactRev int64, targetCompactRev int64) (int64, int64, error) {
+	compact := s.compact
+	if s.orderedCompact {
+		compact = s.compactOrdered
+	}
+
+	delay := compactRetryDelay
+	for i := 0; ; i++ {
+		compactedRev, currentRev, err := compact(compactRev, targetCompactRev)
+		if err == nil || i >= compactRetries || !s.d.IsRetriable(err) {
+			return compactedRev, currentRev, err
+		}
+
+		logrus.Warnf("Compact failed with a retriable error, retrying in %s: %v", delay, err)
+		select {
+		case <-s.ctx.Done():
+			return compactedRev, currentRev, err
+		case <-time.After(delay):
+		}
+		delay *= 2
 	}
 }
 
@@ -184,12 +453,12 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	}
 	defer t.MustRollback()
 
-	currentRev, err := t.CurrentRevision(s.ctx)
+	currentRev, err := t.CurrentRevision(ctx)
 	if err != nil {
 		return compactRev, targetCompactRev, errors.Wrap(err, "failed to get current revision")
 	}
 
-	dbCompactRev, err := t.GetCompactRevision(s.ctx)
+	dbCompactRev, err := t.GetCompactRevision(ctx)
 	if err != nil {
 		return compactRev, targetCompactRev, errors.Wrap(err, "failed to get compact revision")
 	}
@@ -199,8 +468,8 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 		return dbCompactRev, currentRev, server.ErrCompacted
 	}
 
-	// Ensure that we never compact the most recent 1000 revisions
-	targetCompactRev = safeCompactRev(targetCompactRev, currentRev)
+	// Ensure that we never compact the most recent compactMinRetain revisions
+	targetCompactRev = s.safeCompactRev(targetCompactRev, currentRev)
 
 	// Don't bother compacting to a revision that has already been compacted
 	if targetCompactRev <= compactRev {
@@ -211,16 +480,17 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 	logrus.Tracef("COMPACT compactRev=%d targetCompactRev=%d currentRev=%d", compactRev, targetCompactRev, currentRev)
 
 	start := time.Now()
-	deletedRows, err := t.Compact(s.ctx, targetCompactRev)
+	deletedRows, err := t.Compact(ctx, compactRev, targetCompactRev)
 	if err != nil {
 		return compactRev, targetCompactRev, errors.Wrapf(err, "failed to compact to revision %d", targetCompactRev)
 	}
 
-	if err := t.SetCompactRevision(s.ctx, targetCompactRev); err != nil {
+	if err := t.SetCompactRevision(ctx, targetCompactRev); err != nil {
 		return compactRev, targetCompactRev, errors.Wrap(err, "failed to record compact revision")
 	}
 
 	t.MustCommit()
+	s.compactedRows += deletedRows
 	logrus.Debugf("COMPACT deleted %d rows from %d revisions in %s - compacted to %d/%d", deletedRows, (targetCompactRev - compactRev), time.Since(start), targetCompactRev, currentRev)
 
 	return targetCompactRev, currentRev, nil
@@ -228,19 +498,107 @@ func (s *SQLLog) compact(compactRev int64, targetCompactRev int64) (int64, int64
 
 // postCompact executes any post-compact database cleanup - vacuuming, WAL truncate, etc.
 func (s *SQLLog) postCompact() error {
-	return s.d.PostCompact(s.ctx)
+	deletedRows := s.compactedRows
+	s.compactedRows = 0
+	return s.d.PostCompact(s.ctx, deletedRows)
+}
+
+// GetMany returns the current revision of each of the keys that exists, ordered by key. Keys are
+// read using a query per batch of keys, instead of a query per key.
+func (s *SQLLog) GetMany(ctx context.Context, keys []string) (int64, []*server.Event, error) {
+	var (
+		rev    int64
+		result []*server.Event
+	)
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > getManyBatchSize {
+			batch = batch[:getManyBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		rows, err := s.d.GetCurrentKeys(ctx, batch)
+		if err != nil {
+			return 0, nil, err
+		}
+		batchRev, _, events, err := RowsToEvents(rows)
+		if err != nil {
+			return 0, nil, err
+		}
+		if batchRev > rev {
+			rev = batchRev
+		}
+		result = append(result, events...)
+	}
+	return rev, result, nil
+}
+
+// Snapshot writes a snapshot of the current revision of each key to w.
+func (s *SQLLog) Snapshot(ctx context.Context, w io.Writer) (int64, error) {
+	return Snapshot(ctx, s.d, w)
+}
+
+// Defragment reclaims the space freed by compaction, if the dialect supports it.
+func (s *SQLLog) Defragment(ctx context.Context) error {
+	start := time.Now()
+	if err := s.d.Defragment(ctx); err != nil {
+		return err
+	}
+	logrus.Infof("Defragmented datastore in %s", time.Since(start))
+	return nil
+}
+
+// Restore loads a snapshot into the datastore, which must be empty.
+func (s *SQLLog) Restore(ctx context.Context, r io.Reader) (int64, error) {
+	return Restore(ctx, s.d, r)
+}
+
+// GetAtRevision returns the key as of the given revision, even if that revision has been
+// compacted, as long as the dialect archives compacted rows. nil is returned if the key did
+// not exist at the revision.
+func (s *SQLLog) GetAtRevision(ctx context.Context, key string, revision int64) (*server.KeyValue, error) {
+	rows, err := s.d.GetAtRevision(ctx, key, revision)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, events, err := RowsToEvents(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(events) == 0 || events[0].Delete {
+		return nil, nil
+	}
+	return events[0].KV, nil
+}
+
+// RewriteValue replaces the stored value of a revision, and its previous value if prevValue is not
+// nil, without changing the revision or notifying watchers.
+func (s *SQLLog) RewriteValue(ctx context.Context, revision int64, value, prevValue []byte) error {
+	return s.d.UpdateValue(ctx, revision, value, prevValue)
 }
 
 func (s *SQLLog) CurrentRevision(ctx context.Context) (int64, error) {
 	return s.d.CurrentRevision(ctx)
 }
 
+// After returns up to limit events after the revision for keys matching the prefix. Keys with
+// any of the prefixes excluded by server.WithWatchExclusions are not read.
 func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64) (int64, []*server.Event, error) {
-	if strings.HasSuffix(prefix, "/") {
-		prefix += "%"
+	if s.eventCache != nil && revision >= atomic.LoadInt64(&s.compactRevision) {
+		if rev, events, ok := s.eventCache.after(prefix, server.WatchExclusions(ctx), revision, limit); ok {
+			return rev, events, nil
+		}
 	}
 
-	rows, err := s.d.After(ctx, prefix, revision, limit)
+	prefix = likePattern(prefix)
+
+	var exclude []string
+	for _, excluded := range server.WatchExclusions(ctx) {
+		exclude = append(exclude, escapeLike(excluded)+"%")
+	}
+
+	rows, err := s.d.After(ctx, prefix, exclude, revision, limit)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -255,7 +613,7 @@ func (s *SQLLog) After(ctx context.Context, prefix string, revision, limit int64
 
 func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (int64, []*server.Event, error) {
 	var (
-		rows *sql.Rows
+		rows server.Rows
 		err  error
 	)
 
@@ -265,11 +623,11 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 		if prefix == startKey {
 			startKey = ""
 		}
-		prefix += "%"
 	} else {
 		// Also if this isn't a list there is no reason to pass startKey
 		startKey = ""
 	}
+	prefix = likePattern(prefix)
 
 	if revision == 0 {
 		rows, err = s.d.ListCurrent(ctx, prefix, limit, includeDeleted)
@@ -305,7 +663,7 @@ func (s *SQLLog) List(ctx context.Context, prefix, startKey string, limit, revis
 	return rev, result, err
 }
 
-func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
+func RowsToEvents(rows server.Rows) (int64, int64, []*server.Event, error) {
 	var (
 		result  []*server.Event
 		rev     int64
@@ -321,14 +679,28 @@ func RowsToEvents(rows *sql.Rows) (int64, int64, []*server.Event, error) {
 		result = append(result, event)
 	}
 
+	// iteration stops early if the query fails or its context is cancelled, so the
+	// error must be checked to avoid returning a partial result
+	if err := rows.Err(); err != nil {
+		return 0, 0, nil, err
+	}
+
 	return rev, compact, result, nil
 }
 
+// WatchProgressRevision returns the most recent revision read by the poll loop. Events up to this
+// revision have been, or are being, dispatched to watches.
+func (s *SQLLog) WatchProgressRevision() int64 {
+	return atomic.LoadInt64(&s.pollRevision)
+}
+
 func (s *SQLLog) Watch(ctx context.Context, prefix string) <-chan []*server.Event {
 	res := make(chan []*server.Event, 100)
 	values, err := s.broadcaster.Subscribe(ctx, s.startWatch)
 	if err != nil {
-		return nil
+		logrus.Errorf("Failed to start watch: %v", err)
+		close(res)
+		return res
 	}
 
 	checkPrefix := strings.HasSuffix(prefix, "/")
@@ -365,11 +737,25 @@ func (s *SQLLog) startWatch() (chan interface{}, error) {
 		return nil, err
 	}
 
+	if s.eventCache != nil {
+		s.eventCache.reset(pollStart)
+	}
+
 	c := make(chan interface{})
 	// start compaction and polling at the same time to watch starts
 	// at the oldest revision, but compaction doesn't create gaps
-	go s.compactor(compactInterval)
-	go s.poll(c, pollStart)
+	if !s.readOnly {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.compactor(s.compactInterval)
+		}()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.poll(c, pollStart)
+	}()
 	return c, nil
 }
 
@@ -381,7 +767,7 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 		waitForMore = true
 	)
 
-	wait := time.NewTicker(time.Second)
+	wait := time.NewTicker(s.pollInterval)
 	defer wait.Stop()
 	defer close(result)
 
@@ -399,7 +785,7 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 		}
 		waitForMore = true
 
-		rows, err := s.d.After(s.ctx, "%", last, pollBatchSize)
+		rows, err := s.d.After(s.ctx, "%", nil, last, s.pollBatchSize)
 		if err != nil {
 			logrus.Errorf("fail to list latest changes: %v", err)
 			continue
@@ -443,6 +829,10 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 					default:
 					}
 					break
+				} else if s.readOnly {
+					// gaps cannot be filled by a read-only client, so wait for the
+					// writer to fill them, or for the skip timeout to expire
+					break
 				} else {
 					if err := s.d.Fill(s.ctx, next); err == nil {
 						logrus.Tracef("FILL, revision=%d, err=%v", next, err)
@@ -474,6 +864,14 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 
 		if saveLast {
 			last = rev
+			atomic.StoreInt64(&s.pollRevision, last)
+			s.observeRevision(last)
+			s.checkMaxRevisions(last)
+			// events are cached before they are sent, so that a watch that misses them on
+			// the channel because it has not yet subscribed finds them in the cache
+			if s.eventCache != nil {
+				s.eventCache.add(last, sequential)
+			}
 			if len(sequential) > 0 {
 				result <- sequential
 			}
@@ -481,15 +879,77 @@ func (s *SQLLog) poll(result chan interface{}, pollStart int64) {
 	}
 }
 
+// observeRevision records the most recent revision, warning once if it is close to overflowing
+// the id column of the dialect.
+func (s *SQLLog) observeRevision(rev int64) {
+	metrics.CurrentRevision.Set(float64(rev))
+	maxRevision := s.d.MaxRevision()
+	if rev >= maxRevision/10*9 && !s.revisionWarned {
+		s.revisionWarned = true
+		logrus.Warnf("Current revision %d is over 90%% of the maximum id %d; migrate the datastore schema to 64-bit ids before it is reached", rev, maxRevision)
+	}
+}
+
+// Compact schedules compaction to the given revision, which must not be newer than the current
+// revision. The most recent compactMinRetain revisions are retained regardless.
+func (s *SQLLog) Compact(ctx context.Context, revision int64) error {
+	if s.readOnly {
+		return server.ErrReadOnly
+	}
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return errors.Wrap(err, "failed to get current revision")
+	}
+	if revision > currentRev {
+		return server.ErrFutureRev
+	}
+	if revision <= atomic.LoadInt64(&s.compactRevision) {
+		return server.ErrCompacted
+	}
+	// replace any request that the compactor has not yet picked up
+	select {
+	case <-s.compactTo:
+	default:
+	}
+	select {
+	case s.compactTo <- revision:
+	default:
+	}
+	return nil
+}
+
+// checkMaxRevisions triggers compaction if the history retained exceeds the maximum number of revisions.
+func (s *SQLLog) checkMaxRevisions(rev int64) {
+	if s.maxRevisions <= 0 || s.readOnly || s.compactDryRun || rev-atomic.LoadInt64(&s.compactRevision) <= s.maxRevisions {
+		return
+	}
+	select {
+	case s.compactNow <- struct{}{}:
+	default:
+	}
+}
+
 func canSkipRevision(rev, skip int64, skipTime time.Time) bool {
 	return rev == skip && time.Since(skipTime) > time.Second
 }
 
 func (s *SQLLog) Count(ctx context.Context, prefix string) (int64, int64, error) {
-	if strings.HasSuffix(prefix, "/") {
-		prefix += "%"
+	return s.d.Count(ctx, likePattern(prefix))
+}
+
+// likePattern returns the LIKE pattern matching the key, or all keys under the key if it
+// ends with a slash. Keys may contain LIKE wildcards, so they are escaped with the '!'
+// character, which is used as the escape character by all LIKE clauses in the dialect.
+func likePattern(key string) string {
+	pattern := escapeLike(key)
+	if strings.HasSuffix(key, "/") {
+		pattern += "%"
 	}
-	return s.d.Count(ctx, prefix)
+	return pattern
+}
+
+func escapeLike(str string) string {
+	return likeEscaper.Replace(str)
 }
 
 func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error) {
@@ -520,7 +980,25 @@ func (s *SQLLog) Append(ctx context.Context, event *server.Event) (int64, error)
 	return rev, nil
 }
 
-func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error {
+// DeleteLease deletes all keys attached to the given lease whose latest revision is
+// not newer than the provided revision, using a single statement.
+func (s *SQLLog) DeleteLease(ctx context.Context, lease, revision int64) (int64, error) {
+	count, err := s.d.DeleteLease(ctx, lease, revision)
+	if err != nil {
+		return 0, err
+	}
+	if count > 0 {
+		if rev, err := s.d.CurrentRevision(ctx); err == nil {
+			select {
+			case s.notify <- rev:
+			default:
+			}
+		}
+	}
+	return count, nil
+}
+
+func scan(rows server.Rows, rev *int64, compact *int64, event *server.Event) error {
 	event.KV = &server.KeyValue{}
 	event.PrevKV = &server.KeyValue{}
 
@@ -552,9 +1030,9 @@ func scan(rows *sql.Rows, rev *int64, compact *int64, event *server.Event) error
 	return nil
 }
 
-// safeCompactRev ensures that we never compact the most recent 1000 revisions.
-func safeCompactRev(targetCompactRev int64, currentRev int64) int64 {
-	safeRev := currentRev - compactMinRetain
+// safeCompactRev ensures that we never compact the most recent compactMinRetain revisions.
+func (s *SQLLog) safeCompactRev(targetCompactRev int64, currentRev int64) int64 {
+	safeRev := currentRev - s.compactMinRetain
 	if targetCompactRev < safeRev {
 		safeRev = targetCompactRev
 	}
@@ -567,3 +1045,52 @@ func safeCompactRev(targetCompactRev int64, currentRev int64) int64 {
 func (s *SQLLog) DbSize(ctx context.Context) (int64, error) {
 	return s.d.GetSize(ctx)
 }
+
+// Health checks that the database is reachable, and that compaction has completed recently.
+func (s *SQLLog) Health(ctx context.Context) (*server.HealthStatus, error) {
+	if err := s.d.Ping(ctx); err != nil {
+		return nil, err
+	}
+
+	currentRev, err := s.d.CurrentRevision(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get current revision")
+	}
+
+	compactRev, err := s.d.GetCompactRevision(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get compact revision")
+	}
+
+	status := &server.HealthStatus{
+		CurrentRevision: currentRev,
+		CompactRevision: compactRev,
+	}
+	if lastCompact := atomic.LoadInt64(&s.lastCompact); lastCompact != 0 {
+		status.LastCompact = time.Unix(0, lastCompact)
+		status.CompactStale = time.Since(status.LastCompact) > compactStaleIntervals*s.compactInterval
+	}
+	return status, nil
+}
+
+// Close stops the compaction and polling loops and closes the database. Cancelling the
+// loops aborts any in-progress compaction, which is rolled back. If ctx is done before
+// the loops have stopped, the database is closed anyway.
+func (s *SQLLog) Close(ctx context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logrus.Warnf("Timed out waiting for compaction and polling to stop: %v", ctx.Err())
+	}
+
+	return s.d.Close()
+}
@@ -0,0 +1,107 @@
+package sqllog
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers/generic"
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestObserveRevision(t *testing.T) {
+	tests := []struct {
+		name     string
+		idBits   int
+		revision int64
+		wantWarn bool
+	}{
+		{name: "32-bit below threshold", idBits: 32, revision: math.MaxInt32 / 2},
+		{name: "32-bit above threshold", idBits: 32, revision: math.MaxInt32 - 1000, wantWarn: true},
+		{name: "64-bit past 32-bit limit", idBits: 64, revision: math.MaxInt32 + 1000},
+		{name: "default width past 32-bit limit", revision: math.MaxInt32 + 1000},
+		{name: "64-bit above threshold", idBits: 64, revision: math.MaxInt64 - 1000, wantWarn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook := test.NewGlobal()
+			defer hook.Reset()
+
+			s := &SQLLog{d: &generic.Generic{IDColumnBits: tt.idBits}}
+			// the warning is only logged once
+			s.observeRevision(tt.revision)
+			s.observeRevision(tt.revision + 1)
+
+			if got := testutil.ToFloat64(metrics.CurrentRevision); got != float64(tt.revision+1) {
+				t.Errorf("current revision gauge = %v, want %v", got, tt.revision+1)
+			}
+			var warnings int
+			for _, entry := range hook.AllEntries() {
+				if entry.Level == logrus.WarnLevel && strings.Contains(entry.Message, "maximum id") {
+					warnings++
+				}
+			}
+			want := 0
+			if tt.wantWarn {
+				want = 1
+			}
+			if warnings != want {
+				t.Errorf("warnings = %d, want %d", warnings, want)
+			}
+		})
+	}
+}
+
+func TestJitterInterval(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name     string
+		interval time.Duration
+		jitter   int
+		min, max time.Duration
+	}{
+		{name: "no jitter", interval: time.Minute, min: time.Minute, max: time.Minute},
+		{name: "negative jitter", interval: time.Minute, jitter: -10, min: time.Minute, max: time.Minute},
+		{name: "10 percent", interval: time.Minute, jitter: 10, min: 54 * time.Second, max: 66 * time.Second},
+		{name: "capped at 100 percent", interval: time.Minute, jitter: 200, min: 0, max: 2 * time.Minute},
+		{name: "interval too short to jitter", interval: 5, jitter: 10, min: 5, max: 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := map[time.Duration]bool{}
+			for i := 0; i < 1000; i++ {
+				got := jitterInterval(r, tt.interval, tt.jitter)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("jitterInterval = %v, want between %v and %v", got, tt.min, tt.max)
+				}
+				seen[got] = true
+			}
+			if tt.min != tt.max && len(seen) < 2 {
+				t.Errorf("jitterInterval always returned %v", tt.interval)
+			}
+		})
+	}
+}
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		key, want string
+	}{
+		{key: "/registry/pods/a", want: "/registry/pods/a"},
+		{key: "/registry/pods/", want: "/registry/pods/%"},
+		{key: "/100%/", want: "/100!%/%"},
+		{key: "/a_b", want: "/a!_b"},
+		{key: "/a!b/", want: "/a!!b/%"},
+		{key: "/!%_/", want: "/!!!%!_/%"},
+	}
+	for _, tt := range tests {
+		if got := likePattern(tt.key); got != tt.want {
+			t.Errorf("likePattern(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+//go:build cgo
+// +build cgo
+
+package sqllog_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/drivers"
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestVacuumAfterLargeCompaction(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, dialect := openTestBackend(t, &drivers.Config{DataSourceName: newTestDSN(t), CompactMinRetain: 1})
+	// record the number of times the table is vacuumed
+	if _, err := dialect.DB.Exec(`CREATE TABLE vacuums (n INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	dialect.VacuumSQL = `INSERT INTO vacuums (n) VALUES (1)`
+	dialect.VacuumThreshold = 5
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// compact runs a compaction to the revision and waits for it to complete.
+	compact := func(rev int64) {
+		t.Helper()
+		status, err := backend.Health(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lastCompact := status.LastCompact
+		if err := backend.(server.Compactor).Compact(ctx, rev); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(10 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			if status, err = backend.Health(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if status.LastCompact.After(lastCompact) && status.CompactRevision > 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("compaction to revision %d did not complete", rev)
+			}
+		}
+	}
+	vacuums := func() int {
+		t.Helper()
+		var n int
+		if err := dialect.DB.QueryRow(`SELECT COUNT(*) FROM vacuums`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	// deletes the first revision of /a
+	compact(createRevisions(t, backend, "/a", 3))
+	if n := vacuums(); n != 0 {
+		t.Errorf("table vacuumed %d times after a small compaction, want 0", n)
+	}
+
+	// deletes the second revision of /a and the first eight of /b
+	compact(createRevisions(t, backend, "/b", 10))
+	if n := vacuums(); n != 1 {
+		t.Errorf("table vacuumed %d times after a large compaction, want 1", n)
+	}
+}
@@ -0,0 +1,73 @@
+package sqllog_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/server"
+)
+
+func TestWatchExclusions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend, _ := newTestBackend(t)
+	if err := backend.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var startRev int64
+	for _, key := range []string{"/excluded/1", "/excluded/2", "/a/1", "/excluded/3", "/a/2"} {
+		rev, err := backend.Create(ctx, key, []byte("past"), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if startRev == 0 {
+			startRev = rev
+		}
+	}
+
+	all := backend.Watch(ctx, "/", startRev)
+	filtered := backend.Watch(server.WithWatchExclusions(ctx, "/excluded/"), "/", startRev)
+	expectWatchKeys(t, filtered, "/a/1", "/a/2")
+	expectWatchKeys(t, all, "/excluded/1", "/excluded/2", "/a/1", "/excluded/3", "/a/2")
+
+	// Once the unfiltered watch has received the live event for an excluded key, the filtered
+	// watch has been dispatched a batch containing only that key, which it must not send on.
+	if _, err := backend.Create(ctx, "/excluded/4", []byte("live"), 0); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchKeys(t, all, "/excluded/4")
+	if _, err := backend.Create(ctx, "/a/3", []byte("live"), 0); err != nil {
+		t.Fatal(err)
+	}
+	expectWatchKeys(t, filtered, "/a/3")
+}
+
+// expectWatchKeys fails the test unless the next events received from the watch are for the
+// given keys, in order, and no empty batches are received.
+func expectWatchKeys(t *testing.T, events <-chan []*server.Event, keys ...string) {
+	t.Helper()
+	var got []string
+	timeout := time.After(10 * time.Second)
+	for len(got) < len(keys) {
+		select {
+		case batch, ok := <-events:
+			if !ok {
+				t.Fatalf("watch closed after %v, want %v", got, keys)
+			}
+			if len(batch) == 0 {
+				t.Fatalf("watch sent an empty batch after %v", got)
+			}
+			for _, event := range batch {
+				got = append(got, event.KV.Key)
+			}
+		case <-timeout:
+			t.Fatalf("timed out after receiving %v, want %v", got, keys)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("watch received %v, want %v", got, keys)
+	}
+}
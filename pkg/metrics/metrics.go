@@ -3,14 +3,17 @@ package metrics
 import (
 	"time"
 
-	"github.com/k3s-io/kine/pkg/util"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/sirupsen/logrus"
 )
 
 const (
 	ResultSuccess = "success"
 	ResultError   = "error"
+
+	// TxnCompareFailed and TxnKeyExists are the results of transactions that were not applied
+	// because the revision of the key did not match, or because the key being created already exists.
+	TxnCompareFailed = "compare_failed"
+	TxnKeyExists     = "key_exists"
 )
 
 var (
@@ -26,23 +29,78 @@ var (
 			1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30},
 	}, []string{"error_code"})
 
+	SQLStatementTime = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "kine_sql_statement_time_seconds",
+		Help: "Length of time per SQL statement, by kind of statement and backend",
+		Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.6, 0.7, 0.8, 0.9, 1.0,
+			1.5, 2.0, 2.5, 3.0, 3.5, 4.0, 4.5, 5, 6, 7, 8, 9, 10, 15, 20, 25, 30},
+	}, []string{"statement", "backend"})
+
+	SQLRetriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_sql_retries_total",
+		Help: "Total number of SQL statements retried after a retriable error",
+	}, []string{"backend"})
+
+	SQLFailoversTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_sql_failovers_total",
+		Help: "Total number of times connections failed over to another host of the datastore",
+	}, []string{"backend"})
+
+	SQLTranslatedErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_sql_translated_errors_total",
+		Help: "Total number of SQL errors translated into etcd errors, by database error code",
+	}, []string{"error_code", "backend"})
+
 	CompactTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "kine_compact_total",
 		Help: "Total number of compactions",
 	}, []string{"result"})
+
+	CompactDeletedRows = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kine_compact_deleted_rows",
+		Help:    "Number of rows deleted by each compaction",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 12),
+	})
+
+	WatchStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_watch_streams",
+		Help: "Number of active watch streams",
+	})
+
+	WatchEventsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "kine_watch_events_total",
+		Help: "Total number of events delivered to watch streams",
+	})
+
+	WatchLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "kine_watch_lag_revisions",
+		Help:    "Number of revisions between the current revision and the last revision delivered to a watch stream",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+	})
+
+	TxnTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kine_txn_total",
+		Help: "Total number of transactions",
+	}, []string{"result"})
+
+	CurrentRevision = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_current_revision",
+		Help: "Most recent revision read from the datastore",
+	})
+
+	SQLReplicaLag = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "kine_sql_replica_lag_revisions",
+		Help: "Number of revisions by which the read replica lags the datastore",
+	})
 )
 
 var (
-	// SlowSQLThreshold is a duration which SQL executed longer than will be logged.
+	// SlowSQLThreshold is a duration which SQL executed longer than will be logged by the SQL drivers.
 	// This can be directly modified to override the default value when kine is used as a library.
 	SlowSQLThreshold = time.Second
 )
 
-func ObserveSQL(start time.Time, errCode string, sql util.Stripped, args ...interface{}) {
+func ObserveSQL(start time.Time, errCode string) {
 	SQLTotal.WithLabelValues(errCode).Inc()
-	duration := time.Since(start)
-	SQLTime.WithLabelValues(errCode).Observe(duration.Seconds())
-	if SlowSQLThreshold > 0 && duration >= SlowSQLThreshold {
-		logrus.Infof("Slow SQL (started: %v) (total time: %v): %s : %v", start, duration, sql, args)
-	}
+	SQLTime.WithLabelValues(errCode).Observe(time.Since(start).Seconds())
 }
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bytes"
+	"context"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+)
+
+// explicit interface check
+var _ etcdserverpb.AuthServer = (*KVServerBridge)(nil)
+
+// AuthEnable enables authentication. As in etcd, the root user must exist and have the root role,
+// and once enabled, only users with the root role may manage users and roles. Users are
+// identified by the common name of their verified TLS client certificate.
+func (s *KVServerBridge) AuthEnable(ctx context.Context, r *etcdserverpb.AuthEnableRequest) (*etcdserverpb.AuthEnableResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	root, ok := state.users[rootUser]
+	if !ok {
+		return nil, rpctypes.ErrGRPCRootUserNotExist
+	}
+	if !hasRole(root, rootRole) {
+		return nil, rpctypes.ErrGRPCRootRoleNotExist
+	}
+	rev, err := s.auth.put(ctx, authEnabledKey, []byte("true"))
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthEnableResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) AuthDisable(ctx context.Context, r *etcdserverpb.AuthDisableRequest) (*etcdserverpb.AuthDisableResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	rev, err := s.auth.put(ctx, authEnabledKey, []byte("false"))
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthDisableResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) AuthStatus(ctx context.Context, r *etcdserverpb.AuthStatusRequest) (*etcdserverpb.AuthStatusResponse, error) {
+	state, err := s.auth.state(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthStatusResponse{
+		Header:       txnHeader(state.revision),
+		Enabled:      state.enabled,
+		AuthRevision: uint64(state.revision),
+	}, nil
+}
+
+// Authenticate is not supported, as users are identified by their TLS client certificate, which
+// the client presents on every connection, instead of by a token obtained with a password.
+func (s *KVServerBridge) Authenticate(ctx context.Context, r *etcdserverpb.AuthenticateRequest) (*etcdserverpb.AuthenticateResponse, error) {
+	return nil, ErrPasswordNotSupported
+}
+
+// UserAdd adds a user. Users cannot have passwords, so the request must not set one.
+func (s *KVServerBridge) UserAdd(ctx context.Context, r *etcdserverpb.AuthUserAddRequest) (*etcdserverpb.AuthUserAddResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if r.Name == "" {
+		return nil, rpctypes.ErrGRPCUserEmpty
+	}
+	if r.Password != "" || r.HashedPassword != "" {
+		return nil, ErrPasswordNotSupported
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := state.users[r.Name]; ok {
+		return nil, rpctypes.ErrGRPCUserAlreadyExist
+	}
+	rev, err := s.auth.putUser(ctx, &authpb.User{
+		Name:    []byte(r.Name),
+		Options: &authpb.UserAddOptions{NoPassword: true},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserAddResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) UserGet(ctx context.Context, r *etcdserverpb.AuthUserGetRequest) (*etcdserverpb.AuthUserGetResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := state.users[r.Name]
+	if !ok {
+		return nil, rpctypes.ErrGRPCUserNotFound
+	}
+	return &etcdserverpb.AuthUserGetResponse{
+		Header: txnHeader(state.revision),
+		Roles:  user.Roles,
+	}, nil
+}
+
+func (s *KVServerBridge) UserList(ctx context.Context, r *etcdserverpb.AuthUserListRequest) (*etcdserverpb.AuthUserListResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserListResponse{
+		Header: txnHeader(state.revision),
+		Users:  state.userNames(),
+	}, nil
+}
+
+func (s *KVServerBridge) UserDelete(ctx context.Context, r *etcdserverpb.AuthUserDeleteRequest) (*etcdserverpb.AuthUserDeleteResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if state.enabled && r.Name == rootUser {
+		return nil, rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+	if _, ok := state.users[r.Name]; !ok {
+		return nil, rpctypes.ErrGRPCUserNotFound
+	}
+	rev, err := s.auth.delete(ctx, authUserPrefix+r.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserDeleteResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) UserChangePassword(ctx context.Context, r *etcdserverpb.AuthUserChangePasswordRequest) (*etcdserverpb.AuthUserChangePasswordResponse, error) {
+	return nil, ErrPasswordNotSupported
+}
+
+// UserGrantRole grants a role to a user. The root role always exists, and grants all permissions.
+func (s *KVServerBridge) UserGrantRole(ctx context.Context, r *etcdserverpb.AuthUserGrantRoleRequest) (*etcdserverpb.AuthUserGrantRoleResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	user, ok := state.users[r.User]
+	if !ok {
+		return nil, rpctypes.ErrGRPCUserNotFound
+	}
+	if _, ok := state.roles[r.Role]; !ok && r.Role != rootRole {
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+	if hasRole(user, r.Role) {
+		return &etcdserverpb.AuthUserGrantRoleResponse{
+			Header: txnHeader(state.revision),
+		}, nil
+	}
+
+	updated := *user
+	updated.Roles = append(append([]string{}, user.Roles...), r.Role)
+	rev, err := s.auth.putUser(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserGrantRoleResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) UserRevokeRole(ctx context.Context, r *etcdserverpb.AuthUserRevokeRoleRequest) (*etcdserverpb.AuthUserRevokeRoleResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if state.enabled && r.Name == rootUser && r.Role == rootRole {
+		return nil, rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+	user, ok := state.users[r.Name]
+	if !ok {
+		return nil, rpctypes.ErrGRPCUserNotFound
+	}
+	if !hasRole(user, r.Role) {
+		return nil, rpctypes.ErrGRPCRoleNotGranted
+	}
+
+	updated := *user
+	updated.Roles = nil
+	for _, role := range user.Roles {
+		if role != r.Role {
+			updated.Roles = append(updated.Roles, role)
+		}
+	}
+	rev, err := s.auth.putUser(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthUserRevokeRoleResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) RoleAdd(ctx context.Context, r *etcdserverpb.AuthRoleAddRequest) (*etcdserverpb.AuthRoleAddResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if r.Name == "" {
+		return nil, rpctypes.ErrGRPCRoleEmpty
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := state.roles[r.Name]; ok {
+		return nil, rpctypes.ErrGRPCRoleAlreadyExist
+	}
+	rev, err := s.auth.putRole(ctx, &authpb.Role{
+		Name: []byte(r.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleAddResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) RoleGet(ctx context.Context, r *etcdserverpb.AuthRoleGetRequest) (*etcdserverpb.AuthRoleGetResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	role, ok := state.roles[r.Role]
+	if !ok {
+		if r.Role == rootRole {
+			return &etcdserverpb.AuthRoleGetResponse{
+				Header: txnHeader(state.revision),
+			}, nil
+		}
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+	return &etcdserverpb.AuthRoleGetResponse{
+		Header: txnHeader(state.revision),
+		Perm:   role.KeyPermission,
+	}, nil
+}
+
+func (s *KVServerBridge) RoleList(ctx context.Context, r *etcdserverpb.AuthRoleListRequest) (*etcdserverpb.AuthRoleListResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleListResponse{
+		Header: txnHeader(state.revision),
+		Roles:  state.roleNames(),
+	}, nil
+}
+
+// RoleDelete deletes a role, and revokes it from the users it was granted to.
+func (s *KVServerBridge) RoleDelete(ctx context.Context, r *etcdserverpb.AuthRoleDeleteRequest) (*etcdserverpb.AuthRoleDeleteResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	if state.enabled && r.Role == rootRole {
+		return nil, rpctypes.ErrGRPCInvalidAuthMgmt
+	}
+	if _, ok := state.roles[r.Role]; !ok {
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+
+	for _, name := range state.userNames() {
+		user := state.users[name]
+		if !hasRole(user, r.Role) {
+			continue
+		}
+		updated := *user
+		updated.Roles = nil
+		for _, role := range user.Roles {
+			if role != r.Role {
+				updated.Roles = append(updated.Roles, role)
+			}
+		}
+		if _, err := s.auth.putUser(ctx, &updated); err != nil {
+			return nil, err
+		}
+	}
+
+	rev, err := s.auth.delete(ctx, authRolePrefix+r.Role)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleDeleteResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+// RoleGrantPermission grants the role permission to read, write, or read and write a key or range
+// of keys, replacing any permission previously granted for the same key and range end.
+func (s *KVServerBridge) RoleGrantPermission(ctx context.Context, r *etcdserverpb.AuthRoleGrantPermissionRequest) (*etcdserverpb.AuthRoleGrantPermissionResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if r.Perm == nil {
+		return nil, rpctypes.ErrGRPCPermissionNotGiven
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	role, ok := state.roles[r.Name]
+	if !ok {
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+
+	updated := *role
+	updated.KeyPermission = nil
+	for _, perm := range role.KeyPermission {
+		if !bytes.Equal(perm.Key, r.Perm.Key) || !bytes.Equal(perm.RangeEnd, r.Perm.RangeEnd) {
+			updated.KeyPermission = append(updated.KeyPermission, perm)
+		}
+	}
+	updated.KeyPermission = append(updated.KeyPermission, r.Perm)
+	rev, err := s.auth.putRole(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleGrantPermissionResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
+
+func (s *KVServerBridge) RoleRevokePermission(ctx context.Context, r *etcdserverpb.AuthRoleRevokePermissionRequest) (*etcdserverpb.AuthRoleRevokePermissionResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	state, err := s.auth.state(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	role, ok := state.roles[r.Role]
+	if !ok {
+		return nil, rpctypes.ErrGRPCRoleNotFound
+	}
+
+	updated := *role
+	updated.KeyPermission = nil
+	for _, perm := range role.KeyPermission {
+		if !bytes.Equal(perm.Key, r.Key) || !bytes.Equal(perm.RangeEnd, r.RangeEnd) {
+			updated.KeyPermission = append(updated.KeyPermission, perm)
+		}
+	}
+	if len(updated.KeyPermission) == len(role.KeyPermission) {
+		return nil, rpctypes.ErrGRPCPermissionNotGranted
+	}
+	rev, err := s.auth.putRole(ctx, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.AuthRoleRevokePermissionResponse{
+		Header: txnHeader(rev),
+	}, nil
+}
@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// fakeBackend is a Backend and Leaser that holds only the current value of each key.
+type fakeBackend struct {
+	mu     sync.Mutex
+	rev    int64
+	kvs    map[string]*KeyValue
+	leases map[int64]bool
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{kvs: map[string]*KeyValue{}, leases: map[int64]bool{}}
+}
+
+func (b *fakeBackend) Start(ctx context.Context) error { return nil }
+
+func (b *fakeBackend) Get(ctx context.Context, key, rangeEnd string, limit, revision int64) (int64, *KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rev, b.kvs[key], nil
+}
+
+func (b *fakeBackend) Create(ctx context.Context, key string, value []byte, lease int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.kvs[key]; ok {
+		return 0, ErrKeyExists
+	}
+	b.rev++
+	b.kvs[key] = &KeyValue{Key: key, CreateRevision: b.rev, ModRevision: b.rev, Value: value, Lease: lease}
+	return b.rev, nil
+}
+
+func (b *fakeBackend) Delete(ctx context.Context, key string, revision int64) (int64, *KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kv, ok := b.kvs[key]
+	if !ok || (revision != 0 && kv.ModRevision != revision) {
+		return b.rev, kv, false, nil
+	}
+	b.rev++
+	delete(b.kvs, key)
+	return b.rev, kv, true, nil
+}
+
+func (b *fakeBackend) List(ctx context.Context, prefix, startKey string, limit, revision int64) (int64, []*KeyValue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var kvs []*KeyValue
+	for key, kv := range b.kvs {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, kv)
+		}
+	}
+	return b.rev, kvs, nil
+}
+
+func (b *fakeBackend) Count(ctx context.Context, prefix string) (int64, int64, error) {
+	rev, kvs, err := b.List(ctx, prefix, "", 0, 0)
+	return rev, int64(len(kvs)), err
+}
+
+func (b *fakeBackend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kv, ok := b.kvs[key]
+	if !ok || kv.ModRevision != revision {
+		return b.rev, kv, false, nil
+	}
+	b.rev++
+	b.kvs[key] = &KeyValue{Key: key, CreateRevision: kv.CreateRevision, ModRevision: b.rev, Value: value, Lease: lease}
+	return b.rev, b.kvs[key], true, nil
+}
+
+func (b *fakeBackend) Watch(ctx context.Context, key string, revision int64) <-chan []*Event {
+	return make(chan []*Event)
+}
+
+func (b *fakeBackend) DbSize(ctx context.Context) (int64, error) { return 0, nil }
+
+func (b *fakeBackend) Health(ctx context.Context) (*HealthStatus, error) { return &HealthStatus{}, nil }
+
+func (b *fakeBackend) Close(ctx context.Context) error { return nil }
+
+func (b *fakeBackend) LeaseGrant(ctx context.Context, id, ttl int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.leases[id] = true
+	return id, nil
+}
+
+func (b *fakeBackend) LeaseRevoke(ctx context.Context, id int64) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.leases[id] {
+		return 0, ErrLeaseNotFound
+	}
+	delete(b.leases, id)
+	for key, kv := range b.kvs {
+		if kv.Lease == id {
+			b.rev++
+			delete(b.kvs, key)
+		}
+	}
+	return b.rev, nil
+}
+
+func (b *fakeBackend) LeaseKeepAlive(ctx context.Context, id int64) (int64, error) { return 0, nil }
+
+func (b *fakeBackend) LeaseTimeToLive(ctx context.Context, id int64, keys bool) (*Lease, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.leases[id] {
+		return nil, ErrLeaseNotFound
+	}
+	lease := &Lease{ID: id}
+	for key, kv := range b.kvs {
+		if kv.Lease == id && keys {
+			lease.Keys = append(lease.Keys, key)
+		}
+	}
+	return lease, nil
+}
+
+func (b *fakeBackend) LeaseLeases(ctx context.Context) ([]int64, error) { return nil, nil }
+
+// asUser returns a context for a request made with a verified client certificate for the user.
+func asUser(name string) context.Context {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+	return peer.NewContext(context.Background(), &peer.Peer{
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}},
+	})
+}
+
+// newAuthTestServer returns a server with a root user, and a user "reader" with a role granting
+// read access to /registry/, and with authentication enabled if enabled is true.
+func newAuthTestServer(t *testing.T, enabled bool) (*KVServerBridge, *fakeBackend) {
+	t.Helper()
+	backend := newFakeBackend()
+	s := New(backend, "", 0, "fake", nil)
+	ctx := context.Background()
+	for _, user := range []string{rootUser, "reader"} {
+		if _, err := s.UserAdd(ctx, &etcdserverpb.AuthUserAddRequest{Name: user}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.RoleAdd(ctx, &etcdserverpb.AuthRoleAddRequest{Name: "registry-reader"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RoleGrantPermission(ctx, &etcdserverpb.AuthRoleGrantPermissionRequest{
+		Name: "registry-reader",
+		Perm: &authpb.Permission{PermType: authpb.READ, Key: []byte("/registry/"), RangeEnd: []byte("/registry0")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for user, role := range map[string]string{rootUser: rootRole, "reader": "registry-reader"} {
+		if _, err := s.UserGrantRole(ctx, &etcdserverpb.AuthUserGrantRoleRequest{User: user, Role: role}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if enabled {
+		if _, err := s.AuthEnable(ctx, &etcdserverpb.AuthEnableRequest{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s, backend
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		name                            string
+		permKey, permEnd, key, rangeEnd string
+		want                            bool
+	}{
+		{name: "same single key", permKey: "/a", key: "/a", want: true},
+		{name: "other single key", permKey: "/a", key: "/b"},
+		{name: "range for single key permission", permKey: "/a", key: "/a", rangeEnd: "/b"},
+		{name: "key within range", permKey: "/a/", permEnd: "/a0", key: "/a/x", want: true},
+		{name: "key at range end", permKey: "/a/", permEnd: "/a0", key: "/a0"},
+		{name: "key before range", permKey: "/a/", permEnd: "/a0", key: "/"},
+		{name: "range within range", permKey: "/a/", permEnd: "/a0", key: "/a/x", rangeEnd: "/a/y", want: true},
+		{name: "range past range end", permKey: "/a/", permEnd: "/a0", key: "/a/x", rangeEnd: "/b"},
+		{name: "from key within range", permKey: "/a/", permEnd: "/a0", key: "/a/x", rangeEnd: "\x00"},
+		{name: "key within from key permission", permKey: "/a", permEnd: "\x00", key: "/z", want: true},
+		{name: "from key within from key permission", permKey: "/a", permEnd: "\x00", key: "/b", rangeEnd: "\x00", want: true},
+		{name: "key before from key permission", permKey: "/b", permEnd: "\x00", key: "/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rangeContains([]byte(tt.permKey), []byte(tt.permEnd), []byte(tt.key), []byte(tt.rangeEnd))
+			if got != tt.want {
+				t.Errorf("rangeContains = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermitted(t *testing.T) {
+	state := &authState{
+		enabled: true,
+		roles: map[string]*authpb.Role{
+			"reader": {Name: []byte("reader"), KeyPermission: []*authpb.Permission{
+				{PermType: authpb.READ, Key: []byte("/registry/"), RangeEnd: []byte("/registry0")},
+			}},
+			"writer": {Name: []byte("writer"), KeyPermission: []*authpb.Permission{
+				{PermType: authpb.WRITE, Key: []byte("/registry/pods/"), RangeEnd: []byte("/registry/pods0")},
+			}},
+			"all": {Name: []byte("all"), KeyPermission: []*authpb.Permission{
+				{PermType: authpb.READWRITE, Key: []byte("/"), RangeEnd: []byte("\x00")},
+			}},
+		},
+	}
+	tests := []struct {
+		name          string
+		roles         []string
+		key, rangeEnd string
+		write         bool
+		want          bool
+	}{
+		{name: "root", roles: []string{rootRole}, key: "/anything", write: true, want: true},
+		{name: "no roles", key: "/registry/pods/a"},
+		{name: "unknown role", roles: []string{"missing"}, key: "/registry/pods/a"},
+		{name: "read permitted", roles: []string{"reader"}, key: "/registry/", rangeEnd: "/registry0", want: true},
+		{name: "write with read permission", roles: []string{"reader"}, key: "/registry/pods/a", write: true},
+		{name: "read with write permission", roles: []string{"writer"}, key: "/registry/pods/a"},
+		{name: "write permitted", roles: []string{"reader", "writer"}, key: "/registry/pods/a", write: true, want: true},
+		{name: "read outside permission", roles: []string{"reader"}, key: "/other"},
+		{name: "read from key", roles: []string{"reader"}, key: "/registry/", rangeEnd: "\x00"},
+		{name: "readwrite from key", roles: []string{"all"}, key: "/", rangeEnd: "\x00", write: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &authpb.User{Name: []byte("user"), Roles: tt.roles}
+			if got := state.permitted(user, []byte(tt.key), []byte(tt.rangeEnd), tt.write); got != tt.want {
+				t.Errorf("permitted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEachTxnRange(t *testing.T) {
+	txn := &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{Key: []byte("/compare")}},
+		Success: []*etcdserverpb.RequestOp{
+			{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte("/put")}}},
+			{Request: &etcdserverpb.RequestOp_RequestTxn{RequestTxn: &etcdserverpb.TxnRequest{
+				Compare: []*etcdserverpb.Compare{{Key: []byte("/nested/compare")}},
+				Failure: []*etcdserverpb.RequestOp{
+					{Request: &etcdserverpb.RequestOp_RequestDeleteRange{RequestDeleteRange: &etcdserverpb.DeleteRangeRequest{Key: []byte("/nested/delete/"), RangeEnd: []byte("/nested/delete0")}}},
+				},
+			}}},
+		},
+		Failure: []*etcdserverpb.RequestOp{
+			{Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte("/range")}}},
+		},
+	}
+	want := []string{"/compare r", "/put w", "/nested/compare r", "/nested/delete/-/nested/delete0 w", "/range r"}
+
+	var got []string
+	if !eachTxnRange(txn, func(key, rangeEnd []byte, write bool) bool {
+		s := string(key)
+		if len(rangeEnd) > 0 {
+			s += "-" + string(rangeEnd)
+		}
+		if write {
+			s += " w"
+		} else {
+			s += " r"
+		}
+		got = append(got, s)
+		return true
+	}) {
+		t.Fatal("eachTxnRange returned false")
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("ranges = %v, want %v", got, want)
+	}
+
+	// iteration stops at the first range for which fn returns false, including in nested transactions
+	calls := 0
+	if eachTxnRange(txn, func(key, rangeEnd []byte, write bool) bool {
+		calls++
+		return !strings.HasPrefix(string(key), "/nested/")
+	}) {
+		t.Error("eachTxnRange returned true")
+	}
+	if calls != 3 {
+		t.Errorf("fn called %d times, want 3", calls)
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		ctx     context.Context
+		wantErr error
+	}{
+		{name: "disabled without certificate", ctx: context.Background()},
+		{name: "disabled as user", ctx: asUser("reader")},
+		{name: "enabled without certificate", enabled: true, ctx: context.Background(), wantErr: rpctypes.ErrGRPCUserEmpty},
+		{name: "enabled as unknown user", enabled: true, ctx: asUser("unknown"), wantErr: rpctypes.ErrGRPCPermissionDenied},
+		{name: "enabled as user", enabled: true, ctx: asUser("reader"), wantErr: rpctypes.ErrGRPCPermissionDenied},
+		{name: "enabled as root", enabled: true, ctx: asUser(rootUser)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newAuthTestServer(t, tt.enabled)
+			if err := s.auth.checkAdmin(tt.ctx); err != tt.wantErr {
+				t.Errorf("checkAdmin error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRootManagementWhileEnabled(t *testing.T) {
+	s, _ := newAuthTestServer(t, true)
+	ctx := asUser(rootUser)
+
+	if _, err := s.UserRevokeRole(ctx, &etcdserverpb.AuthUserRevokeRoleRequest{Name: rootUser, Role: rootRole}); err != rpctypes.ErrGRPCInvalidAuthMgmt {
+		t.Errorf("revoking root role from root user: error = %v, want %v", err, rpctypes.ErrGRPCInvalidAuthMgmt)
+	}
+	if _, err := s.RoleDelete(ctx, &etcdserverpb.AuthRoleDeleteRequest{Role: rootRole}); err != rpctypes.ErrGRPCInvalidAuthMgmt {
+		t.Errorf("deleting root role: error = %v, want %v", err, rpctypes.ErrGRPCInvalidAuthMgmt)
+	}
+	if _, err := s.UserDelete(ctx, &etcdserverpb.AuthUserDeleteRequest{Name: rootUser}); err != rpctypes.ErrGRPCInvalidAuthMgmt {
+		t.Errorf("deleting root user: error = %v, want %v", err, rpctypes.ErrGRPCInvalidAuthMgmt)
+	}
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		t.Errorf("root user is no longer an admin: %v", err)
+	}
+
+	// other roles can still be revoked and deleted
+	if _, err := s.UserRevokeRole(ctx, &etcdserverpb.AuthUserRevokeRoleRequest{Name: "reader", Role: "registry-reader"}); err != nil {
+		t.Errorf("revoking role: %v", err)
+	}
+	if _, err := s.RoleDelete(ctx, &etcdserverpb.AuthRoleDeleteRequest{Role: "registry-reader"}); err != nil {
+		t.Errorf("deleting role: %v", err)
+	}
+}
+
+func TestCheckReserved(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		s, _ := newAuthTestServer(t, enabled)
+		ctx := asUser(rootUser)
+		tests := []struct {
+			key, rangeEnd string
+			wantErr       error
+		}{
+			{key: "/registry/pods/a"},
+			{key: "/", rangeEnd: "/registry0"},
+			{key: authUserPrefix + rootUser, wantErr: rpctypes.ErrGRPCPermissionDenied},
+			{key: authKeyPrefix, rangeEnd: string(prefixRangeEnd(authKeyPrefix)), wantErr: rpctypes.ErrGRPCPermissionDenied},
+			{key: "/", rangeEnd: "\x00", wantErr: rpctypes.ErrGRPCPermissionDenied},
+			{key: "\x00", rangeEnd: "\x00", wantErr: rpctypes.ErrGRPCPermissionDenied},
+			{key: "a", rangeEnd: "l", wantErr: rpctypes.ErrGRPCPermissionDenied},
+		}
+		for _, tt := range tests {
+			if err := s.checkRange(ctx, []byte(tt.key), []byte(tt.rangeEnd), false); err != tt.wantErr {
+				t.Errorf("enabled=%v: range %q-%q: error = %v, want %v", enabled, tt.key, tt.rangeEnd, err, tt.wantErr)
+			}
+		}
+
+		// a user cannot be written through a transaction, even by root
+		txn := &etcdserverpb.TxnRequest{
+			Success: []*etcdserverpb.RequestOp{
+				{Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(authUserPrefix + "reader")}}},
+			},
+		}
+		if err := s.checkTxn(ctx, txn); err != rpctypes.ErrGRPCPermissionDenied {
+			t.Errorf("enabled=%v: txn writing user: error = %v, want %v", enabled, err, rpctypes.ErrGRPCPermissionDenied)
+		}
+	}
+}
+
+func TestLeaseRevokePermission(t *testing.T) {
+	s, backend := newAuthTestServer(t, true)
+	ctx := context.Background()
+	if _, err := backend.LeaseGrant(ctx, 1, 60); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.Create(ctx, "/registry/pods/a", []byte("a"), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.LeaseRevoke(asUser("reader"), &etcdserverpb.LeaseRevokeRequest{ID: 1}); err != rpctypes.ErrGRPCPermissionDenied {
+		t.Errorf("revoking lease as reader: error = %v, want %v", err, rpctypes.ErrGRPCPermissionDenied)
+	}
+	if _, kv, _ := backend.Get(ctx, "/registry/pods/a", "", 1, 0); kv == nil {
+		t.Fatal("key attached to lease was deleted by reader")
+	}
+
+	if _, err := s.LeaseRevoke(asUser(rootUser), &etcdserverpb.LeaseRevokeRequest{ID: 1}); err != nil {
+		t.Fatalf("revoking lease as root: %v", err)
+	}
+	if _, kv, _ := backend.Get(ctx, "/registry/pods/a", "", 1, 0); kv != nil {
+		t.Error("key attached to lease was not deleted")
+	}
+}
@@ -0,0 +1,367 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/authpb"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// The users and roles of the Auth service, and whether authentication is enabled, are stored in
+// the backend under these keys. The keys do not start with a slash, so they are outside of the
+// keyspace used by the apiserver, and KV requests that include them are denied by checkReserved.
+const (
+	authKeyPrefix  = "kine/auth/"
+	authEnabledKey = authKeyPrefix + "enabled"
+	authUserPrefix = authKeyPrefix + "users/"
+	authRolePrefix = authKeyPrefix + "roles/"
+
+	// authRefreshInterval is how long the auth state read from the backend is used before it is
+	// read again, so that changes made through other kine servers sharing the datastore are seen.
+	authRefreshInterval = 5 * time.Second
+
+	rootUser = "root"
+	rootRole = "root"
+)
+
+var (
+	// ErrPasswordNotSupported is returned for requests that set or check passwords, as users are
+	// only identified by the common name of their TLS client certificate.
+	ErrPasswordNotSupported = status.New(codes.Unimplemented, "kine: password authentication is not supported, use a TLS client certificate").Err()
+
+	errAuthConflict = status.New(codes.Aborted, "kine: auth state was changed concurrently, retry the request").Err()
+)
+
+// authStore holds the users and roles of the Auth service, as read from the backend, and checks
+// the permissions of requests when authentication is enabled.
+type authStore struct {
+	backend Backend
+
+	mu      sync.Mutex
+	loaded  time.Time
+	current *authState
+}
+
+// authState is the auth state as of a revision of the backend. It is not modified once read.
+type authState struct {
+	revision int64
+	enabled  bool
+	users    map[string]*authpb.User
+	roles    map[string]*authpb.Role
+}
+
+func newAuthStore(backend Backend) *authStore {
+	return &authStore{
+		backend: backend,
+	}
+}
+
+// state returns the auth state, reading it from the backend if it has not been read within
+// authRefreshInterval, or if refresh is true.
+func (a *authStore) state(ctx context.Context, refresh bool) (*authState, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !refresh && a.current != nil && time.Since(a.loaded) < authRefreshInterval {
+		return a.current, nil
+	}
+
+	rev, kvs, err := a.backend.List(ctx, authKeyPrefix, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	enabled := false
+	users := map[string]*authpb.User{}
+	roles := map[string]*authpb.Role{}
+	for _, kv := range kvs {
+		switch {
+		case kv.Key == authEnabledKey:
+			enabled = string(kv.Value) == "true"
+		case strings.HasPrefix(kv.Key, authUserPrefix):
+			user := &authpb.User{}
+			if err := user.Unmarshal(kv.Value); err != nil {
+				return nil, err
+			}
+			users[string(user.Name)] = user
+		case strings.HasPrefix(kv.Key, authRolePrefix):
+			role := &authpb.Role{}
+			if err := role.Unmarshal(kv.Value); err != nil {
+				return nil, err
+			}
+			roles[string(role.Name)] = role
+		}
+	}
+
+	a.loaded = time.Now()
+	a.current = &authState{revision: rev, enabled: enabled, users: users, roles: roles}
+	return a.current, nil
+}
+
+// invalidate causes the auth state to be read from the backend when it is next used.
+func (a *authStore) invalidate() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.loaded = time.Time{}
+}
+
+// put writes the value of an auth key, failing if the key is written concurrently.
+func (a *authStore) put(ctx context.Context, key string, value []byte) (int64, error) {
+	defer a.invalidate()
+
+	rev, kv, err := a.backend.Get(ctx, key, "", 1, 0)
+	if err != nil {
+		return 0, err
+	}
+	if kv == nil {
+		rev, err = a.backend.Create(ctx, key, value, 0)
+		if err == ErrKeyExists {
+			return 0, errAuthConflict
+		}
+		return rev, err
+	}
+
+	rev, _, ok, err := a.backend.Update(ctx, key, value, kv.ModRevision, 0)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errAuthConflict
+	}
+	return rev, nil
+}
+
+// delete removes an auth key.
+func (a *authStore) delete(ctx context.Context, key string) (int64, error) {
+	defer a.invalidate()
+
+	rev, kv, err := a.backend.Get(ctx, key, "", 1, 0)
+	if err != nil || kv == nil {
+		return rev, err
+	}
+	rev, _, ok, err := a.backend.Delete(ctx, key, kv.ModRevision)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		return 0, errAuthConflict
+	}
+	return rev, nil
+}
+
+func (a *authStore) putUser(ctx context.Context, user *authpb.User) (int64, error) {
+	value, err := user.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return a.put(ctx, authUserPrefix+string(user.Name), value)
+}
+
+func (a *authStore) putRole(ctx context.Context, role *authpb.Role) (int64, error) {
+	value, err := role.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return a.put(ctx, authRolePrefix+string(role.Name), value)
+}
+
+// identity returns the name of the user making the request, which is the common name of the
+// verified TLS client certificate of the connection.
+func identity(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", rpctypes.ErrGRPCUserEmpty
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return "", rpctypes.ErrGRPCUserEmpty
+	}
+	name := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return "", rpctypes.ErrGRPCUserEmpty
+	}
+	return name, nil
+}
+
+// user returns the user making the request, if authentication is enabled. Nil is returned if
+// authentication is disabled.
+func (a *authStore) user(ctx context.Context) (*authState, *authpb.User, error) {
+	state, err := a.state(ctx, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !state.enabled {
+		return state, nil, nil
+	}
+	name, err := identity(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	user, ok := state.users[name]
+	if !ok {
+		return nil, nil, rpctypes.ErrGRPCPermissionDenied
+	}
+	return state, user, nil
+}
+
+// checkAuthenticated checks that the request is made by a known user, if authentication is enabled.
+func (a *authStore) checkAuthenticated(ctx context.Context) error {
+	_, _, err := a.user(ctx)
+	return err
+}
+
+// checkAdmin checks that the request is made by a user with the root role, if authentication is
+// enabled.
+func (a *authStore) checkAdmin(ctx context.Context) error {
+	_, user, err := a.user(ctx)
+	if err != nil || user == nil {
+		return err
+	}
+	if !hasRole(user, rootRole) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// checkRange checks that the request is made by a user with permission to read, or write, the
+// range of keys, if authentication is enabled.
+func (a *authStore) checkRange(ctx context.Context, key, rangeEnd []byte, write bool) error {
+	state, user, err := a.user(ctx)
+	if err != nil || user == nil {
+		return err
+	}
+	if !state.permitted(user, key, rangeEnd, write) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// checkTxn checks that the request is made by a user with permission to read the keys compared
+// and read by the transaction, and to write the keys written by it, if authentication is enabled.
+func (a *authStore) checkTxn(ctx context.Context, txn *etcdserverpb.TxnRequest) error {
+	state, user, err := a.user(ctx)
+	if err != nil || user == nil {
+		return err
+	}
+	if !state.permittedTxn(user, txn) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+func (a *authState) permittedTxn(user *authpb.User, txn *etcdserverpb.TxnRequest) bool {
+	return eachTxnRange(txn, func(key, rangeEnd []byte, write bool) bool {
+		return a.permitted(user, key, rangeEnd, write)
+	})
+}
+
+// eachTxnRange calls fn with each range of keys compared or read by the transaction, and each
+// key or range written by it, including those of nested transactions, until fn returns false.
+// The result of the last call is returned.
+func eachTxnRange(txn *etcdserverpb.TxnRequest, fn func(key, rangeEnd []byte, write bool) bool) bool {
+	for _, compare := range txn.Compare {
+		if !fn(compare.Key, compare.RangeEnd, false) {
+			return false
+		}
+	}
+	for _, ops := range [][]*etcdserverpb.RequestOp{txn.Success, txn.Failure} {
+		for _, op := range ops {
+			ok := true
+			switch {
+			case op.GetRequestRange() != nil:
+				ok = fn(op.GetRequestRange().Key, op.GetRequestRange().RangeEnd, false)
+			case op.GetRequestPut() != nil:
+				ok = fn(op.GetRequestPut().Key, nil, true)
+			case op.GetRequestDeleteRange() != nil:
+				ok = fn(op.GetRequestDeleteRange().Key, op.GetRequestDeleteRange().RangeEnd, true)
+			case op.GetRequestTxn() != nil:
+				ok = eachTxnRange(op.GetRequestTxn(), fn)
+			}
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// permitted returns true if the user has the root role, or a role granting permission to read,
+// or write, the range of keys.
+func (a *authState) permitted(user *authpb.User, key, rangeEnd []byte, write bool) bool {
+	if hasRole(user, rootRole) {
+		return true
+	}
+	for _, name := range user.Roles {
+		role, ok := a.roles[name]
+		if !ok {
+			continue
+		}
+		for _, perm := range role.KeyPermission {
+			if perm.PermType != authpb.READWRITE && (perm.PermType == authpb.WRITE) != write {
+				continue
+			}
+			if rangeContains(perm.Key, perm.RangeEnd, key, rangeEnd) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rangeContains returns true if the range of keys from key to rangeEnd is within the range of
+// keys permitted from permKey to permEnd. As in etcd, an empty range end is a single key, and a
+// range end of "\x00" includes all keys from the key onwards.
+func rangeContains(permKey, permEnd, key, rangeEnd []byte) bool {
+	if len(permEnd) == 0 {
+		return len(rangeEnd) == 0 && bytes.Equal(permKey, key)
+	}
+	if bytes.Compare(key, permKey) < 0 {
+		return false
+	}
+	if bytes.Equal(permEnd, []byte{0}) {
+		return true
+	}
+	if len(rangeEnd) == 0 {
+		return bytes.Compare(key, permEnd) < 0
+	}
+	return !bytes.Equal(rangeEnd, []byte{0}) && bytes.Compare(rangeEnd, permEnd) <= 0
+}
+
+func hasRole(user *authpb.User, role string) bool {
+	for _, r := range user.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// userNames returns the names of the users, in order.
+func (a *authState) userNames() []string {
+	names := make([]string, 0, len(a.users))
+	for name := range a.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// roleNames returns the names of the roles, in order.
+func (a *authState) roleNames() []string {
+	names := make([]string, 0, len(a.roles))
+	for name := range a.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
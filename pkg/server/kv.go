@@ -49,6 +49,10 @@ func (k *KVServerBridge) Range(ctx context.Context, r *etcdserverpb.RangeRequest
 		return nil, unsupported("maxModRevision")
 	}
 
+	if err := k.checkRange(ctx, r.Key, r.RangeEnd, false); err != nil {
+		return nil, err
+	}
+
 	resp, err := k.limited.Range(ctx, r)
 	if err != nil {
 		logrus.Errorf("error while range on %s %s: %v", r.Key, r.RangeEnd, err)
@@ -102,6 +106,9 @@ func (k *KVServerBridge) DeleteRange(ctx context.Context, r *etcdserverpb.Delete
 }
 
 func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+	if err := k.checkTxn(ctx, r); err != nil {
+		return nil, err
+	}
 	res, err := k.limited.Txn(ctx, r)
 	if err != nil {
 		logrus.Errorf("error in txn: %v", err)
@@ -109,7 +116,19 @@ func (k *KVServerBridge) Txn(ctx context.Context, r *etcdserverpb.TxnRequest) (*
 	return res, err
 }
 
+// Compact schedules compaction of the backend to the requested revision, if the backend supports
+// it. Compaction is asynchronous, even if a physical compaction is requested, and never removes the
+// most recent revisions retained by the backend. Backends that only compact on their own schedule
+// ignore the request, as kine always has.
 func (k *KVServerBridge) Compact(ctx context.Context, r *etcdserverpb.CompactionRequest) (*etcdserverpb.CompactionResponse, error) {
+	if err := k.auth.checkAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+	if compactor, ok := k.limited.backend.(Compactor); ok {
+		if err := compactor.Compact(ctx, r.Revision); err != nil && err != ErrNotSupported {
+			return nil, err
+		}
+	}
 	return &etcdserverpb.CompactionResponse{
 		Header: &etcdserverpb.ResponseHeader{
 			Revision: r.Revision,
@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
@@ -10,26 +11,158 @@ import (
 // explicit interface check
 var _ etcdserverpb.LeaseServer = (*KVServerBridge)(nil)
 
+// leaser returns the backend if it manages leases. Otherwise, leases cannot be revoked or kept
+// alive.
+func (s *KVServerBridge) leaser() (Leaser, bool) {
+	leaser, ok := s.limited.backend.(Leaser)
+	return leaser, ok
+}
+
 func (s *KVServerBridge) LeaseGrant(ctx context.Context, req *etcdserverpb.LeaseGrantRequest) (*etcdserverpb.LeaseGrantResponse, error) {
+	if err := s.auth.checkAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+	var (
+		id  int64
+		err = ErrNotSupported
+	)
+	if leaser, ok := s.leaser(); ok {
+		id, err = leaser.LeaseGrant(ctx, req.ID, req.TTL)
+	}
+	// Without lease support, the lease of a key is its TTL in seconds.
+	if err == ErrNotSupported {
+		return &etcdserverpb.LeaseGrantResponse{
+			Header: &etcdserverpb.ResponseHeader{},
+			ID:     req.TTL,
+			TTL:    req.TTL,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
 	return &etcdserverpb.LeaseGrantResponse{
 		Header: &etcdserverpb.ResponseHeader{},
-		ID:     req.TTL,
+		ID:     id,
 		TTL:    req.TTL,
 	}, nil
 }
 
-func (s *KVServerBridge) LeaseRevoke(context.Context, *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
-	return nil, fmt.Errorf("lease revoke is not supported")
+// LeaseRevoke revokes a lease, deleting the keys attached to it. The client must be permitted to
+// write each of the keys.
+func (s *KVServerBridge) LeaseRevoke(ctx context.Context, req *etcdserverpb.LeaseRevokeRequest) (*etcdserverpb.LeaseRevokeResponse, error) {
+	if err := s.auth.checkAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+	leaser, ok := s.leaser()
+	if !ok {
+		return nil, fmt.Errorf("lease revoke is not supported")
+	}
+
+	lease, err := leaser.LeaseTimeToLive(ctx, req.ID, true)
+	if err != nil && err != ErrLeaseNotFound {
+		return nil, err
+	}
+	if lease != nil {
+		for _, key := range lease.Keys {
+			if err := s.checkRange(ctx, []byte(key), nil, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	rev, err := leaser.LeaseRevoke(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.LeaseRevokeResponse{
+		Header: txnHeader(rev),
+	}, nil
 }
 
-func (s *KVServerBridge) LeaseKeepAlive(etcdserverpb.Lease_LeaseKeepAliveServer) error {
-	return fmt.Errorf("lease keep alive is not supported")
+func (s *KVServerBridge) LeaseKeepAlive(ks etcdserverpb.Lease_LeaseKeepAliveServer) error {
+	if err := s.auth.checkAuthenticated(ks.Context()); err != nil {
+		return err
+	}
+	leaser, ok := s.leaser()
+	if !ok {
+		return fmt.Errorf("lease keep alive is not supported")
+	}
+
+	for {
+		req, err := ks.Recv()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// As in etcd, a TTL of zero tells the client that the lease was not found.
+		ttl, err := leaser.LeaseKeepAlive(ks.Context(), req.ID)
+		if err != nil && err != ErrLeaseNotFound {
+			return err
+		}
+		if err := ks.Send(&etcdserverpb.LeaseKeepAliveResponse{
+			Header: &etcdserverpb.ResponseHeader{},
+			ID:     req.ID,
+			TTL:    ttl,
+		}); err != nil {
+			return err
+		}
+	}
 }
 
-func (s *KVServerBridge) LeaseTimeToLive(context.Context, *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
-	return nil, fmt.Errorf("lease time to live is not supported")
+func (s *KVServerBridge) LeaseTimeToLive(ctx context.Context, req *etcdserverpb.LeaseTimeToLiveRequest) (*etcdserverpb.LeaseTimeToLiveResponse, error) {
+	if err := s.auth.checkAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+	leaser, ok := s.leaser()
+	if !ok {
+		return nil, fmt.Errorf("lease time to live is not supported")
+	}
+
+	lease, err := leaser.LeaseTimeToLive(ctx, req.ID, req.Keys)
+	if err == ErrLeaseNotFound {
+		// As in etcd, a TTL of -1 tells the client that the lease was not found.
+		return &etcdserverpb.LeaseTimeToLiveResponse{
+			Header: &etcdserverpb.ResponseHeader{},
+			ID:     req.ID,
+			TTL:    -1,
+		}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	keys := make([][]byte, 0, len(lease.Keys))
+	for _, key := range lease.Keys {
+		keys = append(keys, []byte(key))
+	}
+	return &etcdserverpb.LeaseTimeToLiveResponse{
+		Header:     &etcdserverpb.ResponseHeader{},
+		ID:         lease.ID,
+		TTL:        lease.TTL,
+		GrantedTTL: lease.GrantedTTL,
+		Keys:       keys,
+	}, nil
 }
 
-func (s *KVServerBridge) LeaseLeases(context.Context, *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
-	return nil, fmt.Errorf("lease leases is not supported")
+func (s *KVServerBridge) LeaseLeases(ctx context.Context, req *etcdserverpb.LeaseLeasesRequest) (*etcdserverpb.LeaseLeasesResponse, error) {
+	if err := s.auth.checkAuthenticated(ctx); err != nil {
+		return nil, err
+	}
+	leaser, ok := s.leaser()
+	if !ok {
+		return nil, fmt.Errorf("lease leases is not supported")
+	}
+
+	ids, err := leaser.LeaseLeases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	leases := make([]*etcdserverpb.LeaseStatus, 0, len(ids))
+	for _, id := range ids {
+		leases = append(leases, &etcdserverpb.LeaseStatus{ID: id})
+	}
+	return &etcdserverpb.LeaseLeasesResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+		Leases: leases,
+	}, nil
 }
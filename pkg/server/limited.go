@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 
+	"github.com/k3s-io/kine/pkg/metrics"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 )
 
@@ -25,8 +26,30 @@ func txnHeader(rev int64) *etcdserverpb.ResponseHeader {
 	}
 }
 
-func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (*etcdserverpb.TxnResponse, error) {
+func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (resp *etcdserverpb.TxnResponse, err error) {
+	var (
+		failedResult = metrics.TxnCompareFailed
+		observe      = true
+	)
+	defer func() {
+		if !observe {
+			return
+		}
+		result := metrics.ResultSuccess
+		switch {
+		case err == ErrKeyExists:
+			result = metrics.TxnKeyExists
+		case err != nil:
+			result = metrics.ResultError
+		case !resp.Succeeded:
+			result = failedResult
+		}
+		metrics.TxnTotal.WithLabelValues(result).Inc()
+	}()
+
 	if put := isCreate(txn); put != nil {
+		// creates are only applied if the key does not exist
+		failedResult = metrics.TxnKeyExists
 		return l.create(ctx, put, txn)
 	}
 	if rev, key, ok := isDelete(txn); ok {
@@ -36,6 +59,8 @@ func (l *LimitedServer) Txn(ctx context.Context, txn *etcdserverpb.TxnRequest) (
 		return l.update(ctx, rev, key, value, lease)
 	}
 	if isCompact(txn) {
+		// compaction requests from the apiserver are always ignored
+		observe = false
 		return l.compact(ctx)
 	}
 	return nil, fmt.Errorf("unsupported transaction: %v", txn)
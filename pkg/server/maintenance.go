@@ -3,10 +3,15 @@ package server
 import (
 	"context"
 	"fmt"
+	"io"
 
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	etcdversion "go.etcd.io/etcd/api/v3/version"
 )
 
+// snapshotChunkSize is the size of the chunks in which snapshots are sent to the client.
+const snapshotChunkSize = 32 * 1024
+
 // explicit interface check
 var _ etcdserverpb.MaintenanceServer = (*KVServerBridge)(nil)
 
@@ -14,19 +19,58 @@ func (s *KVServerBridge) Alarm(context.Context, *etcdserverpb.AlarmRequest) (*et
 	return nil, fmt.Errorf("alarm is not supported")
 }
 
+// Status reports the size and current revision of the datastore. As there is no raft log, the
+// raft index is emulated with the current revision, in a single term. The version is the etcd
+// API version, with the name of the backend driver as build metadata.
 func (s *KVServerBridge) Status(ctx context.Context, r *etcdserverpb.StatusRequest) (*etcdserverpb.StatusResponse, error) {
 	size, err := s.limited.dbSize(ctx)
 	if err != nil {
 		return nil, err
 	}
+	health, err := s.limited.backend.Health(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	if health.CompactStale {
+		errs = append(errs, fmt.Sprintf("compaction has not completed since %s", health.LastCompact))
+	}
+
+	version := etcdversion.Version
+	if s.driver != "" {
+		version += "+kine." + s.driver
+	}
+
 	return &etcdserverpb.StatusResponse{
-		Header: &etcdserverpb.ResponseHeader{},
-		DbSize: size,
+		Header:           txnHeader(health.CurrentRevision),
+		Version:          version,
+		DbSize:           size,
+		DbSizeInUse:      size,
+		RaftIndex:        uint64(health.CurrentRevision),
+		RaftTerm:         1,
+		RaftAppliedIndex: uint64(health.CurrentRevision),
+		Errors:           errs,
 	}, nil
 }
 
-func (s *KVServerBridge) Defragment(context.Context, *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
-	return nil, fmt.Errorf("defragment is not supported")
+// Defragment runs the maintenance operation of the datastore that reclaims space freed by
+// compaction, such as VACUUM for SQLite. The operation may lock the kine table until it
+// completes.
+func (s *KVServerBridge) Defragment(ctx context.Context, r *etcdserverpb.DefragmentRequest) (*etcdserverpb.DefragmentResponse, error) {
+	if err := s.auth.checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	defragmenter, ok := s.limited.backend.(Defragmenter)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	if err := defragmenter.Defragment(ctx); err != nil {
+		return nil, err
+	}
+	return &etcdserverpb.DefragmentResponse{
+		Header: &etcdserverpb.ResponseHeader{},
+	}, nil
 }
 
 func (s *KVServerBridge) Hash(context.Context, *etcdserverpb.HashRequest) (*etcdserverpb.HashResponse, error) {
@@ -37,8 +81,42 @@ func (s *KVServerBridge) HashKV(context.Context, *etcdserverpb.HashKVRequest) (*
 	return nil, fmt.Errorf("hash kv is not supported")
 }
 
-func (s *KVServerBridge) Snapshot(*etcdserverpb.SnapshotRequest, etcdserverpb.Maintenance_SnapshotServer) error {
-	return fmt.Errorf("snapshot is not supported")
+// Snapshot streams a snapshot of the datastore, in the format written by the backend, to the
+// client. The snapshot can be restored into an empty datastore with kine's restore command;
+// it is not an etcd database file, so it cannot be restored with etcdutl.
+func (s *KVServerBridge) Snapshot(r *etcdserverpb.SnapshotRequest, ss etcdserverpb.Maintenance_SnapshotServer) error {
+	if err := s.auth.checkAdmin(ss.Context()); err != nil {
+		return err
+	}
+	snapshotter, ok := s.limited.backend.(Snapshotter)
+	if !ok {
+		return ErrNotSupported
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := snapshotter.Snapshot(ss.Context(), pw)
+		pw.CloseWithError(err)
+	}()
+
+	buf := make([]byte, snapshotChunkSize)
+	for {
+		n, err := io.ReadFull(pr, buf)
+		if n > 0 {
+			if err := ss.Send(&etcdserverpb.SnapshotResponse{
+				Header: &etcdserverpb.ResponseHeader{},
+				Blob:   buf[:n],
+			}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
 }
 
 func (s *KVServerBridge) MoveLeader(context.Context, *etcdserverpb.MoveLeaderRequest) (*etcdserverpb.MoveLeaderResponse, error) {
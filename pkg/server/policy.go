@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"sigs.k8s.io/yaml"
+)
+
+// policyReloadInterval is the interval at which the policy file is checked for changes.
+const policyReloadInterval = 10 * time.Second
+
+// Authorizer decides whether a client may read, or write, a range of keys. The identity of the
+// client is the common name of its verified TLS client certificate, or empty if it has none.
+type Authorizer interface {
+	Authorize(identity string, key, rangeEnd []byte, write bool) bool
+}
+
+// Access is the access to keys granted by a policy rule.
+type Access string
+
+const (
+	AccessNone      Access = "none"
+	AccessRead      Access = "read"
+	AccessReadWrite Access = "readwrite"
+)
+
+func (a Access) allows(write bool) bool {
+	return a == AccessReadWrite || (a == AccessRead && !write)
+}
+
+func (a Access) valid() bool {
+	switch a {
+	case AccessNone, AccessRead, AccessReadWrite:
+		return true
+	}
+	return false
+}
+
+// Policy authorizes requests by the key prefixes they read and write. The access to a range of
+// keys is that of the rule with the longest prefix that contains the range, or the default if no
+// rule does, and a range that spans the prefix of a more specific rule must also be allowed by
+// that rule. For example, a rule denying access to /registry/secrets/ also denies lists of
+// /registry/.
+type Policy struct {
+	// Default is the access to keys not matched by any rule, readwrite if not set.
+	Default Access       `json:"default"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// PolicyRule grants access to keys with a prefix to clients with one of the identities. The
+// identity "*" matches all clients, including those without a client certificate.
+type PolicyRule struct {
+	Identities []string `json:"identities"`
+	Prefix     string   `json:"prefix"`
+	Access     Access   `json:"access"`
+}
+
+func (p *Policy) validate() error {
+	if p.Default == "" {
+		p.Default = AccessReadWrite
+	}
+	if !p.Default.valid() {
+		return fmt.Errorf("invalid default access %q: must be one of none, read, or readwrite", p.Default)
+	}
+	for _, rule := range p.Rules {
+		if !rule.Access.valid() {
+			return fmt.Errorf("invalid access %q for prefix %q: must be one of none, read, or readwrite", rule.Access, rule.Prefix)
+		}
+		if len(rule.Identities) == 0 {
+			return fmt.Errorf("rule for prefix %q has no identities", rule.Prefix)
+		}
+	}
+	return nil
+}
+
+func (p *Policy) Authorize(identity string, key, rangeEnd []byte, write bool) bool {
+	start, end := requestRange(key, rangeEnd)
+
+	access := p.Default
+	longest := -1
+	for _, rule := range p.Rules {
+		if !rule.matches(identity) {
+			continue
+		}
+		prefixStart, prefixEnd := []byte(rule.Prefix), prefixRangeEnd(rule.Prefix)
+		if !overlaps(start, end, prefixStart, prefixEnd) {
+			continue
+		}
+		if contains(prefixStart, prefixEnd, start, end) {
+			if len(rule.Prefix) > longest {
+				access, longest = rule.Access, len(rule.Prefix)
+			}
+			continue
+		}
+		// the range spans part of the prefix, so must be allowed by the rule
+		if !rule.Access.allows(write) {
+			return false
+		}
+	}
+	return access.allows(write)
+}
+
+func (r *PolicyRule) matches(identity string) bool {
+	for _, i := range r.Identities {
+		if i == "*" || i == identity {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixRangeEnd returns the end of the range of keys with the prefix, or nil if the range is
+// unbounded.
+func prefixRangeEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// requestRange returns the start and end of the range of keys read or written by a request for
+// the key and range end. As in etcd, an empty range end is the single key, and a range end of
+// "\x00" includes all keys from the key onwards, which is returned as a nil end.
+func requestRange(key, rangeEnd []byte) ([]byte, []byte) {
+	if len(rangeEnd) == 0 {
+		return key, append(append([]byte{}, key...), 0)
+	}
+	if bytes.Equal(rangeEnd, []byte{0}) {
+		return key, nil
+	}
+	return key, rangeEnd
+}
+
+// overlaps returns true if the ranges intersect. A nil end is unbounded.
+func overlaps(start1, end1, start2, end2 []byte) bool {
+	return (end1 == nil || bytes.Compare(start2, end1) < 0) && (end2 == nil || bytes.Compare(start1, end2) < 0)
+}
+
+// contains returns true if the first range contains the second. A nil end is unbounded.
+func contains(start1, end1, start2, end2 []byte) bool {
+	if bytes.Compare(start2, start1) < 0 {
+		return false
+	}
+	return end1 == nil || (end2 != nil && bytes.Compare(end2, end1) <= 0)
+}
+
+// PolicyFile is an Authorizer using the Policy in a YAML file, which is reloaded when it changes.
+// If the changed file cannot be loaded, the previous policy continues to be used.
+type PolicyFile struct {
+	path string
+
+	mu      sync.RWMutex
+	policy  *Policy
+	modTime time.Time
+}
+
+// NewPolicyFile loads the policy in the file, and reloads it when it changes until the context
+// is done.
+func NewPolicyFile(ctx context.Context, path string) (*PolicyFile, error) {
+	f := &PolicyFile{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(policyReloadInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if reloaded, err := f.reload(); err != nil {
+				logrus.Errorf("Failed to reload authorization policy, continuing to use the previous policy: %v", err)
+			} else if reloaded {
+				logrus.Infof("Reloaded authorization policy from %s", f.path)
+			}
+		}
+	}()
+
+	return f, nil
+}
+
+// reload loads the policy if the file has changed since it was last loaded.
+func (f *PolicyFile) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.RLock()
+	modTime := f.modTime
+	f.mu.RUnlock()
+	if info.ModTime().Equal(modTime) {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return false, errors.Wrapf(err, "parsing authorization policy %s", f.path)
+	}
+	if err := policy.validate(); err != nil {
+		return false, errors.Wrapf(err, "validating authorization policy %s", f.path)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.policy, f.modTime = policy, info.ModTime()
+	return true, nil
+}
+
+func (f *PolicyFile) Authorize(identity string, key, rangeEnd []byte, write bool) bool {
+	f.mu.RLock()
+	policy := f.policy
+	f.mu.RUnlock()
+	return policy.Authorize(identity, key, rangeEnd, write)
+}
+
+// authorize checks that the client may read, or write, the range of keys, if an Authorizer is set.
+func (k *KVServerBridge) authorize(ctx context.Context, key, rangeEnd []byte, write bool) error {
+	if k.authorizer == nil {
+		return nil
+	}
+	name, _ := identity(ctx)
+	if !k.authorizer.Authorize(name, key, rangeEnd, write) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// checkReserved checks that the range of keys does not include the keys of the Auth service,
+// which are only read and written through the Auth service, whether or not authentication is
+// enabled. Otherwise, a client could grant itself the root role by writing its user.
+func checkReserved(key, rangeEnd []byte) error {
+	start, end := requestRange(key, rangeEnd)
+	if overlaps(start, end, []byte(authKeyPrefix), prefixRangeEnd(authKeyPrefix)) {
+		return rpctypes.ErrGRPCPermissionDenied
+	}
+	return nil
+}
+
+// checkRange checks that the range of keys is not reserved, the permissions of the user, if
+// authentication is enabled, and the authorization policy, if set, for a request reading or
+// writing a range of keys.
+func (k *KVServerBridge) checkRange(ctx context.Context, key, rangeEnd []byte, write bool) error {
+	if err := checkReserved(key, rangeEnd); err != nil {
+		return err
+	}
+	if err := k.auth.checkRange(ctx, key, rangeEnd, write); err != nil {
+		return err
+	}
+	return k.authorize(ctx, key, rangeEnd, write)
+}
+
+// checkTxn checks that the keys read and written by a transaction are not reserved, the
+// permissions of the user, if authentication is enabled, and the authorization policy, if set,
+// for those keys.
+func (k *KVServerBridge) checkTxn(ctx context.Context, txn *etcdserverpb.TxnRequest) error {
+	var err error
+	eachTxnRange(txn, func(key, rangeEnd []byte, write bool) bool {
+		err = checkReserved(key, rangeEnd)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := k.auth.checkTxn(ctx, txn); err != nil {
+		return err
+	}
+	eachTxnRange(txn, func(key, rangeEnd []byte, write bool) bool {
+		err = k.authorize(ctx, key, rangeEnd, write)
+		return err == nil
+	})
+	return err
+}
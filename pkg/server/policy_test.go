@@ -0,0 +1,138 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolicyAuthorize(t *testing.T) {
+	policy := &Policy{
+		Default: AccessRead,
+		Rules: []PolicyRule{
+			{Identities: []string{"apiserver"}, Prefix: "/registry/", Access: AccessReadWrite},
+			{Identities: []string{"apiserver", "reader"}, Prefix: "/registry/secrets/", Access: AccessNone},
+			{Identities: []string{"apiserver"}, Prefix: "/registry/secrets/kube-system/", Access: AccessRead},
+			{Identities: []string{"*"}, Prefix: "/public/", Access: AccessReadWrite},
+		},
+	}
+	if err := policy.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		identity      string
+		key, rangeEnd string
+		write         bool
+		want          bool
+	}{
+		{name: "default read", identity: "other", key: "/other", want: true},
+		{name: "default write", identity: "other", key: "/other", write: true},
+		{name: "prefix write", identity: "apiserver", key: "/registry/pods/a", write: true, want: true},
+		{name: "longer prefix denies", identity: "apiserver", key: "/registry/secrets/default/a"},
+		{name: "longest prefix allows read", identity: "apiserver", key: "/registry/secrets/kube-system/a", want: true},
+		{name: "longest prefix denies write", identity: "apiserver", key: "/registry/secrets/kube-system/a", write: true},
+		{name: "list spanning denied prefix", identity: "apiserver", key: "/registry/", rangeEnd: "/registry0"},
+		{name: "list of denied prefix", identity: "reader", key: "/registry/secrets/", rangeEnd: "/registry/secrets0"},
+		{name: "list of other prefix", identity: "apiserver", key: "/registry/pods/", rangeEnd: "/registry/pods0", want: true},
+		{name: "list from key spanning denied prefix", identity: "apiserver", key: "/registry/pods/", rangeEnd: "\x00"},
+		{name: "single key gets rule of own prefix", identity: "apiserver", key: "/registry/secrets/"},
+		{name: "key equal to prefix without slash", identity: "apiserver", key: "/registry/secrets", write: true, want: true},
+		{name: "wildcard identity", identity: "other", key: "/public/a", write: true, want: true},
+		{name: "wildcard identity without certificate", key: "/public/a", write: true, want: true},
+		{name: "rule for other identity", identity: "reader", key: "/registry/pods/a", write: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Authorize(tt.identity, []byte(tt.key), []byte(tt.rangeEnd), tt.write); got != tt.want {
+				t.Errorf("Authorize = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrefixRangeEnd(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   []byte
+	}{
+		{prefix: "/registry/", want: []byte("/registry0")},
+		{prefix: "a", want: []byte("b")},
+		{prefix: "a\xff", want: []byte("b")},
+		{prefix: "\xff\xff"},
+		{prefix: ""},
+	}
+	for _, tt := range tests {
+		if got := prefixRangeEnd(tt.prefix); string(got) != string(tt.want) || (got == nil) != (tt.want == nil) {
+			t.Errorf("prefixRangeEnd(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	write := func(data string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+
+	write(`
+default: none
+rules:
+- identities: ["reader"]
+  prefix: /registry/
+  access: read
+`, start)
+	f := &PolicyFile{path: path}
+	if reloaded, err := f.reload(); err != nil || !reloaded {
+		t.Fatalf("reload = %v, %v", reloaded, err)
+	}
+	if !f.Authorize("reader", []byte("/registry/a"), nil, false) {
+		t.Error("reader cannot read /registry/a")
+	}
+
+	// an unchanged file is not reloaded
+	if reloaded, err := f.reload(); err != nil || reloaded {
+		t.Errorf("reload of unchanged file = %v, %v", reloaded, err)
+	}
+
+	// a file that cannot be parsed or is invalid leaves the previous policy in place
+	for i, data := range []string{
+		"default: [",
+		"default: all",
+		"rules:\n- prefix: /registry/\n  access: read\n",
+		"unknown: field",
+	} {
+		write(data, start.Add(time.Duration(i+1)*time.Minute))
+		if reloaded, err := f.reload(); err == nil || reloaded {
+			t.Errorf("reload of %q = %v, %v, want error", data, reloaded, err)
+		}
+		if !f.Authorize("reader", []byte("/registry/a"), nil, false) {
+			t.Errorf("previous policy not used after failed reload of %q", data)
+		}
+	}
+
+	write(`
+rules:
+- identities: ["reader"]
+  prefix: /registry/
+  access: none
+`, start.Add(time.Hour))
+	if reloaded, err := f.reload(); err != nil || !reloaded {
+		t.Fatalf("reload = %v, %v", reloaded, err)
+	}
+	if f.Authorize("reader", []byte("/registry/a"), nil, false) {
+		t.Error("reader can read /registry/a after the policy was changed")
+	}
+	if !f.Authorize("reader", []byte("/other"), nil, true) {
+		t.Error("default access is not readwrite when not set")
+	}
+}
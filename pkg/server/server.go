@@ -1,6 +1,8 @@
 package server
 
 import (
+	"time"
+
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/health"
@@ -9,14 +11,27 @@ import (
 
 type KVServerBridge struct {
 	limited *LimitedServer
+	// notifyInterval is the interval at which progress notifications are sent to watches
+	// that request them, or zero if progress notifications are disabled
+	notifyInterval time.Duration
+	// driver is the name of the backend driver, reported in the version returned by Status
+	driver string
+	// auth holds the users and roles of the Auth service, and checks the permissions of requests
+	auth *authStore
+	// authorizer checks the keys read and written by requests against a policy, if set
+	authorizer Authorizer
 }
 
-func New(backend Backend, scheme string) *KVServerBridge {
+func New(backend Backend, scheme string, notifyInterval time.Duration, driver string, authorizer Authorizer) *KVServerBridge {
 	return &KVServerBridge{
 		limited: &LimitedServer{
 			backend: backend,
 			scheme:  scheme,
 		},
+		notifyInterval: notifyInterval,
+		driver:         driver,
+		auth:           newAuthStore(backend),
+		authorizer:     authorizer,
 	}
 }
 
@@ -26,6 +41,7 @@ func (k *KVServerBridge) Register(server *grpc.Server) {
 	etcdserverpb.RegisterKVServer(server, k)
 	etcdserverpb.RegisterClusterServer(server, k)
 	etcdserverpb.RegisterMaintenanceServer(server, k)
+	etcdserverpb.RegisterAuthServer(server, k)
 
 	hsrv := health.NewServer()
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// failingUpdateBackend is a fakeBackend whose updates fail with err.
+type failingUpdateBackend struct {
+	*fakeBackend
+	err error
+}
+
+func (b *failingUpdateBackend) Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error) {
+	return 0, nil, false, b.err
+}
+
+func createTxn(key string) *etcdserverpb.TxnRequest {
+	return &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte(key),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: 0},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("v")}},
+		}},
+	}
+}
+
+func updateTxn(key string, revision int64) *etcdserverpb.TxnRequest {
+	return &etcdserverpb.TxnRequest{
+		Compare: []*etcdserverpb.Compare{{
+			Key:         []byte(key),
+			Target:      etcdserverpb.Compare_MOD,
+			Result:      etcdserverpb.Compare_EQUAL,
+			TargetUnion: &etcdserverpb.Compare_ModRevision{ModRevision: revision},
+		}},
+		Success: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestPut{RequestPut: &etcdserverpb.PutRequest{Key: []byte(key), Value: []byte("v2")}},
+		}},
+		Failure: []*etcdserverpb.RequestOp{{
+			Request: &etcdserverpb.RequestOp_RequestRange{RequestRange: &etcdserverpb.RangeRequest{Key: []byte(key)}},
+		}},
+	}
+}
+
+func TestTxnMetrics(t *testing.T) {
+	ctx := context.Background()
+	backend := newFakeBackend()
+	l := &LimitedServer{backend: backend}
+	errDatabase := errors.New("connection reset by peer")
+	failing := &LimitedServer{backend: &failingUpdateBackend{fakeBackend: backend, err: errDatabase}}
+
+	tests := []struct {
+		name    string
+		server  *LimitedServer
+		txn     *etcdserverpb.TxnRequest
+		result  string
+		wantErr error
+	}{
+		{name: "create", server: l, txn: createTxn("/a"), result: metrics.ResultSuccess},
+		{name: "create of existing key", server: l, txn: createTxn("/a"), result: metrics.TxnKeyExists},
+		{name: "update", server: l, txn: updateTxn("/a", 1), result: metrics.ResultSuccess},
+		{name: "update of stale revision", server: l, txn: updateTxn("/a", 1), result: metrics.TxnCompareFailed},
+		// an update at revision zero creates the key
+		{name: "update creating existing key", server: l, txn: updateTxn("/a", 0), result: metrics.TxnKeyExists, wantErr: ErrKeyExists},
+		{name: "database error", server: failing, txn: updateTxn("/a", 2), result: metrics.ResultError, wantErr: errDatabase},
+	}
+	for _, tt := range tests {
+		before := map[string]float64{}
+		for _, result := range []string{metrics.ResultSuccess, metrics.ResultError, metrics.TxnCompareFailed, metrics.TxnKeyExists} {
+			before[result] = testutil.ToFloat64(metrics.TxnTotal.WithLabelValues(result))
+		}
+
+		if _, err := tt.server.Txn(ctx, tt.txn); err != tt.wantErr {
+			t.Fatalf("%s: Txn returned %v, want %v", tt.name, err, tt.wantErr)
+		}
+
+		for result, count := range before {
+			want := count
+			if result == tt.result {
+				want++
+			}
+			if got := testutil.ToFloat64(metrics.TxnTotal.WithLabelValues(result)); got != want {
+				t.Errorf("%s: %s transactions = %v, want %v", tt.name, result, got, want)
+			}
+		}
+	}
+}
@@ -3,13 +3,39 @@ package server
 import (
 	"context"
 	"database/sql"
+	"io"
+	"time"
 
 	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 var (
 	ErrKeyExists = rpctypes.ErrGRPCDuplicateKey
 	ErrCompacted = rpctypes.ErrGRPCCompacted
+	ErrTooLarge  = rpctypes.ErrGRPCRequestTooLarge
+	ErrReadOnly  = status.New(codes.FailedPrecondition, "kine: datastore is read-only").Err()
+	ErrFutureRev = rpctypes.ErrGRPCFutureRev
+
+	// ErrTooManyRequests is returned when writes to a key exceed the configured rate limit.
+	// The client may retry after backing off.
+	ErrTooManyRequests = rpctypes.ErrGRPCRequestTooManyRequests
+
+	// ErrLeaseNotFound, ErrLeaseExist, and ErrLeaseTTLTooLarge are returned by backends that
+	// manage leases.
+	ErrLeaseNotFound    = rpctypes.ErrGRPCLeaseNotFound
+	ErrLeaseExist       = rpctypes.ErrGRPCLeaseExist
+	ErrLeaseTTLTooLarge = rpctypes.ErrGRPCLeaseTTLTooLarge
+
+	// ErrConflict, ErrTimeout, and ErrUnavailable are returned by drivers for transient
+	// datastore failures, which the client may retry.
+	ErrConflict    = status.New(codes.Aborted, "kine: datastore transaction conflict").Err()
+	ErrTimeout     = rpctypes.ErrGRPCTimeout
+	ErrUnavailable = status.New(codes.Unavailable, "kine: datastore unavailable").Err()
+
+	// ErrNotSupported is returned for operations that the datastore does not support.
+	ErrNotSupported = status.New(codes.Unimplemented, "kine: operation not supported by datastore").Err()
 )
 
 type Backend interface {
@@ -22,25 +48,131 @@ type Backend interface {
 	Update(ctx context.Context, key string, value []byte, revision, lease int64) (int64, *KeyValue, bool, error)
 	Watch(ctx context.Context, key string, revision int64) <-chan []*Event
 	DbSize(ctx context.Context) (int64, error)
+	Health(ctx context.Context) (*HealthStatus, error)
+	Close(ctx context.Context) error
+}
+
+// Snapshotter is implemented by backends that can write a point-in-time snapshot of the
+// datastore, and restore a snapshot into an empty datastore. The revision of the snapshot
+// is returned.
+type Snapshotter interface {
+	Snapshot(ctx context.Context, w io.Writer) (int64, error)
+	Restore(ctx context.Context, r io.Reader) (int64, error)
+}
+
+// Migrator is implemented by backends that can copy their full history, including deleted and
+// replaced revisions, into another empty backend, preserving revisions. The current revision
+// of the target is returned.
+type Migrator interface {
+	MigrateTo(ctx context.Context, target Backend) (int64, error)
+}
+
+// Leaser is implemented by backends that manage leases, as in etcd. Keys attached to a lease
+// are deleted when the lease is revoked, or expires because it was not kept alive.
+type Leaser interface {
+	// LeaseGrant grants a lease with the given TTL in seconds. If id is zero, an id is
+	// chosen by the backend. The id of the lease is returned.
+	LeaseGrant(ctx context.Context, id, ttl int64) (int64, error)
+	// LeaseRevoke revokes a lease, deleting the keys attached to it, and returns the
+	// current revision.
+	LeaseRevoke(ctx context.Context, id int64) (int64, error)
+	// LeaseKeepAlive renews a lease, and returns its TTL.
+	LeaseKeepAlive(ctx context.Context, id int64) (int64, error)
+	// LeaseTimeToLive returns the state of a lease, including the attached keys if keys is true.
+	LeaseTimeToLive(ctx context.Context, id int64, keys bool) (*Lease, error)
+	// LeaseLeases returns the ids of all leases.
+	LeaseLeases(ctx context.Context) ([]int64, error)
+}
+
+// Lease describes a lease granted by a Leaser.
+type Lease struct {
+	ID int64
+	// TTL is the remaining time to live of the lease, in seconds
+	TTL int64
+	// GrantedTTL is the TTL with which the lease was granted, in seconds
+	GrantedTTL int64
+	Keys       []string
+}
+
+// WatchProgressReporter is implemented by backends that can report the revision up to which
+// events have been dispatched to watches, so that progress notifications can be sent to
+// watches on which no keys have changed.
+type WatchProgressReporter interface {
+	WatchProgressRevision() int64
+}
+
+// Compactor is implemented by backends that can compact their history on request, in addition
+// to any compaction they run periodically. Compact schedules compaction to the given revision and
+// returns without waiting for it to complete.
+type Compactor interface {
+	Compact(ctx context.Context, revision int64) error
+}
+
+// Defragmenter is implemented by backends that can reclaim space freed by compaction, by
+// running the maintenance operation of the datastore that rebuilds the kine table.
+type Defragmenter interface {
+	Defragment(ctx context.Context) error
+}
+
+// HealthStatus describes the state of the datastore. An error is returned by Health
+// instead if the datastore cannot be reached.
+type HealthStatus struct {
+	CurrentRevision int64
+	CompactRevision int64
+	// LastCompact is the time at which compaction last completed, or started if it has not yet completed.
+	// It is zero if compaction is not managed by kine, or has not been started.
+	LastCompact time.Time
+	// CompactStale is true if compaction has not completed within the expected interval.
+	CompactStale bool
+}
+
+// Rows is the result of a query executed by a Dialect. It is implemented by *sql.Rows, and
+// must be closed once read so that the resources held by the query are released.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close() error
 }
 
 type Dialect interface {
-	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (*sql.Rows, error)
-	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (*sql.Rows, error)
+	ListCurrent(ctx context.Context, prefix string, limit int64, includeDeleted bool) (Rows, error)
+	List(ctx context.Context, prefix, startKey string, limit, revision int64, includeDeleted bool) (Rows, error)
 	Count(ctx context.Context, prefix string) (int64, int64, error)
 	CurrentRevision(ctx context.Context) (int64, error)
-	After(ctx context.Context, prefix string, rev, limit int64) (*sql.Rows, error)
+	After(ctx context.Context, prefix string, exclude []string, rev, limit int64) (Rows, error)
 	Insert(ctx context.Context, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) (int64, error)
-	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
+	GetRevision(ctx context.Context, revision int64) (Rows, error)
+	GetAtRevision(ctx context.Context, key string, revision int64) (Rows, error)
+	GetCurrentKeys(ctx context.Context, keys []string) (Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
+	UpdateValue(ctx context.Context, revision int64, value, prevValue []byte) error
+	DeleteLease(ctx context.Context, lease, revision int64) (int64, error)
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
-	PostCompact(ctx context.Context) error
+	Compact(ctx context.Context, compactRev, revision int64) (int64, error)
+	CompactDryRun(ctx context.Context, revision int64) (int64, int64, int64, error)
+	CompactPrefix(ctx context.Context, prefix string, revision int64) (int64, error)
+	PostCompact(ctx context.Context, deletedRows int64) error
 	Fill(ctx context.Context, revision int64) error
 	IsFill(key string) bool
+	MaxRevision() int64
+	IsRetriable(err error) bool
+	InsertRevision(ctx context.Context, revision int64, key string, create, delete bool, createRevision, previousRevision int64, ttl int64, value, prevValue []byte) error
+	PreRestore(ctx context.Context) error
+	PostRestore(ctx context.Context) error
+	GrantLease(ctx context.Context, id, ttl, expires int64) error
+	RenewLease(ctx context.Context, id, now int64) (bool, error)
+	GetLease(ctx context.Context, id int64) (int64, int64, error)
+	RevokeLease(ctx context.Context, id int64) error
+	ListLeases(ctx context.Context) ([]int64, error)
+	ExpiredLeases(ctx context.Context, now int64) ([]int64, error)
+	LeaseKeys(ctx context.Context, id int64) ([]string, error)
+	Defragment(ctx context.Context) error
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (Transaction, error)
 	GetSize(ctx context.Context) (int64, error)
+	Ping(ctx context.Context) error
+	Close() error
 }
 
 type Transaction interface {
@@ -50,8 +182,9 @@ type Transaction interface {
 	MustRollback()
 	GetCompactRevision(ctx context.Context) (int64, error)
 	SetCompactRevision(ctx context.Context, revision int64) error
-	Compact(ctx context.Context, revision int64) (int64, error)
-	GetRevision(ctx context.Context, revision int64) (*sql.Rows, error)
+	Compact(ctx context.Context, compactRev, revision int64) (int64, error)
+	CompactIDs(ctx context.Context, compactRev, revision int64) ([]int64, error)
+	GetRevision(ctx context.Context, revision int64) (Rows, error)
 	DeleteRevision(ctx context.Context, revision int64) error
 	CurrentRevision(ctx context.Context) (int64, error)
 }
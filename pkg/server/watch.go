@@ -4,7 +4,9 @@ import (
 	"context"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"github.com/k3s-io/kine/pkg/metrics"
 	"github.com/sirupsen/logrus"
 	"go.etcd.io/etcd/api/v3/etcdserverpb"
 	"go.etcd.io/etcd/api/v3/mvccpb"
@@ -17,9 +19,11 @@ var _ etcdserverpb.WatchServer = (*KVServerBridge)(nil)
 
 func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 	w := watcher{
-		server:  ws,
-		backend: s.limited.backend,
-		watches: map[int64]func(){},
+		server:         ws,
+		backend:        s.limited.backend,
+		watches:        map[int64]func(){},
+		progress:       map[int64]progressChannel{},
+		notifyInterval: s.notifyInterval,
 	}
 	defer w.Close()
 
@@ -29,11 +33,22 @@ func (s *KVServerBridge) Watch(ws etcdserverpb.Watch_WatchServer) error {
 			return err
 		}
 
-		if msg.GetCreateRequest() != nil {
-			w.Start(ws.Context(), msg.GetCreateRequest())
+		if create := msg.GetCreateRequest(); create != nil {
+			if err := s.checkRange(ws.Context(), create.Key, create.RangeEnd, false); err != nil {
+				w.Reject(err)
+				continue
+			}
+			w.Start(ws.Context(), create)
 		} else if msg.GetCancelRequest() != nil {
 			logrus.Tracef("WATCH CANCEL REQ id=%d", msg.GetCancelRequest().GetWatchId())
 			w.Cancel(msg.GetCancelRequest().WatchId, nil)
+		} else if msg.GetProgressRequest() != nil {
+			logrus.Tracef("WATCH PROGRESS REQ")
+			w.wg.Add(1)
+			go func() {
+				defer w.wg.Done()
+				w.Progress(ws.Context())
+			}()
 		}
 	}
 }
@@ -45,6 +60,10 @@ type watcher struct {
 	backend Backend
 	server  etcdserverpb.Watch_WatchServer
 	watches map[int64]func()
+	// progress holds the channels on which each watch receives progress requests
+	progress map[int64]progressChannel
+	// notifyInterval is the interval at which progress notifications are sent
+	notifyInterval time.Duration
 }
 
 func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest) {
@@ -55,6 +74,8 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 
 	id := atomic.AddInt64(&watchID, 1)
 	w.watches[id] = cancel
+	progressReqs := make(chan chan struct{})
+	w.progress[id] = progressChannel{requests: progressReqs, done: ctx.Done()}
 	w.wg.Add(1)
 
 	key := string(r.Key)
@@ -63,6 +84,9 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 
 	go func() {
 		defer w.wg.Done()
+		metrics.WatchStreams.Inc()
+		defer metrics.WatchStreams.Dec()
+
 		if err := w.server.Send(&etcdserverpb.WatchResponse{
 			Header:  &etcdserverpb.ResponseHeader{},
 			Created: true,
@@ -72,24 +96,58 @@ func (w *watcher) Start(ctx context.Context, r *etcdserverpb.WatchCreateRequest)
 			return
 		}
 
-		for events := range w.backend.Watch(ctx, key, r.StartRevision) {
-			if len(events) == 0 {
-				continue
-			}
+		progress := w.newProgressNotifier(r)
+		defer progress.stop()
 
-			if logrus.IsLevelEnabled(logrus.DebugLevel) {
-				for _, event := range events {
-					logrus.Tracef("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+		watchChan := w.backend.Watch(ctx, key, r.StartRevision)
+	loop:
+		for {
+			select {
+			case events, ok := <-watchChan:
+				if !ok {
+					break loop
+				}
+				progress.idle = false
+				if len(events) == 0 {
+					progress.drained(watchChan)
+					continue
 				}
-			}
 
-			if err := w.server.Send(&etcdserverpb.WatchResponse{
-				Header:  txnHeader(events[len(events)-1].KV.ModRevision),
-				WatchId: id,
-				Events:  toEvents(events...),
-			}); err != nil {
-				w.Cancel(id, err)
-				continue
+				if logrus.IsLevelEnabled(logrus.DebugLevel) {
+					for _, event := range events {
+						logrus.Tracef("WATCH READ id=%d, key=%s, revision=%d", id, event.KV.Key, event.KV.ModRevision)
+					}
+				}
+
+				revision := events[len(events)-1].KV.ModRevision
+				if err := w.server.Send(&etcdserverpb.WatchResponse{
+					Header:  txnHeader(revision),
+					WatchId: id,
+					Events:  toEvents(events...),
+				}); err != nil {
+					w.Cancel(id, err)
+					continue
+				}
+				progress.sent(revision)
+				progress.drained(watchChan)
+				metrics.WatchEventsTotal.Add(float64(len(events)))
+				if reporter, ok := w.backend.(WatchProgressReporter); ok {
+					observeWatchLag(reporter.WatchProgressRevision(), revision)
+				}
+			case ack := <-progressReqs:
+				progress.request(ack, watchChan)
+			case <-progress.C:
+				revision, ok := progress.tick()
+				if !ok {
+					continue
+				}
+				logrus.Tracef("WATCH PROGRESS id=%d, key=%s, revision=%d", id, key, revision)
+				if err := w.server.Send(&etcdserverpb.WatchResponse{
+					Header:  txnHeader(revision),
+					WatchId: id,
+				}); err != nil {
+					w.Cancel(id, err)
+				}
 			}
 		}
 		w.Cancel(id, nil)
@@ -119,11 +177,37 @@ func toEvent(event *Event) *mvccpb.Event {
 	return e
 }
 
+// Reject tells the client that a watch was not created, as in etcd.
+func (w *watcher) Reject(err error) {
+	logrus.Tracef("WATCH REJECT reason=%v", err)
+	if serr := w.server.Send(&etcdserverpb.WatchResponse{
+		Header:       &etcdserverpb.ResponseHeader{},
+		WatchId:      -1,
+		Created:      true,
+		Canceled:     true,
+		CancelReason: err.Error(),
+	}); serr != nil {
+		logrus.Errorf("WATCH Failed to send reject response: %v", serr)
+	}
+}
+
+// observeWatchLag records how far the revision just sent to a watch is behind the latest revision
+// read by the backend. Watches that are catching up on past events, or that are not reading events
+// as fast as they are written, fall behind.
+func observeWatchLag(current, sent int64) {
+	lag := current - sent
+	if lag < 0 {
+		lag = 0
+	}
+	metrics.WatchLag.Observe(float64(lag))
+}
+
 func (w *watcher) Cancel(watchID int64, err error) {
 	w.Lock()
 	if cancel, ok := w.watches[watchID]; ok {
 		cancel()
 		delete(w.watches, watchID)
+		delete(w.progress, watchID)
 	}
 	w.Unlock()
 
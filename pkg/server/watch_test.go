@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3s-io/kine/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"google.golang.org/grpc"
+)
+
+// watchBackend is a fakeBackend whose watches receive the events sent on channels created by
+// each call to Watch, and which reports a fixed watch progress revision.
+type watchBackend struct {
+	*fakeBackend
+	progress int64
+	mu       sync.Mutex
+	watches  []chan []*Event
+}
+
+func (b *watchBackend) Watch(ctx context.Context, key string, revision int64) <-chan []*Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := make(chan []*Event, 1)
+	b.watches = append(b.watches, c)
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		close(c)
+	}()
+	return c
+}
+
+func (b *watchBackend) WatchProgressRevision() int64 {
+	return b.progress
+}
+
+// fakeWatchServer is a Watch_WatchServer that records the responses sent to it.
+type fakeWatchServer struct {
+	grpc.ServerStream
+	ctx       context.Context
+	mu        sync.Mutex
+	responses []*etcdserverpb.WatchResponse
+}
+
+func (s *fakeWatchServer) Context() context.Context { return s.ctx }
+
+func (s *fakeWatchServer) Send(r *etcdserverpb.WatchResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses = append(s.responses, r)
+	return nil
+}
+
+func (s *fakeWatchServer) Recv() (*etcdserverpb.WatchRequest, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+// eventResponses returns the number of responses sent that contain events.
+func (s *fakeWatchServer) eventResponses() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, r := range s.responses {
+		if len(r.Events) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// waitFor fails the test if the condition is not met within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func watchLagSum(t *testing.T) (uint64, float64) {
+	t.Helper()
+	m := &dto.Metric{}
+	if err := metrics.WatchLag.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestWatchMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	backend := &watchBackend{fakeBackend: newFakeBackend(), progress: 12}
+	ws := &fakeWatchServer{ctx: ctx}
+	w := &watcher{
+		server:   ws,
+		backend:  backend,
+		watches:  map[int64]func(){},
+		progress: map[int64]progressChannel{},
+	}
+
+	streams := testutil.ToFloat64(metrics.WatchStreams)
+	events := testutil.ToFloat64(metrics.WatchEventsTotal)
+	lagCount, lagSum := watchLagSum(t)
+
+	const watches = 3
+	for i := 0; i < watches; i++ {
+		w.Start(ctx, &etcdserverpb.WatchCreateRequest{Key: []byte("/a")})
+	}
+	waitFor(t, "watch streams gauge to count the watches", func() bool {
+		return testutil.ToFloat64(metrics.WatchStreams) == streams+watches
+	})
+
+	// An event at revision 5 is 7 revisions behind the backend's progress.
+	backend.mu.Lock()
+	backend.watches[0] <- []*Event{{KV: &KeyValue{Key: "/a", ModRevision: 4}}, {KV: &KeyValue{Key: "/a", ModRevision: 5}}}
+	backend.mu.Unlock()
+	waitFor(t, "events to be sent", func() bool { return ws.eventResponses() == 1 })
+	if got := testutil.ToFloat64(metrics.WatchEventsTotal) - events; got != 2 {
+		t.Errorf("watch events delivered = %v, want 2", got)
+	}
+	count, sum := watchLagSum(t)
+	if count-lagCount != 1 || sum-lagSum != 7 {
+		t.Errorf("watch lag observed %d times with sum %v, want once with 7", count-lagCount, sum-lagSum)
+	}
+
+	w.Lock()
+	ids := make([]int64, 0, len(w.watches))
+	for id := range w.watches {
+		ids = append(ids, id)
+	}
+	w.Unlock()
+	for _, id := range ids {
+		w.Cancel(id, nil)
+	}
+	waitFor(t, "watch streams gauge to drop once the watches are cancelled", func() bool {
+		return testutil.ToFloat64(metrics.WatchStreams) == streams
+	})
+	w.Close()
+}
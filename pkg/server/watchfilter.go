@@ -0,0 +1,40 @@
+package server
+
+import (
+	"context"
+	"strings"
+)
+
+type watchExclusionsKey struct{}
+
+// WithWatchExclusions returns a context that causes watches started with it to omit events
+// for keys with any of the given prefixes. Events are excluded both when reading past events
+// from the datastore and when delivering new events, so this can be used by a GRPC stream
+// interceptor to keep high-churn keys out of the watches of clients that do not need them.
+func WithWatchExclusions(ctx context.Context, prefixes ...string) context.Context {
+	return context.WithValue(ctx, watchExclusionsKey{}, prefixes)
+}
+
+// WatchExclusions returns the key prefixes excluded from watches started with the context.
+func WatchExclusions(ctx context.Context) []string {
+	prefixes, _ := ctx.Value(watchExclusionsKey{}).([]string)
+	return prefixes
+}
+
+// ExcludeEvents returns the events for keys that do not have any of the prefixes.
+func ExcludeEvents(events []*Event, prefixes []string) []*Event {
+	if len(prefixes) == 0 {
+		return events
+	}
+	result := make([]*Event, 0, len(events))
+outer:
+	for _, event := range events {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(event.KV.Key, prefix) {
+				continue outer
+			}
+		}
+		result = append(result, event)
+	}
+	return result
+}
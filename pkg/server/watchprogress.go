@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+)
+
+// progressNotifier decides when a watch should be sent a progress notification, and the
+// revision to report. Notifications are only sent to watches that request them, and only if
+// the backend can report how far it has dispatched events to watches.
+//
+// The revision reported at each tick is the one sampled from the backend at the previous
+// tick, and is only sent if no events were received by the watch in the meantime. This gives
+// events up to that revision a full interval to be delivered to the watch, so that a
+// notification never tells the client that it has seen a revision whose events are still in
+// flight.
+type progressNotifier struct {
+	// C receives a value at each tick, and is nil if notifications are disabled
+	C <-chan time.Time
+	// idle is true if no events have been received since the previous tick
+	idle bool
+
+	ticker   *time.Ticker
+	reporter WatchProgressReporter
+	// sampled is the revision reported by the backend at the previous tick
+	sampled int64
+	// last is the highest revision sent to the watch, by an event or a notification
+	last int64
+	// pending holds progress requests waiting for the watch to send the events it has received
+	pending []chan struct{}
+}
+
+func (w *watcher) newProgressNotifier(r *etcdserverpb.WatchCreateRequest) *progressNotifier {
+	p := &progressNotifier{}
+	reporter, ok := w.backend.(WatchProgressReporter)
+	if !ok || !r.ProgressNotify || w.notifyInterval <= 0 {
+		return p
+	}
+	p.reporter = reporter
+	p.ticker = time.NewTicker(w.notifyInterval)
+	p.C = p.ticker.C
+	if r.StartRevision > 0 {
+		p.last = r.StartRevision - 1
+	}
+	return p
+}
+
+// sent records that events up to the given revision have been sent to the watch.
+func (p *progressNotifier) sent(revision int64) {
+	if revision > p.last {
+		p.last = revision
+	}
+}
+
+// tick samples the backend's progress, and returns the revision to notify the watch of, if any.
+func (p *progressNotifier) tick() (int64, bool) {
+	revision, idle := p.sampled, p.idle
+	p.sampled = p.reporter.WatchProgressRevision()
+	p.idle = true
+	if !idle || revision <= p.last {
+		return 0, false
+	}
+	p.last = revision
+	return revision, true
+}
+
+func (p *progressNotifier) stop() {
+	if p.ticker != nil {
+		p.ticker.Stop()
+	}
+}
+
+// progressWatchID is the watch ID of responses to progress requests, which apply to every watch
+// on the stream. It matches clientv3.InvalidWatchID.
+const progressWatchID = -1
+
+// progressChannel is used to ask a watch to acknowledge a progress request once it has sent all
+// events that it has received.
+type progressChannel struct {
+	requests chan<- chan struct{}
+	// done is closed when the watch is cancelled
+	done <-chan struct{}
+}
+
+// Progress responds to a progress request on the watch stream. As in etcd, a single response is
+// sent for every watch on the stream, with the revision up to which the watches are synced. The
+// backend's progress is sampled first, and the response is only sent once every watch has
+// delivered all the events that it has received.
+func (w *watcher) Progress(ctx context.Context) {
+	reporter, ok := w.backend.(WatchProgressReporter)
+	if !ok {
+		logrus.Debugf("WATCH PROGRESS REQ ignored: backend does not report watch progress")
+		return
+	}
+	revision := reporter.WatchProgressRevision()
+	if revision == 0 {
+		return
+	}
+
+	w.Lock()
+	channels := make([]progressChannel, 0, len(w.progress))
+	for _, c := range w.progress {
+		channels = append(channels, c)
+	}
+	w.Unlock()
+
+	for _, c := range channels {
+		ack := make(chan struct{})
+		select {
+		case c.requests <- ack:
+		case <-c.done:
+			continue
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case <-ack:
+		case <-c.done:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	logrus.Tracef("WATCH PROGRESS revision=%d", revision)
+	if err := w.server.Send(&etcdserverpb.WatchResponse{
+		Header:  txnHeader(revision),
+		WatchId: progressWatchID,
+	}); err != nil {
+		logrus.Errorf("WATCH Failed to send progress response: %v", err)
+	}
+}
+
+// request acknowledges a progress request once the watch has no more events waiting to be sent.
+func (p *progressNotifier) request(ack chan struct{}, events <-chan []*Event) {
+	p.pending = append(p.pending, ack)
+	p.drained(events)
+}
+
+// drained acknowledges pending progress requests if no events are waiting to be sent.
+func (p *progressNotifier) drained(events <-chan []*Event) {
+	if len(events) > 0 {
+		return
+	}
+	for _, ack := range p.pending {
+		close(ack)
+	}
+	p.pending = nil
+}
@@ -0,0 +1,60 @@
+// Package sigv4 signs requests with AWS Signature Version 4, for the clients of AWS services, and
+// of services with compatible APIs such as MinIO, that kine implements over HTTP itself.
+package sigv4
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// ErrNoCredentials is returned by New if the credentials are not set in the environment.
+var ErrNoCredentials = errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+
+// Signer signs requests to a service in a region.
+type Signer struct {
+	service     string
+	region      string
+	credentials aws.Credentials
+	signer      *v4.Signer
+	now         func() time.Time
+}
+
+// New returns a signer for requests to the service in the region, with the credentials set by
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN. The options are those of the
+// AWS SDK signer; S3 requires that the path is not escaped again, as it is escaped once by the
+// client.
+func New(service, region string, optFns ...func(*v4.SignerOptions)) (*Signer, error) {
+	credentials := aws.Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+		return nil, ErrNoCredentials
+	}
+	return &Signer{
+		service:     service,
+		region:      region,
+		credentials: credentials,
+		signer:      v4.NewSigner(optFns...),
+		now:         time.Now,
+	}, nil
+}
+
+// Sign signs the request, whose body is the payload. The hash of the payload is also set as the
+// X-Amz-Content-Sha256 header, which S3 requires, and the query of the URL is replaced by its
+// canonical encoding, which is that signed.
+func (s *Signer) Sign(ctx context.Context, req *http.Request, payload []byte) error {
+	hash := sha256.Sum256(payload)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	return s.signer.SignHTTP(ctx, s.credentials, req, payloadHash, s.service, s.region, s.now())
+}
@@ -2,6 +2,9 @@ package tls
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
 
 	"go.etcd.io/etcd/client/pkg/v3/transport"
 )
@@ -29,3 +32,36 @@ func (c Config) ClientConfig() (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// ServerConfig returns the configuration of a server using the certificate and key. If the CA is
+// set, client certificates are verified against it, and are required if clientCertAuth is true.
+func (c Config) ServerConfig(clientCertAuth bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+
+	if c.CAFile == "" {
+		if clientCertAuth {
+			return nil, fmt.Errorf("client certificate authentication requires a CA file")
+		}
+		return tlsConfig, nil
+	}
+
+	ca, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in CA file %s", c.CAFile)
+	}
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if clientCertAuth {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
 )
@@ -11,3 +12,22 @@ func (s Stripped) String() string {
 	str := strings.ReplaceAll(string(s), "\n", "")
 	return regexp.MustCompile("[\t ]+").ReplaceAllString(str, " ")
 }
+
+// Redacted formats SQL arguments for logging. Byte slices, which are used to pass
+// key values, are replaced with their length so that secrets are never logged.
+type Redacted []interface{}
+
+func (r Redacted) String() string {
+	args := make([]string, 0, len(r))
+	for _, arg := range r {
+		switch a := arg.(type) {
+		case []byte:
+			args = append(args, fmt.Sprintf("<%d bytes>", len(a)))
+		case []interface{}:
+			args = append(args, Redacted(a).String())
+		default:
+			args = append(args, fmt.Sprintf("%v", a))
+		}
+	}
+	return "[" + strings.Join(args, " ") + "]"
+}